@@ -0,0 +1,397 @@
+package mqtt
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/Sirupsen/logrus"
+)
+
+// Stats is a point-in-time view of the broker counters.
+type Stats struct {
+	Goroutines    int `json:"goroutines"`
+	Clients       int `json:"clients"`
+	Subscriptions int `json:"subscriptions"`
+	InPackets     int `json:"in_packets"`
+	OutPackets    int `json:"out_packets"`
+	Retained      int `json:"retained"`
+
+	// the connections admitted by the listeners, and the ones refused
+	Connections int         `json:"connections"`
+	Rejected    RejectStats `json:"rejected"`
+}
+
+// ClientInfo describes a connected client.
+type ClientInfo struct {
+	ID        string `json:"id"`
+	Address   string `json:"address"`
+	Clean     bool   `json:"clean"`
+	KeepAlive int    `json:"keepalive"`
+	// the common name of the client certificate
+	CommonName string `json:"common_name,omitempty"`
+}
+
+// SubscriptionInfo describes one subscription in the subscription tree.
+type SubscriptionInfo struct {
+	ClientID string `json:"client_id"`
+	Filter   string `json:"filter"`
+	QoS      byte   `json:"qos"`
+}
+
+// SessionInfo describes the session of a client, connected or not.
+type SessionInfo struct {
+	ID             string             `json:"id"`
+	Connected      bool               `json:"connected"`
+	Address        string             `json:"address,omitempty"`
+	Clean          bool               `json:"clean"`
+	Subscriptions  []SubscriptionInfo `json:"subscriptions"`
+	OfflinePackets int                `json:"offline_packets"`
+}
+
+// RetainedInfo describes a retained message.
+type RetainedInfo struct {
+	Topic   string `json:"topic"`
+	QoS     byte   `json:"qos"`
+	Payload []byte `json:"payload"`
+}
+
+func (this *Server) Stats() Stats {
+	this.retainsLock.RLock()
+	retained := this.retains.size()
+	this.retainsLock.RUnlock()
+
+	in, err := this.store.InPacketsSize()
+	this.storeFailed("count inbound packets", err)
+	out, err := this.store.OutPacketsSize()
+	this.storeFailed("count outbound packets", err)
+
+	return Stats{
+		Goroutines:    runtime.NumGoroutine(),
+		Clients:       this.clients.size(),
+		Subscriptions: this.subhier.size(),
+		InPackets:     in,
+		OutPackets:    out,
+		Retained:      retained,
+		Connections:   int(atomic.LoadInt32(&this.limits.conns)),
+		Rejected:      this.limits.stats(),
+	}
+}
+
+// Clients returns all the connected clients.
+func (this *Server) Clients() []ClientInfo {
+	result := []ClientInfo{}
+	for _, c := range this.clients.list() {
+		if c.State() != clientConnected {
+			continue
+		}
+		result = append(result, ClientInfo{
+			ID:         c.id,
+			Address:    c.address,
+			CommonName: c.commonName,
+			Clean:      c.clean,
+			KeepAlive:  int(c.keepAlive / time.Second),
+		})
+	}
+	return result
+}
+
+// Subscriptions returns all subscriptions, or only those of the client if cid is not empty.
+func (this *Server) Subscriptions(cid string) []SubscriptionInfo {
+	result := []SubscriptionInfo{}
+	this.subhier.walk(nil, func(filter, id string, qos byte) {
+		if cid == "" || cid == id {
+			result = append(result, SubscriptionInfo{ClientID: id, Filter: filter, QoS: qos})
+		}
+	})
+	return result
+}
+
+// Session returns the session state of a client, ok is false if there is nothing known about it.
+func (this *Server) Session(cid string) (s SessionInfo, ok bool) {
+	s.ID = cid
+	s.Subscriptions = this.Subscriptions(cid)
+	if c, online := this.clients.get(cid); online && c.State() == clientConnected {
+		s.Connected = true
+		s.Address = c.address
+		s.Clean = c.clean
+	}
+	err := this.store.StreamOfflinePackets(cid, func(packets.ControlPacket) {
+		s.OfflinePackets++
+	})
+	this.storeFailed("count offline packets", err)
+	ok = s.Connected || len(s.Subscriptions) > 0 || s.OfflinePackets > 0
+	return
+}
+
+// Kick disconnects a connected client, the session is kept if it's not clean.
+func (this *Server) Kick(cid string) bool {
+	c, ok := this.clients.get(cid)
+	if !ok {
+		return false
+	}
+	c.stop(ErrKicked)
+	return true
+}
+
+// PurgeSession disconnects the client if connected and removes all its session state.
+func (this *Server) PurgeSession(cid string) error {
+	this.Kick(cid)
+	return this.cleanSession(cid)
+}
+
+// Retained returns the retained messages matched by the topic filter.
+func (this *Server) Retained(filter string) ([]RetainedInfo, error) {
+	result := []RetainedInfo{}
+	err := this.matchRetain(filter, func(p *packets.PublishPacket) {
+		result = append(result, RetainedInfo{Topic: p.TopicName, QoS: p.Qos, Payload: p.Payload})
+	})
+	return result, err
+}
+
+// DeleteRetained removes the retained messages matched by the topic filter, returns the count removed.
+func (this *Server) DeleteRetained(filter string) (int, error) {
+	l, err := this.Retained(filter)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range l {
+		p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		p.TopicName = r.Topic
+		p.Retain = true
+		if err := this.retainPacket(p); err != nil {
+			return 0, err
+		}
+	}
+	return len(l), nil
+}
+
+// ListenAndServeAdmin serves the admin interface used by mqtts-ctl on the given address.
+// The interface has no authentication without Options.AdminToken, bind it to a loopback
+// or management address only.
+func (this *Server) ListenAndServeAdmin(addr string) error {
+	log.Info("MQTT admin interface listenning on ", addr)
+	return http.ListenAndServe(addr, this.AdminHandler())
+}
+
+// AdminHandler returns the http handler of the admin interface.
+//
+//	GET    /health
+//	GET    /stats
+//	GET    /clients
+//	DELETE /clients/<id>
+//	GET    /sessions/<id>
+//	DELETE /sessions/<id>
+//	GET    /subscriptions[?client=<id>]
+//	GET    /retained?filter=<filter>
+//	DELETE /retained?filter=<filter>
+//	GET    /backup
+//	POST   /backup?dir=<dir>
+//	GET    /log/level
+//	PUT    /log/level?level=<level>
+func (this *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, "GET") {
+			return
+		}
+		h := this.Health()
+		code := http.StatusOK
+		if h.Status != HealthOK {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, h)
+	})
+
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, "GET") {
+			return
+		}
+		writeJSON(w, http.StatusOK, this.Stats())
+	})
+
+	mux.HandleFunc("/clients", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, "GET") {
+			return
+		}
+		writeJSON(w, http.StatusOK, this.Clients())
+	})
+
+	mux.HandleFunc("/clients/", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, "DELETE") {
+			return
+		}
+		cid := strings.TrimPrefix(r.URL.Path, "/clients/")
+		if !this.Kick(cid) {
+			writeError(w, http.StatusNotFound, "client not connected")
+			return
+		}
+		log.Infof("admin: client(%v) kicked", cid)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/sessions/", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, "GET", "DELETE") {
+			return
+		}
+		cid := strings.TrimPrefix(r.URL.Path, "/sessions/")
+		s, ok := this.Session(cid)
+		if !ok {
+			writeError(w, http.StatusNotFound, "session not found")
+			return
+		}
+		if r.Method == "GET" {
+			writeJSON(w, http.StatusOK, s)
+			return
+		}
+		if err := this.PurgeSession(cid); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Infof("admin: session of %q purged", cid)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/subscriptions", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, "GET") {
+			return
+		}
+		writeJSON(w, http.StatusOK, this.Subscriptions(r.URL.Query().Get("client")))
+	})
+
+	mux.HandleFunc("/retained", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, "GET", "DELETE") {
+			return
+		}
+		filter := r.URL.Query().Get("filter")
+		if filter == "" {
+			writeError(w, http.StatusBadRequest, "filter required")
+			return
+		}
+		if r.Method == "GET" {
+			l, err := this.Retained(filter)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, l)
+			return
+		}
+		count, err := this.DeleteRetained(filter)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Infof("admin: %v retained messages matched %q removed", count, filter)
+		writeJSON(w, http.StatusOK, map[string]int{"deleted": count})
+	})
+
+	mux.HandleFunc("/backup", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, "GET", "POST") {
+			return
+		}
+		if r.Method == "GET" {
+			sw := &startedWriter{ResponseWriter: w}
+			w.Header().Set("Content-Type", "application/x-tar")
+			if err := this.Backup(sw); err != nil {
+				log.Errorf("admin: backup failed, %v", err)
+				// the errors after the first write can only break the stream
+				if sw.started {
+					panic(http.ErrAbortHandler)
+				}
+				writeError(w, backupErrorCode(err), err.Error())
+			}
+			return
+		}
+		dir := r.URL.Query().Get("dir")
+		if dir == "" {
+			writeError(w, http.StatusBadRequest, "dir required")
+			return
+		}
+		if err := this.BackupTo(dir); err != nil {
+			writeError(w, backupErrorCode(err), err.Error())
+			return
+		}
+		log.Infof("admin: store backed up to %v", dir)
+		writeJSON(w, http.StatusOK, map[string]string{"dir": dir})
+	})
+
+	mux.HandleFunc("/log/level", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, "GET", "PUT") {
+			return
+		}
+		if r.Method == "PUT" {
+			level, err := logrus.ParseLevel(r.URL.Query().Get("level"))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			logrus.SetLevel(level)
+			log.Infof("admin: log level set to %v", level)
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"level": logrus.GetLevel().String()})
+	})
+
+	return this.adminAuth(mux)
+}
+
+// the requests must carry the admin token if it's set, but the health checks of the load
+// balancers.
+func (this *Server) adminAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := this.opts.AdminToken; token != "" && r.URL.Path != "/health" {
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") ||
+				subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="mqtt-admin"`)
+				writeError(w, http.StatusUnauthorized, "invalid admin token")
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func backupErrorCode(err error) int {
+	if err == ErrBackupNotSupported {
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
+}
+
+// records if the response is started, the errors before it can still be reported.
+type startedWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (this *startedWriter) Write(b []byte) (int, error) {
+	this.started = true
+	return this.ResponseWriter.Write(b)
+}
+
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
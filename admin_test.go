@@ -0,0 +1,148 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// serve a request to the handler, the json response is decoded into result if it's not nil.
+func adminRequest(t *testing.T, handler http.Handler, method, url, token string, result interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, url, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if result != nil && w.Code < 300 {
+		if err := json.Unmarshal(w.Body.Bytes(), result); err != nil {
+			t.Fatalf("%v %v, bad response %q", method, url, w.Body.String())
+		}
+	}
+	return w
+}
+
+func adminError(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var e map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+		t.Fatalf("bad error response %q", w.Body.String())
+	}
+	return e["error"]
+}
+
+func TestAdminHandler(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	addr := serveTestServer(t, server)
+	handler := server.AdminHandler()
+
+	c := dialTestClient(t, addr, "c1", false)
+	c.publish("a/1", "one", 1, true)
+	c.publish("b/1", "two", 1, true)
+	c.subscribe("a/#", 1)
+
+	var clients []ClientInfo
+	adminRequest(t, handler, "GET", "/clients", "", &clients)
+	if assert.Len(t, clients, 1) {
+		assert.Equal(t, "c1", clients[0].ID)
+		assert.False(t, clients[0].Clean)
+	}
+	var stats Stats
+	adminRequest(t, handler, "GET", "/stats", "", &stats)
+	assert.Equal(t, 1, stats.Clients)
+	assert.Equal(t, 1, stats.Subscriptions)
+	assert.Equal(t, 2, stats.Retained)
+
+	var subs []SubscriptionInfo
+	adminRequest(t, handler, "GET", "/subscriptions?client=c1", "", &subs)
+	assert.Equal(t, []SubscriptionInfo{{ClientID: "c1", Filter: "a/#", QoS: 1}}, subs)
+	adminRequest(t, handler, "GET", "/subscriptions?client=c2", "", &subs)
+	assert.Empty(t, subs)
+
+	var retained []RetainedInfo
+	adminRequest(t, handler, "GET", "/retained?filter=a/%23", "", &retained)
+	assert.Equal(t, []RetainedInfo{{Topic: "a/1", QoS: 1, Payload: []byte("one")}}, retained)
+	w := adminRequest(t, handler, "GET", "/retained", "", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "filter required", adminError(t, w))
+	w = adminRequest(t, handler, "GET", "/retained?filter=a/%23/b", "", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var deleted map[string]int
+	adminRequest(t, handler, "DELETE", "/retained?filter=%23", "", &deleted)
+	assert.Equal(t, map[string]int{"deleted": 2}, deleted)
+	adminRequest(t, handler, "GET", "/retained?filter=%23", "", &retained)
+	assert.Empty(t, retained)
+
+	// the session is kept after a kick, and removed by a purge
+	w = adminRequest(t, handler, "DELETE", "/clients/c1", "", nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	waitFor(t, func() bool {
+		return len(server.Clients()) == 0
+	})
+	w = adminRequest(t, handler, "DELETE", "/clients/c1", "", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "client not connected", adminError(t, w))
+	var session SessionInfo
+	adminRequest(t, handler, "GET", "/sessions/c1", "", &session)
+	assert.False(t, session.Connected)
+	assert.Len(t, session.Subscriptions, 1)
+	w = adminRequest(t, handler, "DELETE", "/sessions/c1", "", nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = adminRequest(t, handler, "GET", "/sessions/c1", "", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "session not found", adminError(t, w))
+
+	w = adminRequest(t, handler, "POST", "/clients", "", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET", w.Header().Get("Allow"))
+	w = adminRequest(t, handler, "PUT", "/sessions/c1", "", nil)
+	assert.Equal(t, "GET, DELETE", w.Header().Get("Allow"))
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	defer logrus.SetLevel(logrus.GetLevel())
+	handler := newServer(NewOptions(), newMemoryStore()).AdminHandler()
+
+	var level map[string]string
+	adminRequest(t, handler, "PUT", "/log/level?level=warning", "", &level)
+	assert.Equal(t, map[string]string{"level": "warning"}, level)
+	adminRequest(t, handler, "GET", "/log/level", "", &level)
+	assert.Equal(t, "warning", level["level"])
+	w := adminRequest(t, handler, "PUT", "/log/level?level=loud", "", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, logrus.WarnLevel, logrus.GetLevel())
+}
+
+func TestAdminToken(t *testing.T) {
+	opts := NewOptions()
+	opts.AdminToken = "secret"
+	handler := newServer(opts, newMemoryStore()).AdminHandler()
+
+	for _, token := range []string{"", "wrong"} {
+		w := adminRequest(t, handler, "GET", "/stats", token, nil)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Equal(t, `Bearer realm="mqtt-admin"`, w.Header().Get("WWW-Authenticate"))
+		assert.Equal(t, "invalid admin token", adminError(t, w))
+	}
+	// the token without its scheme
+	r := httptest.NewRequest("GET", "/stats", nil)
+	r.Header.Set("Authorization", "secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	var stats Stats
+	w = adminRequest(t, handler, "GET", "/stats", "secret", &stats)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = adminRequest(t, handler, "DELETE", "/sessions/none", "secret", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// the health checks are open to the load balancers
+	w = adminRequest(t, handler, "GET", "/health", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,25 @@
+package mqtt
+
+// An Authorizer checks the credentials of the users and their access to the topics, of
+// the MQTT clients and of the requests of the HTTP bridge alike. The anonymous user is "".
+type Authorizer interface {
+	// Authenticate checks the password of the user.
+	Authenticate(user, password string) bool
+	// CanPublish checks the user may publish to the topic name, the will topic included.
+	CanPublish(user, topic string) bool
+	// CanSubscribe checks the user may subscribe to the topic filter.
+	CanSubscribe(user, filter string) bool
+}
+
+// everything is allowed without an authorizer.
+func (this *Server) authenticate(user, password string) bool {
+	return this.opts.Authorizer == nil || this.opts.Authorizer.Authenticate(user, password)
+}
+
+func (this *Server) canPublish(user, topic string) bool {
+	return this.opts.Authorizer == nil || this.opts.Authorizer.CanPublish(user, topic)
+}
+
+func (this *Server) canSubscribe(user, filter string) bool {
+	return this.opts.Authorizer == nil || this.opts.Authorizer.CanSubscribe(user, filter)
+}
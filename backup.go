@@ -0,0 +1,234 @@
+package mqtt
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// BackupStore is a store able to back up itself while the broker is running.
+type BackupStore interface {
+	// BackupTo writes a point-in-time copy of the store to a new directory.
+	BackupTo(dir string) error
+	// Backup writes a point-in-time copy of the store as a tar stream.
+	Backup(w io.Writer) error
+}
+
+// BackupTo copies a leveldb snapshot of the store to a new leveldb in dir,
+// the copy can be opened as the store or restored by RestoreLevelStore.
+func (this *LevelStore) BackupTo(dir string) error {
+	snap, err := this.db.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	db, err := leveldb.OpenFile(dir, &opt.Options{ErrorIfExist: true})
+	if err != nil {
+		return err
+	}
+	iter := snap.NewIterator(nil, nil)
+	defer iter.Release()
+	b := new(leveldb.Batch)
+	for iter.Next() {
+		b.Put(iter.Key(), iter.Value())
+		if b.Len() >= 1000 {
+			if err := db.Write(b, nil); err != nil {
+				db.Close()
+				return err
+			}
+			b.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		db.Close()
+		return err
+	}
+	if err := db.Write(b, nil); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+// Backup writes the files of a backup directory as a tar stream.
+func (this *LevelStore) Backup(w io.Writer) error {
+	tmp, err := os.MkdirTemp("", "mqtt-backup")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	dir := filepath.Join(tmp, "store.db")
+	if err := this.BackupTo(dir); err != nil {
+		return err
+	}
+	return tarDir(w, dir)
+}
+
+// RestoreLevelStore replaces the leveldb at path with a backup, a directory made by
+// BackupTo or a tar file made by Backup. The store at path must not be open.
+func RestoreLevelStore(backup, path string) error {
+	info, err := os.Stat(backup)
+	if err != nil {
+		return err
+	}
+
+	// restore to a new directory first, the store is kept if the backup is broken
+	tmp := strings.TrimRight(path, string(filepath.Separator)) + ".restore"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if info.IsDir() {
+		err = copyDir(backup, tmp)
+	} else {
+		err = untarFile(backup, tmp)
+	}
+	if err != nil {
+		return err
+	}
+
+	db, err := leveldb.OpenFile(tmp, &opt.Options{ErrorIfMissing: true})
+	if err != nil {
+		return err
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// BackupTo writes a backup of the running store to dir.
+func (this *Server) BackupTo(dir string) error {
+	store, ok := this.store.(BackupStore)
+	if !ok {
+		return ErrBackupNotSupported
+	}
+	log.Infof("backup store to %v", dir)
+	return store.BackupTo(dir)
+}
+
+// Backup writes a backup of the running store to w as a tar stream.
+func (this *Server) Backup(w io.Writer) error {
+	store, ok := this.store.(BackupStore)
+	if !ok {
+		return ErrBackupNotSupported
+	}
+	log.Info("backup store to stream")
+	return store.Backup(w)
+}
+
+// the leveldb directory is flat, only the regular files are written.
+func tarDir(w io.Writer, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if err := copyFile(tw, filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func untarFile(file, dir string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// a backup has only the files of the leveldb directory
+		name := filepath.Base(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || name != hdr.Name {
+			return ErrInvalidBackup
+		}
+		if err := writeFile(filepath.Join(dir, name), tr); err != nil {
+			return err
+		}
+	}
+}
+
+func copyDir(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		f, err := os.Open(filepath.Join(src, e.Name()))
+		if err != nil {
+			return err
+		}
+		err = writeFile(filepath.Join(dst, e.Name()), f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(w io.Writer, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func writeFile(name string, r io.Reader) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
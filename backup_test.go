@@ -0,0 +1,95 @@
+package mqtt
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevelStoreBackup(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newLevelStore(filepath.Join(dir, "store.db"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer store.Close()
+	server := newServer(NewOptions(), store)
+
+	assert.NoError(t, store.StoreSubscription("a/#", "c1", 1))
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = "a/b"
+	p.Qos = 1
+	p.MessageID = 1
+	p.Payload = []byte("before")
+	assert.NoError(t, store.StoreOutboundPacket("c1", p))
+
+	// a backup to a directory and a tar stream through the admin interface
+	handler := server.AdminHandler()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/backup?dir="+filepath.Join(dir, "backup"), nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/backup", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "backup.tar"), w.Body.Bytes(), 0644))
+
+	// an existing directory is not overwritten
+	assert.Error(t, server.BackupTo(filepath.Join(dir, "backup")))
+
+	// the changes after the backup are not in it
+	p.Payload = []byte("after")
+	assert.NoError(t, store.StoreOutboundPacket("c1", p))
+	assert.NoError(t, store.StoreSubscription("b", "c1", 1))
+
+	for _, backup := range []string{"backup", "backup.tar"} {
+		path := filepath.Join(dir, "restored-"+backup)
+		restored, err := OpenStore(&Options{StorePath: path, StoreRestore: filepath.Join(dir, backup)})
+		if !assert.NoError(t, err, backup) {
+			continue
+		}
+		var filters []string
+		restored.LookupSubscriptions(func(filter, cid string, qos byte) {
+			filters = append(filters, filter)
+		})
+		assert.Equal(t, []string{"a/#"}, filters, backup)
+		restored.StreamOfflinePackets("c1", func(p packets.ControlPacket) {
+			assert.Equal(t, "before", string(p.(*packets.PublishPacket).Payload), backup)
+		})
+		restored.(io.Closer).Close()
+	}
+}
+
+func TestRestoreInvalidBackup(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "store.db")
+	store, err := newLevelStore(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, store.StoreSubscription("a", "c1", 0))
+	store.Close()
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "broken.tar"), []byte("not a tar"), 0644))
+	assert.Error(t, RestoreLevelStore(filepath.Join(dir, "broken.tar"), path))
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "empty"), 0755))
+	assert.Error(t, RestoreLevelStore(filepath.Join(dir, "empty"), path))
+
+	// the store is kept
+	store, err = newLevelStore(path)
+	if assert.NoError(t, err) {
+		n := 0
+		store.LookupSubscriptions(func(string, string, byte) { n++ })
+		assert.Equal(t, 1, n)
+		store.Close()
+	}
+
+	w := httptest.NewRecorder()
+	newServer(NewOptions(), newMemoryStore()).AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/backup", nil))
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
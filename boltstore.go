@@ -0,0 +1,415 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	boltSubscriptions = []byte("subscriptions")
+	boltRetained      = []byte("retained")
+	boltInbound       = []byte("inbound")
+	boltOutbound      = []byte("outbound")
+	boltWills         = []byte("wills")
+	boltMeta          = []byte("meta")
+	// marks a store created with a keyring
+	boltEncrypted = []byte("encrypted")
+)
+
+// BoltStore keeps everything in a single bbolt file.
+//
+// The subscriptions and the packets are grouped by client in nested buckets,
+// the client ids, the filters and the topics are encrypted with a keyring:
+//
+//	subscriptions/<cid>/<filter> = qos
+//	retained/<topic>             = packet
+//	inbound/<cid>/<mid>          = packet
+//	outbound/<cid>/<mid>         = packet
+//	wills/<cid>                  = packet
+//	meta/encrypted               = marks a store created with a keyring
+type BoltStore struct {
+	db *bbolt.DB
+	// encrypts the packets and the names in the keys if not nil
+	keys *Keyring
+}
+
+func newBoltStore(path string) (*BoltStore, error) {
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{boltSubscriptions, boltRetained, boltInbound, boltOutbound, boltWills, boltMeta} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (this *BoltStore) Close() error {
+	return this.db.Close()
+}
+
+func (this *BoltStore) encrypted() (marked, empty bool, err error) {
+	err = this.db.View(func(tx *bbolt.Tx) error {
+		if marked = tx.Bucket(boltMeta).Get(boltEncrypted) != nil; marked {
+			return nil
+		}
+		empty = true
+		for _, name := range [][]byte{boltSubscriptions, boltRetained, boltInbound, boltOutbound, boltWills} {
+			if k, _ := tx.Bucket(name).Cursor().First(); k != nil {
+				empty = false
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (this *BoltStore) markEncrypted() error {
+	return this.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltMeta).Put(boltEncrypted, []byte{1})
+	})
+}
+
+func (this *BoltStore) StoreSubscription(filter, cid string, qos byte) error {
+	return this.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.Bucket(boltSubscriptions).CreateBucketIfNotExists(this.name(cid))
+		if err != nil {
+			return err
+		}
+		return b.Put(this.name(filter), []byte{qos})
+	})
+}
+
+func (this *BoltStore) DeleteSubscription(filter, cid string) error {
+	return this.db.Update(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket(boltSubscriptions).Bucket(this.name(cid)); b != nil {
+			return b.Delete(this.name(filter))
+		}
+		return nil
+	})
+}
+
+func (this *BoltStore) CleanSubscription(cid string) error {
+	return this.db.Update(func(tx *bbolt.Tx) error {
+		return deleteBoltBucket(tx.Bucket(boltSubscriptions), this.name(cid))
+	})
+}
+
+func (this *BoltStore) LookupSubscriptions(callback func(filter, cid string, qos byte)) error {
+	var corrupt error
+	err := this.db.View(func(tx *bbolt.Tx) error {
+		root := tx.Bucket(boltSubscriptions)
+		return root.ForEach(func(key, _ []byte) error {
+			b := root.Bucket(key)
+			cid, err := this.keys.reveal(string(key))
+			if b == nil || err != nil {
+				corrupt = ErrCorruptValue
+				return nil
+			}
+			return b.ForEach(func(key, qos []byte) error {
+				filter, err := this.keys.reveal(string(key))
+				if len(qos) != 1 || err != nil {
+					corrupt = ErrCorruptValue
+					return nil
+				}
+				callback(filter, cid, qos[0])
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return corrupt
+}
+
+func (this *BoltStore) StoreRetained(p *packets.PublishPacket) error {
+	return this.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(boltRetained)
+		if len(p.Payload) == 0 {
+			return b.Delete(this.name(p.TopicName))
+		}
+		return b.Put(this.name(p.TopicName), this.keys.marshal(p))
+	})
+}
+
+func (this *BoltStore) LookupRetained(callback func(*packets.PublishPacket)) error {
+	var corrupt error
+	err := this.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltRetained).ForEach(func(_, value []byte) error {
+			p, err := this.keys.decodePublish(value)
+			if err != nil {
+				corrupt = err
+				return nil
+			}
+			callback(p)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return corrupt
+}
+
+func (this *BoltStore) StoreWill(cid string, p *packets.PublishPacket) error {
+	return this.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltWills).Put(this.name(cid), this.keys.marshal(p))
+	})
+}
+
+func (this *BoltStore) DeleteWill(cid string) error {
+	return this.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltWills).Delete(this.name(cid))
+	})
+}
+
+func (this *BoltStore) LookupWills(callback func(cid string, p *packets.PublishPacket)) error {
+	type will struct {
+		cid string
+		p   *packets.PublishPacket
+	}
+	var l []will
+	var corrupt error
+	err := this.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltWills).ForEach(func(key, value []byte) error {
+			p, err := this.keys.decodePublish(value)
+			if err != nil {
+				corrupt = err
+				return nil
+			}
+			cid, err := this.keys.reveal(string(key))
+			if err != nil {
+				corrupt = err
+				return nil
+			}
+			l = append(l, will{cid, p})
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// the encrypted client ids are not ordered
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].cid < l[j].cid
+	})
+	for _, w := range l {
+		callback(w.cid, w.p)
+	}
+	return corrupt
+}
+
+func (this *BoltStore) FindInboundPacket(cid string, mid uint16) (cp packets.ControlPacket, err error) {
+	err = this.db.View(func(tx *bbolt.Tx) (err error) {
+		if b := tx.Bucket(boltInbound).Bucket(this.name(cid)); b != nil {
+			if value := b.Get(boltPacketKey(mid)); value != nil {
+				cp, err = this.keys.decode(value)
+			}
+		}
+		return
+	})
+	return
+}
+
+func (this *BoltStore) StoreInboundPacket(cid string, p packets.ControlPacket) error {
+	return this.storePacket(boltInbound, cid, p)
+}
+
+func (this *BoltStore) StoreOutboundPacket(cid string, p packets.ControlPacket) error {
+	return this.storePacket(boltOutbound, cid, p)
+}
+
+func (this *BoltStore) storePacket(direction []byte, cid string, p packets.ControlPacket) error {
+	return this.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.Bucket(direction).CreateBucketIfNotExists(this.name(cid))
+		if err != nil {
+			return err
+		}
+		return b.Put(boltPacketKey(p.Details().MessageID), this.keys.marshal(p))
+	})
+}
+
+func (this *BoltStore) StreamOfflinePackets(cid string, callback func(packets.ControlPacket)) error {
+	// decode all packets first, the callback may write to the store
+	var l []packets.ControlPacket
+	var corrupt error
+	err := this.db.View(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket(boltOutbound).Bucket(this.name(cid)); b != nil {
+			return b.ForEach(func(_, value []byte) error {
+				cp, err := this.keys.decode(value)
+				if err != nil {
+					corrupt = err
+					return nil
+				}
+				l = append(l, cp)
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, cp := range l {
+		callback(cp)
+	}
+	return corrupt
+}
+
+func (this *BoltStore) LookupPackets(callback func(cid string, inbound bool, p packets.ControlPacket)) error {
+	type storedPacket struct {
+		cid     string
+		inbound bool
+		p       packets.ControlPacket
+	}
+	// decode all packets first, the callback may write to the store
+	var l []storedPacket
+	var corrupt error
+	err := this.db.View(func(tx *bbolt.Tx) error {
+		for _, direction := range [][]byte{boltInbound, boltOutbound} {
+			root := tx.Bucket(direction)
+			err := root.ForEach(func(key, _ []byte) error {
+				b := root.Bucket(key)
+				cid, err := this.keys.reveal(string(key))
+				if b == nil || err != nil {
+					corrupt = ErrCorruptValue
+					return nil
+				}
+				return b.ForEach(func(_, value []byte) error {
+					cp, err := this.keys.decode(value)
+					if err != nil {
+						corrupt = err
+						return nil
+					}
+					l = append(l, storedPacket{cid, bytes.Equal(direction, boltInbound), cp})
+					return nil
+				})
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the buckets are ordered by message id, and by client id without a keyring
+	sort.SliceStable(l, func(i, j int) bool {
+		if l[i].cid != l[j].cid {
+			return l[i].cid < l[j].cid
+		}
+		return l[i].inbound && !l[j].inbound
+	})
+	for _, sp := range l {
+		callback(sp.cid, sp.inbound, sp.p)
+	}
+	return corrupt
+}
+
+func (this *BoltStore) DeleteInboundPacket(cid string, mid uint16) error {
+	return this.deletePacket(boltInbound, cid, mid)
+}
+
+func (this *BoltStore) DeleteOutboundPacket(cid string, mid uint16) error {
+	return this.deletePacket(boltOutbound, cid, mid)
+}
+
+func (this *BoltStore) deletePacket(direction []byte, cid string, mid uint16) error {
+	return this.db.Update(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket(direction).Bucket(this.name(cid)); b != nil {
+			return b.Delete(boltPacketKey(mid))
+		}
+		return nil
+	})
+}
+
+// writeOutbound writes the packets in one transaction.
+func (this *BoltStore) writeOutbound(writes []outboundWrite) error {
+	return this.db.Update(func(tx *bbolt.Tx) error {
+		for _, w := range writes {
+			if w.p == nil {
+				if b := tx.Bucket(boltOutbound).Bucket(this.name(w.cid)); b != nil {
+					if err := b.Delete(boltPacketKey(w.mid)); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			b, err := tx.Bucket(boltOutbound).CreateBucketIfNotExists(this.name(w.cid))
+			if err != nil {
+				return err
+			}
+			if err := b.Put(boltPacketKey(w.mid), this.keys.marshal(w.p)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (this *BoltStore) CleanPackets(cid string) error {
+	return this.db.Update(func(tx *bbolt.Tx) error {
+		if err := deleteBoltBucket(tx.Bucket(boltInbound), this.name(cid)); err != nil {
+			return err
+		}
+		return deleteBoltBucket(tx.Bucket(boltOutbound), this.name(cid))
+	})
+}
+
+func (this *BoltStore) InPacketsSize() (int, error) {
+	return this.countPackets(boltInbound)
+}
+
+func (this *BoltStore) OutPacketsSize() (int, error) {
+	return this.countPackets(boltOutbound)
+}
+
+func (this *BoltStore) countPackets(direction []byte) (count int, err error) {
+	err = this.db.View(func(tx *bbolt.Tx) error {
+		root := tx.Bucket(direction)
+		return root.ForEach(func(cid, _ []byte) error {
+			if b := root.Bucket(cid); b != nil {
+				count += b.Stats().KeyN
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// the key of a client id, a filter or a topic, encrypted with a keyring.
+func (this *BoltStore) name(s string) []byte {
+	return []byte(this.keys.hide(s))
+}
+
+func deleteBoltBucket(parent *bbolt.Bucket, name []byte) error {
+	if parent.Bucket(name) == nil {
+		return nil
+	}
+	return parent.DeleteBucket(name)
+}
+
+// big endian keys keep the packets ordered by message id
+func boltPacketKey(mid uint16) []byte {
+	key := make([]byte, 2)
+	binary.BigEndian.PutUint16(key, mid)
+	return key
+}
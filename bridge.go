@@ -0,0 +1,557 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"gopkg.in/tomb.v2"
+)
+
+const (
+	DefaultBridgeMinBackoff = 1 * time.Second
+	DefaultBridgeMaxBackoff = 2 * time.Minute
+	DefaultBridgeQueueSize  = 256
+)
+
+type BridgeDirection int
+
+const (
+	// mirror local messages to the remote broker
+	BridgeOut BridgeDirection = iota
+	// mirror remote messages to the local broker
+	BridgeIn
+	BridgeBoth
+)
+
+// BridgeRule mirrors the topics matched by Filter. The local topic is LocalPrefix + topic and the
+// remote topic is RemotePrefix + topic, so the prefixes are swapped when a message crosses the bridge.
+//
+// Rules with direction BridgeBoth loop if the remote broker mirrors the same topics back, there is
+// no way to stop it in MQTT 3.1.1 other than using different prefixes on each side.
+type BridgeRule struct {
+	Direction    BridgeDirection
+	Filter       string
+	LocalPrefix  string
+	RemotePrefix string
+	// the maximum qos used to subscribe and forward messages
+	QoS byte
+}
+
+type BridgeOptions struct {
+	// Name identifies the bridge, the outbound messages are buffered in the store as client "$bridge/<name>".
+	Name string
+
+	// Address of the remote broker, ie: tcp://central:1883.
+	Address string
+
+	// ClientID used to connect to the remote broker. If not set then default to the name.
+	ClientID string
+	Username string
+	Password string
+
+	// CleanSession of the remote session, if false the remote broker keeps the inbound
+	// messages while the uplink is down.
+	CleanSession bool
+
+	// KeepAlive of the uplink. If not set then default to Options.KeepAlive.
+	KeepAlive time.Duration
+
+	// The delay before reconnecting doubles from MinBackoff to MaxBackoff.
+	// If not set then default to 1 second and 2 minutes.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// QueueSize is the most messages queued to the uplink, the local publishers never wait
+	// for it. The others of qos 1 and 2 are sent from the store once there's room, those of
+	// qos 0 are dropped. If not set then default to 256.
+	QueueSize int
+
+	Rules []BridgeRule
+}
+
+// Bridge connects to a remote broker as a client, and mirrors the messages matched by its rules.
+//
+// Outbound messages of qos 1 and 2 are stored before sending and deleted when acknowledged,
+// those published while the uplink is down are sent after reconnecting. Outbound qos 0
+// messages are dropped while the uplink is down or behind.
+type Bridge struct {
+	tomb.Tomb
+	sync.Mutex
+
+	id     string
+	opts   *BridgeOptions
+	server *Server
+
+	// the send queue and the down signal of the current uplink, nil if it's down
+	uplink chan packets.ControlPacket
+	down   chan struct{}
+	// the ids of the stored messages queued to the current uplink, and the signal to queue
+	// the others
+	queued map[uint16]bool
+	resend chan struct{}
+}
+
+// AddBridge starts a bridge to the remote broker, it keeps reconnecting until stopped.
+func (this *Server) AddBridge(opts *BridgeOptions) (*Bridge, error) {
+	if opts.Name == "" {
+		return nil, errors.New("bridge name required")
+	}
+	if _, err := url.Parse(opts.Address); err != nil {
+		return nil, err
+	}
+	for _, rule := range opts.Rules {
+		if err := validateQoS(rule.QoS); err != nil {
+			return nil, err
+		}
+		if _, err := topicTokenise(rule.LocalPrefix + rule.Filter); err != nil {
+			return nil, err
+		}
+		if _, err := topicTokenise(rule.RemotePrefix + rule.Filter); err != nil {
+			return nil, err
+		}
+	}
+
+	b := &Bridge{
+		id:     "$bridge/" + opts.Name,
+		opts:   opts,
+		server: this,
+	}
+
+	if _, ok := this.deliverer(b.id); ok {
+		return nil, fmt.Errorf("bridge %q already exists", opts.Name)
+	}
+	this.addDeliverer(b.id, b)
+
+	for _, rule := range opts.Rules {
+		if rule.Direction == BridgeIn {
+			continue
+		}
+		tokens, _ := topicTokenise(rule.LocalPrefix + rule.Filter)
+		this.subhier.subscribe(tokens, b.id, rule.QoS)
+	}
+
+	b.Go(b.run)
+	return b, nil
+}
+
+// Stop disconnects the bridge, the buffered messages are kept in the store.
+func (this *Bridge) Stop() error {
+	this.server.subhier.clean(this.id)
+	this.server.removeDeliverer(this.id)
+	this.Kill(nil)
+	return this.Wait()
+}
+
+func (this *Bridge) run() error {
+	backoff := this.opts.MinBackoff
+	if backoff == 0 {
+		backoff = DefaultBridgeMinBackoff
+	}
+
+	for {
+		conn, err := this.connect()
+		if err == nil {
+			log.Infof("bridge(%v) connected to %v", this.opts.Name, this.opts.Address)
+			backoff = this.opts.MinBackoff
+			if backoff == 0 {
+				backoff = DefaultBridgeMinBackoff
+			}
+			err = this.serve(conn)
+		}
+		log.Warnf("bridge(%v) uplink down, %v, reconnecting in %v", this.opts.Name, err, backoff)
+
+		select {
+		case <-this.Dying():
+			return nil
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		max := this.opts.MaxBackoff
+		if max == 0 {
+			max = DefaultBridgeMaxBackoff
+		}
+		if backoff > max {
+			backoff = max
+		}
+	}
+}
+
+func (this *Bridge) keepAlive() time.Duration {
+	if this.opts.KeepAlive > 0 {
+		return this.opts.KeepAlive
+	}
+	if this.server.opts.KeepAlive > 0 {
+		return this.server.opts.KeepAlive
+	}
+	return DefaultKeepAlive
+}
+
+// dial the remote broker and finish the connect handshake.
+func (this *Bridge) connect() (net.Conn, error) {
+	u, err := url.Parse(this.opts.Address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout(u.Scheme, u.Host, this.server.opts.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	cp := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ClientIdentifier = this.opts.ClientID
+	if cp.ClientIdentifier == "" {
+		cp.ClientIdentifier = this.opts.Name
+	}
+	cp.CleanSession = this.opts.CleanSession
+	cp.KeepaliveTimer = uint16(this.keepAlive() / time.Second)
+	if this.opts.Username != "" {
+		cp.UsernameFlag = true
+		cp.Username = this.opts.Username
+	}
+	if this.opts.Password != "" {
+		cp.PasswordFlag = true
+		cp.Password = []byte(this.opts.Password)
+	}
+
+	conn.SetDeadline(time.Now().Add(this.server.opts.ConnectTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if err = cp.Write(conn); err == nil {
+		var p packets.ControlPacket
+		if p, err = packets.ReadPacket(conn); err == nil {
+			if ack, ok := p.(*packets.ConnackPacket); !ok {
+				err = errors.New("connack message expected")
+			} else if ack.ReturnCode != packets.Accepted {
+				err = fmt.Errorf("connection refused, code %v", ack.ReturnCode)
+			}
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// serve a connected uplink until it's down or the bridge stopped.
+func (this *Bridge) serve(conn net.Conn) error {
+	size := this.opts.QueueSize
+	if size <= 0 {
+		size = DefaultBridgeQueueSize
+	}
+	out := make(chan packets.ControlPacket, size)
+	down := make(chan struct{})
+	var once sync.Once
+	shutdown := func() {
+		once.Do(func() {
+			close(down)
+			conn.Close()
+		})
+	}
+	defer shutdown()
+
+	go func() {
+		select {
+		case <-this.Dying():
+		case <-down:
+		}
+		shutdown()
+	}()
+	go this.writer(conn, out, down, shutdown)
+
+	send := func(p packets.ControlPacket) bool {
+		select {
+		case out <- p:
+			return true
+		case <-down:
+			return false
+		}
+	}
+
+	if filters, qoss := this.remoteFilters(); len(filters) > 0 {
+		sp := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		sp.MessageID = this.server.mids.request(this.id)
+		sp.Topics = filters
+		sp.Qoss = qoss
+		send(sp)
+	}
+
+	// the messages delivered from now on are queued to the uplink, the ones buffered while
+	// it's down or not acknowledged are resent from the store.
+	queued := make(map[uint16]bool)
+	resend := make(chan struct{}, 1)
+	resend <- struct{}{}
+	this.Lock()
+	this.uplink, this.down, this.queued, this.resend = out, down, queued, resend
+	this.Unlock()
+	defer func() {
+		this.Lock()
+		this.uplink, this.down, this.queued, this.resend = nil, nil, nil, nil
+		this.Unlock()
+	}()
+	go this.resender(queued, resend, down, send)
+
+	timeout := this.keepAlive() + this.keepAlive()/2
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			select {
+			case <-this.Dying():
+				return ErrDisconnect
+			default:
+			}
+			return err
+		}
+
+		if err = this.handle(p, send); err != nil {
+			return err
+		}
+	}
+}
+
+// queue the stored messages not queued to the uplink yet, each time it's signaled.
+func (this *Bridge) resender(queued map[uint16]bool, resend, down chan struct{}, send func(packets.ControlPacket) bool) {
+	for {
+		select {
+		case <-resend:
+		case <-down:
+			return
+		}
+		err := this.server.store.StreamOfflinePackets(this.id, func(p packets.ControlPacket) {
+			mid := p.Details().MessageID
+			this.Lock()
+			ok := queued[mid]
+			queued[mid] = true
+			this.Unlock()
+			if !ok {
+				this.server.mids.use(this.id, mid)
+				// the stored messages may have been sent already
+				if publish, ok := p.(*packets.PublishPacket); ok {
+					dup := *publish
+					dup.Dup = true
+					p = &dup
+				}
+				send(p)
+			}
+		})
+		this.server.storeFailed("stream bridge messages", err)
+	}
+}
+
+func (this *Bridge) writer(conn net.Conn, out chan packets.ControlPacket, down chan struct{}, shutdown func()) {
+	ticker := time.NewTicker(this.keepAlive())
+	defer ticker.Stop()
+
+	for {
+		var p packets.ControlPacket
+		select {
+		case p = <-out:
+		case <-ticker.C:
+			p = packets.NewControlPacket(packets.Pingreq)
+		case <-down:
+			return
+		}
+		if err := p.Write(conn); err != nil {
+			log.Warnf("bridge(%v) writting message to uplink err, %v", this.opts.Name, err)
+			shutdown()
+			return
+		}
+	}
+}
+
+// handle a packet received from the remote broker.
+func (this *Bridge) handle(p packets.ControlPacket, send func(packets.ControlPacket) bool) error {
+	store := this.server.store
+	switch p := p.(type) {
+	case *packets.PublishPacket:
+		topic, ok := this.localTopic(p.TopicName)
+		if !ok {
+			log.Warnf("bridge(%v) unexpected message on topic %q", this.opts.Name, p.TopicName)
+			break
+		}
+		message := p.Copy()
+		message.TopicName = topic
+		message.Qos = p.Qos
+		message.Retain = p.Retain
+
+		switch p.Qos {
+		case 0:
+			this.server.publishMessage(this.id, message)
+		case 1:
+			// the remote broker resends the message not acknowledged after reconnecting.
+			if err := this.server.publishMessage(this.id, message); err != nil {
+				return err
+			}
+			ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			ack.MessageID = p.MessageID
+			send(ack)
+		case 2:
+			cp, err := store.FindInboundPacket(this.id, p.MessageID)
+			if err = this.server.storeFailed("find inbound packet", err); err != nil {
+				return err
+			}
+			// stored before it's published, it's never published again when resent
+			if cp == nil {
+				if err := this.server.checkStore("store inbound packet", store.StoreInboundPacket(this.id, p)); err != nil {
+					return err
+				}
+				if err := this.server.publishMessage(this.id, message); err != nil {
+					this.server.checkStore("delete inbound packet", store.DeleteInboundPacket(this.id, p.MessageID))
+					return err
+				}
+			}
+			ack := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+			ack.MessageID = p.MessageID
+			send(ack)
+		}
+	case *packets.PubrelPacket:
+		if err := this.server.checkStore("delete inbound packet", store.DeleteInboundPacket(this.id, p.MessageID)); err != nil {
+			return err
+		}
+		ack := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+		ack.MessageID = p.MessageID
+		send(ack)
+	case *packets.PubackPacket:
+		return this.published(p.MessageID)
+	case *packets.PubrecPacket:
+		rel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+		rel.MessageID = p.MessageID
+		if err := this.server.checkStore("store pubrel", store.StoreOutboundPacket(this.id, rel)); err != nil {
+			return err
+		}
+		send(rel)
+	case *packets.PubcompPacket:
+		return this.published(p.MessageID)
+	case *packets.SubackPacket:
+		this.server.mids.free(this.id, p.MessageID)
+		for i, qos := range p.GrantedQoss {
+			if qos == 0x80 {
+				log.Warnf("bridge(%v) subscription %v refused by remote broker", this.opts.Name, i)
+			}
+		}
+	case *packets.PingrespPacket:
+	default:
+		return fmt.Errorf("unexpected packet %v", p)
+	}
+	return nil
+}
+
+// the id is freed once the message is deleted, a message reusing it is not queued before.
+func (this *Bridge) published(mid uint16) error {
+	if err := this.server.checkStore("delete outbound packet", this.server.store.DeleteOutboundPacket(this.id, mid)); err != nil {
+		return err
+	}
+	this.Lock()
+	if this.queued != nil {
+		delete(this.queued, mid)
+	}
+	this.Unlock()
+	this.server.mids.free(this.id, mid)
+	return nil
+}
+
+// deliver a local message to the remote broker.
+func (this *Bridge) deliver(origin string, message *packets.PublishPacket, qos byte) error {
+	// never send back a message received from the uplink
+	if origin == this.id {
+		return nil
+	}
+	topic, ok := this.remoteTopic(message.TopicName)
+	if !ok {
+		return nil
+	}
+
+	p := message.Copy()
+	p.TopicName = topic
+	p.Qos = qos
+	p.Dup = false
+
+	// stored and queued at once, the resender sees the message only once it's queued or not.
+	// The publisher never waits for the uplink, the stored messages are resent if it's behind.
+	this.Lock()
+	defer this.Unlock()
+	if qos > 0 {
+		p.MessageID = this.server.mids.request(this.id)
+		if err := this.server.checkStore("store bridge message", this.server.store.StoreOutboundPacket(this.id, p)); err != nil {
+			this.server.mids.free(this.id, p.MessageID)
+			return err
+		}
+	}
+	if this.uplink == nil {
+		return nil
+	}
+	select {
+	case this.uplink <- p:
+		if qos > 0 {
+			this.queued[p.MessageID] = true
+		}
+	default:
+		if qos == 0 {
+			log.Debugf("bridge(%v) message to %q dropped, the uplink is behind", this.opts.Name, p.TopicName)
+			break
+		}
+		select {
+		case this.resend <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// the filters and qos to subscribe on the remote broker.
+func (this *Bridge) remoteFilters() (filters []string, qoss []byte) {
+	for _, rule := range this.opts.Rules {
+		if rule.Direction == BridgeOut {
+			continue
+		}
+		filters = append(filters, rule.RemotePrefix+rule.Filter)
+		qoss = append(qoss, rule.QoS)
+	}
+	return
+}
+
+// map a local topic to the remote topic by the first matched outbound rule.
+func (this *Bridge) remoteTopic(topic string) (string, bool) {
+	for _, rule := range this.opts.Rules {
+		if rule.Direction != BridgeIn && matchTopic(rule.LocalPrefix+rule.Filter, topic) {
+			return rule.RemotePrefix + strings.TrimPrefix(topic, rule.LocalPrefix), true
+		}
+	}
+	return "", false
+}
+
+// map a remote topic to the local topic by the first matched inbound rule.
+func (this *Bridge) localTopic(topic string) (string, bool) {
+	for _, rule := range this.opts.Rules {
+		if rule.Direction != BridgeOut && matchTopic(rule.RemotePrefix+rule.Filter, topic) {
+			return rule.LocalPrefix + strings.TrimPrefix(topic, rule.RemotePrefix), true
+		}
+	}
+	return "", false
+}
+
+// check the topic name is matched by the topic filter.
+func matchTopic(filter, topic string) bool {
+	filters := strings.Split(filter, "/")
+	topics := strings.Split(topic, "/")
+	for i, f := range filters {
+		if f == "#" {
+			return true
+		}
+		if i >= len(topics) {
+			return false
+		}
+		if f != "+" && f != topics[i] {
+			return false
+		}
+	}
+	return len(filters) == len(topics)
+}
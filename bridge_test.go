@@ -0,0 +1,177 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func plantRules() []BridgeRule {
+	return []BridgeRule{
+		{Direction: BridgeOut, Filter: "telemetry/#", RemotePrefix: "plant1/", QoS: 1},
+		{Direction: BridgeIn, Filter: "commands/#", RemotePrefix: "plant1/", QoS: 1},
+	}
+}
+
+func TestBridgeRemapTopics(t *testing.T) {
+	central, centralAddr := newTestServer(t)
+	edge, edgeAddr := newTestServer(t)
+
+	b, err := edge.AddBridge(&BridgeOptions{
+		Name:       "plant1",
+		Address:    "tcp://" + centralAddr,
+		MinBackoff: 50 * time.Millisecond,
+		Rules:      plantRules(),
+	})
+	assert.NoError(t, err)
+	defer b.Stop()
+
+	_, err = edge.AddBridge(&BridgeOptions{Name: "plant1"})
+	assert.Error(t, err, "duplicated bridge name")
+	_, err = edge.AddBridge(&BridgeOptions{
+		Name:  "invalid",
+		Rules: []BridgeRule{{Filter: "+", RemotePrefix: "a/#/"}},
+	})
+	assert.Error(t, err, "invalid remote filter")
+
+	sub := dialTestClient(t, centralAddr, "sub", true)
+	sub.subscribe("plant1/telemetry/#", 1)
+	cmd := dialTestClient(t, edgeAddr, "cmd", true)
+	cmd.subscribe("commands/#", 1)
+
+	// wait for the bridge subscribed to the commands
+	waitFor(t, func() bool {
+		return len(central.Subscriptions("plant1")) == 1
+	})
+
+	pub := dialTestClient(t, edgeAddr, "pub", true)
+	pub.publish("telemetry/temperature", "21.5", 1, false)
+	p := sub.receive()
+	assert.Equal(t, "plant1/telemetry/temperature", p.TopicName)
+	assert.Equal(t, "21.5", string(p.Payload))
+
+	// local topics not matched by any rule stay local
+	pub.publish("status", "ok", 1, false)
+
+	pub = dialTestClient(t, centralAddr, "pub", true)
+	pub.publish("plant1/commands/reboot", "now", 1, false)
+	p = cmd.receive()
+	assert.Equal(t, "commands/reboot", p.TopicName)
+	assert.Equal(t, "now", string(p.Payload))
+}
+
+func TestBridgeStoreAndForward(t *testing.T) {
+	central, centralAddr := newTestServer(t)
+	edge, edgeAddr := newTestServer(t)
+
+	// reserve an address for the uplink which is not listening yet
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	uplink := ln.Addr().String()
+	ln.Close()
+
+	b, err := edge.AddBridge(&BridgeOptions{
+		Name:       "plant1",
+		Address:    "tcp://" + uplink,
+		MinBackoff: 20 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+		Rules:      plantRules(),
+	})
+	assert.NoError(t, err)
+	defer b.Stop()
+
+	pub := dialTestClient(t, edgeAddr, "pub", true)
+	pub.publish("telemetry/1", "1", 1, false)
+	pub.publish("telemetry/2", "2", 1, false)
+	pub.publish("telemetry/3", "3", 0, false)
+
+	assert.Equal(t, 2, storeSize(t, edge.store.OutPacketsSize), "qos 1 messages buffered")
+
+	sub := dialTestClient(t, centralAddr, "sub", true)
+	sub.subscribe("plant1/telemetry/#", 1)
+
+	ln, err = net.Listen("tcp", uplink)
+	assert.NoError(t, err)
+	go central.Serve(ln)
+	defer ln.Close()
+
+	topics := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		p := sub.receive()
+		topics[p.TopicName] = true
+	}
+	assert.Equal(t, map[string]bool{"plant1/telemetry/1": true, "plant1/telemetry/2": true}, topics)
+
+	waitFor(t, func() bool {
+		return storeSize(t, edge.store.OutPacketsSize) == 0
+	})
+}
+
+func TestBridgeSlowUplink(t *testing.T) {
+	// a remote broker reading nothing after the connect until the messages are published,
+	// its small receive buffer fills up at once
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, 4096)
+		})
+	}}
+	ln, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	edge, edgeAddr := newTestServer(t)
+	b, err := edge.AddBridge(&BridgeOptions{
+		Name:      "plant1",
+		Address:   "tcp://" + ln.Addr().String(),
+		QueueSize: 1,
+		Rules:     []BridgeRule{{Direction: BridgeOut, Filter: "telemetry/#", QoS: 1}},
+	})
+	assert.NoError(t, err)
+	defer b.Stop()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := packets.ReadPacket(conn); err != nil {
+		t.Fatal(err)
+	}
+	packets.NewControlPacket(packets.Connack).Write(conn)
+
+	// the publisher never waits for the uplink, far more is published than it can hold
+	pub := dialTestClient(t, edgeAddr, "pub", true)
+	payload := strings.Repeat("x", 256<<10)
+	const n = 60
+	for i := 0; i < n; i++ {
+		pub.publish(fmt.Sprintf("telemetry/%v", i), payload, 1, false)
+	}
+
+	// the messages stored while the uplink is behind are sent without reconnecting
+	received := make(map[string]bool)
+	for len(received) < n {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			t.Fatalf("%v messages received, %v", len(received), err)
+		}
+		if p, ok := p.(*packets.PublishPacket); ok {
+			received[p.TopicName] = true
+			ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			ack.MessageID = p.MessageID
+			ack.Write(conn)
+		}
+	}
+	waitFor(t, func() bool {
+		return storeSize(t, edge.store.OutPacketsSize) == 0
+	})
+}
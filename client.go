@@ -13,25 +13,69 @@ import (
 	"github.com/pborman/uuid"
 )
 
+// the lifecycle of a client connection, the states only move forward.
+//
+// A connecting client owns its id once the CONNECT is valid, the connection it takes
+// over is stopped and closed before the session is touched. The will and the session
+// of a disconnecting client are released before the next connection of its id starts.
+type clientState int
+
+const (
+	clientConnecting clientState = iota
+	clientConnected
+	clientDisconnecting
+	clientClosed
+)
+
+func (this clientState) String() string {
+	switch this {
+	case clientConnecting:
+		return "connecting"
+	case clientConnected:
+		return "connected"
+	case clientDisconnecting:
+		return "disconnecting"
+	case clientClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
 type client struct {
 	tomb.Tomb
 	sync.RWMutex
 	ctx       context.Context
 	id        string
 	address   string
+	// the common name of the verified client certificate, of the TLS listener or the proxy
+	commonName string
+	// the user name checked by the authorizer, "" for anonymous
+	username  string
 
-	topics    []string
+	// the filters subscribed, counted if the policy limits them
+	topics    map[string]bool
 	clean     bool
 	will      *packets.PublishPacket
 	keepAlive time.Duration
 
 	server    *Server
 
-	connected bool
+	// the lifecycle state, guarded by the mutex
+	state     clientState
 	stopOnce  sync.Once
+	// closed when the connect is processed, accepted or not
+	ready     chan struct{}
+	// closed when the client is closed and its session released
+	done      chan struct{}
 
 	conn      net.Conn
 	opts      *Options
+	policy    *Policy
+	listener  *listener
+
+	// the user name sharing a quota, and the quotas of the traffic
+	user      string
+	quotas    []*quotaBuckets
 
 	in        chan packets.ControlPacket
 	out       chan packets.ControlPacket
@@ -40,46 +84,86 @@ type client struct {
 func (this *client) start() (err error) {
 	this.in = make(chan packets.ControlPacket)
 	this.out = make(chan packets.ControlPacket)
+	this.ready = make(chan struct{})
+	this.done = make(chan struct{})
+	defer close(this.ready)
 
 	this.address = this.conn.RemoteAddr().String()
 	this.keepAlive = this.opts.ConnectTimeout
 	if err = this.waitConnect(); err != nil {
 		log.Debugf("client(%v) connect processing failed, %v", this.id, err)
-		this.conn.Close()
+		this.abort(err)
 		return
 	}
 	this.Go(this.reader)
 	this.Go(this.writer)
 	this.Go(this.process)
 
-	this.connected = true
-	this.server.clients.add(this)
-
+	this.setState(clientConnected)
+	if !this.clean {
+		go this.server.forwardOfflineMessage(this)
+	}
 	return
 }
 
-// shutdown the client when it's running
-func (this *client) stop(err error) error {
+// the lifecycle state of the client.
+func (this *client) State() clientState {
+	this.RLock()
+	defer this.RUnlock()
+	return this.state
+}
+
+func (this *client) setState(state clientState) {
 	this.Lock()
 	defer this.Unlock()
+	log.Debugf("client(%v) %v -> %v", this.id, this.state, state)
+	this.state = state
+}
 
+// run f while the client is connecting, its state doesn't change meanwhile.
+// Returns false if it's not connecting.
+func (this *client) whileConnecting(f func()) bool {
+	this.RLock()
+	defer this.RUnlock()
+	if this.state != clientConnecting {
+		return false
+	}
+	f()
+	return true
+}
+
+// stop the client and wait until it's closed, a connecting client is stopped
+// once its connect is processed.
+func (this *client) stop(err error) {
 	log.Debugf("client(%v) stop called", this.id)
-	//	if this.connected && this.Alive() {
-	//		this.Kill(errors.New("shutdown"))
-	//		return this.Wait()
-	//	}
-	//	this.close()
 	if err == nil {
 		err = errors.New("shutdown")
 	}
+	<-this.ready
 	this.Kill(err)
 	this.close()
-	return nil
+	<-this.done
+}
+
+// release the connection of a client refused, or stopped, while connecting.
+// It's never started, the writes to it fail and the id is released.
+func (this *client) abort(err error) {
+	this.stopOnce.Do(func() {
+		this.Kill(err)
+		this.conn.Close()
+		if this.id != "" {
+			this.server.clients.delete(this)
+		}
+		this.releaseQuotas()
+		this.setState(clientClosed)
+		close(this.done)
+	})
 }
 
 // release all resources
 func (this *client) close() {
 	this.stopOnce.Do(func() {
+		this.setState(clientDisconnecting)
 		this.conn.Close()
 		close(this.in)
 		close(this.out)
@@ -95,6 +179,8 @@ func (this *client) close() {
 		}
 
 		this.handleDisconnect(err)
+		this.setState(clientClosed)
+		close(this.done)
 	})
 }
 
@@ -107,7 +193,7 @@ func (this *client) waitConnect() (err error) {
 
 	if code := cp.Validate(); code != packets.Accepted {
 		this.connack(code, false)
-		return fmt.Errorf("client(%v) bad connect packet %x, %q", cp.ClientIdentifier, code)
+		return fmt.Errorf("client(%q) bad connect packet %x", cp.ClientIdentifier, code)
 	}
 
 	if len(cp.ClientIdentifier) == 0 {
@@ -116,16 +202,27 @@ func (this *client) waitConnect() (err error) {
 			return ErrRefusedClientId
 		}
 		cp.ClientIdentifier = uuid.New()
+	} else if err = this.policy.checkClientId(cp.ClientIdentifier); err != nil {
+		this.connack(packets.ErrRefusedIDRejected, false)
+		return
 	}
 
 
 	this.id = cp.ClientIdentifier
-	if cp.KeepaliveTimer != 0 {
-		this.keepAlive = time.Duration(cp.KeepaliveTimer) * time.Second
-	} else {
-		this.keepAlive = this.opts.KeepAlive
-	}
 	this.clean = cp.CleanSession
+	if err = this.policy.checkConnect(this.clean, cp.Username); err != nil {
+		this.connack(packets.ErrRefusedNotAuthorised, false)
+		return
+	}
+	if this.keepAlive, err = this.policy.keepAlive(time.Duration(cp.KeepaliveTimer)*time.Second, this.opts.KeepAlive); err != nil {
+		this.connack(packets.ErrRefusedNotAuthorised, false)
+		return
+	}
+	if !this.server.authenticate(cp.Username, string(cp.Password)) {
+		this.connack(packets.ErrRefusedBadUsernameOrPassword, false)
+		return ErrBadCredentials
+	}
+	this.username = cp.Username
 
 	if cp.WillFlag && len(cp.WillTopic) != 0 {
 		will := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
@@ -135,78 +232,121 @@ func (this *client) waitConnect() (err error) {
 		will.Retain = cp.WillRetain
 
 		this.will = will
+		if err = this.policy.checkTopic(will.TopicName); err != nil {
+			this.connack(packets.ErrRefusedNotAuthorised, false)
+			return
+		}
+		if !this.server.canPublish(this.username, will.TopicName) {
+			this.connack(packets.ErrRefusedNotAuthorised, false)
+			return ErrNotAuthorized
+		}
 	}
 
-	log.Infof("client(%v) connect as %q, %q, clean %v, from %v", this.id, cp.Username, string(cp.Password), this.clean, this.address)
+	this.commonName = connCommonName(this.conn)
+	log.Infof("client(%v) connect as %q, clean %v, from %v, certificate %q", this.id, cp.Username, this.clean, this.address, this.commonName)
+
+	this.acquireQuotas(cp.Username)
+
+	// the previous connection of the id releases its will and session first,
+	// nothing of it runs once the new one goes on.
+	if old := this.server.clients.add(this); old != nil {
+		log.Infof("client(%v) taking over the connection from %v", this.id, old.address)
+		old.stop(ErrTakeOver)
+	}
+	if c := this.server.clustered(); c != nil {
+		c.takeover(this.id, this.clean)
+	}
+	// the will is published after a restart if the broker stops before the disconnect
+	if err = this.storeWill(); err != nil {
+		this.connack(packets.ErrRefusedServerUnavailable, false)
+		return
+	}
 	if this.clean {
-		this.server.cleanSession(this)
+		if this.policy != nil && this.policy.MaxSubscriptions != 0 {
+			this.topics = make(map[string]bool)
+		}
+		if err = this.server.cleanSession(this.id); err != nil {
+			// the old session may come back with the next connection, refuse until it's cleaned.
+			this.connack(packets.ErrRefusedServerUnavailable, false)
+			return
+		}
 		this.connack(packets.Accepted, false)
 	} else {
+		if this.policy != nil && this.policy.MaxSubscriptions != 0 {
+			// the subscriptions of the session count to the limit
+			this.topics = make(map[string]bool)
+			for _, sub := range this.server.Subscriptions(this.id) {
+				this.topics[sub.Filter] = true
+			}
+		}
 		this.connack(packets.Accepted, true)
-		go this.server.forwardOfflineMessage(this)
 	}
 
 	return nil
 }
 
+// release the will and the session of a disconnecting client. It's still registered,
+// a new connection of its id waits until it's closed.
 func (this *client) handleDisconnect(err error) {
 	if this.will != nil {
-		this.handlePublish(this.will)
+		if err := this.handlePublish(this.will); err != nil {
+			log.Warnf("client(%v) will message not published, %v", this.id, err)
+		}
 	}
-
-	this.server.clients.delete(this)
+	// a taking over connection stores its own will once this one is closed
+	this.server.checkStore("delete will", this.server.store.DeleteWill(this.id))
 
 	if this.clean {
-		this.server.cleanSession(this)
+		this.server.cleanSession(this.id)
 	}
 
-	this.connected = false
+	this.server.clients.delete(this)
+	this.releaseQuotas()
 
 	log.Infof("client(%v) disconnect, %v", this.id, err)
 }
 
 func (this *client) handleSubscribe(mid uint16, filter string, qos byte) error {
-	log.Debugf("client(%v) subscribe to %q qos %q", this.id, filter, qos)
+	log.Debugf("client(%v) subscribe to %q qos %v", this.id, filter, qos)
 	if err := this.server.subscribe(filter, this.id, qos); err != nil {
-		log.Warnf("client(%v) sub to %q failed, %v, disconnecting", this.id, filter, err)
+		log.Warnf("client(%v) sub to %q failed, %v", this.id, filter, err)
 		return err
 	}
+	if this.topics != nil {
+		this.topics[filter] = true
+	}
 	this.server.matchRetain(filter, func(m *packets.PublishPacket) {
 		// we should choose the min one as qos to send this message.
 		qos = minQoS(qos, m.Qos)
 
 		log.Debugf("client(%v) matched retain message, topic: %v, qos: %v, mid: %v", this.id, m.TopicName, qos, m.MessageID)
 		// for new subscribe client, the retained should be true.
-		this.publish(m.TopicName, m.Payload, qos, true, m.Dup)
+		if err := this.publish(m.TopicName, m.Payload, qos, true, m.Dup); err != nil && err != ErrDisconnect {
+			go this.stop(err)
+		}
 	})
 	return nil
 }
 
 func (this *client) handleUnsubscribe(topics []string) error {
 	for _, topic := range topics {
-		log.Debugf("client(%v) unsub to %q qos %q", this.id, topic)
+		log.Debugf("client(%v) unsub to %q", this.id, topic)
 		if err := this.server.unsubscribe(topic, this.id); err != nil {
 			log.Warnf("client(%v) unsub to %q failed, %v, disconnecting", this.id, topic, err)
 			return err
 		}
-
+		delete(this.topics, topic)
 	}
 	return nil
 }
 
 func (this *client) handlePublish(message *packets.PublishPacket) error {
-	log.Debugf("client(%v) publish messge received, topic: %q, id: %q", this.id, message.TopicName, message.MessageID)
+	log.Debugf("client(%v) publish messge received, topic: %q, id: %v", this.id, message.TopicName, message.MessageID)
 	// forward message to all subscribers
-	if message.Retain {
-		this.server.retainPacket(message)
-	}
-
-	this.server.forwardMessage(message)
-	return nil
+	return this.server.publishMessage(this.id, message)
 }
 
 func (this *client) handlePublished(mid uint16) error {
 	this.server.mids.free(this.id, mid)
-	this.server.store.DeleteOutboundPacket(this.id, mid)
-	return nil
+	return this.server.checkStore("delete outbound packet", this.server.store.DeleteOutboundPacket(this.id, mid))
 }
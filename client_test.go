@@ -0,0 +1,131 @@
+package mqtt
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+// the connect of a persistent session with a will.
+func willConnect(cid, topic, payload string) *packets.ConnectPacket {
+	cp := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ClientIdentifier = cid
+	cp.KeepaliveTimer = 30
+	cp.WillFlag = true
+	cp.WillTopic = topic
+	cp.WillMessage = []byte(payload)
+	return cp
+}
+
+// connect without failing the test, for the clients of many goroutines.
+func dialRaw(addr string, cp *packets.ConnectPacket) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := cp.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := packets.ReadPacket(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ack, ok := p.(*packets.ConnackPacket); !ok || ack.ReturnCode != packets.Accepted {
+		conn.Close()
+		return nil, fmt.Errorf("connect refused, %v", p)
+	}
+	return conn, nil
+}
+
+func TestClientTakeover(t *testing.T) {
+	server, addr := newTestServer(t)
+	dialTestClient(t, addr, "c", false).subscribe("a/#", 1)
+	old, ok := server.clients.get("c")
+	assert.True(t, ok)
+	assert.Equal(t, clientConnected, old.State())
+
+	// the old connection is closed before the new one is acknowledged
+	dialTestClient(t, addr, "c", false)
+	assert.Equal(t, clientClosed, old.State())
+	c, _ := server.clients.get("c")
+	assert.True(t, old != c)
+	waitFor(t, func() bool {
+		return c.State() == clientConnected
+	})
+	assert.Equal(t, []SubscriptionInfo{{ClientID: "c", Filter: "a/#", QoS: 1}}, server.Subscriptions("c"))
+
+	// the taken over clean session is released before the new one starts
+	dialTestClient(t, addr, "d", true).subscribe("b/#", 0)
+	dialTestClient(t, addr, "d", false)
+	assert.Empty(t, server.Subscriptions("d"))
+}
+
+// the session subscribes to the will of the connection taken over, the new connection
+// gets it once it's started.
+func TestClientTakeoverWill(t *testing.T) {
+	_, addr := newTestServer(t)
+	cp := willConnect("c", "will/c", "gone")
+	cp.WillQos = 1
+	connectTestClient(t, addr, cp).subscribe("will/#", 1)
+
+	c := dialTestClient(t, addr, "c", false)
+	p := c.receive()
+	assert.Equal(t, "will/c", p.TopicName)
+	assert.Equal(t, "gone", string(p.Payload))
+}
+
+// the same client id reconnects from many connections at once, the session is
+// never cleaned underneath the connection which wins.
+func TestClientTakeoverStress(t *testing.T) {
+	server, addr := newTestServer(t)
+	c := connectTestClient(t, addr, willConnect("c", "will/c", "gone"))
+	c.subscribe("a/#", 1)
+
+	const workers, loops = 4, 25
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*loops)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < loops; i++ {
+				conn, err := dialRaw(addr, willConnect("c", fmt.Sprintf("will/%v", w), "gone"))
+				if err != nil {
+					errs <- err
+					continue
+				}
+				if i%2 == 0 {
+					conn.Close()
+				} else {
+					defer conn.Close()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	last := connectTestClient(t, addr, willConnect("c", "will/c", "last"))
+	assert.Equal(t, []SubscriptionInfo{{ClientID: "c", Filter: "a/#", QoS: 1}}, server.Subscriptions("c"))
+	waitFor(t, func() bool {
+		return len(server.Clients()) == 1
+	})
+	assert.Equal(t, map[string]string{"c": "last"}, storedWills(t, server.store))
+
+	pub := dialTestClient(t, addr, "pub", true)
+	pub.publish("a/b", "hi", 1, false)
+	p := last.receive()
+	assert.Equal(t, "a/b", p.TopicName)
+	assert.Equal(t, "hi", string(p.Payload))
+}
@@ -13,23 +13,24 @@ func newClients() *clients {
 	}
 }
 
-func (this *clients) add(c *client) (dup bool) {
+// add the client, returns the client it replaces with the same id, it must be stopped.
+func (this *clients) add(c *client) (old *client) {
 	this.Lock()
 	defer this.Unlock()
-	if p, ok := this.m[c.id]; ok {
-		dup = true
-		go p.stop(ErrTakeOver)
-	}
+	old = this.m[c.id]
 	this.m[c.id] = c
 	return
 }
 
-func (this *clients) delete(c *client) {
+// delete the client, returns false if it's replaced by a new one with the same id.
+func (this *clients) delete(c *client) bool {
 	this.Lock()
 	defer this.Unlock()
 	if p, ok := this.m[c.id]; ok && p == c {
 		delete(this.m, c.id)
+		return true
 	}
+	return false
 }
 
 func (this *clients) get(id string) (c *client, ok bool) {
@@ -44,3 +45,13 @@ func (this *clients) size() int {
 	defer this.RUnlock()
 	return len(this.m)
 }
+
+func (this *clients) list() []*client {
+	this.RLock()
+	defer this.RUnlock()
+	l := make([]*client, 0, len(this.m))
+	for _, c := range this.m {
+		l = append(l, c)
+	}
+	return l
+}
@@ -0,0 +1,396 @@
+package mqtt
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+)
+
+const DefaultClusterTakeoverTimeout = time.Second
+
+// ClusterTransport carries messages between the nodes of a cluster.
+type ClusterTransport interface {
+	// ID of the local node, unique in the cluster.
+	ID() string
+
+	// Start delivering incoming messages and node events to the handler.
+	Start(handler ClusterHandler) error
+
+	// Send a message to a node, fails if the node is not reachable.
+	Send(node string, m *ClusterMessage) error
+
+	// Nodes returns the ids of the reachable nodes, not including the local node.
+	Nodes() []string
+
+	Close() error
+}
+
+// ClusterHandler receives messages and node events from a ClusterTransport.
+type ClusterHandler interface {
+	HandleMessage(from string, m *ClusterMessage)
+	NodeJoined(node string)
+	NodeLeft(node string)
+}
+
+// ClusterMessage is exchanged between the nodes, the transport should deliver the messages
+// sent to a node in order.
+type ClusterMessage struct {
+	Type     byte
+	ID       uint64
+	ClientID string
+	Clean    bool
+	Filters  []string
+	Qoss     []byte
+	Packets  [][]byte
+}
+
+const (
+	// the routes and retained messages of the sender, replied with clusterSync
+	clusterHello byte = iota + 1
+	clusterSync
+	clusterRouteAdd
+	clusterRouteRemove
+	clusterPublish
+	clusterRetain
+	// take over a client from the other nodes, replied with clusterSession
+	clusterTakeover
+	clusterSession
+)
+
+// Cluster shares the subscription routes, sessions and retained messages with the other nodes.
+//
+// Each node subscribes the filters of the other nodes in its own tree with client id "$node/<id>",
+// so a message published on any node is forwarded once to each node having matched subscribers.
+// The forwarding is fire-and-forget whatever the qos, the publisher is acknowledged by its own
+// node, and a message sent while a node is unreachable, or lost with the connection to it, is
+// not sent again.
+//
+// When a client connects, the other nodes disconnect it like the takeover of a local client,
+// and hand over its subscriptions and pending outbound messages if the session is not clean.
+// The client waits for the sessions at most Options.ClusterTakeoverTimeout, a session handed
+// over later is lost. A clean client doesn't wait.
+type Cluster struct {
+	sync.Mutex
+
+	id        string
+	server    *Server
+	transport ClusterTransport
+
+	// local topic filters and the client ids subscribed to them
+	routes map[string]map[string]bool
+
+	// the takeover requests waiting for the replies
+	seq     uint64
+	pending map[uint64]chan *ClusterMessage
+}
+
+// JoinCluster shares this server with the other nodes reachable by the transport.
+func (this *Server) JoinCluster(transport ClusterTransport) (*Cluster, error) {
+	c := &Cluster{
+		id:        transport.ID(),
+		server:    this,
+		transport: transport,
+		routes:    make(map[string]map[string]bool),
+		pending:   make(map[uint64]chan *ClusterMessage),
+	}
+
+	// routes of the clients subscribed before joining
+	this.subhier.walk(nil, func(filter, cid string, qos byte) {
+		if !strings.HasPrefix(cid, "$") {
+			c.subscribed(filter, cid)
+		}
+	})
+
+	this.Lock()
+	this.cluster = c
+	this.Unlock()
+
+	if err := transport.Start(c); err != nil {
+		this.Lock()
+		this.cluster = nil
+		this.Unlock()
+		return nil, err
+	}
+	log.Infof("cluster(%v) joined", c.id)
+	return c, nil
+}
+
+// Leave the cluster, the routes of the other nodes are removed.
+func (this *Cluster) Leave() error {
+	this.server.Lock()
+	this.server.cluster = nil
+	this.server.Unlock()
+
+	err := this.transport.Close()
+	for _, node := range this.transport.Nodes() {
+		this.NodeLeft(node)
+	}
+	return err
+}
+
+func nodeClientId(node string) string {
+	return "$node/" + node
+}
+
+func (this *Cluster) broadcast(m *ClusterMessage) {
+	for _, node := range this.transport.Nodes() {
+		this.send(node, m)
+	}
+}
+
+func (this *Cluster) send(node string, m *ClusterMessage) {
+	if err := this.transport.Send(node, m); err != nil {
+		log.Warnf("cluster(%v) send to %v failed, %v", this.id, node, err)
+	}
+}
+
+// a local client subscribed to the filter.
+func (this *Cluster) subscribed(filter, cid string) {
+	this.Lock()
+	cids, ok := this.routes[filter]
+	if !ok {
+		cids = make(map[string]bool)
+		this.routes[filter] = cids
+	}
+	cids[cid] = true
+	this.Unlock()
+
+	if !ok {
+		this.broadcast(&ClusterMessage{Type: clusterRouteAdd, Filters: []string{filter}})
+	}
+}
+
+// a local client unsubscribed from the filter.
+func (this *Cluster) unsubscribed(filter, cid string) {
+	this.Lock()
+	cids, ok := this.routes[filter]
+	if ok {
+		delete(cids, cid)
+		if len(cids) == 0 {
+			delete(this.routes, filter)
+		}
+	}
+	this.Unlock()
+
+	if ok && len(cids) == 0 {
+		this.broadcast(&ClusterMessage{Type: clusterRouteRemove, Filters: []string{filter}})
+	}
+}
+
+// all subscriptions of a local client removed.
+func (this *Cluster) cleaned(cid string) {
+	var removed []string
+	this.Lock()
+	for filter, cids := range this.routes {
+		if cids[cid] {
+			delete(cids, cid)
+			if len(cids) == 0 {
+				delete(this.routes, filter)
+				removed = append(removed, filter)
+			}
+		}
+	}
+	this.Unlock()
+
+	if len(removed) > 0 {
+		this.broadcast(&ClusterMessage{Type: clusterRouteRemove, Filters: removed})
+	}
+}
+
+// a retained message is set or removed locally.
+func (this *Cluster) retained(p *packets.PublishPacket) {
+	this.broadcast(&ClusterMessage{Type: clusterRetain, Packets: [][]byte{MarshalPacket(p)}})
+}
+
+// the routes and retained messages of this node.
+func (this *Cluster) state(t byte) *ClusterMessage {
+	m := &ClusterMessage{Type: t}
+	this.Lock()
+	for filter := range this.routes {
+		m.Filters = append(m.Filters, filter)
+	}
+	this.Unlock()
+
+	this.server.matchRetain("#", func(p *packets.PublishPacket) {
+		m.Packets = append(m.Packets, MarshalPacket(p))
+	})
+	return m
+}
+
+// take over the client from the other nodes, the session is moved to this node if not clean.
+func (this *Cluster) takeover(cid string, clean bool) {
+	nodes := this.transport.Nodes()
+	if len(nodes) == 0 {
+		return
+	}
+	if clean {
+		// no session to wait for, the other nodes only disconnect the client
+		go this.broadcast(&ClusterMessage{Type: clusterTakeover, ClientID: cid, Clean: true})
+		return
+	}
+
+	replies := make(chan *ClusterMessage, len(nodes))
+	this.Lock()
+	this.seq++
+	id := this.seq
+	this.pending[id] = replies
+	this.Unlock()
+	defer func() {
+		this.Lock()
+		delete(this.pending, id)
+		this.Unlock()
+	}()
+
+	// a node slow to receive doesn't delay the others
+	m := &ClusterMessage{Type: clusterTakeover, ID: id, ClientID: cid}
+	for _, node := range nodes {
+		go this.send(node, m)
+	}
+
+	d := this.server.opts.ClusterTakeoverTimeout
+	if d == 0 {
+		d = DefaultClusterTakeoverTimeout
+	}
+	timeout := time.After(d)
+	for range nodes {
+		select {
+		case reply := <-replies:
+			this.restoreSession(reply)
+		case <-timeout:
+			log.Warnf("cluster(%v) takeover of %q timeout", this.id, cid)
+			return
+		}
+	}
+}
+
+// restore the session handed over by another node.
+func (this *Cluster) restoreSession(m *ClusterMessage) {
+	for i, filter := range m.Filters {
+		this.server.subscribe(filter, m.ClientID, m.Qoss[i])
+	}
+	for _, b := range m.Packets {
+		p := UnmarshalPacket(b)
+		if p == nil {
+			continue
+		}
+		this.server.mids.use(m.ClientID, p.Details().MessageID)
+		this.server.checkStore("restore session", this.server.store.StoreOutboundPacket(m.ClientID, p))
+	}
+	if len(m.Filters) > 0 || len(m.Packets) > 0 {
+		log.Infof("cluster(%v) session of %q restored, %v subscriptions, %v packets", this.id, m.ClientID, len(m.Filters), len(m.Packets))
+	}
+}
+
+// hand over the session of a client to the node taking over it.
+func (this *Cluster) handover(node string, m *ClusterMessage) {
+	cid := m.ClientID
+	if c, ok := this.server.clients.get(cid); ok {
+		log.Infof("cluster(%v) client(%v) taken over by %v", this.id, cid, node)
+		c.stop(ErrTakeOver)
+	}
+
+	reply := &ClusterMessage{Type: clusterSession, ID: m.ID, ClientID: cid}
+	if !m.Clean {
+		for _, sub := range this.server.Subscriptions(cid) {
+			reply.Filters = append(reply.Filters, sub.Filter)
+			reply.Qoss = append(reply.Qoss, sub.QoS)
+		}
+		err := this.server.store.StreamOfflinePackets(cid, func(p packets.ControlPacket) {
+			reply.Packets = append(reply.Packets, MarshalPacket(p))
+		})
+		this.server.storeFailed("hand over session", err)
+	}
+	this.server.cleanSession(cid)
+	if !m.Clean {
+		this.send(node, reply)
+	}
+}
+
+func (this *Cluster) HandleMessage(from string, m *ClusterMessage) {
+	server := this.server
+	ncid := nodeClientId(from)
+
+	switch m.Type {
+	case clusterHello, clusterSync:
+		server.subhier.clean(ncid)
+		for _, filter := range m.Filters {
+			tokens, _ := topicTokenise(filter)
+			server.subhier.subscribe(tokens, ncid, 2)
+		}
+		for _, b := range m.Packets {
+			if p, ok := UnmarshalPacket(b).(*packets.PublishPacket); ok {
+				server.retainLocal(p)
+			}
+		}
+		if m.Type == clusterHello {
+			this.send(from, this.state(clusterSync))
+		}
+	case clusterRouteAdd:
+		for _, filter := range m.Filters {
+			tokens, _ := topicTokenise(filter)
+			server.subhier.subscribe(tokens, ncid, 2)
+		}
+	case clusterRouteRemove:
+		for _, filter := range m.Filters {
+			tokens, _ := topicTokenise(filter)
+			server.subhier.unsubscribe(tokens, ncid)
+		}
+	case clusterPublish:
+		for _, b := range m.Packets {
+			if p, ok := UnmarshalPacket(b).(*packets.PublishPacket); ok {
+				server.forwardMessage(ncid, p)
+			}
+		}
+	case clusterRetain:
+		for _, b := range m.Packets {
+			if p, ok := UnmarshalPacket(b).(*packets.PublishPacket); ok {
+				server.retainLocal(p)
+			}
+		}
+	case clusterTakeover:
+		// stopping the client waits for its goroutines, don't block the transport.
+		go this.handover(from, m)
+	case clusterSession:
+		this.Lock()
+		replies, ok := this.pending[m.ID]
+		this.Unlock()
+		if ok {
+			replies <- m
+		}
+	default:
+		log.Warnf("cluster(%v) unknown message type %v from %v", this.id, m.Type, from)
+	}
+}
+
+func (this *Cluster) NodeJoined(node string) {
+	log.Infof("cluster(%v) node %v joined", this.id, node)
+	this.server.addDeliverer(nodeClientId(node), &clusterNode{cluster: this, id: node})
+	this.send(node, this.state(clusterHello))
+}
+
+func (this *Cluster) NodeLeft(node string) {
+	log.Infof("cluster(%v) node %v left", this.id, node)
+	this.server.removeDeliverer(nodeClientId(node))
+	this.server.subhier.clean(nodeClientId(node))
+}
+
+// forwards the messages matched by the routes of a remote node.
+type clusterNode struct {
+	cluster *Cluster
+	id      string
+}
+
+// deliver sends the message once, see Cluster.
+func (this *clusterNode) deliver(origin string, message *packets.PublishPacket, qos byte) error {
+	// a message from another node is only delivered to the local clients.
+	if strings.HasPrefix(origin, "$node/") {
+		return nil
+	}
+	p := message.Copy()
+	p.Qos = message.Qos
+	p.Retain = false
+	this.cluster.send(this.id, &ClusterMessage{Type: clusterPublish, Packets: [][]byte{MarshalPacket(p)}})
+	return nil
+}
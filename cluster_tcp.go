@@ -0,0 +1,285 @@
+package mqtt
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNodeUnreachable  = errors.New("Node unreachable")
+	ErrNoClusterSecret  = errors.New("No cluster secret")
+	ErrClusterHandshake = errors.New("Cluster handshake failed")
+	ErrInvalidNodeId    = errors.New("Invalid node id")
+)
+
+// the size of the random challenges of the handshake
+const tcpChallengeSize = 16
+
+// TCPTransport connects the nodes of a cluster over tcp, messages are encoded by gob.
+//
+// Every node dials all its peers and sends messages through the dialed connections,
+// the accepted connections are only used to receive.
+//
+// The nodes share a secret, a connection is used once both ends proved they know it:
+// the accepting node sends a challenge, the dialing node answers with its id, the mac
+// of the challenge and a challenge of its own, which the accepting node answers too.
+// Nothing is decoded from a node before. The messages are not encrypted, the listener
+// of the transport may be a TLS one to hide them.
+type TCPTransport struct {
+	sync.RWMutex
+
+	id      string
+	ln      net.Listener
+	peers   map[string]string
+	secret  []byte
+	conns   map[string]*tcpPeer
+	handler ClusterHandler
+
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+type tcpPeer struct {
+	sync.Mutex
+	conn net.Conn
+	enc  *gob.Encoder
+}
+
+// ListenTCPTransport listens on the address for the other nodes, peers maps the node ids to their addresses,
+// and the nodes share the secret.
+func ListenTCPTransport(id, addr string, peers map[string]string, secret []byte) (*TCPTransport, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewTCPTransport(id, ln, peers, secret), nil
+}
+
+// NewTCPTransport accepts the other nodes on the listener, peers maps the node ids to their addresses,
+// and the nodes share the secret.
+func NewTCPTransport(id string, ln net.Listener, peers map[string]string, secret []byte) *TCPTransport {
+	return &TCPTransport{
+		id:     id,
+		ln:     ln,
+		peers:  peers,
+		secret: secret,
+		conns:  make(map[string]*tcpPeer),
+		quit:   make(chan struct{}),
+	}
+}
+
+func (this *TCPTransport) ID() string {
+	return this.id
+}
+
+func (this *TCPTransport) Start(handler ClusterHandler) error {
+	if len(this.secret) == 0 {
+		return ErrNoClusterSecret
+	}
+	if len(this.id) == 0 || len(this.id) > 255 {
+		return ErrInvalidNodeId
+	}
+	this.handler = handler
+	go this.accept()
+	for node, addr := range this.peers {
+		if node != this.id {
+			go this.dial(node, addr)
+		}
+	}
+	return nil
+}
+
+func (this *TCPTransport) Send(node string, m *ClusterMessage) error {
+	this.RLock()
+	peer, ok := this.conns[node]
+	this.RUnlock()
+	if !ok {
+		return ErrNodeUnreachable
+	}
+
+	peer.Lock()
+	defer peer.Unlock()
+	peer.conn.SetWriteDeadline(time.Now().Add(DefaultAckTimeout))
+	if err := peer.enc.Encode(m); err != nil {
+		peer.conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (this *TCPTransport) Nodes() []string {
+	this.RLock()
+	defer this.RUnlock()
+	nodes := make([]string, 0, len(this.conns))
+	for node := range this.conns {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func (this *TCPTransport) Close() error {
+	var err error
+	this.closeOnce.Do(func() {
+		close(this.quit)
+		err = this.ln.Close()
+		this.RLock()
+		for _, peer := range this.conns {
+			peer.conn.Close()
+		}
+		this.RUnlock()
+	})
+	return err
+}
+
+func (this *TCPTransport) accept() {
+	for {
+		conn, err := this.ln.Accept()
+		if err != nil {
+			select {
+			case <-this.quit:
+				return
+			default:
+			}
+			log.Errorf("cluster(%v) accept error, %v", this.id, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go this.receive(conn)
+	}
+}
+
+// receive messages from a node once it's authenticated.
+func (this *TCPTransport) receive(conn net.Conn) {
+	defer conn.Close()
+	go func() {
+		<-this.quit
+		conn.Close()
+	}()
+
+	node, err := this.handshakeAccept(conn)
+	if err != nil {
+		log.Warnf("cluster(%v) handshake from %v failed, %v", this.id, conn.RemoteAddr(), err)
+		return
+	}
+	dec := gob.NewDecoder(conn)
+	for {
+		m := new(ClusterMessage)
+		if err := dec.Decode(m); err != nil {
+			if err != io.EOF {
+				log.Debugf("cluster(%v) receive from %v failed, %v", this.id, node, err)
+			}
+			return
+		}
+		this.handler.HandleMessage(node, m)
+	}
+}
+
+// keep connecting to a node until the transport closed.
+func (this *TCPTransport) dial(node, addr string) {
+	backoff := 100 * time.Millisecond
+	for {
+		if conn, err := net.DialTimeout("tcp", addr, DefaultConnectTimeout); err == nil {
+			peer := &tcpPeer{conn: conn, enc: gob.NewEncoder(conn)}
+			if err = this.handshakeDial(conn, node); err != nil {
+				log.Warnf("cluster(%v) handshake with %v failed, %v", this.id, node, err)
+			} else {
+				backoff = 100 * time.Millisecond
+				this.Lock()
+				this.conns[node] = peer
+				this.Unlock()
+				this.handler.NodeJoined(node)
+
+				// nothing is sent back on this connection, returns when it's closed.
+				io.Copy(ioutil.Discard, conn)
+
+				this.Lock()
+				delete(this.conns, node)
+				this.Unlock()
+				this.handler.NodeLeft(node)
+			}
+			conn.Close()
+		}
+
+		select {
+		case <-this.quit:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+	}
+}
+
+// authenticate the dialing node, returns its id.
+func (this *TCPTransport) handshakeAccept(conn net.Conn) (string, error) {
+	conn.SetDeadline(time.Now().Add(DefaultConnectTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	challenge := make([]byte, tcpChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write(challenge); err != nil {
+		return "", err
+	}
+	var size [1]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, int(size[0])+sha256.Size+tcpChallengeSize)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return "", err
+	}
+	node, mac, theirs := string(b[:size[0]]), b[size[0]:int(size[0])+sha256.Size], b[int(size[0])+sha256.Size:]
+	if !hmac.Equal(mac, this.mac("dial", challenge, node)) {
+		return "", ErrClusterHandshake
+	}
+	_, err := conn.Write(this.mac("accept", theirs, this.id))
+	return node, err
+}
+
+// authenticate to the node, and the node.
+func (this *TCPTransport) handshakeDial(conn net.Conn, node string) error {
+	conn.SetDeadline(time.Now().Add(DefaultConnectTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	challenge := make([]byte, tcpChallengeSize)
+	if _, err := io.ReadFull(conn, challenge); err != nil {
+		return err
+	}
+	mine := make([]byte, tcpChallengeSize)
+	if _, err := rand.Read(mine); err != nil {
+		return err
+	}
+	b := append([]byte{byte(len(this.id))}, this.id...)
+	b = append(append(b, this.mac("dial", challenge, this.id)...), mine...)
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+	mac := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, mac); err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, this.mac("accept", mine, node)) {
+		return ErrClusterHandshake
+	}
+	return nil
+}
+
+// the proof of the node answering the challenge, the role is "dial" or "accept".
+func (this *TCPTransport) mac(role string, challenge []byte, node string) []byte {
+	mac := hmac.New(sha256.New, this.secret)
+	mac.Write([]byte(role))
+	mac.Write(challenge)
+	mac.Write([]byte(node))
+	return mac.Sum(nil)
+}
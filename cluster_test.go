@@ -0,0 +1,245 @@
+package mqtt
+
+import (
+	"encoding/gob"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testClusterSecret = []byte("cluster secret")
+
+// start servers joined in a cluster over loopback tcp.
+func newTestCluster(t *testing.T, size int) ([]*Server, []string) {
+	ids := []string{"a", "b", "c", "d", "e"}[:size]
+	listeners := make([]net.Listener, size)
+	peers := make(map[string]string)
+	for i, id := range ids {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = ln
+		peers[id] = ln.Addr().String()
+	}
+
+	servers := make([]*Server, size)
+	addrs := make([]string, size)
+	for i, id := range ids {
+		servers[i], addrs[i] = newTestServer(t)
+		c, err := servers[i].JoinCluster(NewTCPTransport(id, listeners[i], peers, testClusterSecret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			c.Leave()
+		})
+	}
+
+	for _, server := range servers {
+		server := server
+		waitFor(t, func() bool {
+			return len(server.clustered().transport.Nodes()) == size-1
+		})
+	}
+	return servers, addrs
+}
+
+// wait until the node has the route of the filter from another node.
+func waitForRoute(t *testing.T, server *Server, node, filter string) {
+	t.Helper()
+	waitFor(t, func() bool {
+		for _, sub := range server.Subscriptions(nodeClientId(node)) {
+			if sub.Filter == filter {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestClusterRoutes(t *testing.T) {
+	servers, addrs := newTestCluster(t, 3)
+
+	sub := dialTestClient(t, addrs[1], "sub", true)
+	sub.subscribe("a/#", 1)
+	waitForRoute(t, servers[0], "b", "a/#")
+	waitForRoute(t, servers[2], "b", "a/#")
+
+	pub := dialTestClient(t, addrs[0], "pub", true)
+	pub.publish("a/b", "hello", 1, false)
+	p := sub.receive()
+	assert.Equal(t, "a/b", p.TopicName)
+	assert.Equal(t, "hello", string(p.Payload))
+
+	// the route is removed after the last subscriber gone
+	sub.conn.Close()
+	waitFor(t, func() bool {
+		return len(servers[0].Subscriptions(nodeClientId("b"))) == 0
+	})
+}
+
+func TestClusterSessionTakeover(t *testing.T) {
+	servers, addrs := newTestCluster(t, 3)
+
+	sub := dialTestClient(t, addrs[1], "device", false)
+	sub.subscribe("cmd/#", 1)
+	waitForRoute(t, servers[0], "b", "cmd/#")
+	sub.conn.Close()
+	waitFor(t, func() bool {
+		_, ok := servers[1].clients.get("device")
+		return !ok
+	})
+
+	// published while the device is offline, stored on node b
+	pub := dialTestClient(t, addrs[0], "pub", true)
+	pub.publish("cmd/reboot", "now", 1, false)
+	waitFor(t, func() bool {
+		return storeSize(t, servers[1].store.OutPacketsSize) == 1
+	})
+
+	// reconnect to node c, the session is moved from node b
+	sub = dialTestClient(t, addrs[2], "device", false)
+	p := sub.receive()
+	assert.Equal(t, "cmd/reboot", p.TopicName)
+	assert.Equal(t, 0, storeSize(t, servers[1].store.OutPacketsSize))
+	assert.Empty(t, servers[1].Subscriptions("device"))
+	assert.Len(t, servers[2].Subscriptions("device"), 1)
+
+	// the online client is taken over by node a
+	dialTestClient(t, addrs[0], "device", false)
+	sub.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := sub.conn.Read(make([]byte, 1))
+	assert.Error(t, err, "connection closed by takeover")
+
+	pub.publish("cmd/update", "v2", 1, false)
+	waitFor(t, func() bool {
+		_, ok := servers[2].clients.get("device")
+		return !ok
+	})
+	assert.Len(t, servers[0].Subscriptions("device"), 1)
+}
+
+func TestClusterRetainReplication(t *testing.T) {
+	servers, addrs := newTestCluster(t, 3)
+
+	pub := dialTestClient(t, addrs[0], "pub", true)
+	pub.publish("status/a", "online", 1, true)
+	for _, server := range servers {
+		server := server
+		waitFor(t, func() bool {
+			return server.Stats().Retained == 1
+		})
+	}
+
+	sub := dialTestClient(t, addrs[2], "sub", true)
+	sub.subscribe("status/#", 1)
+	p := sub.receive()
+	assert.Equal(t, "status/a", p.TopicName)
+	assert.True(t, p.Retain)
+
+	// retained messages are removed from all nodes
+	pub.publish("status/a", "", 1, true)
+	for _, server := range servers {
+		server := server
+		waitFor(t, func() bool {
+			return server.Stats().Retained == 0
+		})
+	}
+}
+
+func TestClusterHandshake(t *testing.T) {
+	ids := []string{"a", "b"}
+	listeners := make(map[string]net.Listener)
+	peers := make(map[string]string)
+	for _, id := range ids {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[id] = ln
+		peers[id] = ln.Addr().String()
+	}
+	a, _ := newTestServer(t)
+	ca, err := a.JoinCluster(NewTCPTransport("a", listeners["a"], peers, testClusterSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ca.Leave()
+	b, _ := newTestServer(t)
+	cb, err := b.JoinCluster(NewTCPTransport("b", listeners["b"], peers, []byte("wrong secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cb.Leave()
+
+	// the messages of a node not authenticated are not decoded
+	conn, err := net.Dial("tcp", peers["a"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	enc := gob.NewEncoder(conn)
+	enc.Encode("b")
+	enc.Encode(&ClusterMessage{Type: clusterRouteAdd, Filters: []string{"#"}})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.Copy(io.Discard, conn)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("connection not closed")
+	}
+
+	// the nodes with another secret don't join, they've tried by now
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, ca.transport.Nodes())
+	assert.Empty(t, cb.transport.Nodes())
+	assert.Empty(t, a.Subscriptions(nodeClientId("b")))
+
+	c, _ := newTestServer(t)
+	_, err = c.JoinCluster(NewTCPTransport("c", listeners["b"], peers, nil))
+	assert.Equal(t, ErrNoClusterSecret, err)
+}
+
+// a transport to a node which never answers.
+type silentTransport struct {
+	sent chan *ClusterMessage
+}
+
+func (this *silentTransport) ID() string                 { return "a" }
+func (this *silentTransport) Start(ClusterHandler) error { return nil }
+func (this *silentTransport) Nodes() []string            { return []string{"b"} }
+func (this *silentTransport) Close() error               { return nil }
+func (this *silentTransport) Send(node string, m *ClusterMessage) error {
+	this.sent <- m
+	return nil
+}
+
+func TestClusterTakeoverTimeout(t *testing.T) {
+	opts := NewOptions()
+	opts.ClusterTakeoverTimeout = 300 * time.Millisecond
+	server := newServer(opts, newMemoryStore())
+	addr := serveTestServer(t, server)
+	transport := &silentTransport{sent: make(chan *ClusterMessage, 10)}
+	if _, err := server.JoinCluster(transport); err != nil {
+		t.Fatal(err)
+	}
+
+	// a clean client doesn't wait for the other nodes
+	start := time.Now()
+	dialTestClient(t, addr, "sensor", true)
+	assert.True(t, time.Since(start) < opts.ClusterTakeoverTimeout, "waited %v", time.Since(start))
+	m := <-transport.sent
+	assert.Equal(t, clusterTakeover, m.Type)
+	assert.True(t, m.Clean)
+
+	// the session of a persistent one is waited for a while only
+	start = time.Now()
+	dialTestClient(t, addr, "device", false)
+	assert.True(t, time.Since(start) >= opts.ClusterTakeoverTimeout)
+	assert.True(t, time.Since(start) < opts.ConnectTimeout, "waited %v", time.Since(start))
+	m = <-transport.sent
+	assert.Equal(t, "device", m.ClientID)
+	assert.False(t, m.Clean)
+}
@@ -0,0 +1,364 @@
+// mqtts-ctl operates a running broker through its admin interface.
+//
+//	mqtts-ctl [-addr http://127.0.0.1:8081] [-token <token>] [-o table|json] <command> [args]
+//
+//	clients ls
+//	clients kick <id>
+//	sessions show <id>
+//	sessions purge <id>
+//	subs ls [-client <id>]
+//	retained ls <filter>
+//	retained get <filter>
+//	retained rm <filter>
+//	stats
+//	health
+//	backup [-dir <dir>] [<file>]
+//	log-level [set <level>]
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"bitbucket.org/j3r0lin/mqtt"
+)
+
+var (
+	addr   = flag.String("addr", "http://127.0.0.1:8081", "admin interface address of the broker")
+	output = flag.String("o", "table", "output format, table or json")
+	token  = flag.String("token", os.Getenv("MQTTS_CTL_TOKEN"), "admin token of the broker, default to $MQTTS_CTL_TOKEN")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: mqtts-ctl [flags] <command> [args]
+
+commands:
+  clients ls                list connected clients
+  clients kick <id>         disconnect a client
+  sessions show <id>        show the session of a client
+  sessions purge <id>       disconnect a client and remove its session
+  subs ls [-client <id>]    list subscriptions
+  retained ls <filter>      list retained messages matched by filter
+  retained get <filter>     print payloads of retained messages matched by filter
+  retained rm <filter>      remove retained messages matched by filter
+  stats                     show broker statistics
+  health                    show broker health, exit 1 if degraded
+  backup [<file>]           download a backup of the store as a tar file, or to stdout
+  backup -dir <dir>         back up the store to a directory on the broker host
+  log-level [set <level>]   show or change the broker log level
+
+flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if *output != "table" && *output != "json" {
+		fatalf("unknown output format %q", *output)
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "clients":
+		clients(args[1:])
+	case "sessions":
+		sessions(args[1:])
+	case "subs":
+		subs(args[1:])
+	case "retained":
+		retained(args[1:])
+	case "stats":
+		stats()
+	case "health":
+		health()
+	case "backup":
+		backup(args[1:])
+	case "log-level":
+		logLevel(args[1:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func clients(args []string) {
+	switch subcommand(args) {
+	case "ls":
+		var l []mqtt.ClientInfo
+		call("GET", "/clients", nil, &l)
+		table(l, "ID\tADDRESS\tCLEAN\tKEEPALIVE", func() {
+			for _, c := range l {
+				row(c.ID, c.Address, c.Clean, c.KeepAlive)
+			}
+		})
+	case "kick":
+		call("DELETE", "/clients/"+url.PathEscape(argument(args, "client id")), nil, nil)
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func sessions(args []string) {
+	switch subcommand(args) {
+	case "show":
+		var s mqtt.SessionInfo
+		call("GET", "/sessions/"+url.PathEscape(argument(args, "client id")), nil, &s)
+		table(s, "ID\tCONNECTED\tADDRESS\tCLEAN\tSUBSCRIPTIONS\tOFFLINE PACKETS", func() {
+			row(s.ID, s.Connected, s.Address, s.Clean, len(s.Subscriptions), s.OfflinePackets)
+		})
+	case "purge":
+		call("DELETE", "/sessions/"+url.PathEscape(argument(args, "client id")), nil, nil)
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func subs(args []string) {
+	if subcommand(args) != "ls" {
+		usage()
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("subs ls", flag.ExitOnError)
+	cid := fs.String("client", "", "only list subscriptions of this client")
+	fs.Parse(args[1:])
+
+	var l []mqtt.SubscriptionInfo
+	call("GET", "/subscriptions", url.Values{"client": {*cid}}, &l)
+	table(l, "CLIENT\tFILTER\tQOS", func() {
+		for _, s := range l {
+			row(s.ClientID, s.Filter, s.QoS)
+		}
+	})
+}
+
+func retained(args []string) {
+	cmd := subcommand(args)
+	if cmd != "ls" && cmd != "get" && cmd != "rm" {
+		usage()
+		os.Exit(2)
+	}
+	query := url.Values{"filter": {argument(args, "topic filter")}}
+	switch cmd {
+	case "ls":
+		var l []mqtt.RetainedInfo
+		call("GET", "/retained", query, &l)
+		table(l, "TOPIC\tQOS\tSIZE", func() {
+			for _, r := range l {
+				row(r.Topic, r.QoS, len(r.Payload))
+			}
+		})
+	case "get":
+		var l []mqtt.RetainedInfo
+		call("GET", "/retained", query, &l)
+		if *output == "json" {
+			printJSON(l)
+			return
+		}
+		for _, r := range l {
+			fmt.Printf("%s\n%s\n", r.Topic, r.Payload)
+		}
+	case "rm":
+		var result map[string]int
+		call("DELETE", "/retained", query, &result)
+		table(result, "DELETED", func() {
+			row(result["deleted"])
+		})
+	}
+}
+
+func stats() {
+	var s mqtt.Stats
+	call("GET", "/stats", nil, &s)
+	table(s, "GOROUTINES\tCLIENTS\tSUBS\tIN PACKETS\tOUT PACKETS\tRETAINED\tCONNS\tREJECTED", func() {
+		r := s.Rejected
+		row(s.Goroutines, s.Clients, s.Subscriptions, s.InPackets, s.OutPackets, s.Retained, s.Connections,
+			r.MaxConnections+r.RateLimited+r.Banned+r.Denied)
+	})
+}
+
+// the broker answers 503 with the health state if it's degraded.
+func health() {
+	resp := send("GET", "/health", nil)
+	defer resp.Body.Close()
+
+	var h mqtt.Health
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil || h.Status == "" {
+		fatalf("bad response, %v", resp.Status)
+	}
+	table(h, "STATUS\tSINCE\tSTORE ERROR", func() {
+		since := ""
+		if h.Since != nil {
+			since = h.Since.Format(time.RFC3339)
+		}
+		row(h.Status, since, h.StoreError)
+	})
+	if h.Status != mqtt.HealthOK {
+		os.Exit(1)
+	}
+}
+
+func backup(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	dir := fs.String("dir", "", "back up to this directory on the broker host")
+	fs.Parse(args)
+
+	if *dir != "" {
+		var result map[string]string
+		call("POST", "/backup", url.Values{"dir": {*dir}}, &result)
+		table(result, "DIR", func() {
+			row(result["dir"])
+		})
+		return
+	}
+
+	resp := send("GET", "/backup", nil)
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		if e.Error == "" {
+			e.Error = resp.Status
+		}
+		fatalf("%s", e.Error)
+	}
+
+	w := io.Writer(os.Stdout)
+	if fs.NArg() > 0 {
+		f, err := os.Create(fs.Arg(0))
+		if err != nil {
+			fatalf("%v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		fatalf("backup broken, %v", err)
+	}
+}
+
+func logLevel(args []string) {
+	var result map[string]string
+	switch subcommand(args) {
+	case "":
+		call("GET", "/log/level", nil, &result)
+	case "set":
+		call("PUT", "/log/level", url.Values{"level": {argument(args, "level")}}, &result)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	table(result, "LEVEL", func() {
+		row(result["level"])
+	})
+}
+
+func subcommand(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+func argument(args []string, name string) string {
+	if len(args) < 2 || args[1] == "" {
+		fatalf("%s required", name)
+	}
+	return args[1]
+}
+
+// send a request to the admin interface, with the admin token if it's set.
+func send(method, path string, query url.Values) *http.Response {
+	u := strings.TrimRight(*addr, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	return resp
+}
+
+// call the admin interface and decode the json response into result if it's not nil.
+func call(method, path string, query url.Values, result interface{}) {
+	resp := send(method, path, query)
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		if e.Error == "" {
+			e.Error = resp.Status
+		}
+		fatalf("%s", e.Error)
+	}
+
+	if result == nil {
+		io.Copy(io.Discard, resp.Body)
+		return
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		fatalf("bad response, %v", err)
+	}
+}
+
+var tw = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+// print v as json, or as a table with the header and rows written by fn.
+func table(v interface{}, header string, fn func()) {
+	if *output == "json" {
+		printJSON(v)
+		return
+	}
+	fmt.Fprintln(tw, header)
+	fn()
+	tw.Flush()
+}
+
+func row(columns ...interface{}) {
+	s := make([]string, len(columns))
+	for i, c := range columns {
+		s[i] = fmt.Sprint(c)
+	}
+	fmt.Fprintln(tw, strings.Join(s, "\t"))
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "mqtts-ctl: "+format+"\n", args...)
+	os.Exit(1)
+}
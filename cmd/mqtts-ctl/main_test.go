@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"bitbucket.org/j3r0lin/mqtt"
+	"github.com/stretchr/testify/assert"
+)
+
+// the test binary runs the tool when it's executed by run.
+func TestMain(m *testing.M) {
+	if os.Getenv("MQTTS_CTL_TEST") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// run the tool with the arguments, returns its stdout, stderr and exit code.
+func run(t *testing.T, args ...string) (string, string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "MQTTS_CTL_TEST=1", "MQTTS_CTL_TOKEN=")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	code := 0
+	if e, ok := err.(*exec.ExitError); ok {
+		code = e.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), code
+}
+
+// a broker with an admin token, its messages published through the HTTP bridge.
+func serveBroker(t *testing.T) string {
+	opts := mqtt.NewOptions()
+	opts.StoreBackend = "memory"
+	opts.AdminToken = "secret"
+	server := mqtt.NewServer(opts)
+	mux := http.NewServeMux()
+	mux.Handle("/", server.AdminHandler())
+	mux.Handle("/publish", server.HTTPBridgeHandler())
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	resp, err := http.Post(ts.URL+"/publish?topic=a/b&retain=true", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return ts.URL
+}
+
+func TestRetained(t *testing.T) {
+	addr := serveBroker(t)
+
+	stdout, stderr, code := run(t, "-addr", addr, "-token", "secret", "retained", "ls", "#")
+	assert.Equal(t, 0, code, stderr)
+	assert.Equal(t, "TOPIC  QOS  SIZE\na/b    0    5\n", stdout)
+
+	stdout, _, code = run(t, "-addr", addr, "-token", "secret", "-o", "json", "retained", "get", "a/+")
+	assert.Equal(t, 0, code)
+	var l []mqtt.RetainedInfo
+	if assert.NoError(t, json.Unmarshal([]byte(stdout), &l)) && assert.Len(t, l, 1) {
+		assert.Equal(t, "hello", string(l[0].Payload))
+	}
+
+	stdout, _, _ = run(t, "-addr", addr, "-token", "secret", "-o", "json", "retained", "rm", "#")
+	assert.JSONEq(t, `{"deleted": 1}`, stdout)
+}
+
+func TestErrors(t *testing.T) {
+	addr := serveBroker(t)
+
+	// the errors of the broker are printed
+	_, stderr, code := run(t, "-addr", addr, "stats")
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "mqtts-ctl: invalid admin token\n", stderr)
+	_, stderr, code = run(t, "-addr", addr, "-token", "secret", "sessions", "show", "none")
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "mqtts-ctl: session not found\n", stderr)
+	_, stderr, code = run(t, "-addr", addr, "-token", "secret", "log-level", "set", "loud")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "not a valid logrus Level")
+
+	// the usage errors
+	_, stderr, code = run(t, "-addr", addr, "-token", "secret", "clients", "kick")
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "mqtts-ctl: client id required\n", stderr)
+	_, stderr, code = run(t, "-addr", addr, "clients", "rm")
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "usage: mqtts-ctl")
+	_, stderr, code = run(t, "-o", "yaml", "stats")
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "mqtts-ctl: unknown output format \"yaml\"\n", stderr)
+}
+
+func TestHealth(t *testing.T) {
+	addr := serveBroker(t)
+
+	// open without the token
+	stdout, _, code := run(t, "-addr", addr, "-o", "json", "health")
+	assert.Equal(t, 0, code)
+	var h mqtt.Health
+	if assert.NoError(t, json.Unmarshal([]byte(stdout), &h)) {
+		assert.Equal(t, mqtt.HealthOK, h.Status)
+	}
+}
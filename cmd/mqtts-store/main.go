@@ -0,0 +1,229 @@
+// mqtts-store dumps a broker store to JSON Lines, loads it back, or migrates it between backends.
+// The broker must be stopped, the stores are opened directly.
+//
+//	mqtts-store dump      [-backend leveldb] [-path store.db] [-client <id>] [-topic <filter>] [-o <file>]
+//	mqtts-store load      [-backend leveldb] [-path store.db] [-client <id>] [-topic <filter>] [<file>]
+//	mqtts-store migrate   -from <backend>:<path> -to <backend>:<path> [-to-key-file <file>] [-client <id>] [-topic <filter>]
+//	mqtts-store reencrypt [-backend leveldb] [-path store.db] -key-file <file>
+//	mqtts-store genkey    <id>
+//
+// The encrypted stores are opened with the keyring of -key-file, or of the environment
+// variable named by -key-env, migrate writes the destination with the same keyring unless
+// -to-key-file or -to-key-env is set, ie: to encrypt a clear store. A keyring has an index
+// key, "mqtts-store genkey index", which encrypts the names in the store keys.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"bitbucket.org/j3r0lin/mqtt"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: mqtts-store <command> [flags]
+
+commands:
+  dump      write the store to a JSON Lines file, or stdout
+  load      read a JSON Lines dump from a file, or stdin, into the store
+  migrate   copy a store to another one, ie: -from leveldb:store.db -to bolt:store.bolt
+  reencrypt rewrite the stored packets with the primary key, after a key rotation
+  genkey    print a new random key entry for a keyring, "genkey index" for its index key
+
+the backends are leveldb, bolt, sqlite and memory, run "mqtts-store <command> -h" for the flags.
+`)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "dump":
+		dump(os.Args[2:])
+	case "load":
+		load(os.Args[2:])
+	case "migrate":
+		migrate(os.Args[2:])
+	case "reencrypt":
+		reencrypt(os.Args[2:])
+	case "genkey":
+		genkey(os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func filterFlags(fs *flag.FlagSet) *mqtt.DumpFilter {
+	filter := new(mqtt.DumpFilter)
+	fs.StringVar(&filter.ClientID, "client", "", "only the subscriptions and session packets of this client")
+	fs.StringVar(&filter.Topic, "topic", "", "only the retained and session messages matched by this topic filter")
+	return filter
+}
+
+func storeFlags(fs *flag.FlagSet) (backend, path *string) {
+	backend = fs.String("backend", mqtt.DefaultStoreBackend, "store backend, leveldb, bolt, sqlite or memory")
+	path = fs.String("path", mqtt.DefaultStorePath, "store path")
+	keyFlags(fs)
+	return
+}
+
+// the keyring of the stores of a command, migrate changes it for the destination
+var keyFile, keyEnv string
+
+func keyFlags(fs *flag.FlagSet) {
+	fs.StringVar(&keyFile, "key-file", "", "keyring file of an encrypted store")
+	fs.StringVar(&keyEnv, "key-env", "", "environment variable with the keyring of an encrypted store")
+}
+
+func dump(args []string) {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	backend, path := storeFlags(fs)
+	filter := filterFlags(fs)
+	output := fs.String("o", "", "output file, default to stdout")
+	fs.Parse(args)
+
+	store := openStore(*backend, *path)
+	defer closeStore(store)
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	count, err := mqtt.DumpStore(store, w, filter)
+	if err != nil {
+		fatalf("dump failed after %v records, %v", count, err)
+	}
+	fmt.Fprintf(os.Stderr, "%v records dumped\n", count)
+}
+
+func load(args []string) {
+	fs := flag.NewFlagSet("load", flag.ExitOnError)
+	backend, path := storeFlags(fs)
+	filter := filterFlags(fs)
+	fs.Parse(args)
+
+	r := io.Reader(os.Stdin)
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fatalf("%v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	store := openStore(*backend, *path)
+	defer closeStore(store)
+	count, err := mqtt.LoadStore(store, r, filter)
+	if err != nil {
+		fatalf("load failed after %v records, %v", count, err)
+	}
+	fmt.Fprintf(os.Stderr, "%v records loaded\n", count)
+}
+
+func migrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := fs.String("from", "", "source store, <backend>:<path>")
+	to := fs.String("to", "", "destination store, <backend>:<path>")
+	filter := filterFlags(fs)
+	keyFlags(fs)
+	toKeyFile := fs.String("to-key-file", "", "keyring file of the destination, default to the keyring of the source")
+	toKeyEnv := fs.String("to-key-env", "", "environment variable with the keyring of the destination")
+	fs.Parse(args)
+
+	src := openStore(parseStore(*from))
+	defer closeStore(src)
+	if *toKeyFile != "" || *toKeyEnv != "" {
+		keyFile, keyEnv = *toKeyFile, *toKeyEnv
+	}
+	dst := openStore(parseStore(*to))
+	defer closeStore(dst)
+
+	// the source is streamed through the dump format, the filter is applied once when dumping.
+	r, w := io.Pipe()
+	go func() {
+		_, err := mqtt.DumpStore(src, w, filter)
+		w.CloseWithError(err)
+	}()
+	count, err := mqtt.LoadStore(dst, r, nil)
+	if err != nil {
+		r.CloseWithError(err)
+		fatalf("migrate failed after %v records, %v", count, err)
+	}
+	fmt.Fprintf(os.Stderr, "%v records migrated from %v to %v\n", count, *from, *to)
+}
+
+func reencrypt(args []string) {
+	fs := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	backend, path := storeFlags(fs)
+	fs.Parse(args)
+	if keyFile == "" && keyEnv == "" {
+		fatalf("reencrypt needs a keyring, -key-file or -key-env")
+	}
+
+	store := openStore(*backend, *path)
+	defer closeStore(store)
+	count, err := mqtt.ReencryptStore(store)
+	if err != nil {
+		fatalf("reencrypt failed after %v records, %v", count, err)
+	}
+	fmt.Fprintf(os.Stderr, "%v records reencrypted\n", count)
+}
+
+func genkey(args []string) {
+	if len(args) != 1 || args[0] == "" {
+		fatalf("usage: mqtts-store genkey <id>")
+	}
+	entry, err := mqtt.NewKeyEntry(args[0])
+	if err != nil {
+		fatalf("%v", err)
+	}
+	fmt.Println(entry)
+}
+
+func parseStore(s string) (backend, path string) {
+	i := strings.Index(s, ":")
+	if i <= 0 || i == len(s)-1 {
+		fatalf("store %q must be <backend>:<path>", s)
+	}
+	return s[:i], s[i+1:]
+}
+
+func openStore(backend, path string) mqtt.Store {
+	opts := &mqtt.Options{StoreBackend: backend, StorePath: path, StoreKeyFile: keyFile, StoreKeyEnv: keyEnv}
+	if backend == "memory" {
+		// the memory store is loaded from the snapshot and saved on close
+		opts.StoreSnapshotInterval = time.Hour
+	}
+	store, err := mqtt.OpenStore(opts)
+	if err != nil {
+		fatalf("open %v store %q, %v", backend, path, err)
+	}
+	return store
+}
+
+func closeStore(store mqtt.Store) {
+	if c, ok := store.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "mqtts-store: close store, %v\n", err)
+		}
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "mqtts-store: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -2,9 +2,12 @@ package main
 import (
 	"bitbucket.org/j3r0lin/mqtt"
 	"github.com/Sirupsen/logrus"
+	"net/http"
 	"os"
+	"os/signal"
 	_ "net/http/pprof"
 	"sync"
+	"syscall"
 )
 
 func init() {
@@ -21,14 +24,38 @@ func main() {
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	server := mqtt.NewServer(mqtt.NewOptions())
+
+	// close the store on shutdown, the buffered writes are flushed
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		if err := server.Close(); err != nil {
+			logrus.Errorf("close server, %v", err)
+		}
+		os.Exit(0)
+	}()
+	// MQTT, MQTT over WebSocket, the HTTP bridge and the health checks on one port
+	go func() {
+		web := http.NewServeMux()
+		web.Handle("/health", server.AdminHandler())
+		bridge := server.HTTPBridgeHandler()
+		web.Handle("/publish", bridge)
+		web.Handle("/subscribe", bridge)
+		logrus.Fatal(server.ListenAndServeListener("tcp://0.0.0.0:1883", &mqtt.ListenerOptions{HTTPHandler: web}))
+		wg.Done()
+	}()
+
+	// the MQTT-SN gateway of the sensors
+	wg.Add(1)
 	go func() {
-		logrus.Fatal(server.ListenAndServe("tcp://0.0.0.0:1883"))
+		logrus.Fatal(server.ListenAndServeSN("0.0.0.0:1884", nil))
 		wg.Done()
 	}()
 
 	wg.Add(1)
 	go func() {
-		logrus.Fatal(server.ListenAndServeWebSocket(":8080"))
+		logrus.Fatal(server.ListenAndServeAdmin("127.0.0.1:8081"))
 		wg.Done()
 	}()
 
@@ -0,0 +1,259 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+)
+
+// DumpVersion is the version of the dump format written by DumpStore.
+const DumpVersion = 1
+
+// the types of the dump records
+const (
+	DumpHeader       = "header"
+	DumpSubscription = "subscription"
+	DumpRetained     = "retained"
+	DumpWill         = "will"
+	DumpInbound      = "inbound"
+	DumpOutbound     = "outbound"
+)
+
+// DumpRecord is one line of a store dump, the dump is a JSON Lines stream of records
+// starting with a header:
+//
+//	{"type":"header","version":1,"time":"2016-05-04T10:00:00Z"}
+//	{"type":"subscription","client_id":"c1","filter":"a/#","qos":1}
+//	{"type":"retained","topic":"status","qos":1,"payload":"b25saW5l"}
+//	{"type":"will","client_id":"c1","topic":"status/c1","qos":1,"retain":true,"payload":"b2ZmbGluZQ=="}
+//	{"type":"outbound","client_id":"c1","packet":"publish","mid":3,"topic":"a/b","qos":1,"payload":"aGk="}
+//	{"type":"outbound","client_id":"c1","packet":"pubrel","mid":4}
+//
+// The payloads are base64 encoded.
+type DumpRecord struct {
+	Type    string     `json:"type"`
+	Version int        `json:"version,omitempty"`
+	Time    *time.Time `json:"time,omitempty"`
+
+	ClientID string `json:"client_id,omitempty"`
+	Filter   string `json:"filter,omitempty"`
+
+	// the session packets are a "publish" or a "pubrel"
+	Packet    string `json:"packet,omitempty"`
+	MessageID uint16 `json:"mid,omitempty"`
+	Topic     string `json:"topic,omitempty"`
+	QoS       byte   `json:"qos,omitempty"`
+	Dup       bool   `json:"dup,omitempty"`
+	Retain    bool   `json:"retain,omitempty"`
+	Payload   []byte `json:"payload,omitempty"`
+}
+
+// DumpFilter selects the records to dump or load, the zero value selects everything.
+type DumpFilter struct {
+	// only the subscriptions, will and session packets of this client, and no retained messages.
+	ClientID string
+
+	// only the retained messages and the published messages matched by this topic filter,
+	// and the subscriptions to the topics matched by it. The releases have no topic,
+	// they are selected with the session of their client.
+	Topic string
+}
+
+func (this *DumpFilter) match(r *DumpRecord) bool {
+	switch r.Type {
+	case DumpSubscription:
+		return this.matchClient(r.ClientID) && this.matchTopic(r.Filter)
+	case DumpRetained:
+		return this.ClientID == "" && this.matchTopic(r.Topic)
+	case DumpWill:
+		return this.matchClient(r.ClientID) && this.matchTopic(r.Topic)
+	case DumpInbound, DumpOutbound:
+		if !this.matchClient(r.ClientID) {
+			return false
+		}
+		return r.Packet != "publish" || this.matchTopic(r.Topic)
+	}
+	return false
+}
+
+func (this *DumpFilter) matchClient(cid string) bool {
+	return this.ClientID == "" || this.ClientID == cid
+}
+
+func (this *DumpFilter) matchTopic(topic string) bool {
+	return this.Topic == "" || matchTopic(this.Topic, topic)
+}
+
+// DumpStore writes the records of the store selected by the filter to w, returns the count written.
+func DumpStore(store Store, w io.Writer, filter *DumpFilter) (count int, err error) {
+	if filter == nil {
+		filter = &DumpFilter{}
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	now := time.Now().UTC()
+	if err = enc.Encode(&DumpRecord{Type: DumpHeader, Version: DumpVersion, Time: &now}); err != nil {
+		return
+	}
+
+	// the encoding errors are kept until the lookups return, they can't be stopped.
+	write := func(r *DumpRecord) {
+		if err != nil || !filter.match(r) {
+			return
+		}
+		if err = enc.Encode(r); err == nil {
+			count++
+		}
+	}
+
+	lookups := []func() error{
+		func() error {
+			return store.LookupSubscriptions(func(f, cid string, qos byte) {
+				write(&DumpRecord{Type: DumpSubscription, ClientID: cid, Filter: f, QoS: qos})
+			})
+		},
+		func() error {
+			return store.LookupRetained(func(p *packets.PublishPacket) {
+				write(&DumpRecord{Type: DumpRetained, Topic: p.TopicName, QoS: p.Qos, Payload: p.Payload})
+			})
+		},
+		func() error {
+			return store.LookupWills(func(cid string, p *packets.PublishPacket) {
+				write(&DumpRecord{Type: DumpWill, ClientID: cid, Topic: p.TopicName, QoS: p.Qos, Retain: p.Retain, Payload: p.Payload})
+			})
+		},
+		func() error {
+			return store.LookupPackets(func(cid string, inbound bool, p packets.ControlPacket) {
+				if r := dumpPacket(p); r != nil {
+					r.Type, r.ClientID = DumpOutbound, cid
+					if inbound {
+						r.Type = DumpInbound
+					}
+					write(r)
+				}
+			})
+		},
+	}
+	for _, lookup := range lookups {
+		if e := lookup(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return
+		}
+	}
+	err = bw.Flush()
+	return
+}
+
+func dumpPacket(cp packets.ControlPacket) *DumpRecord {
+	switch p := cp.(type) {
+	case *packets.PublishPacket:
+		return &DumpRecord{Packet: "publish", MessageID: p.MessageID, Topic: p.TopicName, QoS: p.Qos, Dup: p.Dup, Retain: p.Retain, Payload: p.Payload}
+	case *packets.PubrelPacket:
+		return &DumpRecord{Packet: "pubrel", MessageID: p.MessageID}
+	}
+	return nil
+}
+
+// the session packet of a record
+func (this *DumpRecord) packet() (packets.ControlPacket, error) {
+	switch this.Packet {
+	case "publish":
+		p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		p.MessageID = this.MessageID
+		p.TopicName = this.Topic
+		p.Qos = this.QoS
+		p.Dup = this.Dup
+		p.Retain = this.Retain
+		p.Payload = this.Payload
+		return p, validateTopic(p.TopicName)
+	case "pubrel":
+		p := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+		p.MessageID = this.MessageID
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown packet %q", this.Packet)
+}
+
+// LoadStore reads a dump from r and writes the records selected by the filter to the store,
+// returns the count loaded. The records replace the ones in the store with the same keys.
+func LoadStore(store Store, r io.Reader, filter *DumpFilter) (count int, err error) {
+	if filter == nil {
+		filter = &DumpFilter{}
+	}
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for line := 1; ; line++ {
+		var record DumpRecord
+		if err = dec.Decode(&record); err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, fmt.Errorf("record %v: %v", line, err)
+		}
+
+		if line == 1 {
+			if record.Type != DumpHeader {
+				return count, fmt.Errorf("record %v: header expected", line)
+			}
+			if record.Version > DumpVersion {
+				return count, fmt.Errorf("record %v: unsupported version %v", line, record.Version)
+			}
+			continue
+		}
+		if !filter.match(&record) {
+			continue
+		}
+		if err = loadRecord(store, &record); err != nil {
+			return count, fmt.Errorf("record %v: %v", line, err)
+		}
+		count++
+	}
+}
+
+func loadRecord(store Store, r *DumpRecord) error {
+	switch r.Type {
+	case DumpSubscription:
+		if err := validateQoS(r.QoS); err != nil {
+			return err
+		}
+		return store.StoreSubscription(r.Filter, r.ClientID, r.QoS)
+	case DumpRetained:
+		if err := validateTopic(r.Topic); err != nil {
+			return err
+		}
+		p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		p.TopicName = r.Topic
+		p.Qos = r.QoS
+		p.Retain = true
+		p.Payload = r.Payload
+		return store.StoreRetained(p)
+	case DumpWill:
+		if err := validateTopic(r.Topic); err != nil {
+			return err
+		}
+		if err := validateQoS(r.QoS); err != nil {
+			return err
+		}
+		p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		p.TopicName = r.Topic
+		p.Qos = r.QoS
+		p.Retain = r.Retain
+		p.Payload = r.Payload
+		return store.StoreWill(r.ClientID, p)
+	case DumpInbound, DumpOutbound:
+		p, err := r.packet()
+		if err != nil {
+			return err
+		}
+		if r.Type == DumpInbound {
+			return store.StoreInboundPacket(r.ClientID, p)
+		}
+		return store.StoreOutboundPacket(r.ClientID, p)
+	}
+	return fmt.Errorf("unknown record type %q", r.Type)
+}
@@ -0,0 +1,120 @@
+package mqtt
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func newDumpTestStore(t *testing.T) Store {
+	store := newMemoryStore()
+	assert.NoError(t, store.StoreSubscription("a/#", "c1", 1))
+	assert.NoError(t, store.StoreSubscription("b/+", "c2", 2))
+
+	retain := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	retain.TopicName = "a/status"
+	retain.Qos = 1
+	retain.Payload = []byte("online")
+	assert.NoError(t, store.StoreRetained(retain))
+	retain.TopicName = "b/status"
+	assert.NoError(t, store.StoreRetained(retain))
+	retain.TopicName = "a/will"
+	assert.NoError(t, store.StoreWill("c1", retain))
+
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = "a/1"
+	p.Qos = 2
+	p.MessageID = 5
+	p.Payload = []byte{0, 1, 2}
+	assert.NoError(t, store.StoreInboundPacket("c1", p))
+	p.TopicName = "b/1"
+	p.Qos = 1
+	p.MessageID = 6
+	assert.NoError(t, store.StoreOutboundPacket("c2", p))
+	rel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	rel.MessageID = 7
+	assert.NoError(t, store.StoreOutboundPacket("c1", rel))
+	return store
+}
+
+func TestDumpAndLoadStore(t *testing.T) {
+	var buf bytes.Buffer
+	count, err := DumpStore(newDumpTestStore(t), &buf, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, count)
+	assert.Equal(t, 9, strings.Count(buf.String(), "\n"), "a header and a record per line")
+
+	// migrate to another backend through the dump
+	store, err := newBoltStore(filepath.Join(t.TempDir(), "store.bolt"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer store.Close()
+	count, err = LoadStore(store, &buf, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, count)
+
+	var again bytes.Buffer
+	_, err = DumpStore(store, &again, nil)
+	assert.NoError(t, err)
+	var first bytes.Buffer
+	DumpStore(newDumpTestStore(t), &first, nil)
+	// the same records but the header time
+	assert.Equal(t, lines(first.String())[1:], lines(again.String())[1:])
+
+	p, err := store.FindInboundPacket("c1", 5)
+	assert.NoError(t, err)
+	if p, ok := p.(*packets.PublishPacket); assert.True(t, ok) {
+		assert.Equal(t, "a/1", p.TopicName)
+		assert.Equal(t, byte(2), p.Qos)
+		assert.Equal(t, []byte{0, 1, 2}, p.Payload)
+	}
+}
+
+func TestDumpStoreFilter(t *testing.T) {
+	store := newDumpTestStore(t)
+	records := func(filter *DumpFilter) []string {
+		var buf bytes.Buffer
+		_, err := DumpStore(store, &buf, filter)
+		assert.NoError(t, err)
+		var l []string
+		for _, line := range lines(buf.String())[1:] {
+			l = append(l, line[:strings.Index(line, ",")])
+		}
+		return l
+	}
+
+	assert.Equal(t, []string{
+		`{"type":"subscription"`, `{"type":"will"`, `{"type":"inbound"`, `{"type":"outbound"`,
+	}, records(&DumpFilter{ClientID: "c1"}))
+	assert.Equal(t, []string{
+		`{"type":"subscription"`, `{"type":"retained"`, `{"type":"will"`, `{"type":"inbound"`, `{"type":"outbound"`,
+	}, records(&DumpFilter{Topic: "a/#"}), "the pubrel is kept with the session")
+	assert.Equal(t, []string{
+		`{"type":"outbound"`,
+	}, records(&DumpFilter{ClientID: "c2", Topic: "b/1"}))
+}
+
+func TestLoadStoreErrors(t *testing.T) {
+	store := newMemoryStore()
+	_, err := LoadStore(store, strings.NewReader(`{"type":"subscription","client_id":"c1","filter":"a"}`), nil)
+	assert.EqualError(t, err, "record 1: header expected")
+
+	_, err = LoadStore(store, strings.NewReader(`{"type":"header","version":99}`), nil)
+	assert.EqualError(t, err, "record 1: unsupported version 99")
+
+	count, err := LoadStore(store, strings.NewReader(`{"type":"header","version":1}
+{"type":"subscription","client_id":"c1","filter":"a","qos":1}
+{"type":"outbound","client_id":"c1","packet":"puback","mid":1}
+`), nil)
+	assert.Equal(t, 1, count)
+	assert.EqualError(t, err, `record 3: unknown packet "puback"`)
+}
+
+func lines(s string) []string {
+	return strings.Split(strings.TrimSpace(s), "\n")
+}
@@ -0,0 +1,121 @@
+package mqtt
+
+import (
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// the durability of the writes to the leveldb store, see Options.StoreDurability.
+const (
+	// the writes are in the OS cache when acknowledged, a power loss may drop the last ones.
+	DurabilityNone = "none"
+	// every write is synced to disk before it's acknowledged.
+	DurabilitySync = "sync"
+	// the concurrent writes are synced together in one batch before they're acknowledged.
+	DurabilityGroup = "group"
+)
+
+// the most writes synced in one group commit
+const maxGroupCommit = 1000
+
+var syncWrite = &opt.WriteOptions{Sync: true}
+
+type commitRequest struct {
+	b    *leveldb.Batch
+	done chan error
+}
+
+// groupCommit syncs the writes queued while the previous sync was running in one batch,
+// the writers wait until their batch is synced.
+type groupCommit struct {
+	db       *leveldb.DB
+	requests chan *commitRequest
+	quit     chan struct{}
+	wg       sync.WaitGroup
+
+	// no write is queued after the close
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newGroupCommit(db *leveldb.DB) *groupCommit {
+	g := &groupCommit{
+		db:       db,
+		requests: make(chan *commitRequest, maxGroupCommit),
+		quit:     make(chan struct{}),
+	}
+	g.wg.Add(1)
+	go g.run()
+	return g
+}
+
+// write queues the batch and waits until it's synced.
+func (this *groupCommit) write(b *leveldb.Batch) error {
+	r := &commitRequest{b: b, done: make(chan error, 1)}
+	this.mu.RLock()
+	if this.closed {
+		this.mu.RUnlock()
+		return leveldb.ErrClosed
+	}
+	this.requests <- r
+	this.mu.RUnlock()
+	return <-r.done
+}
+
+func (this *groupCommit) run() {
+	defer this.wg.Done()
+	var waiting []*commitRequest
+	batch := new(leveldb.Batch)
+	for {
+		select {
+		case r := <-this.requests:
+			waiting = append(waiting, r)
+		case <-this.quit:
+			// the requests queued before the close are still written
+			for len(this.requests) > 0 {
+				waiting = append(waiting, <-this.requests)
+			}
+			if len(waiting) > 0 {
+				this.commit(batch, waiting)
+			}
+			return
+		}
+
+		// take the writes queued meanwhile
+	collect:
+		for len(waiting) < maxGroupCommit {
+			select {
+			case r := <-this.requests:
+				waiting = append(waiting, r)
+			default:
+				break collect
+			}
+		}
+		this.commit(batch, waiting)
+		waiting = waiting[:0]
+		batch.Reset()
+	}
+}
+
+func (this *groupCommit) commit(batch *leveldb.Batch, waiting []*commitRequest) {
+	for _, r := range waiting {
+		r.b.Replay(batch)
+	}
+	err := this.db.Write(batch, syncWrite)
+	for _, r := range waiting {
+		r.done <- err
+	}
+}
+
+// close stops the commits after writing the queued ones.
+func (this *groupCommit) close() {
+	this.mu.Lock()
+	if !this.closed {
+		this.closed = true
+		close(this.quit)
+	}
+	this.mu.Unlock()
+	this.wg.Wait()
+}
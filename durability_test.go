@@ -0,0 +1,80 @@
+package mqtt
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func openDurableStore(t testing.TB, durability string) *LevelStore {
+	store, err := OpenStore(&Options{StorePath: filepath.Join(t.TempDir(), "store.db"), StoreDurability: durability})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.(*LevelStore)
+}
+
+func TestStoreDurability(t *testing.T) {
+	_, err := OpenStore(&Options{StorePath: filepath.Join(t.TempDir(), "store.db"), StoreDurability: "fast"})
+	assert.Equal(t, ErrUnknownDurability, err)
+
+	store := openDurableStore(t, DurabilityGroup)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cid := fmt.Sprintf("c%v", i)
+			for mid := uint16(1); mid <= 20; mid++ {
+				assert.NoError(t, store.StoreInboundPacket(cid, testPublish(mid)))
+			}
+			assert.NoError(t, store.DeleteInboundPacket(cid, 1))
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 50*19, storeSize(t, store.InPacketsSize))
+
+	// the writes after the close fail, they're not lost silently
+	assert.NoError(t, store.Close())
+	assert.Equal(t, leveldb.ErrClosed, store.StoreInboundPacket("c1", testPublish(1)))
+}
+
+func testPublish(mid uint16) *packets.PublishPacket {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = "a/b"
+	p.Qos = 2
+	p.MessageID = mid
+	p.Payload = make([]byte, 100)
+	return p
+}
+
+// go test -run none -bench StoreDurability -cpu 1,16
+func BenchmarkStoreDurability(b *testing.B) {
+	for _, durability := range []string{DurabilityNone, DurabilitySync, DurabilityGroup} {
+		b.Run(durability, func(b *testing.B) {
+			store := openDurableStore(b, durability)
+			defer store.Close()
+
+			// one client per goroutine, each writes its QoS 2 state
+			var clients int64
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				cid := fmt.Sprintf("c%v", atomic.AddInt64(&clients, 1))
+				mid := uint16(0)
+				for pb.Next() {
+					mid++
+					if err := store.StoreInboundPacket(cid, testPublish(mid)); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -14,5 +14,33 @@ var (
 	ErrInvalidTopicMultilevel  = errors.New("Invalid topic multi level")
 	ErrInvalidQoS              = errors.New("Invalid QoS")
 	ErrTakeOver                = errors.New("Takeover")
+	ErrKicked                  = errors.New("Kicked")
 	ErrInvalidMessageId        = errors.New("Invalid message id")
+	ErrUnknownRaftCommand      = errors.New("Unknown raft command")
+	ErrUnknownStoreBackend     = errors.New("Unknown store backend")
+	ErrCorruptValue            = errors.New("Corrupt value in store")
+	ErrBackupNotSupported      = errors.New("Backup not supported by the store")
+	ErrInvalidBackup           = errors.New("Invalid backup")
+	ErrNoStoreKey              = errors.New("No store key")
+	ErrUnknownStoreKey         = errors.New("Unknown store key")
+	ErrNoIndexKey              = errors.New("No index key in the keyring")
+	ErrStoreNotEncrypted       = errors.New("Store created without a keyring")
+	ErrUnknownDurability       = errors.New("Unknown store durability")
+	ErrStoreClosed             = errors.New("Store closed")
+	ErrPolicyKeepAlive         = errors.New("Keepalive out of the policy range")
+	ErrPolicyClientId          = errors.New("Client id refused by the policy")
+	ErrPolicyPersistent        = errors.New("Persistent session refused by the policy")
+	ErrPolicyAnonymous         = errors.New("Anonymous connection refused by the policy")
+	ErrPolicyTopicLevels       = errors.New("Too many topic levels")
+	ErrPolicyWildcard          = errors.New("Wildcard subscription refused by the policy")
+	ErrPolicySubscriptions     = errors.New("Too many subscriptions")
+	ErrQuotaExceeded           = errors.New("Quota exceeded")
+	ErrUnknownQuotaAction      = errors.New("Unknown quota action")
+	ErrInvalidProxyHeader      = errors.New("Invalid PROXY protocol header")
+	ErrInvalidWebSocketFrame   = errors.New("Invalid WebSocket frame")
+	ErrWebSocketHandshake      = errors.New("Invalid WebSocket handshake")
+	ErrQUICWithoutTLS          = errors.New("QUIC listener without a TLS config")
+	ErrInvalidSNMessage        = errors.New("Invalid MQTT-SN message")
+	ErrBadCredentials          = errors.New("Bad user name or password")
+	ErrNotAuthorized           = errors.New("Not authorized")
 )
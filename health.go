@@ -0,0 +1,70 @@
+package mqtt
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+)
+
+// Health is the state of the broker, it's degraded while the store is failing.
+// A degraded broker refuses to acknowledge the QoS 1 and 2 messages it can not persist.
+type Health struct {
+	Status string `json:"status"`
+	// the last store error, and the time the store started failing.
+	StoreError string     `json:"store_error,omitempty"`
+	Since      *time.Time `json:"since,omitempty"`
+}
+
+type health struct {
+	sync.Mutex
+	err   error
+	since time.Time
+}
+
+// Health returns the current health state of the broker.
+func (this *Server) Health() Health {
+	this.health.Lock()
+	defer this.health.Unlock()
+	if this.health.err == nil {
+		return Health{Status: HealthOK}
+	}
+	since := this.health.since
+	return Health{Status: HealthDegraded, StoreError: this.health.err.Error(), Since: &since}
+}
+
+// storeFailed records a failed store operation, the broker is degraded until a write succeeds.
+// It returns err, so the callers can check and record the result of an operation at once.
+func (this *Server) storeFailed(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	log.Errorf("store: %v failed, %v", op, err)
+
+	this.health.Lock()
+	defer this.health.Unlock()
+	if this.health.err == nil {
+		this.health.since = time.Now()
+		log.Warnf("store degraded since %v", this.health.since)
+	}
+	this.health.err = err
+	return err
+}
+
+// checkStore records the result of a write, a succeeded one brings the store back to health.
+func (this *Server) checkStore(op string, err error) error {
+	if err != nil {
+		return this.storeFailed(op, err)
+	}
+
+	this.health.Lock()
+	defer this.health.Unlock()
+	if this.health.err != nil {
+		log.Infof("store recovered, degraded for %v", time.Since(this.health.since))
+		this.health.err = nil
+	}
+	return nil
+}
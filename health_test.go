@@ -0,0 +1,149 @@
+package mqtt
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+var errDiskFull = errors.New("disk full")
+
+// a store failing all the writes while broken is set, as a full disk.
+type brokenStore struct {
+	Store
+	broken int32
+}
+
+func (this *brokenStore) set(broken bool) {
+	var v int32
+	if broken {
+		v = 1
+	}
+	atomic.StoreInt32(&this.broken, v)
+}
+
+func (this *brokenStore) err() error {
+	if atomic.LoadInt32(&this.broken) == 1 {
+		return errDiskFull
+	}
+	return nil
+}
+
+func (this *brokenStore) StoreSubscription(filter, cid string, qos byte) error {
+	if err := this.err(); err != nil {
+		return err
+	}
+	return this.Store.StoreSubscription(filter, cid, qos)
+}
+
+func (this *brokenStore) StoreInboundPacket(cid string, p packets.ControlPacket) error {
+	if err := this.err(); err != nil {
+		return err
+	}
+	return this.Store.StoreInboundPacket(cid, p)
+}
+
+func (this *brokenStore) StoreOutboundPacket(cid string, p packets.ControlPacket) error {
+	if err := this.err(); err != nil {
+		return err
+	}
+	return this.Store.StoreOutboundPacket(cid, p)
+}
+
+// the connection must be closed without any acknowledgement.
+func assertClosed(t *testing.T, c *testClient) {
+	t.Helper()
+	p, err := packets.ReadPacket(c.conn)
+	assert.Error(t, err, "connection closed expected, got %v", p)
+}
+
+func TestStoreDegraded(t *testing.T) {
+	store := &brokenStore{Store: newMemoryStore()}
+	server, addr := newTestServerWithStore(t, store)
+
+	sub := dialTestClient(t, addr, "sub", false)
+	sub.subscribe("a/#", 1)
+	sub.conn.Close()
+	waitFor(t, func() bool {
+		_, ok := server.clients.get("sub")
+		return !ok
+	})
+	assert.Equal(t, HealthOK, server.Health().Status)
+
+	store.set(true)
+
+	// the offline message can't be kept, the publisher gets no puback
+	pub := dialTestClient(t, addr, "pub", true)
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = "a/1"
+	p.Payload = []byte("lost")
+	p.Qos = 1
+	p.MessageID = pub.nextId()
+	pub.write(p)
+	assertClosed(t, pub)
+
+	// neither a pubrec for qos 2
+	pub = dialTestClient(t, addr, "pub", true)
+	p.Qos = 2
+	pub.write(p)
+	assertClosed(t, pub)
+
+	// the subscription refused
+	c := dialTestClient(t, addr, "other", true)
+	sp := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sp.MessageID = c.nextId()
+	sp.Topics = []string{"b"}
+	sp.Qoss = []byte{1}
+	c.write(sp)
+	if ack, ok := c.read().(*packets.SubackPacket); assert.True(t, ok, "suback expected") {
+		assert.Equal(t, []byte{0x80}, ack.GrantedQoss)
+	}
+	assert.Empty(t, server.Subscriptions("other"))
+
+	h := server.Health()
+	assert.Equal(t, HealthDegraded, h.Status)
+	assert.Equal(t, errDiskFull.Error(), h.StoreError)
+	w := httptest.NewRecorder()
+	server.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	// back to health after the next write succeeds
+	store.set(false)
+	pub = dialTestClient(t, addr, "pub", true)
+	pub.publish("a/2", "kept", 1, false)
+	assert.Equal(t, HealthOK, server.Health().Status)
+	w = httptest.NewRecorder()
+	server.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	sub = dialTestClient(t, addr, "sub", false)
+	assert.Equal(t, "kept", string(sub.receive().Payload))
+}
+
+// a qos 2 message is kept before it's forwarded, nothing is forwarded if it can't be.
+func TestStoreDegradedQoS2(t *testing.T) {
+	store := &brokenStore{Store: newMemoryStore()}
+	_, addr := newTestServerWithStore(t, store)
+	sub := dialTestClient(t, addr, "sub", true)
+	sub.subscribe("a/#", 0)
+
+	store.set(true)
+	pub := dialTestClient(t, addr, "pub", true)
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = "a/1"
+	p.Payload = []byte("lost")
+	p.Qos = 2
+	p.MessageID = pub.nextId()
+	pub.write(p)
+	assertClosed(t, pub)
+
+	store.set(false)
+	pub = dialTestClient(t, addr, "pub", true)
+	pub.publish("a/2", "kept", 2, false)
+	assert.Equal(t, "kept", string(sub.receive().Payload))
+}
@@ -0,0 +1,262 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/pborman/uuid"
+)
+
+const (
+	// the largest payload published over HTTP, the remaining length limit of MQTT
+	httpMaxPayload = 268435455
+	// the messages queued to an event stream, the others are dropped until it catches up
+	sseQueueLen = 256
+	// the interval of the comments keeping an idle event stream open through the proxies
+	sseKeepAlive = 30 * time.Second
+)
+
+// MessageEvent is the data of a message event of the subscribe endpoint, the payload is
+// base64 encoded.
+type MessageEvent struct {
+	Topic   string `json:"topic"`
+	Retain  bool   `json:"retain"`
+	Payload []byte `json:"payload"`
+}
+
+// HTTPBridgeHandler serves the clients holding no MQTT connection:
+//
+//	POST /publish?topic=a/b&qos=1&retain=true publishes the request body, like a client does
+//	GET /subscribe?filter=a/%23&retained=true streams the matched messages as Server-Sent Events
+//
+// The user of the basic authentication, or the anonymous user, is checked by the Authorizer.
+// The users, the topics and the filters are limited by the Policy of the sniffing listener
+// serving the request, or of the server, and the banned addresses are refused.
+func (this *Server) HTTPBridgeHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/publish", this.httpPublish)
+	mux.HandleFunc("/subscribe", this.httpSubscribe)
+	return mux
+}
+
+// the user of the request, the request is answered if it's not authenticated.
+// A banned source address is refused before its credentials are checked, the anonymous
+// requests are refused like the clients if the policy denies them.
+func (this *Server) httpUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if this.banned(r.RemoteAddr) {
+		writeError(w, http.StatusForbidden, "address banned")
+		return "", false
+	}
+	user, password, _ := r.BasicAuth()
+	if err := this.listenerPolicy(requestListener(r)).checkConnect(true, user); err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mqtt"`)
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return "", false
+	}
+	if !this.authenticate(user, password) {
+		this.authFailed(r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Basic realm="mqtt"`)
+		writeError(w, http.StatusUnauthorized, "bad user name or password")
+		return "", false
+	}
+	this.authSucceeded(r.RemoteAddr)
+	return user, true
+}
+
+func (this *Server) httpPublish(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "POST") {
+		return
+	}
+	user, ok := this.httpUser(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = query.Get("topic")
+	if s := query.Get("qos"); s != "" {
+		qos, err := strconv.ParseUint(s, 10, 8)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid qos")
+			return
+		}
+		p.Qos = byte(qos)
+	}
+	if s := query.Get("retain"); s != "" {
+		retain, err := strconv.ParseBool(s)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid retain")
+			return
+		}
+		p.Retain = retain
+	}
+	// a topic name, with no wildcard
+	err := validateTopic(p.TopicName)
+	if err == nil && strings.ContainsAny(p.TopicName, "+#") {
+		err = ErrInvalidTopicName
+	}
+	if err == nil {
+		err = validateQoS(p.Qos)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err = this.listenerPolicy(requestListener(r)).checkTopic(p.TopicName); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if !this.canPublish(user, p.TopicName) {
+		writeError(w, http.StatusForbidden, ErrNotAuthorized.Error())
+		return
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, httpMaxPayload))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "payload too large")
+		} else {
+			writeError(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+	p.Payload = payload
+
+	log.Debugf("http(%v) publish to %q, qos: %v, retain: %v", r.RemoteAddr, p.TopicName, p.Qos, p.Retain)
+	// like a client message, it's acknowledged only once it's kept
+	if err := this.publishMessage("$http", p); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// a subscriber of an event stream, its messages are queued to the request.
+type sseSubscriber struct {
+	id       string
+	messages chan *packets.PublishPacket
+}
+
+func (this *sseSubscriber) deliver(origin string, message *packets.PublishPacket, qos byte) error {
+	select {
+	case this.messages <- message:
+	default:
+		log.Debugf("http(%v) message to %q dropped, the stream is behind", this.id, message.TopicName)
+	}
+	return nil
+}
+
+func (this *Server) httpSubscribe(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	user, ok := this.httpUser(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := query.Get("filter")
+	tokens, err := topicTokenise(filter)
+	if err == nil {
+		err = validateTopicFilter(filter)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	retained := false
+	if s := query.Get("retained"); s != "" {
+		if retained, err = strconv.ParseBool(s); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid retained")
+			return
+		}
+	}
+	// a stream is the only subscription of its subscriber
+	if _, err = this.listenerPolicy(requestListener(r)).subscribe(filter, 0, 0); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if !this.canSubscribe(user, filter) {
+		writeError(w, http.StatusForbidden, ErrNotAuthorized.Error())
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	// a temporary subscriber, it's not kept in the store
+	s := &sseSubscriber{
+		id:       "$http/" + uuid.New(),
+		messages: make(chan *packets.PublishPacket, sseQueueLen),
+	}
+	log.Infof("http(%v) subscribe to %q from %v", s.id, filter, r.RemoteAddr)
+	this.addDeliverer(s.id, s)
+	this.subhier.subscribe(tokens, s.id, 0)
+	if c := this.clustered(); c != nil {
+		c.subscribed(filter, s.id)
+	}
+	defer func() {
+		this.subhier.clean(s.id)
+		this.removeDeliverer(s.id)
+		if c := this.clustered(); c != nil {
+			c.cleaned(s.id)
+		}
+		log.Infof("http(%v) subscription closed", s.id)
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// the retained messages are sent first, the messages published meanwhile are queued
+	if retained {
+		this.matchRetain(filter, func(m *packets.PublishPacket) {
+			if err == nil {
+				err = writeMessageEvent(w, m, true)
+			}
+		})
+		if err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case m := <-s.messages:
+			err = writeMessageEvent(w, m, false)
+		case <-ticker.C:
+			_, err = io.WriteString(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-this.quit:
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeMessageEvent(w io.Writer, m *packets.PublishPacket, retain bool) error {
+	data, err := json.Marshal(&MessageEvent{Topic: m.TopicName, Retain: retain, Payload: m.Payload})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "event: message\ndata: "+string(data)+"\n\n")
+	return err
+}
@@ -0,0 +1,303 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+// the users may use the topics under their name, root may use them all.
+type testAuthorizer map[string]string
+
+func (this testAuthorizer) Authenticate(user, password string) bool {
+	p, ok := this[user]
+	return ok && p == password
+}
+
+func (this testAuthorizer) CanPublish(user, topic string) bool {
+	return user == "root" || strings.HasPrefix(topic, user+"/")
+}
+
+func (this testAuthorizer) CanSubscribe(user, filter string) bool {
+	return user == "root" || strings.HasPrefix(filter, user+"/")
+}
+
+func userLogin(cid, user, password string) *packets.ConnectPacket {
+	cp := testConnect(cid, true, 30)
+	cp.UsernameFlag = true
+	cp.Username = user
+	cp.PasswordFlag = true
+	cp.Password = []byte(password)
+	return cp
+}
+
+func httpPost(t *testing.T, url, user, payload string) int {
+	t.Helper()
+	req, _ := http.NewRequest("POST", url, strings.NewReader(payload))
+	if user != "" {
+		req.SetBasicAuth(user, "secret")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// an event stream read line by line.
+type sseTestClient struct {
+	t    *testing.T
+	resp *http.Response
+	r    *bufio.Reader
+}
+
+func dialSSE(t *testing.T, url string) *sseTestClient {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		resp.Body.Close()
+	})
+	return &sseTestClient{t: t, resp: resp, r: bufio.NewReader(resp.Body)}
+}
+
+func (this *sseTestClient) next() MessageEvent {
+	this.t.Helper()
+	var e MessageEvent
+	done := make(chan error, 1)
+	go func() {
+		var event string
+		for {
+			line, err := this.r.ReadString('\n')
+			if err != nil {
+				done <- err
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimSpace(line[7:])
+			case strings.HasPrefix(line, "data: "):
+				assert.Equal(this.t, "message", event)
+				done <- json.Unmarshal([]byte(line[6:]), &e)
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			this.t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		this.t.Fatal("message event expected")
+	}
+	return e
+}
+
+func TestHTTPPublish(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	addr := serveTestServer(t, server)
+	ts := httptest.NewServer(server.HTTPBridgeHandler())
+	defer ts.Close()
+
+	sub := dialTestClient(t, addr, "sub", true)
+	sub.subscribe("a/#", 1)
+
+	assert.Equal(t, http.StatusNoContent, httpPost(t, ts.URL+"/publish?topic=a/b&qos=1&retain=true", "", "hello"))
+	p := sub.receive()
+	assert.Equal(t, "a/b", p.TopicName)
+	assert.Equal(t, "hello", string(p.Payload))
+	assert.Equal(t, byte(1), p.Qos)
+
+	// retained like a message of a client
+	late := dialTestClient(t, addr, "late", true)
+	late.subscribe("a/b", 0)
+	p = late.receive()
+	assert.True(t, p.Retain)
+	assert.Equal(t, "hello", string(p.Payload))
+	assert.Equal(t, http.StatusNoContent, httpPost(t, ts.URL+"/publish?topic=a/b&retain=1", "", ""))
+	retained, _ := server.Retained("#")
+	assert.Empty(t, retained)
+
+	assert.Equal(t, http.StatusBadRequest, httpPost(t, ts.URL+"/publish", "", "x"))
+	assert.Equal(t, http.StatusBadRequest, httpPost(t, ts.URL+"/publish?topic=a/%2B", "", "x"))
+	assert.Equal(t, http.StatusBadRequest, httpPost(t, ts.URL+"/publish?topic=a&qos=3", "", "x"))
+	assert.Equal(t, http.StatusBadRequest, httpPost(t, ts.URL+"/publish?topic=a&retain=maybe", "", "x"))
+	resp, err := http.Get(ts.URL + "/publish?topic=a")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
+
+func TestHTTPSubscribe(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	addr := serveTestServer(t, server)
+	ts := httptest.NewServer(server.HTTPBridgeHandler())
+	defer ts.Close()
+
+	pub := dialTestClient(t, addr, "pub", true)
+	pub.publish("r/1", "retained", 0, true)
+	waitFor(t, func() bool {
+		retained, _ := server.Retained("r/1")
+		return len(retained) == 1
+	})
+
+	c := dialSSE(t, ts.URL+"/subscribe?filter=r/%23&retained=true")
+	assert.Equal(t, http.StatusOK, c.resp.StatusCode)
+	assert.Equal(t, "text/event-stream", c.resp.Header.Get("Content-Type"))
+	assert.Equal(t, MessageEvent{Topic: "r/1", Retain: true, Payload: []byte("retained")}, c.next())
+
+	pub.publish("r/2", "live", 1, false)
+	assert.Equal(t, MessageEvent{Topic: "r/2", Payload: []byte("live")}, c.next())
+
+	// the subscriber is gone with the request, nothing is stored for it
+	c.resp.Body.Close()
+	waitFor(t, func() bool {
+		l, _ := server.subscribers("r/2", 0)
+		server.RLock()
+		defer server.RUnlock()
+		return l.Len() == 0 && len(server.deliverers) == 0
+	})
+
+	resp, err := http.Get(ts.URL + "/subscribe?filter=a/%23/b")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestHTTPBridgeAuthorizer(t *testing.T) {
+	opts := NewOptions()
+	opts.Authorizer = testAuthorizer{"svc": "secret"}
+	server := newServer(opts, newMemoryStore())
+	ts := httptest.NewServer(server.HTTPBridgeHandler())
+	defer ts.Close()
+
+	assert.Equal(t, http.StatusUnauthorized, httpPost(t, ts.URL+"/publish?topic=svc/a", "", "x"))
+	req, _ := http.NewRequest("POST", ts.URL+"/publish?topic=svc/a", nil)
+	req.SetBasicAuth("svc", "wrong")
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		assert.Equal(t, `Basic realm="mqtt"`, resp.Header.Get("WWW-Authenticate"))
+	}
+
+	assert.Equal(t, http.StatusForbidden, httpPost(t, ts.URL+"/publish?topic=other/a", "svc", "x"))
+	assert.Equal(t, http.StatusNoContent, httpPost(t, ts.URL+"/publish?topic=svc/a", "svc", "x"))
+
+	req, _ = http.NewRequest("GET", ts.URL+"/subscribe?filter=other/%23", nil)
+	req.SetBasicAuth("svc", "secret")
+	resp, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestHTTPBridgeLimits(t *testing.T) {
+	opts := NewOptions()
+	opts.Authorizer = testAuthorizer{"svc": "secret"}
+	opts.Policy = &Policy{MaxTopicLevels: 2}
+	opts.BanFailures = 2
+	opts.BanDuration = time.Minute
+	server := newServer(opts, newMemoryStore())
+	ts := httptest.NewServer(server.HTTPBridgeHandler())
+	defer ts.Close()
+
+	// the policy of the server, or of the sniffing listener serving the request
+	assert.Equal(t, http.StatusForbidden, httpPost(t, ts.URL+"/publish?topic=svc/a/b", "svc", "x"))
+	addr := serveTestListener(t, server, &ListenerOptions{
+		HTTPHandler: server.HTTPBridgeHandler(),
+		Policy:      &Policy{MaxTopicLevels: 3},
+	})
+	assert.Equal(t, http.StatusNoContent, httpPost(t, "http://"+addr+"/publish?topic=svc/a/b", "svc", "x"))
+	assert.Equal(t, http.StatusForbidden, httpPost(t, "http://"+addr+"/publish?topic=svc/a/b/c", "svc", "x"))
+	req, _ := http.NewRequest("GET", ts.URL+"/subscribe?filter=svc/a/%23", nil)
+	req.SetBasicAuth("svc", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+
+	// a banned address is refused with good credentials too
+	assert.Equal(t, http.StatusUnauthorized, httpPost(t, ts.URL+"/publish?topic=svc/a", "", "x"))
+	assert.Equal(t, http.StatusUnauthorized, httpPost(t, ts.URL+"/publish?topic=svc/a", "", "x"))
+	assert.Equal(t, http.StatusForbidden, httpPost(t, ts.URL+"/publish?topic=svc/a", "svc", "x"))
+	assert.Equal(t, int64(1), server.Stats().Rejected.Banned)
+}
+
+func TestHTTPBridgePolicy(t *testing.T) {
+	opts := NewOptions()
+	opts.Policy = &Policy{DenyAnonymous: true, DenyWildcards: true, MaxSubscriptions: 1}
+	server := newServer(opts, newMemoryStore())
+	ts := httptest.NewServer(server.HTTPBridgeHandler())
+	defer ts.Close()
+
+	subscribe := func(user, filter string) int {
+		req, _ := http.NewRequest("GET", ts.URL+"/subscribe?filter="+filter, nil)
+		if user != "" {
+			req.SetBasicAuth(user, "secret")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// refused like a client without a user name
+	assert.Equal(t, http.StatusUnauthorized, httpPost(t, ts.URL+"/publish?topic=a", "", "x"))
+	assert.Equal(t, http.StatusUnauthorized, subscribe("", "a"))
+	assert.Equal(t, http.StatusNoContent, httpPost(t, ts.URL+"/publish?topic=a", "svc", "x"))
+
+	// the filters with wildcards are refused
+	assert.Equal(t, http.StatusForbidden, subscribe("svc", "%23"))
+	assert.Equal(t, http.StatusForbidden, subscribe("svc", "a/%2B"))
+
+	// a stream is a single subscription, within the limit of one
+	assert.Equal(t, http.StatusOK, subscribe("svc", "a"))
+}
+
+func TestAuthorizer(t *testing.T) {
+	opts := NewOptions()
+	opts.Authorizer = testAuthorizer{"svc": "secret", "root": "secret"}
+	server := newServer(opts, newMemoryStore())
+	addr := serveTestServer(t, server)
+
+	assert.Equal(t, byte(packets.ErrRefusedBadUsernameOrPassword), connackCode(t, addr, testConnect("anonymous", true, 30)))
+	assert.Equal(t, byte(packets.ErrRefusedBadUsernameOrPassword), connackCode(t, addr, userLogin("svc", "svc", "wrong")))
+	will := userLogin("svc", "svc", "secret")
+	will.WillFlag = true
+	will.WillTopic = "other/status"
+	assert.Equal(t, byte(packets.ErrRefusedNotAuthorised), connackCode(t, addr, will))
+
+	root := connectTestClient(t, addr, userLogin("root", "root", "secret"))
+	root.subscribe("#", 0)
+	svc := connectTestClient(t, addr, userLogin("svc", "svc", "secret"))
+
+	// a subscription is refused, a message acknowledged and dropped
+	p := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	p.MessageID = svc.nextId()
+	p.Topics = []string{"svc/#", "other/#"}
+	p.Qoss = []byte{1, 1}
+	svc.write(p)
+	assert.Equal(t, []byte{1, 0x80}, svc.read().(*packets.SubackPacket).GrantedQoss)
+	svc.publish("other/a", "denied", 1, false)
+	svc.publish("svc/a", "allowed", 0, false)
+	assert.Equal(t, "svc/a", root.receive().TopicName)
+	assert.Equal(t, "allowed", string(svc.receive().Payload))
+}
@@ -0,0 +1,327 @@
+package mqtt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+)
+
+// the first byte of an encrypted value, a stored packet starts with its fixed header
+// and no packet type 14 (DISCONNECT) with flags is ever stored.
+const sealedMagic = 0xE5
+
+// the id of the key entry of the names in the store keys
+const IndexKeyId = "index"
+
+// Keyring encrypts the packets written by the stores with AES-GCM.
+//
+// The keys are given as "<id>:<base64 key>" entries separated by newlines or commas,
+// the key is 16, 24 or 32 bytes for AES-128, AES-192 or AES-256. The first entry
+// is the primary key used to encrypt, the others only decrypt the values written
+// before a rotation, until the store is re-encrypted with ReencryptStore.
+//
+// Each value is sealed in an envelope of the magic byte, the key id, the nonce and the
+// ciphertext. The values written without a keyring are still read.
+//
+// The names in the store keys, the client ids, the subscription filters and the retained
+// topics, are encrypted with the key of the "index" entry, which is required. A name is
+// always encrypted the same way to be found again, so the index key is never rotated.
+// A store created with a keyring is marked as encrypted, it's refused without a keyring,
+// and a clear store is refused with one: it's encrypted by migrating it to a new store.
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+	// encrypts the names, with a nonce derived from the name by nonces
+	index  cipher.AEAD
+	nonces []byte
+}
+
+// ParseKeyring parses the key entries, see Keyring.
+func ParseKeyring(s string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	entries := strings.FieldsFunc(s, func(r rune) bool {
+		return r == '\n' || r == ','
+	})
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		i := strings.Index(entry, ":")
+		if i <= 0 || i > 255 {
+			return nil, fmt.Errorf("key entry must be <id>:<base64 key>")
+		}
+		id := entry[:i]
+		if _, ok := k.keys[id]; ok || id == IndexKeyId && k.index != nil {
+			return nil, fmt.Errorf("key %q duplicated", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(entry[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", id, err)
+		}
+		if id == IndexKeyId {
+			if len(key) < 16 {
+				return nil, fmt.Errorf("key %q shorter than 16 bytes", id)
+			}
+			// the names are not encrypted with the index key itself, but with keys derived from it
+			key, k.nonces = deriveKey(key, "name key"), deriveKey(key, "name nonce")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if id == IndexKeyId {
+			k.index = aead
+			continue
+		}
+		k.keys[id] = aead
+		if k.primary == "" {
+			k.primary = id
+		}
+	}
+	if k.primary == "" {
+		return nil, ErrNoStoreKey
+	}
+	if k.index == nil {
+		return nil, ErrNoIndexKey
+	}
+	return k, nil
+}
+
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// LoadKeyring reads the key entries from a file.
+func LoadKeyring(file string) (*Keyring, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyring(string(b))
+}
+
+// NewKeyEntry generates a random AES-256 key entry with the id, ie: to rotate the keys,
+// or the index key with IndexKeyId.
+func NewKeyEntry(id string) (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(key), nil
+}
+
+// a store marked as encrypted when it's created with a keyring, its names can't be read
+// with no keyring, and its clear names can't be read with one.
+type encryptionMarker interface {
+	// whether the store is marked, and whether it's empty
+	encrypted() (marked, empty bool, err error)
+	markEncrypted() error
+}
+
+// refuse a store opened with a keyring if it's not marked as encrypted, or the reverse,
+// an empty store opened with a keyring is marked.
+func checkEncrypted(store encryptionMarker, keys *Keyring) error {
+	marked, empty, err := store.encrypted()
+	switch {
+	case err != nil:
+		return err
+	case keys == nil && marked:
+		return ErrNoStoreKey
+	case keys != nil && !marked && empty:
+		return store.markEncrypted()
+	case keys != nil && !marked:
+		return ErrStoreNotEncrypted
+	}
+	return nil
+}
+
+// the keyring of the store options, from StoreKeyFile or StoreKeyEnv.
+func storeKeyring(opts *Options) (*Keyring, error) {
+	switch {
+	case opts.StoreKeyFile != "":
+		return LoadKeyring(opts.StoreKeyFile)
+	case opts.StoreKeyEnv != "":
+		s, ok := os.LookupEnv(opts.StoreKeyEnv)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %v not set", opts.StoreKeyEnv)
+		}
+		return ParseKeyring(s)
+	}
+	return nil, nil
+}
+
+// Primary returns the id of the key used to encrypt.
+func (this *Keyring) Primary() string {
+	return this.primary
+}
+
+// encrypt the value with the primary key, a nil keyring keeps it clear.
+func (this *Keyring) seal(value []byte) []byte {
+	if this == nil {
+		return value
+	}
+	aead := this.keys[this.primary]
+	out := make([]byte, 0, 2+len(this.primary)+aead.NonceSize()+len(value)+aead.Overhead())
+	out = append(out, sealedMagic, byte(len(this.primary)))
+	out = append(out, this.primary...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		// the system random source never fails on the supported platforms
+		panic(err)
+	}
+	out = append(out, nonce...)
+	// the header is authenticated with the value
+	return aead.Seal(out, nonce, value, out[:2+len(this.primary)])
+}
+
+// decrypt the value if it's encrypted.
+func (this *Keyring) open(value []byte) ([]byte, error) {
+	if len(value) == 0 || value[0] != sealedMagic {
+		return value, nil
+	}
+	if this == nil {
+		return nil, ErrNoStoreKey
+	}
+	if len(value) < 2 || len(value) < 2+int(value[1]) {
+		return nil, ErrCorruptValue
+	}
+	header := value[:2+int(value[1])]
+	aead, ok := this.keys[string(header[2:])]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownStoreKey, header[2:])
+	}
+	rest := value[len(header):]
+	if len(rest) < aead.NonceSize() {
+		return nil, ErrCorruptValue
+	}
+	clear, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+	if err != nil {
+		return nil, ErrCorruptValue
+	}
+	return clear, nil
+}
+
+// encrypt a name of the store keys, a nil keyring keeps it clear. The nonce is derived
+// from the name, so the same name is always the same key, and the encrypted names have
+// no ':' or '%'.
+func (this *Keyring) hide(name string) string {
+	if this == nil {
+		return name
+	}
+	nonce := deriveKey(this.nonces, name)[:this.index.NonceSize()]
+	return base64.RawURLEncoding.EncodeToString(this.index.Seal(nonce, nonce, []byte(name), nil))
+}
+
+// decrypt a name of the store keys.
+func (this *Keyring) reveal(hidden string) (string, error) {
+	if this == nil {
+		return hidden, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(hidden)
+	if err != nil || len(b) < this.index.NonceSize() {
+		return "", ErrCorruptValue
+	}
+	name, err := this.index.Open(nil, b[:this.index.NonceSize()], b[this.index.NonceSize():], nil)
+	if err != nil {
+		return "", ErrCorruptValue
+	}
+	return string(name), nil
+}
+
+// marshal a packet to be stored.
+func (this *Keyring) marshal(p packets.ControlPacket) []byte {
+	return this.seal(MarshalPacket(p))
+}
+
+// decode a stored packet.
+func (this *Keyring) decode(value []byte) (packets.ControlPacket, error) {
+	value, err := this.open(value)
+	if err != nil {
+		return nil, err
+	}
+	return decodePacket(value)
+}
+
+// decode a stored message, ie: a retained message.
+func (this *Keyring) decodePublish(value []byte) (*packets.PublishPacket, error) {
+	value, err := this.open(value)
+	if err != nil {
+		return nil, err
+	}
+	return decodePublish(value)
+}
+
+// ReencryptStore rewrites the retained messages, the wills and the session packets with the
+// primary key of the store, returns the count rewritten. The broker must be stopped.
+// The names are kept, they're encrypted with the index key.
+func ReencryptStore(store Store) (count int, err error) {
+	var retained []*packets.PublishPacket
+	if err = store.LookupRetained(func(p *packets.PublishPacket) {
+		retained = append(retained, p)
+	}); err != nil {
+		return
+	}
+	for _, p := range retained {
+		if err = store.StoreRetained(p); err != nil {
+			return
+		}
+		count++
+	}
+
+	type will struct {
+		cid string
+		p   *packets.PublishPacket
+	}
+	var wills []will
+	if err = store.LookupWills(func(cid string, p *packets.PublishPacket) {
+		wills = append(wills, will{cid, p})
+	}); err != nil {
+		return
+	}
+	for _, w := range wills {
+		if err = store.StoreWill(w.cid, w.p); err != nil {
+			return
+		}
+		count++
+	}
+
+	type storedPacket struct {
+		cid     string
+		inbound bool
+		p       packets.ControlPacket
+	}
+	var l []storedPacket
+	if err = store.LookupPackets(func(cid string, inbound bool, p packets.ControlPacket) {
+		l = append(l, storedPacket{cid, inbound, p})
+	}); err != nil {
+		return
+	}
+	// the outbound packets replace themselves in place, the order is kept
+	for _, sp := range l {
+		if sp.inbound {
+			err = store.StoreInboundPacket(sp.cid, sp.p)
+		} else {
+			err = store.StoreOutboundPacket(sp.cid, sp.p)
+		}
+		if err != nil {
+			return
+		}
+		count++
+	}
+	return
+}
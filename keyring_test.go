@@ -0,0 +1,209 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+// the index key of the test keyrings, it's never rotated
+var testIndexEntry = IndexKeyId + ":AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+
+func newTestKeyring(t *testing.T, ids ...string) (*Keyring, []string) {
+	var entries []string
+	for _, id := range ids {
+		entry, err := NewKeyEntry(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	keys, err := ParseKeyring(strings.Join(append(entries, testIndexEntry), "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys, entries
+}
+
+func TestParseKeyring(t *testing.T) {
+	keys, err := ParseKeyring("# rotated on monday\nindex:AAAAAAAAAAAAAAAAAAAAAA==, k2:AAAAAAAAAAAAAAAAAAAAAA==, k1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+	assert.NoError(t, err)
+	assert.Equal(t, "k2", keys.Primary())
+
+	for _, s := range []string{"", "# nothing", "nokey", ":AAAA", "k1:!!", "k1:AAAA", "k1:AAAAAAAAAAAAAAAAAAAAAA==,k1:AAAAAAAAAAAAAAAAAAAAAA==",
+		// the index key is required, it encrypts nothing else
+		"k1:AAAAAAAAAAAAAAAAAAAAAA==", "index:AAAAAAAAAAAAAAAAAAAAAA==", "k1:AAAAAAAAAAAAAAAAAAAAAA==,index:AAAA"} {
+		_, err := ParseKeyring(s)
+		assert.Error(t, err, s)
+	}
+	_, err = ParseKeyring("k1:AAAAAAAAAAAAAAAAAAAAAA==")
+	assert.Equal(t, ErrNoIndexKey, err)
+}
+
+func TestKeyringHide(t *testing.T) {
+	keys, _ := newTestKeyring(t, "k1")
+	hidden := keys.hide("patients/1")
+	assert.NotContains(t, hidden, "patients")
+	assert.Equal(t, hidden, keys.hide("patients/1"), "found again")
+	assert.NotEqual(t, hidden, keys.hide("patients/2"))
+	assert.NotContains(t, hidden, ":")
+	assert.NotContains(t, hidden, "%")
+
+	// the same names after a rotation
+	rotated, _ := newTestKeyring(t, "k2", "k1")
+	assert.Equal(t, hidden, rotated.hide("patients/1"))
+	name, err := rotated.reveal(hidden)
+	assert.NoError(t, err)
+	assert.Equal(t, "patients/1", name)
+
+	_, err = keys.reveal("patients/1")
+	assert.Equal(t, ErrCorruptValue, err)
+	other, err := ParseKeyring("k1:AAAAAAAAAAAAAAAAAAAAAA==,index:AAAAAAAAAAAAAAAAAAAAAA==")
+	assert.NoError(t, err)
+	_, err = other.reveal(hidden)
+	assert.Equal(t, ErrCorruptValue, err)
+}
+
+func TestKeyringSeal(t *testing.T) {
+	keys, _ := newTestKeyring(t, "k1")
+	sealed := keys.seal([]byte("secret"))
+	assert.False(t, bytes.Contains(sealed, []byte("secret")))
+	assert.NotEqual(t, sealed, keys.seal([]byte("secret")), "a nonce per value")
+
+	clear, err := keys.open(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", string(clear))
+
+	// the clear values are still read
+	clear, err = keys.open([]byte{0x30, 0x00})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x30, 0x00}, clear)
+
+	// tampered, or with the key missing
+	sealed[len(sealed)-1] ^= 1
+	_, err = keys.open(sealed)
+	assert.Equal(t, ErrCorruptValue, err)
+	_, err = (*Keyring)(nil).open(sealed)
+	assert.Equal(t, ErrNoStoreKey, err)
+	other, _ := newTestKeyring(t, "k2")
+	_, err = other.open(keys.seal([]byte("secret")))
+	assert.True(t, errors.Is(err, ErrUnknownStoreKey))
+}
+
+func TestReencryptStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	store, err := newLevelStore(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		store.Close()
+	}()
+	old, entries := newTestKeyring(t, "k1")
+	store.keys = old
+
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = "patients/1"
+	p.Qos = 1
+	p.Retain = true
+	p.MessageID = 1
+	p.Payload = []byte("heart rate 72")
+	assert.NoError(t, store.StoreRetained(p))
+	assert.NoError(t, store.StoreOutboundPacket("device-17", p))
+	assert.NoError(t, store.StoreSubscription("patients/#", "device-17", 1))
+	for _, s := range []string{"heart rate", "patients", "device-17"} {
+		assert.False(t, levelContains(store, s), s)
+	}
+
+	// rotate: the new primary key first, the old one still reads
+	_, newEntries := newTestKeyring(t, "k2")
+	rotated, err := ParseKeyring(newEntries[0] + "\n" + entries[0] + "\n" + testIndexEntry)
+	assert.NoError(t, err)
+	store.keys = rotated
+	count, err := ReencryptStore(store)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// the old key can be dropped after the re-encryption
+	store.keys, err = ParseKeyring(newEntries[0] + "\n" + testIndexEntry)
+	assert.NoError(t, err)
+	var payloads []string
+	assert.NoError(t, store.LookupRetained(func(p *packets.PublishPacket) {
+		payloads = append(payloads, p.TopicName+" "+string(p.Payload))
+	}))
+	assert.NoError(t, store.StreamOfflinePackets("device-17", func(cp packets.ControlPacket) {
+		payloads = append(payloads, string(cp.(*packets.PublishPacket).Payload))
+	}))
+	assert.NoError(t, store.LookupSubscriptions(func(filter, cid string, qos byte) {
+		payloads = append(payloads, cid+" "+filter)
+	}))
+	assert.Equal(t, []string{"patients/1 heart rate 72", "heart rate 72", "device-17 patients/#"}, payloads)
+
+	// without the keys the values are not readable
+	store.keys = old
+	assert.True(t, errors.Is(store.LookupRetained(func(*packets.PublishPacket) {
+		t.Error("decrypted with a dropped key")
+	}), ErrUnknownStoreKey))
+}
+
+func TestStoreEncryptedMark(t *testing.T) {
+	_, entries := newTestKeyring(t, "k1")
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(keyFile, []byte(strings.Join(append(entries, testIndexEntry), "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	open := func(backend, path string, encrypted bool) (Store, error) {
+		opts := &Options{StoreBackend: backend, StorePath: path}
+		if encrypted {
+			opts.StoreKeyFile = keyFile
+		}
+		return OpenStore(opts)
+	}
+	for _, backend := range []string{"leveldb", "bolt", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			clear := filepath.Join(t.TempDir(), "clear.db")
+			store, err := open(backend, clear, false)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.NoError(t, store.StoreSubscription("a", "c1", 1))
+			store.(io.Closer).Close()
+			// the clear names would not be read with a keyring
+			_, err = open(backend, clear, true)
+			assert.Equal(t, ErrStoreNotEncrypted, err)
+
+			encrypted := filepath.Join(t.TempDir(), "encrypted.db")
+			store, err = open(backend, encrypted, true)
+			if !assert.NoError(t, err) {
+				return
+			}
+			store.(io.Closer).Close()
+			// marked while empty
+			_, err = open(backend, encrypted, false)
+			assert.Equal(t, ErrNoStoreKey, err)
+			store, err = open(backend, encrypted, true)
+			if assert.NoError(t, err) {
+				store.(io.Closer).Close()
+			}
+		})
+	}
+}
+
+// the keys or the values of the store contain s.
+func levelContains(store *LevelStore, s string) bool {
+	iter := store.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if bytes.Contains(iter.Key(), []byte(s)) || bytes.Contains(iter.Value(), []byte(s)) {
+			return true
+		}
+	}
+	return false
+}
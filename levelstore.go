@@ -3,163 +3,390 @@ package mqtt
 import (
 	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
 	"github.com/syndtr/goleveldb/leveldb"
+	"sort"
 	"strconv"
 	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 	"strings"
 )
 
 type LevelStore struct {
 	db *leveldb.DB
+	// encrypts the packets and the names in the keys if not nil
+	keys *Keyring
+	// the writes are synced one by one, or by the group commit if not nil
+	sync  bool
+	group *groupCommit
 }
 
 
-func newLevelStore() Store {
-	db, err := leveldb.OpenFile("store.db", nil)
+func newLevelStore(path string) (*LevelStore, error) {
+	db, err := leveldb.OpenFile(path, nil)
 //	db, err := leveldb.Open(storage.NewMemStorage(), nil)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	store := &LevelStore{
 		db:       db,
 	}
 
-	return store
+	return store, nil
 }
 
-func (this *LevelStore) StoreSubscription(filter, cid string, qos byte) {
-	key := "subscribe:" + cid + ":" + filter
-	this.db.Put([]byte(key), []byte{qos}, nil)
+// the key marking a store created with a keyring
+const levelEncryptedKey = "meta:encrypted"
+
+func (this *LevelStore) encrypted() (marked, empty bool, err error) {
+	if _, err = this.db.Get([]byte(levelEncryptedKey), nil); err == nil {
+		return true, false, nil
+	} else if err != leveldb.ErrNotFound {
+		return false, false, err
+	}
+	iter := this.db.NewIterator(nil, nil)
+	empty = !iter.Next()
+	iter.Release()
+	return false, empty, iter.Error()
 }
 
-func (this *LevelStore) DeleteSubscription(filter, cid string) {
-	key := "subscribe:" + cid + ":" + filter
-	this.db.Delete([]byte(key), nil)
+func (this *LevelStore) markEncrypted() error {
+	return this.db.Put([]byte(levelEncryptedKey), nil, syncWrite)
 }
 
-func (this *LevelStore) CleanSubscription(cid string) {
-	iter := this.db.NewIterator(util.BytesPrefix([]byte("subscribe:" + cid)), nil)
-	defer iter.Release()
+// setDurability chooses how the writes are synced, one of the Durability modes.
+func (this *LevelStore) setDurability(durability string) error {
+	switch durability {
+	case "", DurabilityNone:
+	case DurabilitySync:
+		this.sync = true
+	case DurabilityGroup:
+		this.group = newGroupCommit(this.db)
+	default:
+		return ErrUnknownDurability
+	}
+	return nil
+}
 
+func (this *LevelStore) Close() error {
+	if this.group != nil {
+		this.group.close()
+	}
+	return this.db.Close()
+}
+
+func (this *LevelStore) put(key string, value []byte) error {
+	if this.group == nil {
+		return this.db.Put([]byte(key), value, this.writeOptions())
+	}
 	b := new(leveldb.Batch)
-	for iter.Next() {
-		b.Delete(iter.Key())
+	b.Put([]byte(key), value)
+	return this.group.write(b)
+}
+
+func (this *LevelStore) delete(key string) error {
+	if this.group == nil {
+		return this.db.Delete([]byte(key), this.writeOptions())
 	}
-	this.db.Write(b, nil)
+	b := new(leveldb.Batch)
+	b.Delete([]byte(key))
+	return this.group.write(b)
 }
 
+func (this *LevelStore) write(b *leveldb.Batch) error {
+	if this.group == nil {
+		return this.db.Write(b, this.writeOptions())
+	}
+	return this.group.write(b)
+}
 
-func (this *LevelStore) LookupSubscriptions(callback func(filter, cid string, qos byte)) {
+func (this *LevelStore) writeOptions() *opt.WriteOptions {
+	if this.sync {
+		return syncWrite
+	}
+	return nil
+}
+
+func (this *LevelStore) StoreSubscription(filter, cid string, qos byte) error {
+	key := "subscribe:" + levelEscape(this.keys.hide(cid)) + ":" + this.keys.hide(filter)
+	return this.put(key, []byte{qos})
+}
+
+func (this *LevelStore) DeleteSubscription(filter, cid string) error {
+	key := "subscribe:" + levelEscape(this.keys.hide(cid)) + ":" + this.keys.hide(filter)
+	return this.delete(key)
+}
+
+func (this *LevelStore) CleanSubscription(cid string) error {
+	return this.deletePrefix("subscribe:" + levelEscape(this.keys.hide(cid)) + ":")
+}
+
+
+func (this *LevelStore) LookupSubscriptions(callback func(filter, cid string, qos byte)) error {
 	iter := this.db.NewIterator(util.BytesPrefix([]byte("subscribe")), nil)
 	defer iter.Release()
 
+	var corrupt error
 	for iter.Next() {
 		key := string(iter.Key())
 		value := iter.Value()
 		slice := strings.SplitN(key, ":", 3)
-		cid := slice[1]
-		filter := slice[2]
+		if len(slice) != 3 || len(value) != 1 {
+			corrupt = ErrCorruptValue
+			continue
+		}
+		cid, err := this.keys.reveal(levelUnescape(slice[1]))
+		if err != nil {
+			corrupt = err
+			continue
+		}
+		filter, err := this.keys.reveal(slice[2])
+		if err != nil {
+			corrupt = err
+			continue
+		}
 		qos := value[0]
 		callback(filter, cid, qos)
 	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return corrupt
 }
 
-func (this *LevelStore) StoreRetained(p *packets.PublishPacket) {
-	key := "retain:" + p.TopicName
+func (this *LevelStore) StoreRetained(p *packets.PublishPacket) error {
+	key := "retain:" + this.keys.hide(p.TopicName)
 	if len(p.Payload) == 0 {
-		this.db.Delete([]byte(key), nil)
-		return
+		return this.delete(key)
 	}
 
-	value := MarshalPacket(p)
-	this.db.Put([]byte(key), value, nil)
+	value := this.keys.marshal(p)
+	return this.put(key, value)
 }
 
-func (this *LevelStore) LookupRetained(callback func(*packets.PublishPacket)) {
+func (this *LevelStore) LookupRetained(callback func(*packets.PublishPacket)) error {
 	iter := this.db.NewIterator(util.BytesPrefix([]byte("retain")), nil)
 	defer iter.Release()
 
+	var corrupt error
 	for iter.Next() {
-		cp := UnmarshalPacket(iter.Value()).(*packets.PublishPacket)
+		cp, err := this.keys.decodePublish(iter.Value())
+		if err != nil {
+			corrupt = err
+			continue
+		}
 		callback(cp)
 	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return corrupt
 }
 
-func (this *LevelStore) FindInboundPacket(cid string, mid uint16) packets.ControlPacket {
-	key := levelPacketKey(cid, mid, true)
-	if value, err := this.db.Get([]byte(key), nil); err == nil {
-		return UnmarshalPacket(value)
+func (this *LevelStore) StoreWill(cid string, p *packets.PublishPacket) error {
+	return this.put("will:"+this.keys.hide(cid), this.keys.marshal(p))
+}
+
+func (this *LevelStore) DeleteWill(cid string) error {
+	return this.delete("will:" + this.keys.hide(cid))
+}
+
+func (this *LevelStore) LookupWills(callback func(cid string, p *packets.PublishPacket)) error {
+	type will struct {
+		cid string
+		p   *packets.PublishPacket
+	}
+	var l []will
+	var corrupt error
+	iter := this.db.NewIterator(util.BytesPrefix([]byte("will:")), nil)
+	for iter.Next() {
+		p, err := this.keys.decodePublish(iter.Value())
+		if err != nil {
+			corrupt = err
+			continue
+		}
+		cid, err := this.keys.reveal(strings.TrimPrefix(string(iter.Key()), "will:"))
+		if err != nil {
+			corrupt = err
+			continue
+		}
+		l = append(l, will{cid, p})
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
 	}
 
-	return nil
+	// the encrypted client ids are not ordered
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].cid < l[j].cid
+	})
+	for _, w := range l {
+		callback(w.cid, w.p)
+	}
+	return corrupt
+}
+
+func (this *LevelStore) FindInboundPacket(cid string, mid uint16) (packets.ControlPacket, error) {
+	key := levelPacketKey(this.keys.hide(cid), mid, true)
+	value, err := this.db.Get([]byte(key), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return this.keys.decode(value)
 }
 
 func (this *LevelStore) StoreInboundPacket(cid string, p packets.ControlPacket) error {
-	key := levelPacketKey(cid, p.Details().MessageID, true)
-	value := MarshalPacket(p)
-	return this.db.Put([]byte(key), value, nil)
+	key := levelPacketKey(this.keys.hide(cid), p.Details().MessageID, true)
+	value := this.keys.marshal(p)
+	return this.put(key, value)
 }
 
 func (this *LevelStore) StoreOutboundPacket(cid string, p packets.ControlPacket) error {
-	key := levelPacketKey(cid, p.Details().MessageID, false)
-	value := MarshalPacket(p)
-	return this.db.Put([]byte(key), value, nil)
+	key := levelPacketKey(this.keys.hide(cid), p.Details().MessageID, false)
+	value := this.keys.marshal(p)
+	return this.put(key, value)
 }
 
-func (this *LevelStore) StreamOfflinePackets(cid string, callback func(packets.ControlPacket)) {
-	iter := this.db.NewIterator(util.BytesPrefix([]byte("packets:out:" + cid)), nil)
-	defer iter.Release()
-
+func (this *LevelStore) StreamOfflinePackets(cid string, callback func(packets.ControlPacket)) error {
+	iter := this.db.NewIterator(util.BytesPrefix([]byte("packets:out:" + levelEscape(this.keys.hide(cid)) + ":")), nil)
+	var l []packets.ControlPacket
+	var corrupt error
 	for iter.Next() {
-		cp := UnmarshalPacket(iter.Value())
+		cp, err := this.keys.decode(iter.Value())
+		if err != nil {
+			corrupt = err
+			continue
+		}
+		l = append(l, cp)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	// the keys are ordered as strings, "10" is before "2"
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Details().MessageID < l[j].Details().MessageID
+	})
+	for _, cp := range l {
 		callback(cp)
 	}
+	return corrupt
 }
 
-func (this *LevelStore) DeleteInboundPacket(cid string, mid uint16) {
-	this.db.Delete([]byte(levelPacketKey(cid, mid, true)), nil)
-}
+func (this *LevelStore) LookupPackets(callback func(cid string, inbound bool, p packets.ControlPacket)) error {
+	type storedPacket struct {
+		cid     string
+		inbound bool
+		p       packets.ControlPacket
+	}
+	// decode all packets first, the callback may write to the store
+	var l []storedPacket
+	var corrupt error
+	for _, direction := range []string{"in", "out"} {
+		iter := this.db.NewIterator(util.BytesPrefix([]byte("packets:"+direction+":")), nil)
+		for iter.Next() {
+			key := strings.TrimPrefix(string(iter.Key()), "packets:"+direction+":")
+			i := strings.LastIndex(key, ":")
+			if i < 0 {
+				corrupt = ErrCorruptValue
+				continue
+			}
+			cid, err := this.keys.reveal(levelUnescape(key[:i]))
+			if err != nil {
+				corrupt = err
+				continue
+			}
+			cp, err := this.keys.decode(iter.Value())
+			if err != nil {
+				corrupt = err
+				continue
+			}
+			l = append(l, storedPacket{cid, direction == "in", cp})
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+	}
 
-func (this *LevelStore) DeleteOutboundPacket(cid string, mid uint16) {
-	this.db.Delete([]byte(levelPacketKey(cid, mid, false)), nil)
+	sort.SliceStable(l, func(i, j int) bool {
+		a, b := l[i], l[j]
+		if a.cid != b.cid {
+			return a.cid < b.cid
+		}
+		if a.inbound != b.inbound {
+			return a.inbound
+		}
+		return a.p.Details().MessageID < b.p.Details().MessageID
+	})
+	for _, sp := range l {
+		callback(sp.cid, sp.inbound, sp.p)
+	}
+	return corrupt
 }
 
-
-func (this *LevelStore) CleanPackets(cid string) {
+// writeOutbound writes the packets in one batch.
+func (this *LevelStore) writeOutbound(writes []outboundWrite) error {
 	b := new(leveldb.Batch)
-	iter := this.db.NewIterator(util.BytesPrefix([]byte("packets:in:" + cid)), nil)
-	for iter.Next() {
-		b.Delete(iter.Key())
+	for _, w := range writes {
+		key := []byte(levelPacketKey(this.keys.hide(w.cid), w.mid, false))
+		if w.p == nil {
+			b.Delete(key)
+		} else {
+			b.Put(key, this.keys.marshal(w.p))
+		}
 	}
-	iter.Release()
+	return this.write(b)
+}
 
-	iter = this.db.NewIterator(util.BytesPrefix([]byte("packets:out:" + cid)), nil)
-	for iter.Next() {
-		b.Delete(iter.Key())
+func (this *LevelStore) DeleteInboundPacket(cid string, mid uint16) error {
+	return this.delete(levelPacketKey(this.keys.hide(cid), mid, true))
+}
+
+func (this *LevelStore) DeleteOutboundPacket(cid string, mid uint16) error {
+	return this.delete(levelPacketKey(this.keys.hide(cid), mid, false))
+}
+
+
+func (this *LevelStore) CleanPackets(cid string) error {
+	if err := this.deletePrefix("packets:in:" + levelEscape(this.keys.hide(cid)) + ":"); err != nil {
+		return err
 	}
-	iter.Release()
+	return this.deletePrefix("packets:out:" + levelEscape(this.keys.hide(cid)) + ":")
+}
 
-	this.db.Write(b, nil)
+func (this *LevelStore) InPacketsSize() (int, error) {
+	return this.count("packets:in")
 }
 
-func (this *LevelStore) InPacketsSize() int {
-	iter := this.db.NewIterator(util.BytesPrefix([]byte("packets:in")), nil)
+func (this *LevelStore) OutPacketsSize() (int, error) {
+	return this.count("packets:out")
+}
+
+func (this *LevelStore) count(prefix string) (int, error) {
+	iter := this.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
 	count := 0
 	for iter.Next() {
 		count++
 	}
 	iter.Release()
-	return count
+	return count, iter.Error()
 }
 
-func (this *LevelStore) OutPacketsSize() int {
-	iter := this.db.NewIterator(util.BytesPrefix([]byte("packets:out")), nil)
-	count := 0
+func (this *LevelStore) deletePrefix(prefix string) error {
+	iter := this.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	b := new(leveldb.Batch)
 	for iter.Next() {
-		count++
+		b.Delete(iter.Key())
 	}
 	iter.Release()
-	return count
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return this.write(b)
 }
 
 
@@ -170,5 +397,20 @@ func levelPacketKey(cid string, mid uint16, in bool) string {
 		direction = "in"
 	}
 
-	return "packets:" + direction + ":" + cid + ":" + strconv.Itoa(int(mid))
+	return "packets:" + direction + ":" + levelEscape(cid) + ":" + strconv.Itoa(int(mid))
+}
+
+// the client ids in the keys have no ':', the separator of the keys, "a:b" is "a%3Ab".
+// The ids without ':' or '%' are kept as they are, as the encrypted ones.
+var (
+	levelEscaper   = strings.NewReplacer("%", "%25", ":", "%3A")
+	levelUnescaper = strings.NewReplacer("%25", "%", "%3A", ":")
+)
+
+func levelEscape(cid string) string {
+	return levelEscaper.Replace(cid)
+}
+
+func levelUnescape(cid string) string {
+	return levelUnescaper.Replace(cid)
 }
@@ -0,0 +1,283 @@
+package mqtt
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the source addresses idle for longer are forgotten, their buckets are full again.
+const limitsIdle = 10 * time.Minute
+
+// the reasons a connection is refused when it's accepted
+const (
+	RejectMaxConnections = "max_connections"
+	RejectRateLimited    = "rate_limited"
+	RejectBanned         = "banned"
+	RejectDenied         = "denied"
+)
+
+// RejectStats counts the connections refused by reason.
+type RejectStats struct {
+	MaxConnections int64 `json:"max_connections"`
+	RateLimited    int64 `json:"rate_limited"`
+	Banned         int64 `json:"banned"`
+	Denied         int64 `json:"denied"`
+}
+
+// the allowed and denied networks of the source addresses, a denied network wins.
+type netList struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// parse the CIDR lists, a single address is a network of its own.
+func parseNetList(allow, deny []string) (*netList, error) {
+	l := new(netList)
+	var err error
+	if l.allow, err = parseNets(allow); err != nil {
+		return nil, err
+	}
+	if l.deny, err = parseNets(deny); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func parseNets(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "CIDR address", Text: s}
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			s += "/" + strconv.Itoa(bits)
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (this *netList) permits(ip net.IP) bool {
+	for _, n := range this.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(this.allow) == 0 {
+		return true
+	}
+	for _, n := range this.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// the connect rate and the failures of a source address.
+type source struct {
+	tokens   float64
+	last     time.Time
+	failures int
+	banned   time.Time
+}
+
+// limits of the connections accepted by all the listeners of a server.
+type limits struct {
+	sync.Mutex
+	conns   int32
+	sources map[string]*source
+	pruned  time.Time
+
+	rejected RejectStats
+}
+
+func newLimits() *limits {
+	return &limits{sources: make(map[string]*source)}
+}
+
+// the source of the address, the caller holds the lock.
+func (this *limits) source(ip string, now time.Time, burst float64) *source {
+	if now.Sub(this.pruned) > limitsIdle {
+		for k, s := range this.sources {
+			if now.Sub(s.last) > limitsIdle && now.After(s.banned) {
+				delete(this.sources, k)
+			}
+		}
+		this.pruned = now
+	}
+	s, ok := this.sources[ip]
+	if !ok {
+		s = &source{tokens: burst, last: now}
+		this.sources[ip] = s
+	}
+	return s
+}
+
+func (this *limits) reject(reason string) string {
+	switch reason {
+	case RejectMaxConnections:
+		atomic.AddInt64(&this.rejected.MaxConnections, 1)
+	case RejectRateLimited:
+		atomic.AddInt64(&this.rejected.RateLimited, 1)
+	case RejectBanned:
+		atomic.AddInt64(&this.rejected.Banned, 1)
+	case RejectDenied:
+		atomic.AddInt64(&this.rejected.Denied, 1)
+	}
+	return reason
+}
+
+func (this *limits) stats() RejectStats {
+	return RejectStats{
+		MaxConnections: atomic.LoadInt64(&this.rejected.MaxConnections),
+		RateLimited:    atomic.LoadInt64(&this.rejected.RateLimited),
+		Banned:         atomic.LoadInt64(&this.rejected.Banned),
+		Denied:         atomic.LoadInt64(&this.rejected.Denied),
+	}
+}
+
+// admit a connection accepted by the listener, returns the reason it's refused if not.
+// An admitted connection is released once it's closed.
+func (this *Server) admit(l *listener, addr net.Addr) (reason string) {
+	ip := addrIP(addr)
+	if ip != nil {
+		for _, nets := range l.nets {
+			if !nets.permits(ip) {
+				return this.limits.reject(RejectDenied)
+			}
+		}
+	}
+
+	if ip != nil && (this.opts.ConnectRate > 0 || this.opts.BanFailures > 0) {
+		now := time.Now()
+		burst := this.connectBurst()
+		this.limits.Lock()
+		s := this.limits.source(ip.String(), now, burst)
+		if now.Before(s.banned) {
+			this.limits.Unlock()
+			return this.limits.reject(RejectBanned)
+		}
+		if this.opts.ConnectRate > 0 {
+			s.tokens += now.Sub(s.last).Seconds() * this.opts.ConnectRate
+			if s.tokens > burst {
+				s.tokens = burst
+			}
+			if s.tokens < 1 {
+				s.last = now
+				this.limits.Unlock()
+				return this.limits.reject(RejectRateLimited)
+			}
+			s.tokens--
+		}
+		s.last = now
+		this.limits.Unlock()
+	}
+
+	if n := atomic.AddInt32(&this.limits.conns, 1); this.opts.MaxConnections > 0 && int(n) > this.opts.MaxConnections {
+		atomic.AddInt32(&this.limits.conns, -1)
+		return this.limits.reject(RejectMaxConnections)
+	}
+	if n := atomic.AddInt32(&l.conns, 1); l.max > 0 && int(n) > l.max {
+		atomic.AddInt32(&l.conns, -1)
+		atomic.AddInt32(&this.limits.conns, -1)
+		return this.limits.reject(RejectMaxConnections)
+	}
+	return ""
+}
+
+// the connects accepted at once from a source address.
+func (this *Server) connectBurst() float64 {
+	if this.opts.ConnectBurst < 1 {
+		return 1
+	}
+	return float64(this.opts.ConnectBurst)
+}
+
+// release an admitted connection of the listener.
+func (this *Server) release(l *listener) {
+	atomic.AddInt32(&l.conns, -1)
+	atomic.AddInt32(&this.limits.conns, -1)
+}
+
+// whether the source address is banned for its connect failures, the refusal is counted.
+func (this *Server) banned(address string) bool {
+	ip := hostIP(address)
+	if ip == nil || this.opts.BanFailures <= 0 {
+		return false
+	}
+	this.limits.Lock()
+	s, ok := this.limits.sources[ip.String()]
+	banned := ok && time.Now().Before(s.banned)
+	this.limits.Unlock()
+	if banned {
+		this.limits.reject(RejectBanned)
+	}
+	return banned
+}
+
+// record a connect refused for its credentials, the source is banned after too many.
+func (this *Server) authFailed(address string) {
+	ip := hostIP(address)
+	if ip == nil || this.opts.BanFailures <= 0 {
+		return
+	}
+	now := time.Now()
+	this.limits.Lock()
+	defer this.limits.Unlock()
+	s := this.limits.source(ip.String(), now, this.connectBurst())
+	s.last = now
+	if s.failures++; s.failures >= this.opts.BanFailures {
+		s.failures = 0
+		s.banned = now.Add(this.opts.BanDuration)
+		log.Warnf("%v banned for %v after %v connect failures", ip, this.opts.BanDuration, this.opts.BanFailures)
+	}
+}
+
+// record a connect accepted, the failures of the source are forgotten.
+func (this *Server) authSucceeded(address string) {
+	ip := hostIP(address)
+	if ip == nil || this.opts.BanFailures <= 0 {
+		return
+	}
+	this.limits.Lock()
+	defer this.limits.Unlock()
+	if s, ok := this.limits.sources[ip.String()]; ok {
+		s.failures = 0
+	}
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	if addr == nil {
+		return nil
+	}
+	return hostIP(addr.String())
+}
+
+// the ip of a host:port address, nil if it's not an ip address.
+func hostIP(address string) net.IP {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	return net.ParseIP(host)
+}
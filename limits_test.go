@@ -0,0 +1,109 @@
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+// the connection is closed by the server before the connack.
+func assertRefused(t *testing.T, addr string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testConnect("c", true, 30).Write(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := packets.ReadPacket(conn)
+	assert.Error(t, err, "connection closed expected, got %v", p)
+}
+
+func TestNetList(t *testing.T) {
+	l, err := parseNetList([]string{"10.0.0.0/8", "::1"}, []string{"10.1.0.0/16"})
+	assert.NoError(t, err)
+	assert.True(t, l.permits(net.ParseIP("10.2.3.4")))
+	assert.True(t, l.permits(net.ParseIP("::1")))
+	assert.False(t, l.permits(net.ParseIP("10.1.2.3")))
+	assert.False(t, l.permits(net.ParseIP("192.168.1.1")))
+
+	l, _ = parseNetList(nil, []string{"192.168.1.1"})
+	assert.True(t, l.permits(net.ParseIP("192.168.1.2")))
+	assert.False(t, l.permits(net.ParseIP("192.168.1.1")))
+
+	_, err = parseNetList([]string{"10.0.0.0/33"}, nil)
+	assert.Error(t, err)
+	_, err = parseNetList(nil, []string{"localhost"})
+	assert.Error(t, err)
+}
+
+func TestMaxConnections(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	server.opts.MaxConnections = 3
+	addr := serveTestListener(t, server, &ListenerOptions{MaxConnections: 2})
+	other := serveTestServer(t, server)
+
+	c1 := dialTestClient(t, addr, "c1", true)
+	dialTestClient(t, addr, "c2", true)
+	assertRefused(t, addr)
+
+	// the global limit counts the connections of every listener
+	dialTestClient(t, other, "c3", true)
+	assertRefused(t, other)
+	assert.Equal(t, int64(2), server.Stats().Rejected.MaxConnections)
+
+	// a closed connection is released
+	c1.conn.Close()
+	waitFor(t, func() bool {
+		return server.Stats().Connections == 2
+	})
+	dialTestClient(t, addr, "c4", true)
+}
+
+func TestConnectRate(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	server.opts.ConnectRate = 0.01
+	server.opts.ConnectBurst = 2
+	addr := serveTestServer(t, server)
+
+	dialTestClient(t, addr, "c1", true)
+	dialTestClient(t, addr, "c2", true)
+	assertRefused(t, addr)
+	assert.Equal(t, int64(1), server.Stats().Rejected.RateLimited)
+}
+
+func TestBanAfterFailures(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	server.opts.Policy = &Policy{DenyAnonymous: true}
+	server.opts.BanFailures = 2
+	server.opts.BanDuration = time.Hour
+	addr := serveTestServer(t, server)
+
+	anonymous := testConnect("c", true, 30)
+	assert.Equal(t, byte(packets.ErrRefusedNotAuthorised), connackCode(t, addr, anonymous))
+	assert.Equal(t, byte(packets.ErrRefusedNotAuthorised), connackCode(t, addr, anonymous))
+	assertRefused(t, addr)
+	assert.Equal(t, int64(1), server.Stats().Rejected.Banned)
+}
+
+func TestDenyNets(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	server.opts.AllowNets = []string{"127.0.0.0/8"}
+	denied := serveTestListener(t, server, &ListenerOptions{DenyNets: []string{"127.0.0.1"}})
+	addr := serveTestServer(t, server)
+
+	dialTestClient(t, addr, "c", true)
+	assertRefused(t, denied)
+	assert.Equal(t, int64(1), server.Stats().Rejected.Denied)
+
+	// an invalid list fails the listener
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, server.ServeListener(ln, &ListenerOptions{AllowNets: []string{"nowhere"}}))
+}
@@ -0,0 +1,179 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+)
+
+// ListenerOptions configures the clients accepted by a listener.
+type ListenerOptions struct {
+	// Policy is enforced on the clients of the listener.
+	// If not set then the Options.Policy of the server.
+	Policy *Policy
+
+	// MaxConnections is the most connections of the listener, the ones over it are closed
+	// when they're accepted. If not set then only Options.MaxConnections limits them.
+	MaxConnections int
+
+	// The source addresses of the connections, CIDR networks or single addresses, checked
+	// after the lists of the Options. See Options.AllowNets.
+	AllowNets []string
+	DenyNets  []string
+
+	// ClientQuota and UserQuota override the ones of the Options for the clients of the
+	// listener, a user connected to several listeners shares the quota of its first client.
+	// ListenerQuota limits the traffic of all the clients of the listener.
+	ClientQuota   *Quota
+	UserQuota     *Quota
+	ListenerQuota *Quota
+
+	// ProxyProtocol reads a PROXY protocol header, v1 or v2, at the start of the connections,
+	// the source address of the header is the address of the client. The connections
+	// without a valid header are closed.
+	ProxyProtocol bool
+	// ProxyNets are the CIDR networks of the proxies, the connections from the other
+	// addresses have no header. If not set then every connection has one.
+	ProxyNets []string
+
+	// TLSConfig serves the connections over TLS, after the PROXY header if any.
+	TLSConfig *tls.Config
+
+	// HTTPHandler serves MQTT, MQTT over WebSocket and HTTP on the listener. The protocol of
+	// a connection is told by its first byte, or by its ALPN protocol, ALPNMQTT or ALPNHTTP,
+	// over TLS. The WebSocket upgrades are served as MQTT clients, and the other requests
+	// by the handler. If not set then the listener serves MQTT only.
+	HTTPHandler http.Handler
+}
+
+// a listener with its limits.
+type listener struct {
+	opts  *ListenerOptions
+	nets  []*netList
+	max   int
+	conns int32
+	// the quota shared by the clients of the listener
+	quota *quotaBuckets
+	// the proxies sending a PROXY header, nil if every connection has one
+	proxies *netList
+	// the TLS config, with the ALPN protocols of a sniffing listener
+	tls *tls.Config
+	// the HTTP connections of a sniffing listener
+	http *httpConns
+}
+
+func (this *Server) newListener(opts *ListenerOptions) (*listener, error) {
+	l := &listener{opts: opts}
+	global, err := parseNetList(this.opts.AllowNets, this.opts.DenyNets)
+	if err != nil {
+		return nil, err
+	}
+	l.nets = append(l.nets, global)
+	if opts != nil {
+		own, err := parseNetList(opts.AllowNets, opts.DenyNets)
+		if err != nil {
+			return nil, err
+		}
+		l.nets = append(l.nets, own)
+		l.max = opts.MaxConnections
+		l.quota = newQuotaBuckets(opts.ListenerQuota)
+		l.tls = opts.TLSConfig
+		if l.tls != nil && opts.HTTPHandler != nil {
+			l.tls = sniffTLSConfig(l.tls)
+		}
+		if opts.ProxyProtocol && len(opts.ProxyNets) > 0 {
+			if l.proxies, err = parseNetList(opts.ProxyNets, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	quotas := []*Quota{this.opts.ClientQuota, this.opts.UserQuota}
+	if opts != nil {
+		quotas = append(quotas, opts.ClientQuota, opts.UserQuota, opts.ListenerQuota)
+	}
+	for _, q := range quotas {
+		if q == nil {
+			continue
+		}
+		switch q.Action {
+		case "", QuotaThrottle, QuotaDrop, QuotaDisconnect:
+		default:
+			return nil, ErrUnknownQuotaAction
+		}
+	}
+	return l, nil
+}
+
+// the policy of the clients of the listener, l may be nil.
+func (this *Server) listenerPolicy(l *listener) *Policy {
+	if l != nil && l.opts != nil && l.opts.Policy != nil {
+		return l.opts.Policy
+	}
+	return this.opts.Policy
+}
+
+// ServeListener accepts incoming connections on the listener with its own options,
+// the listener is closed when returns.
+func (this *Server) ServeListener(ln net.Listener, opts *ListenerOptions) error {
+	l, err := this.newListener(opts)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	if opts != nil && opts.HTTPHandler != nil {
+		l.http = newHTTPConns(ln.Addr())
+		defer l.http.Close()
+		go http.Serve(l.http, this.sniffHandler(l, opts.HTTPHandler))
+	}
+	return this.serve(ln, l)
+}
+
+// a connection has a PROXY header if it's from a proxy.
+func (this *listener) proxied(conn net.Conn) bool {
+	if this.opts == nil || !this.opts.ProxyProtocol {
+		return false
+	}
+	if this.proxies == nil {
+		return true
+	}
+	ip := addrIP(conn.RemoteAddr())
+	return ip != nil && this.proxies.permits(ip)
+}
+
+// admit an accepted connection by its source address, it's closed if refused.
+func (this *Server) admitConn(conn net.Conn, l *listener) bool {
+	if reason := this.admit(l, conn.RemoteAddr()); reason != "" {
+		log.Debugf("connection from %v refused, %v", conn.RemoteAddr(), reason)
+		conn.Close()
+		return false
+	}
+	return true
+}
+
+// serve a connection from a proxy, it's admitted by the source address of its header.
+func (this *Server) serveProxied(conn net.Conn, l *listener) {
+	pc, err := readProxyHeader(conn, this.opts.ConnectTimeout)
+	if err != nil {
+		log.Warnf("connection from %v refused, PROXY header: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	log.Debugf("connection from %v proxied by %v", pc.RemoteAddr(), conn.RemoteAddr())
+	if this.admitConn(pc, l) {
+		this.serveAdmitted(pc, l)
+	}
+}
+
+// serve an admitted connection, it's released once closed.
+func (this *Server) serveAdmitted(conn net.Conn, l *listener) {
+	if l.tls != nil {
+		// the handshake is done by the first read, within the connect timeout
+		conn = tls.Server(conn, l.tls)
+	}
+	if l.http != nil {
+		this.serveSniffed(conn, l)
+		return
+	}
+	defer this.release(l)
+	this.serveConn(conn, l)
+}
@@ -1,127 +1,503 @@
 package mqtt
 
 import (
-	"fmt"
-	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"bytes"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
 )
 
+// MemoryStore keeps everything in memory, for tests and ephemeral brokers.
+//
+// The lookups are ordered: subscriptions by client id and filter, retained messages
+// by topic, and offline packets by message id.
+// With a snapshot path it's saved to disk periodically and on Close,
+// and loaded from there when opened.
 type MemoryStore struct {
 	sync.RWMutex
-	messages map[string]map[string]packets.ControlPacket
+	subscriptions map[string]map[string]byte
+	retained      map[string]*packets.PublishPacket
+	inbound       map[string]map[uint16]packets.ControlPacket
+	outbound      map[string]map[uint16]packets.ControlPacket
+	wills         map[string]*packets.PublishPacket
+
+	path string
+	// encrypts the snapshot if not nil
+	keys      *Keyring
+	quit      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// the snapshot file layout, packets are marshaled as they are on the wire,
+// the whole snapshot is encrypted with a keyring
+type memorySnapshot struct {
+	Subscriptions []memorySubscription
+	Retained      [][]byte
+	Inbound       []memorySnapshotPacket
+	Outbound      []memorySnapshotPacket
+	Wills         []memorySnapshotPacket
+}
+
+type memorySubscription struct {
+	ClientID string
+	Filter   string
+	QoS      byte
+}
+
+type memorySnapshotPacket struct {
+	ClientID string
+	Packet   []byte
 }
 
 func newMemoryStore() *MemoryStore {
-	store := &MemoryStore{
-		messages: make(map[string]map[string]packets.ControlPacket),
+	return &MemoryStore{
+		subscriptions: make(map[string]map[string]byte),
+		retained:      make(map[string]*packets.PublishPacket),
+		inbound:       make(map[string]map[uint16]packets.ControlPacket),
+		outbound:      make(map[string]map[uint16]packets.ControlPacket),
+		wills:         make(map[string]*packets.PublishPacket),
 	}
-	return store
 }
 
-func (this *MemoryStore) StoreSubscriptions(client *client) {
-	if client.clean {
-		return
+// newMemoryStoreSnapshot loads the snapshot at path if there is one,
+// then saves the store to it every interval and on Close.
+func newMemoryStoreSnapshot(path string, interval time.Duration, keys *Keyring) (*MemoryStore, error) {
+	store := newMemoryStore()
+	store.path = path
+	store.keys = keys
+	if err := store.load(); err != nil {
+		return nil, err
 	}
-}
 
-func (this *MemoryStore) LookupSubscriptions(client *client) {
+	store.quit = make(chan struct{})
+	store.done = make(chan struct{})
+	go func() {
+		defer close(store.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-store.quit:
+				return
+			case <-ticker.C:
+				if err := store.Snapshot(); err != nil {
+					log.Errorf("memory store: snapshot to %v failed, %v", path, err)
+				}
+			}
+		}
+	}()
+	return store, nil
+}
 
+// Close saves the last snapshot if the store has a snapshot path.
+func (this *MemoryStore) Close() (err error) {
+	if this.quit == nil {
+		return nil
+	}
+	this.closeOnce.Do(func() {
+		close(this.quit)
+		<-this.done
+		err = this.Snapshot()
+	})
+	return
 }
 
-func (this *MemoryStore) StoreRetained(message *packets.PublishPacket) {
+// Snapshot writes the store to its snapshot path, the file is replaced atomically.
+func (this *MemoryStore) Snapshot() error {
+	if this.path == "" {
+		return nil
+	}
+
+	var snap memorySnapshot
+	this.LookupSubscriptions(func(filter, cid string, qos byte) {
+		snap.Subscriptions = append(snap.Subscriptions, memorySubscription{cid, filter, qos})
+	})
+	this.LookupRetained(func(p *packets.PublishPacket) {
+		snap.Retained = append(snap.Retained, MarshalPacket(p))
+	})
+	this.LookupWills(func(cid string, p *packets.PublishPacket) {
+		snap.Wills = append(snap.Wills, memorySnapshotPacket{cid, MarshalPacket(p)})
+	})
+	this.RLock()
+	cids := make([]string, 0, len(this.inbound))
+	for cid := range this.inbound {
+		cids = append(cids, cid)
+	}
+	for _, cid := range sortStrings(cids) {
+		for _, p := range this.inbound[cid] {
+			snap.Inbound = append(snap.Inbound, memorySnapshotPacket{cid, MarshalPacket(p)})
+		}
+	}
+	cids = cids[:0]
+	for cid := range this.outbound {
+		cids = append(cids, cid)
+	}
+	for _, cid := range sortStrings(cids) {
+		for _, p := range this.outboundPackets(cid) {
+			snap.Outbound = append(snap.Outbound, memorySnapshotPacket{cid, MarshalPacket(p)})
+		}
+	}
+	this.RUnlock()
 
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&snap); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(this.path), filepath.Base(this.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(this.keys.seal(buf.Bytes())); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), this.path)
 }
 
-func (this *MemoryStore) LookupRetained(topic string, callback func(*packets.PublishPacket)) {
+func (this *MemoryStore) load() error {
+	b, err := os.ReadFile(this.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// a gob stream never starts with the magic byte of the encrypted values
+	if b, err = this.keys.open(b); err != nil {
+		return err
+	}
 
+	var snap memorySnapshot
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&snap); err != nil {
+		return err
+	}
+	for _, s := range snap.Subscriptions {
+		this.StoreSubscription(s.Filter, s.ClientID, s.QoS)
+	}
+	for _, value := range snap.Retained {
+		p, err := decodePublish(value)
+		if err != nil {
+			return err
+		}
+		this.StoreRetained(p)
+	}
+	for _, sp := range snap.Inbound {
+		p, err := decodePacket(sp.Packet)
+		if err != nil {
+			return err
+		}
+		this.StoreInboundPacket(sp.ClientID, p)
+	}
+	for _, sp := range snap.Outbound {
+		p, err := decodePacket(sp.Packet)
+		if err != nil {
+			return err
+		}
+		this.StoreOutboundPacket(sp.ClientID, p)
+	}
+	for _, sp := range snap.Wills {
+		p, err := decodePublish(sp.Packet)
+		if err != nil {
+			return err
+		}
+		this.StoreWill(sp.ClientID, p)
+	}
+	return nil
 }
 
-func (this *MemoryStore) FindInboundPacket(cid string, mid uint16) packets.ControlPacket {
+func (this *MemoryStore) StoreSubscription(filter, cid string, qos byte) error {
 	this.Lock()
 	defer this.Unlock()
-	if _, ok := this.messages[cid]; ok {
-		return this.messages[cid][keyOfControlPackets(true, mid)]
+	if _, ok := this.subscriptions[cid]; !ok {
+		this.subscriptions[cid] = make(map[string]byte)
 	}
+	this.subscriptions[cid][filter] = qos
 	return nil
 }
 
-func (this *MemoryStore) StoreInboundPacket(cid string, p packets.ControlPacket) error {
-	return this.storePacket(cid, keyOfControlPackets(true, p.Details().MessageID), p)
+func (this *MemoryStore) DeleteSubscription(filter, cid string) error {
+	this.Lock()
+	defer this.Unlock()
+	if subs, ok := this.subscriptions[cid]; ok {
+		delete(subs, filter)
+		if len(subs) == 0 {
+			delete(this.subscriptions, cid)
+		}
+	}
+	return nil
 }
 
-func (this *MemoryStore) StoreOutboundPacket(cid string, p packets.ControlPacket) error {
-	return this.storePacket(cid, keyOfControlPackets(false, p.Details().MessageID), p)
+func (this *MemoryStore) CleanSubscription(cid string) error {
+	this.Lock()
+	defer this.Unlock()
+	delete(this.subscriptions, cid)
+	return nil
 }
 
-func keyOfControlPackets(inbound bool, mid uint16) string {
-	if inbound {
-		return fmt.Sprintf("i.%v", mid)
+func (this *MemoryStore) LookupSubscriptions(callback func(filter, cid string, qos byte)) error {
+	var l []memorySubscription
+	this.RLock()
+	for cid, subs := range this.subscriptions {
+		for filter, qos := range subs {
+			l = append(l, memorySubscription{cid, filter, qos})
+		}
+	}
+	this.RUnlock()
+
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].ClientID != l[j].ClientID {
+			return l[i].ClientID < l[j].ClientID
+		}
+		return l[i].Filter < l[j].Filter
+	})
+	for _, s := range l {
+		callback(s.Filter, s.ClientID, s.QoS)
 	}
-	return fmt.Sprintf("o.%v", mid)
+	return nil
 }
 
-func (this *MemoryStore) storePacket(cid string, key string, message packets.ControlPacket) error {
-	switch message.(type) {
-	case *packets.PublishPacket, *packets.PubrelPacket:
-	default:
-		return ErrInvalidPacket
-	}
+func (this *MemoryStore) StoreRetained(p *packets.PublishPacket) error {
 	this.Lock()
 	defer this.Unlock()
-	if _, ok := this.messages[cid]; !ok {
-		this.messages[cid] = make(map[string]packets.ControlPacket)
+	if len(p.Payload) == 0 {
+		delete(this.retained, p.TopicName)
+		return nil
 	}
-	this.messages[cid][key] = message
+	this.retained[p.TopicName] = clonePacket(p).(*packets.PublishPacket)
 	return nil
 }
 
-func (this *MemoryStore) StreamOfflinePackets(cid string, callback func(packets.ControlPacket)) {
+func (this *MemoryStore) LookupRetained(callback func(*packets.PublishPacket)) error {
+	var l []*packets.PublishPacket
 	this.RLock()
-	defer this.RUnlock()
-	if v, ok := this.messages[cid]; ok {
-		for key, message := range v {
-			if key[0] == 'o' {
-				callback(message)
-			}
+	for _, p := range this.retained {
+		l = append(l, p)
+	}
+	this.RUnlock()
+
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].TopicName < l[j].TopicName
+	})
+	for _, p := range l {
+		callback(clonePacket(p).(*packets.PublishPacket))
+	}
+	return nil
+}
+
+func (this *MemoryStore) StoreWill(cid string, p *packets.PublishPacket) error {
+	this.Lock()
+	defer this.Unlock()
+	this.wills[cid] = clonePacket(p).(*packets.PublishPacket)
+	return nil
+}
+
+func (this *MemoryStore) DeleteWill(cid string) error {
+	this.Lock()
+	defer this.Unlock()
+	delete(this.wills, cid)
+	return nil
+}
+
+func (this *MemoryStore) LookupWills(callback func(cid string, p *packets.PublishPacket)) error {
+	this.RLock()
+	cids := make([]string, 0, len(this.wills))
+	for cid := range this.wills {
+		cids = append(cids, cid)
+	}
+	this.RUnlock()
+
+	for _, cid := range sortStrings(cids) {
+		this.RLock()
+		p, ok := this.wills[cid]
+		this.RUnlock()
+		if ok {
+			callback(cid, clonePacket(p).(*packets.PublishPacket))
 		}
 	}
+	return nil
 }
 
-func (this *MemoryStore) DeleteInboundPacket(cid string, mid uint16) {
-	this.deletePacket(cid, keyOfControlPackets(true, mid))
+func (this *MemoryStore) FindInboundPacket(cid string, mid uint16) (packets.ControlPacket, error) {
+	this.RLock()
+	defer this.RUnlock()
+	if p, ok := this.inbound[cid][mid]; ok {
+		return clonePacket(p), nil
+	}
+	return nil, nil
 }
 
-func (this *MemoryStore) DeleteOutboundPacket(cid string, mid uint16) {
-	this.deletePacket(cid, keyOfControlPackets(false, mid))
+func (this *MemoryStore) StoreInboundPacket(cid string, p packets.ControlPacket) error {
+	if err := checkStoredPacket(p); err != nil {
+		return err
+	}
+	this.Lock()
+	defer this.Unlock()
+	if _, ok := this.inbound[cid]; !ok {
+		this.inbound[cid] = make(map[uint16]packets.ControlPacket)
+	}
+	this.inbound[cid][p.Details().MessageID] = clonePacket(p)
+	return nil
 }
 
-func (this *MemoryStore) deletePacket(cid string, key string) {
+func (this *MemoryStore) StoreOutboundPacket(cid string, p packets.ControlPacket) error {
+	if err := checkStoredPacket(p); err != nil {
+		return err
+	}
 	this.Lock()
 	defer this.Unlock()
-	if _, ok := this.messages[cid]; ok {
-		delete(this.messages[cid], key)
-		if len(this.messages[cid]) == 0 {
-			delete(this.messages, cid)
+	if _, ok := this.outbound[cid]; !ok {
+		this.outbound[cid] = make(map[uint16]packets.ControlPacket)
+	}
+	// a release replaces the message
+	this.outbound[cid][p.Details().MessageID] = clonePacket(p)
+	return nil
+}
+
+// only the messages and the releases are kept for the sessions
+func checkStoredPacket(p packets.ControlPacket) error {
+	switch p.(type) {
+	case *packets.PublishPacket, *packets.PubrelPacket:
+		return nil
+	}
+	return ErrInvalidPacket
+}
+
+func (this *MemoryStore) StreamOfflinePackets(cid string, callback func(packets.ControlPacket)) error {
+	this.RLock()
+	l := this.outboundPackets(cid)
+	this.RUnlock()
+
+	for _, p := range l {
+		callback(p)
+	}
+	return nil
+}
+
+// the outbound packets of the client ordered by message id, must hold the lock.
+func (this *MemoryStore) outboundPackets(cid string) []packets.ControlPacket {
+	mids := make([]int, 0, len(this.outbound[cid]))
+	for mid := range this.outbound[cid] {
+		mids = append(mids, int(mid))
+	}
+	sort.Ints(mids)
+
+	l := make([]packets.ControlPacket, len(mids))
+	for i, mid := range mids {
+		l[i] = clonePacket(this.outbound[cid][uint16(mid)])
+	}
+	return l
+}
+
+func (this *MemoryStore) LookupPackets(callback func(cid string, inbound bool, p packets.ControlPacket)) error {
+	type clientPackets struct {
+		cid     string
+		in, out []packets.ControlPacket
+	}
+	var l []clientPackets
+	this.RLock()
+	cids := make(map[string]bool)
+	for cid := range this.inbound {
+		cids[cid] = true
+	}
+	for cid := range this.outbound {
+		cids[cid] = true
+	}
+	keys := make([]string, 0, len(cids))
+	for cid := range cids {
+		keys = append(keys, cid)
+	}
+	for _, cid := range sortStrings(keys) {
+		c := clientPackets{cid: cid, out: this.outboundPackets(cid)}
+		for _, p := range this.inbound[cid] {
+			c.in = append(c.in, clonePacket(p))
 		}
+		sort.Slice(c.in, func(i, j int) bool {
+			return c.in[i].Details().MessageID < c.in[j].Details().MessageID
+		})
+		l = append(l, c)
 	}
+	this.RUnlock()
+
+	for _, c := range l {
+		for _, p := range c.in {
+			callback(c.cid, true, p)
+		}
+		for _, p := range c.out {
+			callback(c.cid, false, p)
+		}
+	}
+	return nil
 }
 
-func (this *MemoryStore) UpdatePacket(cid string, key string, p packets.ControlPacket) {
+func (this *MemoryStore) DeleteInboundPacket(cid string, mid uint16) error {
+	this.Lock()
+	defer this.Unlock()
+	if l, ok := this.inbound[cid]; ok {
+		delete(l, mid)
+		if len(l) == 0 {
+			delete(this.inbound, cid)
+		}
+	}
+	return nil
+}
 
+func (this *MemoryStore) DeleteOutboundPacket(cid string, mid uint16) error {
+	this.Lock()
+	defer this.Unlock()
+	if l, ok := this.outbound[cid]; ok {
+		delete(l, mid)
+		if len(l) == 0 {
+			delete(this.outbound, cid)
+		}
+	}
+	return nil
 }
 
-func (this *MemoryStore) CleanPackets(cid string) {
+func (this *MemoryStore) CleanPackets(cid string) error {
 	this.Lock()
 	defer this.Unlock()
-	delete(this.messages, cid)
+	delete(this.inbound, cid)
+	delete(this.outbound, cid)
+	return nil
 }
 
-func (this *MemoryStore) OfflineMessageLen() uint64 {
+func (this *MemoryStore) InPacketsSize() (int, error) {
 	this.RLock()
 	defer this.RUnlock()
-	var count uint64 = 0
-	for _, value := range this.messages {
-		count += uint64(len(value))
+	count := 0
+	for _, l := range this.inbound {
+		count += len(l)
 	}
-	return count
+	return count, nil
+}
+
+func (this *MemoryStore) OutPacketsSize() (int, error) {
+	this.RLock()
+	defer this.RUnlock()
+	count := 0
+	for _, l := range this.outbound {
+		count += len(l)
+	}
+	return count, nil
+}
+
+// the packets are cloned in and out, the callers may change them later
+func clonePacket(p packets.ControlPacket) packets.ControlPacket {
+	return UnmarshalPacket(MarshalPacket(p))
+}
+
+func sortStrings(keys []string) []string {
+	sort.Strings(keys)
+	return keys
 }
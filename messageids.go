@@ -2,6 +2,8 @@ package mqtt
 
 import (
 	"sync"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
 )
 
 type messageIds struct {
@@ -38,6 +40,16 @@ func (m *messageIds) request(cid string) uint16 {
 	return 0
 }
 
+// mark the given id as used, ie: restored from the store.
+func (m *messageIds) use(cid string, mid uint16) {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.index[cid]; !ok {
+		m.index[cid] = make(map[uint16]interface{})
+	}
+	m.index[cid][mid] = cid
+}
+
 // check the given id is used or not
 func (m *messageIds) used(cid string, mid uint16) bool {
 	m.RLock()
@@ -62,3 +74,13 @@ func (m *messageIds) clean(cid string) {
 	defer m.Unlock()
 	delete(m.index, cid)
 }
+
+// mark the ids of the stored outbound packets as used, the sessions keep them after a restart.
+func (this *Server) reloadMessageIds() {
+	err := this.store.LookupPackets(func(cid string, inbound bool, p packets.ControlPacket) {
+		if !inbound {
+			this.mids.use(cid, p.Details().MessageID)
+		}
+	})
+	this.storeFailed("reload message ids", err)
+}
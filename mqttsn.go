@@ -0,0 +1,1052 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+)
+
+// the MQTT-SN v1.2 message types.
+const (
+	snAdvertise    = 0x00
+	snSearchGw     = 0x01
+	snGwInfo       = 0x02
+	snConnect      = 0x04
+	snConnack      = 0x05
+	snWillTopicReq = 0x06
+	snWillTopic    = 0x07
+	snWillMsgReq   = 0x08
+	snWillMsg      = 0x09
+	snRegister     = 0x0a
+	snRegack       = 0x0b
+	snPublish      = 0x0c
+	snPuback       = 0x0d
+	snPubcomp      = 0x0e
+	snPubrec       = 0x0f
+	snPubrel       = 0x10
+	snSubscribe    = 0x12
+	snSuback       = 0x13
+	snUnsubscribe  = 0x14
+	snUnsuback     = 0x15
+	snPingreq      = 0x16
+	snPingresp     = 0x17
+	snDisconnect   = 0x18
+)
+
+// the flags of the messages.
+const (
+	snFlagDup       = 0x80
+	snFlagQoS       = 0x60
+	snFlagRetain    = 0x10
+	snFlagWill      = 0x08
+	snFlagClean     = 0x04
+	snFlagTopicType = 0x03
+
+	// the qos bits of the QoS -1 publishes, sent without a connection
+	snQoSMinus1 = 0x60
+
+	snTopicNormal     = 0x00
+	snTopicPredefined = 0x01
+	snTopicShort      = 0x02
+)
+
+// the return codes.
+const (
+	snAccepted             = 0x00
+	snRejectedCongestion   = 0x01
+	snRejectedTopicId      = 0x02
+	snRejectedNotSupported = 0x03
+)
+
+const (
+	DefaultSNMaxBuffered = 100
+
+	snProtocolId = 0x01
+	// the interval of the keepalive checks of the clients
+	snCheckInterval = 500 * time.Millisecond
+	// the messages of a client queued to its MQTT session, the others are dropped like
+	// lost datagrams
+	snQueueLen = 64
+)
+
+// SNOptions are the options of an MQTT-SN gateway, see ServeSN.
+type SNOptions struct {
+	// GatewayId is the id of the gateway in its ADVERTISE and GWINFO messages.
+	GatewayId byte
+
+	// PredefinedTopics are the topic ids known beforehand by the clients and the gateway,
+	// they're used without a REGISTER and by the QoS -1 publishes.
+	PredefinedTopics map[uint16]string
+
+	// AdvertiseAddr is the broadcast or multicast address, ie: 255.255.255.255:1884, the
+	// gateway advertises itself to every AdvertiseInterval. If not set then it's not
+	// advertised, the clients find it with a SEARCHGW.
+	AdvertiseAddr     string
+	AdvertiseInterval time.Duration
+
+	// MaxBuffered is the most messages kept for a sleeping client, or for the registration
+	// of their topic. The oldest of qos 0 are dropped, the session is lost if there are none,
+	// the server resends the others once the client reconnects. If not set then default to 100.
+	MaxBuffered int
+
+	// Listener are the options of the clients as the clients of a listener, ie: their policy,
+	// limits and quotas. The TLS, PROXY protocol and HTTP options don't apply.
+	Listener *ListenerOptions
+}
+
+// an MQTT-SN gateway, its clients are served as MQTT clients of the server.
+type snGateway struct {
+	sync.Mutex
+	server *Server
+	opts   *SNOptions
+	conn   net.PacketConn
+	l      *listener
+	// the clients by address, and the ids of the predefined topics by name
+	sessions   map[string]*snSession
+	predefined map[string]uint16
+	done       chan struct{}
+}
+
+// ListenAndServeSN serves an MQTT-SN gateway on the UDP address, ie: 0.0.0.0:1884.
+func (this *Server) ListenAndServeSN(addr string, opts *SNOptions) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	log.Info("MQTT-SN gateway listenning on ", addr)
+	return this.ServeSN(conn, opts)
+}
+
+// ServeSN serves an MQTT-SN v1.2 gateway on the connection, the connection is closed when
+// returns. Each client is an MQTT client of the server, sharing its subscriptions, retained
+// messages and sessions with the other clients.
+func (this *Server) ServeSN(conn net.PacketConn, opts *SNOptions) error {
+	defer conn.Close()
+	if opts == nil {
+		opts = &SNOptions{}
+	}
+	l, err := this.newListener(opts.Listener)
+	if err != nil {
+		return err
+	}
+	gw := &snGateway{
+		server:     this,
+		opts:       opts,
+		conn:       conn,
+		l:          l,
+		sessions:   make(map[string]*snSession),
+		predefined: make(map[string]uint16),
+		done:       make(chan struct{}),
+	}
+	for id, topic := range opts.PredefinedTopics {
+		gw.predefined[topic] = id
+	}
+	defer gw.close()
+
+	go gw.check()
+	if opts.AdvertiseAddr != "" && opts.AdvertiseInterval > 0 {
+		if err := gw.advertise(); err != nil {
+			return err
+		}
+	}
+	go func() {
+		select {
+		case <-this.quit:
+			conn.Close()
+		case <-gw.done:
+		}
+	}()
+
+	err = gw.serve()
+	select {
+	case <-this.quit:
+		return nil
+	default:
+		return err
+	}
+}
+
+func (this *snGateway) serve() error {
+	b := make([]byte, 0xffff)
+	for {
+		n, addr, err := this.conn.ReadFrom(b)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		typ, body, err := parseSNMessage(b[:n])
+		if err != nil {
+			log.Debugf("mqtt-sn message from %v dropped, %v", addr, err)
+			continue
+		}
+		this.handle(addr, typ, append([]byte(nil), body...))
+	}
+}
+
+// close the sessions of the clients, their MQTT connections are lost.
+func (this *snGateway) close() {
+	close(this.done)
+	this.Lock()
+	defer this.Unlock()
+	for _, s := range this.sessions {
+		s.lose()
+	}
+}
+
+func (this *snGateway) send(addr net.Addr, typ byte, body []byte) {
+	if _, err := this.conn.WriteTo(snMessage(typ, body), addr); err != nil {
+		log.Debugf("mqtt-sn message to %v failed, %v", addr, err)
+	}
+}
+
+// advertise the gateway to the broadcast address.
+func (this *snGateway) advertise() error {
+	addr, err := net.ResolveUDPAddr("udp", this.opts.AdvertiseAddr)
+	if err != nil {
+		return err
+	}
+	body := binary.BigEndian.AppendUint16([]byte{this.opts.GatewayId}, uint16(this.opts.AdvertiseInterval/time.Second))
+	go func() {
+		ticker := time.NewTicker(this.opts.AdvertiseInterval)
+		defer ticker.Stop()
+		for {
+			this.send(addr, snAdvertise, body)
+			select {
+			case <-ticker.C:
+			case <-this.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (this *snGateway) handle(addr net.Addr, typ byte, body []byte) {
+	switch typ {
+	case snSearchGw:
+		this.send(addr, snGwInfo, []byte{this.opts.GatewayId})
+		return
+	case snConnect:
+		this.connect(addr, body)
+		return
+	}
+
+	s := this.session(addr, typ, body)
+	if s == nil {
+		if typ == snPublish && len(body) >= 5 && body[0]&snFlagQoS == snQoSMinus1 {
+			this.publishMinus1(addr, body)
+			return
+		}
+		// the client is to connect again
+		log.Debugf("mqtt-sn message %#x from %v without a connection", typ, addr)
+		this.send(addr, snDisconnect, nil)
+		return
+	}
+	s.handle(typ, body)
+}
+
+// the session of the client at the address, or of the sleeping client waking up
+// from another address.
+func (this *snGateway) session(addr net.Addr, typ byte, body []byte) *snSession {
+	this.Lock()
+	defer this.Unlock()
+	if s, ok := this.sessions[addr.String()]; ok {
+		return s
+	}
+	if typ != snPingreq || len(body) == 0 {
+		return nil
+	}
+	for key, s := range this.sessions {
+		if s.id == string(body) {
+			delete(this.sessions, key)
+			s.Lock()
+			s.addr = addr
+			s.Unlock()
+			this.sessions[addr.String()] = s
+			return s
+		}
+	}
+	return nil
+}
+
+func (this *snGateway) remove(s *snSession) {
+	this.Lock()
+	defer this.Unlock()
+	s.Lock()
+	key := s.addr.String()
+	s.Unlock()
+	if this.sessions[key] == s {
+		delete(this.sessions, key)
+	}
+}
+
+// a CONNECT starts a session for the client, replacing the one at its address. The MQTT
+// CONNECT is sent once the client sent its will, if it has one.
+func (this *snGateway) connect(addr net.Addr, body []byte) {
+	if len(body) < 4 {
+		return
+	}
+	flags, duration, id := body[0], binary.BigEndian.Uint16(body[2:4]), string(body[4:])
+	if body[1] != snProtocolId {
+		this.send(addr, snConnack, []byte{snRejectedNotSupported})
+		return
+	}
+
+	cp := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.CleanSession = flags&snFlagClean != 0
+	cp.KeepaliveTimer = duration
+	cp.ClientIdentifier = id
+
+	s := &snSession{
+		gw:       this,
+		addr:     addr,
+		id:       id,
+		duration: time.Duration(duration) * time.Second,
+		lastSeen: time.Now(),
+		in:       make(chan packets.ControlPacket, snQueueLen),
+		done:     make(chan struct{}),
+		topics:   make(map[uint16]string),
+		ids:      make(map[string]uint16),
+		pending:  make(map[uint16]uint16),
+		// the registrations of the gateway
+		registering: make(map[uint16]uint16),
+		waiting:     make(map[uint16][]*packets.PublishPacket),
+	}
+	this.Lock()
+	old := this.sessions[addr.String()]
+	this.sessions[addr.String()] = s
+	this.Unlock()
+	// the session of another client at the address is lost, the one of the same client
+	// is taken over by its new MQTT connection
+	if old != nil && (old.id != id || !old.started()) {
+		old.lose()
+	}
+
+	if flags&snFlagWill != 0 {
+		s.Lock()
+		s.connect = cp
+		s.Unlock()
+		this.send(addr, snWillTopicReq, nil)
+		return
+	}
+	s.start(cp)
+}
+
+// publish a QoS -1 message of a client without a connection, to a predefined or a short topic.
+func (this *snGateway) publishMinus1(addr net.Addr, body []byte) {
+	if reason := this.server.admit(this.l, addr); reason != "" {
+		log.Debugf("mqtt-sn publish from %v refused, %v", addr, reason)
+		return
+	}
+	defer this.server.release(this.l)
+
+	topic, ok := this.topicName(nil, body[0]&snFlagTopicType, binary.BigEndian.Uint16(body[1:3]))
+	if !ok || validateTopic(topic) != nil {
+		log.Debugf("mqtt-sn publish from %v dropped, invalid topic", addr)
+		return
+	}
+	// the anonymous publisher is limited like the clients of the listener
+	policy := this.server.listenerPolicy(this.l)
+	err := policy.checkConnect(true, "")
+	if err == nil {
+		err = policy.checkTopic(topic)
+	}
+	if err == nil && !this.server.canPublish("", topic) {
+		err = ErrNotAuthorized
+	}
+	if err != nil {
+		log.Debugf("mqtt-sn publish from %v to %q dropped, %v", addr, topic, err)
+		return
+	}
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Retain = body[0]&snFlagRetain != 0
+	p.Payload = body[5:]
+	if err = this.server.publishMessage("", p); err != nil {
+		log.Warnf("mqtt-sn publish from %v to %q failed, %v", addr, topic, err)
+	}
+}
+
+// the topic name of a topic id of the type, s is nil for the publishes without a connection.
+func (this *snGateway) topicName(s *snSession, typ byte, id uint16) (string, bool) {
+	switch typ {
+	case snTopicPredefined:
+		topic, ok := this.opts.PredefinedTopics[id]
+		return topic, ok
+	case snTopicShort:
+		return string([]byte{byte(id >> 8), byte(id)}), true
+	case snTopicNormal:
+		if s != nil {
+			s.Lock()
+			defer s.Unlock()
+			topic, ok := s.topics[id]
+			return topic, ok
+		}
+	}
+	return "", false
+}
+
+// check the keepalive of the clients, the MQTT connection of a silent client is lost and its
+// will published. A sleeping client is lost after its sleep duration.
+func (this *snGateway) check() {
+	ticker := time.NewTicker(snCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-this.done:
+			return
+		}
+		var lost []*snSession
+		this.Lock()
+		for _, s := range this.sessions {
+			if s.expired(this.server.opts.ConnectTimeout) {
+				lost = append(lost, s)
+			}
+		}
+		this.Unlock()
+		for _, s := range lost {
+			log.Infof("mqtt-sn client %q lost", s.id)
+			this.remove(s)
+			s.lose()
+		}
+	}
+}
+
+// an MQTT-SN client, served as the MQTT client of a pipe by the server.
+type snSession struct {
+	sync.Mutex
+	gw   *snGateway
+	addr net.Addr
+	id   string
+	// the gateway end of the pipe, nil until the client sent its will
+	conn net.Conn
+	in   chan packets.ControlPacket
+	done chan struct{}
+	once sync.Once
+
+	// the CONNECT waiting for the will
+	connect  *packets.ConnectPacket
+	duration time.Duration
+	lastSeen time.Time
+	asleep   bool
+	buffered []*packets.PublishPacket
+	// the messages held until the SUBACKs, the retained messages are sent by the server
+	// before the SUBACK giving their topic id
+	subscribing int
+	held        []*packets.PublishPacket
+
+	// the registered topics by id and by name
+	topics map[uint16]string
+	ids    map[string]uint16
+	lastId uint16
+	// the topic ids of the publishes and the subscribes waiting for their ack, by message id
+	pending map[uint16]uint16
+	// the message ids of the REGISTERs of the gateway
+	lastMid uint16
+	// the topic ids of the REGISTERs waiting for their REGACK by message id, and the messages
+	// waiting for them by topic id. The PINGRESP of a client awake waits for them too.
+	registering map[uint16]uint16
+	waiting     map[uint16][]*packets.PublishPacket
+	pingresp    bool
+}
+
+// the address of an MQTT-SN client as the remote address of its pipe.
+type snConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (this *snConn) RemoteAddr() net.Addr {
+	return this.addr
+}
+
+func (this *snSession) started() bool {
+	this.Lock()
+	defer this.Unlock()
+	return this.conn != nil
+}
+
+// start the MQTT client of the session with the CONNECT.
+func (this *snSession) start(cp *packets.ConnectPacket) {
+	gw := this.gw
+	if reason := gw.server.admit(gw.l, this.addr); reason != "" {
+		log.Debugf("mqtt-sn client %q at %v refused, %v", this.id, this.addr, reason)
+		gw.remove(this)
+		gw.send(this.addr, snConnack, []byte{snRejectedCongestion})
+		return
+	}
+	conn, pipe := net.Pipe()
+	this.Lock()
+	this.conn = conn
+	this.connect = nil
+	this.Unlock()
+	go func() {
+		defer gw.server.release(gw.l)
+		gw.server.serveConn(&snConn{Conn: pipe, addr: this.addr}, gw.l)
+	}()
+	go this.reader()
+	go this.writer()
+	this.queue(cp)
+}
+
+// the session ends, the MQTT connection is lost if it's still open.
+func (this *snSession) lose() {
+	this.once.Do(func() {
+		close(this.done)
+	})
+	this.Lock()
+	defer this.Unlock()
+	if this.conn != nil {
+		this.conn.Close()
+	}
+}
+
+func (this *snSession) expired(connectTimeout time.Duration) bool {
+	this.Lock()
+	defer this.Unlock()
+	limit := this.duration + this.duration/2
+	if this.conn == nil {
+		// still sending its will
+		limit = connectTimeout
+	}
+	return limit > 0 && time.Since(this.lastSeen) > limit
+}
+
+func (this *snSession) send(typ byte, body []byte) {
+	this.Lock()
+	addr := this.addr
+	this.Unlock()
+	this.gw.send(addr, typ, body)
+}
+
+// queue a packet to the MQTT client, false if it's dropped.
+func (this *snSession) queue(p packets.ControlPacket) bool {
+	select {
+	case this.in <- p:
+		return true
+	default:
+		log.Debugf("mqtt-sn client %q congested, packet dropped", this.id)
+		return false
+	}
+}
+
+// queue an acknowledgement or a disconnect, it's never dropped. The session is lost if the
+// MQTT client is congested, the server resends the packets not acknowledged after reconnecting.
+func (this *snSession) queueAck(p packets.ControlPacket) {
+	if !this.queue(p) {
+		log.Warnf("mqtt-sn client %q congested, session lost", this.id)
+		this.gw.remove(this)
+		this.lose()
+	}
+}
+
+// append a message to a buffer of the session, the oldest message of qos 0 is dropped if
+// it's full. Returns false if the buffer is full of messages of qos 1 and 2.
+func (this *snSession) buffer(l []*packets.PublishPacket, p *packets.PublishPacket) ([]*packets.PublishPacket, bool) {
+	max := this.gw.opts.MaxBuffered
+	if max <= 0 {
+		max = DefaultSNMaxBuffered
+	}
+	if len(l) < max {
+		return append(l, p), true
+	}
+	for i, m := range l {
+		if m.Qos == 0 {
+			log.Debugf("mqtt-sn client %q behind, message to %q dropped", this.id, m.TopicName)
+			return append(append(l[:i:i], l[i+1:]...), p), true
+		}
+	}
+	if p.Qos == 0 {
+		log.Debugf("mqtt-sn client %q behind, message to %q dropped", this.id, p.TopicName)
+		return l, true
+	}
+	return l, false
+}
+
+func (this *snSession) writer() {
+	for {
+		select {
+		case p := <-this.in:
+			if err := p.Write(this.conn); err != nil {
+				this.lose()
+				return
+			}
+		case <-this.done:
+			return
+		}
+	}
+}
+
+// read the packets of the MQTT client and send them to the MQTT-SN client.
+func (this *snSession) reader() {
+	defer func() {
+		this.gw.remove(this)
+		this.lose()
+	}()
+	for {
+		cp, err := packets.ReadPacket(this.conn)
+		if err != nil {
+			log.Debugf("mqtt-sn client %q disconnected, %v", this.id, err)
+			return
+		}
+		switch p := cp.(type) {
+		case *packets.ConnackPacket:
+			if p.ReturnCode != packets.Accepted {
+				this.send(snConnack, []byte{snRejectedNotSupported})
+				continue
+			}
+			this.send(snConnack, []byte{snAccepted})
+			go this.keepAlive()
+		case *packets.PublishPacket:
+			this.deliver(p)
+		case *packets.PubackPacket:
+			this.send(snPuback, append(this.ackTopic(p.MessageID), byte(p.MessageID>>8), byte(p.MessageID), snAccepted))
+		case *packets.PubrecPacket:
+			this.send(snPubrec, binary.BigEndian.AppendUint16(nil, p.MessageID))
+		case *packets.PubrelPacket:
+			this.send(snPubrel, binary.BigEndian.AppendUint16(nil, p.MessageID))
+		case *packets.PubcompPacket:
+			this.send(snPubcomp, binary.BigEndian.AppendUint16(nil, p.MessageID))
+		case *packets.SubackPacket:
+			qos, rc := byte(0), byte(snAccepted)
+			if len(p.GrantedQoss) == 0 || p.GrantedQoss[0] > 2 {
+				rc = snRejectedNotSupported
+			} else {
+				qos = p.GrantedQoss[0]
+			}
+			body := append([]byte{qos << 5}, this.ackTopic(p.MessageID)...)
+			this.send(snSuback, append(binary.BigEndian.AppendUint16(body, p.MessageID), rc))
+			this.subscribed()
+		case *packets.UnsubackPacket:
+			this.send(snUnsuback, binary.BigEndian.AppendUint16(nil, p.MessageID))
+		case *packets.PingrespPacket:
+			// the pings of the gateway
+		}
+	}
+}
+
+// ping the server while the client is connected, the keepalive of the client is checked
+// by the gateway, even while it's sleeping.
+func (this *snSession) keepAlive() {
+	interval := this.gw.server.opts.KeepAlive / 2
+	if c, ok := this.gw.server.clients.get(this.id); ok && c.keepAlive > 0 {
+		interval = c.keepAlive / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			this.queue(packets.NewControlPacket(packets.Pingreq))
+		case <-this.done:
+			return
+		}
+	}
+}
+
+// the topic id of an acknowledged message.
+func (this *snSession) ackTopic(mid uint16) []byte {
+	this.Lock()
+	defer this.Unlock()
+	id := this.pending[mid]
+	delete(this.pending, mid)
+	return binary.BigEndian.AppendUint16(nil, id)
+}
+
+// the id of a topic name, registered if it's new.
+func (this *snSession) register(topic string) (id uint16, registered bool) {
+	this.Lock()
+	defer this.Unlock()
+	if id, ok := this.ids[topic]; ok {
+		return id, false
+	}
+	for {
+		this.lastId++
+		if _, ok := this.topics[this.lastId]; !ok && this.lastId != 0 && this.lastId != 0xffff {
+			break
+		}
+	}
+	this.topics[this.lastId] = topic
+	this.ids[topic] = this.lastId
+	return this.lastId, true
+}
+
+// a subscription is acknowledged, the messages held are delivered after the last one.
+func (this *snSession) subscribed() {
+	this.Lock()
+	this.subscribing--
+	var held []*packets.PublishPacket
+	if this.subscribing == 0 {
+		held, this.held = this.held, nil
+	}
+	this.Unlock()
+	for _, p := range held {
+		this.deliver(p)
+	}
+}
+
+// deliver a message to the client, kept while it's sleeping or subscribing.
+func (this *snSession) deliver(p *packets.PublishPacket) {
+	this.Lock()
+	if this.subscribing > 0 {
+		this.held = append(this.held, p)
+		this.Unlock()
+		return
+	}
+	if this.asleep {
+		var ok bool
+		this.buffered, ok = this.buffer(this.buffered, p)
+		this.Unlock()
+		if !ok {
+			log.Warnf("mqtt-sn client %q sleeping, too many messages, session lost", this.id)
+			this.gw.remove(this)
+			this.lose()
+		}
+		return
+	}
+	this.Unlock()
+	this.publish(p)
+}
+
+// send a message to the client, its topic is registered first if the client doesn't know it
+// and the message is sent once the client acknowledged it.
+func (this *snSession) publish(p *packets.PublishPacket) {
+	var typ byte
+	var id uint16
+	if predefined, ok := this.gw.predefined[p.TopicName]; ok {
+		typ, id = snTopicPredefined, predefined
+	} else if len(p.TopicName) == 2 {
+		typ, id = snTopicShort, binary.BigEndian.Uint16([]byte(p.TopicName))
+	} else {
+		var registered bool
+		id, registered = this.register(p.TopicName)
+		this.Lock()
+		if registered {
+			this.lastMid++
+			this.registering[this.lastMid] = id
+			this.waiting[id] = []*packets.PublishPacket{p}
+			mid := this.lastMid
+			this.Unlock()
+			this.sendRegister(mid, id, p.TopicName)
+			return
+		}
+		if l, ok := this.waiting[id]; ok {
+			l, ok = this.buffer(l, p)
+			this.waiting[id] = l
+			this.Unlock()
+			if !ok {
+				log.Warnf("mqtt-sn client %q registering %q, too many messages, session lost", this.id, p.TopicName)
+				this.gw.remove(this)
+				this.lose()
+			}
+			return
+		}
+		this.Unlock()
+	}
+	this.sendPublish(p, typ, id)
+}
+
+func (this *snSession) sendRegister(mid, id uint16, topic string) {
+	body := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, id), mid)
+	this.send(snRegister, append(body, topic...))
+}
+
+// a REGACK of the client, the messages waiting for the registration are sent if it's accepted.
+func (this *snSession) registered(mid uint16, rc byte) {
+	this.Lock()
+	id, ok := this.registering[mid]
+	if !ok {
+		this.Unlock()
+		return
+	}
+	delete(this.registering, mid)
+	waiting := this.waiting[id]
+	delete(this.waiting, id)
+	if rc != snAccepted {
+		// registered again with the next message
+		delete(this.ids, this.topics[id])
+		delete(this.topics, id)
+	}
+	pingresp := this.pingresp && len(this.registering) == 0
+	if pingresp {
+		this.pingresp = false
+	}
+	this.Unlock()
+
+	if rc != snAccepted {
+		log.Infof("mqtt-sn client %q refused the topic id %v, %v messages dropped, code %v", this.id, id, len(waiting), rc)
+	} else {
+		for _, p := range waiting {
+			this.sendPublish(p, snTopicNormal, id)
+		}
+	}
+	if pingresp {
+		this.send(snPingresp, nil)
+	}
+}
+
+func (this *snSession) sendPublish(p *packets.PublishPacket, typ byte, id uint16) {
+	flags := p.Qos<<5 | typ
+	if p.Dup {
+		flags |= snFlagDup
+	}
+	if p.Retain {
+		flags |= snFlagRetain
+	}
+	body := binary.BigEndian.AppendUint16([]byte{flags}, id)
+	body = binary.BigEndian.AppendUint16(body, p.MessageID)
+	this.send(snPublish, append(body, p.Payload...))
+}
+
+// handle a message of the client.
+func (this *snSession) handle(typ byte, body []byte) {
+	this.Lock()
+	this.lastSeen = time.Now()
+	connect := this.connect
+	this.Unlock()
+
+	if connect != nil {
+		this.handleWill(connect, typ, body)
+		return
+	}
+	if !this.started() {
+		return
+	}
+
+	switch typ {
+	case snRegister:
+		if len(body) < 4 {
+			return
+		}
+		topic := string(body[4:])
+		if validateTopic(topic) != nil {
+			this.send(snRegack, []byte{0, 0, body[2], body[3], snRejectedNotSupported})
+			return
+		}
+		id, _ := this.register(topic)
+		this.send(snRegack, append(binary.BigEndian.AppendUint16(nil, id), body[2], body[3], snAccepted))
+	case snRegack:
+		if len(body) >= 5 {
+			this.registered(binary.BigEndian.Uint16(body[2:4]), body[4])
+		}
+	case snPublish:
+		if len(body) < 5 {
+			return
+		}
+		this.handlePublish(body[0], binary.BigEndian.Uint16(body[1:3]), binary.BigEndian.Uint16(body[3:5]), body[5:])
+	case snPuback:
+		if len(body) >= 4 {
+			p := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			p.MessageID = binary.BigEndian.Uint16(body[2:4])
+			this.queueAck(p)
+		}
+	case snPubrec, snPubrel, snPubcomp:
+		if len(body) < 2 {
+			return
+		}
+		mid := binary.BigEndian.Uint16(body)
+		switch typ {
+		case snPubrec:
+			p := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+			p.MessageID = mid
+			this.queueAck(p)
+		case snPubrel:
+			p := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+			p.MessageID = mid
+			this.queueAck(p)
+		case snPubcomp:
+			p := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			p.MessageID = mid
+			this.queueAck(p)
+		}
+	case snSubscribe, snUnsubscribe:
+		if len(body) < 3 {
+			return
+		}
+		this.handleSubscribe(typ, body[0], binary.BigEndian.Uint16(body[1:3]), body[3:])
+	case snPingreq:
+		this.Lock()
+		var buffered []*packets.PublishPacket
+		if this.asleep {
+			// awake, the messages kept while sleeping are sent before the PINGRESP
+			buffered, this.buffered = this.buffered, nil
+		}
+		// the REGISTERs not acknowledged may be lost, they're resent
+		type register struct {
+			mid, id uint16
+			topic   string
+		}
+		var registers []register
+		for mid, id := range this.registering {
+			registers = append(registers, register{mid, id, this.topics[id]})
+		}
+		this.Unlock()
+		for _, r := range registers {
+			this.sendRegister(r.mid, r.id, r.topic)
+		}
+		for _, p := range buffered {
+			this.publish(p)
+		}
+		// sent once the topics of the messages kept are registered
+		this.Lock()
+		this.pingresp = len(buffered) > 0 && len(this.registering) > 0
+		pingresp := !this.pingresp
+		this.Unlock()
+		if pingresp {
+			this.send(snPingresp, nil)
+		}
+	case snDisconnect:
+		if len(body) >= 2 && binary.BigEndian.Uint16(body) > 0 {
+			this.Lock()
+			this.asleep = true
+			this.duration = time.Duration(binary.BigEndian.Uint16(body)) * time.Second
+			this.Unlock()
+			this.send(snDisconnect, nil)
+			return
+		}
+		this.queueAck(packets.NewControlPacket(packets.Disconnect))
+		this.send(snDisconnect, nil)
+	default:
+		log.Debugf("mqtt-sn message %#x of %q not supported", typ, this.id)
+	}
+}
+
+// the will of a client, its topic then its message, and the session is started.
+func (this *snSession) handleWill(cp *packets.ConnectPacket, typ byte, body []byte) {
+	switch typ {
+	case snWillTopic:
+		if len(body) == 0 {
+			// no will after all
+			this.start(cp)
+			return
+		}
+		cp.WillFlag = true
+		cp.WillQos = body[0] & snFlagQoS >> 5
+		cp.WillRetain = body[0]&snFlagRetain != 0
+		cp.WillTopic = string(body[1:])
+		this.send(snWillMsgReq, nil)
+	case snWillMsg:
+		if cp.WillFlag {
+			cp.WillMessage = body
+			this.start(cp)
+		}
+	}
+}
+
+func (this *snSession) handlePublish(flags byte, id, mid uint16, data []byte) {
+	qos := flags & snFlagQoS >> 5
+	if flags&snFlagQoS == snQoSMinus1 {
+		qos = 0
+	}
+	topic, ok := this.gw.topicName(this, flags&snFlagTopicType, id)
+	if !ok {
+		body := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, id), mid)
+		this.send(snPuback, append(body, snRejectedTopicId))
+		return
+	}
+	if qos == 1 {
+		this.Lock()
+		this.pending[mid] = id
+		this.Unlock()
+	}
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Qos = qos
+	p.Dup = flags&snFlagDup != 0
+	p.Retain = flags&snFlagRetain != 0
+	p.MessageID = mid
+	p.Payload = data
+	if !this.queue(p) && qos > 0 {
+		// the client resends it later
+		this.ackTopic(mid)
+		body := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, id), mid)
+		this.send(snPuback, append(body, snRejectedCongestion))
+	}
+}
+
+// subscribe or unsubscribe a topic filter, a name without wildcards gets a topic id.
+func (this *snSession) handleSubscribe(typ, flags byte, mid uint16, b []byte) {
+	var topic string
+	var id uint16
+	switch flags & snFlagTopicType {
+	case snTopicNormal:
+		topic = string(b)
+		if topic != "" && !strings.ContainsAny(topic, "+#") {
+			id, _ = this.register(topic)
+		}
+	default:
+		if len(b) < 2 {
+			return
+		}
+		id = binary.BigEndian.Uint16(b)
+		var ok bool
+		if topic, ok = this.gw.topicName(this, flags&snFlagTopicType, id); !ok {
+			if typ == snSubscribe {
+				body := append([]byte{0}, b[:2]...)
+				this.send(snSuback, append(binary.BigEndian.AppendUint16(body, mid), snRejectedTopicId))
+			} else {
+				this.send(snUnsuback, binary.BigEndian.AppendUint16(nil, mid))
+			}
+			return
+		}
+	}
+
+	if typ == snUnsubscribe {
+		p := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+		p.MessageID = mid
+		p.Topics = []string{topic}
+		this.queue(p)
+		return
+	}
+	qos := flags & snFlagQoS >> 5
+	if qos > 2 {
+		qos = 0
+	}
+	this.Lock()
+	this.pending[mid] = id
+	this.subscribing++
+	this.Unlock()
+	p := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	p.MessageID = mid
+	p.Topics = []string{topic}
+	p.Qoss = []byte{qos}
+	if !this.queue(p) {
+		this.subscribed()
+	}
+}
+
+// parse an MQTT-SN message, its length is of one byte or, after 0x01, of two.
+func parseSNMessage(b []byte) (typ byte, body []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, ErrInvalidSNMessage
+	}
+	n, header := int(b[0]), 1
+	if b[0] == 0x01 {
+		if len(b) < 4 {
+			return 0, nil, ErrInvalidSNMessage
+		}
+		n, header = int(binary.BigEndian.Uint16(b[1:3])), 3
+	}
+	if n > len(b) || n <= header {
+		return 0, nil, ErrInvalidSNMessage
+	}
+	return b[header], b[header+1 : n], nil
+}
+
+func snMessage(typ byte, body []byte) []byte {
+	n := len(body) + 2
+	if n <= 0xff {
+		return append([]byte{byte(n), typ}, body...)
+	}
+	n += 2
+	return append([]byte{0x01, byte(n >> 8), byte(n), typ}, body...)
+}
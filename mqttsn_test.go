@@ -0,0 +1,371 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serve a gateway on a random loopback port, returns the address.
+func serveTestGateway(t *testing.T, server *Server, opts *SNOptions) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeSN(conn, opts)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return conn.LocalAddr().String()
+}
+
+// a raw MQTT-SN client.
+type snTestClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func dialSN(t *testing.T, addr string) *snTestClient {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return &snTestClient{t: t, conn: conn}
+}
+
+func (this *snTestClient) send(typ byte, body ...byte) {
+	this.conn.Write(snMessage(typ, body))
+}
+
+func (this *snTestClient) read() (byte, []byte) {
+	this.t.Helper()
+	b := make([]byte, 0xffff)
+	this.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := this.conn.Read(b)
+	if err != nil {
+		this.t.Fatal(err)
+	}
+	typ, body, err := parseSNMessage(b[:n])
+	if err != nil {
+		this.t.Fatal(err)
+	}
+	return typ, body
+}
+
+func (this *snTestClient) expect(typ byte) []byte {
+	this.t.Helper()
+	got, body := this.read()
+	if got != typ {
+		this.t.Fatalf("message %#x expected, got %#x %v", typ, got, body)
+	}
+	return body
+}
+
+// nothing is received for a while.
+func (this *snTestClient) assertSilent() {
+	this.t.Helper()
+	this.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := this.conn.Read(make([]byte, 0xffff))
+	assert.Error(this.t, err)
+}
+
+func (this *snTestClient) connect(cid string, flags byte, duration uint16) {
+	this.t.Helper()
+	body := binary.BigEndian.AppendUint16([]byte{flags, snProtocolId}, duration)
+	this.send(snConnect, append(body, cid...)...)
+	if flags&snFlagWill == 0 {
+		assert.Equal(this.t, []byte{snAccepted}, this.expect(snConnack))
+	}
+}
+
+func u16(b []byte) uint16 {
+	return binary.BigEndian.Uint16(b)
+}
+
+func TestSNPublishSubscribe(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	addr := serveTestServer(t, server)
+	gw := serveTestGateway(t, server, nil)
+
+	sub := dialTestClient(t, addr, "sub", true)
+	sub.subscribe("sensors/#", 1)
+	dialTestClient(t, addr, "pub", true).publish("state/led", "on", 0, true)
+
+	c := dialSN(t, gw)
+	c.connect("sensor", snFlagClean, 30)
+	// the client shares the server with the MQTT clients
+	waitFor(t, func() bool {
+		for _, info := range server.Clients() {
+			if info.ID == "sensor" {
+				return info.Address == c.conn.LocalAddr().String()
+			}
+		}
+		return false
+	})
+
+	// register a topic and publish to it
+	c.send(snRegister, append([]byte{0, 0, 0, 1}, "sensors/t1"...)...)
+	regack := c.expect(snRegack)
+	id := u16(regack)
+	assert.NotEqual(t, uint16(0), id)
+	assert.Equal(t, []byte{0, 1, snAccepted}, regack[2:])
+	c.send(snPublish, append([]byte{1 << 5, byte(id >> 8), byte(id), 0, 2}, "21.5"...)...)
+	assert.Equal(t, append(regack[:2], 0, 2, snAccepted), c.expect(snPuback))
+	p := sub.receive()
+	assert.Equal(t, "sensors/t1", p.TopicName)
+	assert.Equal(t, "21.5", string(p.Payload))
+
+	// an unknown topic id
+	c.send(snPublish, 1<<5, 0x12, 0x34, 0, 3, 'x')
+	assert.Equal(t, []byte{0x12, 0x34, 0, 3, snRejectedTopicId}, c.expect(snPuback))
+
+	// a subscription to a name gets its topic id, the retained message is sent with it
+	c.send(snSubscribe, append([]byte{0, 0, 4}, "state/led"...)...)
+	suback := c.expect(snSuback)
+	ledId := u16(suback[1:3])
+	assert.NotEqual(t, uint16(0), ledId)
+	assert.Equal(t, []byte{0, 4, snAccepted}, suback[3:])
+	publish := c.expect(snPublish)
+	assert.Equal(t, byte(snFlagRetain), publish[0])
+	assert.Equal(t, ledId, u16(publish[1:3]))
+	assert.Equal(t, "on", string(publish[5:]))
+
+	// a topic of a wildcard subscription is registered by the gateway
+	c.send(snSubscribe, append([]byte{1 << 5, 0, 5}, "cmd/+"...)...)
+	assert.Equal(t, []byte{1 << 5, 0, 0, 0, 5, snAccepted}, c.expect(snSuback))
+	dialTestClient(t, addr, "cmd", true).publish("cmd/reboot", "now", 1, false)
+	register := c.expect(snRegister)
+	assert.Equal(t, "cmd/reboot", string(register[4:]))
+	// the message waits for the REGACK
+	c.assertSilent()
+	c.send(snRegack, append(append([]byte{}, register[:4]...), snAccepted)...)
+	publish = c.expect(snPublish)
+	assert.Equal(t, byte(1<<5), publish[0])
+	assert.Equal(t, register[:2], publish[1:3])
+	c.send(snPuback, append(publish[1:5], snAccepted)...)
+
+	c.send(snDisconnect)
+	c.expect(snDisconnect)
+	waitFor(t, func() bool {
+		return len(server.Clients()) == 3
+	})
+}
+
+func TestSNShortAndPredefinedTopics(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	addr := serveTestServer(t, server)
+	gw := serveTestGateway(t, server, &SNOptions{PredefinedTopics: map[uint16]string{7: "alarms/fire"}})
+
+	sub := dialTestClient(t, addr, "sub", true)
+	sub.subscribe("#", 0)
+
+	// QoS -1 publishes without a connection
+	c := dialSN(t, gw)
+	c.send(snPublish, append([]byte{snQoSMinus1 | snTopicPredefined, 0, 7, 0, 0}, "smoke"...)...)
+	p := sub.receive()
+	assert.Equal(t, "alarms/fire", p.TopicName)
+	assert.Equal(t, "smoke", string(p.Payload))
+	c.send(snPublish, append([]byte{snQoSMinus1 | snTopicShort, 't', '1', 0, 0}, "20"...)...)
+	assert.Equal(t, "t1", sub.receive().TopicName)
+	// the other messages need a connection
+	c.send(snPingreq)
+	c.expect(snDisconnect)
+
+	c.connect("sensor", snFlagClean, 30)
+	c.send(snSubscribe, snTopicShort, 0, 1, 'a', 'b')
+	assert.Equal(t, []byte{0, 'a', 'b', 0, 1, snAccepted}, c.expect(snSuback))
+	c.send(snSubscribe, snTopicPredefined, 0, 2, 0, 7)
+	assert.Equal(t, []byte{0, 0, 7, 0, 2, snAccepted}, c.expect(snSuback))
+	c.send(snSubscribe, snTopicPredefined, 0, 3, 0, 8)
+	assert.Equal(t, []byte{0, 0, 8, 0, 3, snRejectedTopicId}, c.expect(snSuback))
+
+	pub := dialTestClient(t, addr, "pub", true)
+	pub.publish("ab", "short", 0, false)
+	publish := c.expect(snPublish)
+	assert.Equal(t, []byte{snTopicShort, 'a', 'b'}, publish[:3])
+	assert.Equal(t, "short", string(publish[5:]))
+	pub.publish("alarms/fire", "predefined", 0, false)
+	publish = c.expect(snPublish)
+	assert.Equal(t, []byte{snTopicPredefined, 0, 7}, publish[:3])
+}
+
+func TestSNPublishMinus1Limits(t *testing.T) {
+	opts := NewOptions()
+	opts.Authorizer = testAuthorizer{"root": "secret"}
+	server := newServer(opts, newMemoryStore())
+	addr := serveTestServer(t, server)
+	sub := connectTestClient(t, addr, userLogin("sub", "root", "secret"))
+	sub.subscribe("#", 0)
+
+	// the anonymous user may publish to the topics under "/" only
+	publish := func(c *snTestClient, topic string) {
+		c.send(snPublish, append([]byte{snQoSMinus1 | snTopicShort, topic[0], topic[1], 0, 0}, "x"...)...)
+	}
+	c := dialSN(t, serveTestGateway(t, server, &SNOptions{}))
+	publish(c, "t1")
+	publish(c, "/a")
+	assert.Equal(t, "/a", sub.receive().TopicName)
+
+	// the policy of the listener of the gateway
+	levels := dialSN(t, serveTestGateway(t, server, &SNOptions{Listener: &ListenerOptions{Policy: &Policy{MaxTopicLevels: 1}}}))
+	publish(levels, "/b")
+	anonymous := dialSN(t, serveTestGateway(t, server, &SNOptions{Listener: &ListenerOptions{Policy: &Policy{DenyAnonymous: true}}}))
+	publish(anonymous, "/c")
+	publish(c, "/d")
+	assert.Equal(t, "/d", sub.receive().TopicName)
+}
+
+func TestSNSleepingClient(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	addr := serveTestServer(t, server)
+	gw := serveTestGateway(t, server, &SNOptions{MaxBuffered: 2})
+
+	c := dialSN(t, gw)
+	c.connect("sensor", snFlagClean, 30)
+	c.send(snSubscribe, snTopicShort, 0, 1, 'z', 'z')
+	c.expect(snSuback)
+
+	// asleep, the messages are kept
+	c.send(snDisconnect, 0, 60)
+	c.expect(snDisconnect)
+	pub := dialTestClient(t, addr, "pub", true)
+	for _, payload := range []string{"1", "2", "3"} {
+		pub.publish("zz", payload, 0, false)
+	}
+	c.assertSilent()
+
+	// awake from another address, the kept messages are sent before the PINGRESP
+	c.conn.Close()
+	c = dialSN(t, gw)
+	c.send(snPingreq, []byte("sensor")...)
+	assert.Equal(t, "2", string(c.expect(snPublish)[5:]))
+	assert.Equal(t, "3", string(c.expect(snPublish)[5:]))
+	c.expect(snPingresp)
+
+	// back to sleep until the next PINGREQ
+	pub.publish("zz", "4", 0, false)
+	c.assertSilent()
+	c.send(snPingreq, []byte("sensor")...)
+	assert.Equal(t, "4", string(c.expect(snPublish)[5:]))
+	c.expect(snPingresp)
+	assert.Len(t, server.Clients(), 2)
+}
+
+func TestSNSleepingClientQoS(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	addr := serveTestServer(t, server)
+	gw := serveTestGateway(t, server, &SNOptions{MaxBuffered: 2})
+
+	c := dialSN(t, gw)
+	c.connect("sensor", snFlagClean, 30)
+	c.send(snSubscribe, append([]byte{1 << 5, 0, 1}, "q/+"...)...)
+	c.expect(snSuback)
+
+	// asleep, only the qos 0 messages are dropped
+	c.send(snDisconnect, 0, 60)
+	c.expect(snDisconnect)
+	pub := dialTestClient(t, addr, "pub", true)
+	pub.publish("q/a", "1", 1, false)
+	pub.publish("q/a", "2", 0, false)
+	pub.publish("q/a", "3", 1, false)
+	c.assertSilent()
+
+	// awake, the topic is registered, the PINGRESP waits for the REGACK
+	c.send(snPingreq, []byte("sensor")...)
+	register := c.expect(snRegister)
+	assert.Equal(t, "q/a", string(register[4:]))
+	c.assertSilent()
+	// a REGISTER not acknowledged is resent with the next PINGREQ
+	c.send(snPingreq, []byte("sensor")...)
+	assert.Equal(t, register, c.expect(snRegister))
+	c.expect(snPingresp)
+	c.send(snRegack, append(append([]byte{}, register[:4]...), snAccepted)...)
+	for _, payload := range []string{"1", "3"} {
+		publish := c.expect(snPublish)
+		assert.Equal(t, payload, string(publish[5:]))
+		c.send(snPuback, append(append([]byte{}, publish[1:5]...), snAccepted)...)
+	}
+	c.assertSilent()
+
+	// too many qos 1 messages while asleep, the session is lost
+	c.send(snDisconnect, 0, 60)
+	c.expect(snDisconnect)
+	for _, payload := range []string{"4", "5", "6"} {
+		pub.publish("q/a", payload, 1, false)
+	}
+	waitFor(t, func() bool {
+		return len(server.Clients()) == 1
+	})
+}
+
+func TestSNWill(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	addr := serveTestServer(t, server)
+	gw := serveTestGateway(t, server, nil)
+
+	sub := dialTestClient(t, addr, "sub", true)
+	sub.subscribe("status/#", 0)
+
+	c := dialSN(t, gw)
+	c.connect("sensor", snFlagClean|snFlagWill, 1)
+	c.expect(snWillTopicReq)
+	c.send(snWillTopic, append([]byte{0}, "status/sensor"...)...)
+	c.expect(snWillMsgReq)
+	c.send(snWillMsg, []byte("gone")...)
+	assert.Equal(t, []byte{snAccepted}, c.expect(snConnack))
+
+	// the client is silent past its keepalive, its will is published
+	p := sub.receive()
+	assert.Equal(t, "status/sensor", p.TopicName)
+	assert.Equal(t, "gone", string(p.Payload))
+	waitFor(t, func() bool {
+		return len(server.Clients()) == 1
+	})
+}
+
+func TestSNGatewayDiscovery(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	server := newServer(NewOptions(), newMemoryStore())
+	gw := serveTestGateway(t, server, &SNOptions{
+		GatewayId:         9,
+		AdvertiseAddr:     listener.LocalAddr().String(),
+		AdvertiseInterval: time.Minute,
+	})
+
+	b := make([]byte, 16)
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := listener.ReadFrom(b)
+	if assert.NoError(t, err) {
+		typ, body, _ := parseSNMessage(b[:n])
+		assert.Equal(t, byte(snAdvertise), typ)
+		assert.Equal(t, []byte{9, 0, 60}, body)
+	}
+
+	c := dialSN(t, gw)
+	c.send(snSearchGw, 1)
+	assert.Equal(t, []byte{9}, c.expect(snGwInfo))
+}
+
+func TestSNMessageLength(t *testing.T) {
+	body := make([]byte, 300)
+	b := snMessage(snPublish, body)
+	assert.Equal(t, []byte{0x01, 0x01, 0x30, snPublish}, b[:4])
+	typ, parsed, err := parseSNMessage(b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, byte(snPublish), typ)
+		assert.Len(t, parsed, 300)
+	}
+	_, _, err = parseSNMessage([]byte{5, snPublish})
+	assert.Equal(t, ErrInvalidSNMessage, err)
+}
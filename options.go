@@ -10,6 +10,9 @@ const (
 	DefaultSessionsProvider = "mem"
 	DefaultAuthenticator    = "mockSuccess"
 	DefaultTopicsProvider   = "mem"
+	DefaultStoreBackend     = "leveldb"
+	DefaultStorePath        = "store.db"
+	DefaultWebSocketPing    = 30 * time.Second
 )
 
 type Options struct {
@@ -41,6 +44,96 @@ type Options struct {
 	// TopicsProvider is the topic store that keeps all the subscription topics.
 	// If not set then default to "mem".
 	TopicsProvider string
+
+	// StoreBackend is the storage of subscriptions, retained messages and sessions,
+	// one of "leveldb", "bolt", "sqlite" or "memory". If not set then default to "leveldb".
+	StoreBackend string
+
+	// StorePath is the directory of "leveldb", the file of "bolt", or the file name or dsn of "sqlite".
+	// If not set then default to "store.db".
+	StorePath string
+
+	// The interval to save the "memory" store to StorePath, and on close, it's loaded from
+	// there on start. If not set then the memory store is not saved.
+	StoreSnapshotInterval time.Duration
+
+	// StoreRestore is a backup of the "leveldb" store, a directory or a tar file,
+	// which replaces the store at StorePath before it's opened.
+	StoreRestore string
+
+	// StoreKeyFile is a file of the keys to encrypt the stored packets and the names in
+	// the store keys, see Keyring. If not set then the keys are read from the environment
+	// variable named by StoreKeyEnv, and the store is in clear if neither is set.
+	StoreKeyFile string
+	StoreKeyEnv  string
+
+	// StoreDurability is how the writes to the "leveldb" store are synced before the
+	// packets are acknowledged, "none", "sync" or "group", see DurabilityNone, DurabilitySync
+	// and DurabilityGroup.
+	// If not set then default to "none". The "bolt" and "sqlite" stores sync every write.
+	StoreDurability string
+
+	// StoreWriteBehind is the longest time the outbound packets are kept in memory
+	// before they're written to the store in a batch, see WriteBehindStore.
+	// If not set then the packets are written when they're sent.
+	StoreWriteBehind time.Duration
+	// The most outbound writes kept in memory before they're flushed.
+	// If not set then default to 10000.
+	StoreWriteBehindSize int
+
+	// WillDelay is the delay to publish the wills of the clients connected when the broker
+	// stopped, a client reconnecting within it cancels its will.
+	// If not set then the wills are published on start.
+	WillDelay time.Duration
+
+	// Policy is the connection policy of the listeners without their own, see ListenerOptions.
+	// If not set then the clients are not limited.
+	Policy *Policy
+
+	// Authorizer checks the users of the clients and of the HTTP bridge, and their access
+	// to the topics. If not set then everything is allowed.
+	Authorizer Authorizer
+
+	// MaxConnections is the most connections of all the listeners, the ones over it are closed
+	// when they're accepted. If not set then there is no limit.
+	MaxConnections int
+
+	// ConnectRate is the connections accepted per second from a source address, up to
+	// ConnectBurst at once. If not set then the connections are not rate limited.
+	ConnectRate  float64
+	ConnectBurst int
+
+	// BanFailures is the connects refused in a row, ie: for their credentials, after which
+	// the source address is banned for BanDuration. If not set then nothing is banned.
+	BanFailures int
+	BanDuration time.Duration
+
+	// AllowNets and DenyNets are CIDR networks, or single addresses, of the source addresses
+	// of the connections. A denied address is closed, and if AllowNets is set then only
+	// the addresses in it are accepted.
+	AllowNets []string
+	DenyNets  []string
+
+	// ClientQuota limits the traffic of each client, UserQuota the traffic of all the clients
+	// of a user name, for the listeners without their own, see Quota.
+	// If not set then the traffic is not limited.
+	ClientQuota *Quota
+	UserQuota   *Quota
+
+	// WebSocketPing is the interval of the pings sent to the WebSocket clients, keeping their
+	// connections open through the proxies. If not set then no pings are sent.
+	WebSocketPing time.Duration
+
+	// Store overrides StoreBackend with a store opened by the caller, ie: a RaftStore.
+	Store Store
+
+	// AdminToken is the bearer token of the admin interface, required by all its requests
+	// but the health checks. If not set then the interface has no authentication.
+	AdminToken string
+
+	// The time a client connecting to a cluster node waits for its session on the other nodes.
+	// If not set then default to 1 second.
+	ClusterTakeoverTimeout time.Duration
 }
 
 func NewOptions() *Options {
@@ -49,5 +142,9 @@ func NewOptions() *Options {
 		ConnectTimeout: DefaultConnectTimeout,
 		AckTimeout: DefaultAckTimeout,
 		TimeoutRetries: DefaultTimeoutRetries,
+		StoreBackend: DefaultStoreBackend,
+		StorePath: DefaultStorePath,
+		WebSocketPing: DefaultWebSocketPing,
+		ClusterTakeoverTimeout: DefaultClusterTakeoverTimeout,
 	}
 }
\ No newline at end of file
@@ -28,7 +28,9 @@ func init() {
 }
 
 func prepare() {
-	server := NewServer(NewOptions())
+	opts := NewOptions()
+	opts.StoreBackend = "memory"
+	server := NewServer(opts)
 	go func() {
 		pprof.Lookup("gorutine")
 		logrus.Println(http.ListenAndServe("0.0.0.0:6060", nil))
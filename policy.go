@@ -0,0 +1,137 @@
+package mqtt
+
+import (
+	"strings"
+	"time"
+)
+
+// the characters of the client ids every server must accept, [MQTT-3.1.3-5].
+const ClientIdAlphanumeric = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// Policy is the connection policy enforced on the clients of a listener, a nil policy
+// accepts everything, and so does the zero value.
+type Policy struct {
+	// The range of the keepalive of the clients, a keepalive of 0 is below any minimum.
+	// The keepalive out of range is clamped, or refused if RejectKeepAlive is set.
+	// If not set then any keepalive is accepted.
+	MinKeepAlive    time.Duration
+	MaxKeepAlive    time.Duration
+	RejectKeepAlive bool
+
+	// The longest client id, and the characters allowed in it, ie: ClientIdAlphanumeric.
+	// If not set then any client id is accepted, the ids assigned by the server are not checked.
+	MaxClientIdLen int
+	ClientIdChars  string
+
+	// The most subscriptions of a client, the subscriptions over it are refused.
+	// If not set then there is no limit.
+	MaxSubscriptions int
+
+	// The most levels of the topic names and filters, a publish over it disconnects the client
+	// and a subscription over it is refused. If not set then there is no limit.
+	MaxTopicLevels int
+
+	// The highest QoS granted to the subscriptions, the higher ones are downgraded.
+	// If not set then any QoS is granted.
+	MaxQoS *byte
+
+	// Refuse the subscriptions with wildcards, the sessions which are not clean,
+	// and the connections without a user name.
+	DenyWildcards  bool
+	DenyPersistent bool
+	DenyAnonymous  bool
+}
+
+func NewPolicy() *Policy {
+	return &Policy{}
+}
+
+// the keepalive of a client, the keepalive of the server if it's 0 and not limited.
+func (this *Policy) keepAlive(keepAlive, serverKeepAlive time.Duration) (time.Duration, error) {
+	if this == nil || (this.MinKeepAlive == 0 && this.MaxKeepAlive == 0) {
+		if keepAlive == 0 {
+			return serverKeepAlive, nil
+		}
+		return keepAlive, nil
+	}
+	switch {
+	case keepAlive < this.MinKeepAlive || keepAlive == 0:
+		if this.RejectKeepAlive {
+			return 0, ErrPolicyKeepAlive
+		}
+		keepAlive = this.MinKeepAlive
+		if keepAlive == 0 {
+			keepAlive = this.MaxKeepAlive
+		}
+	case this.MaxKeepAlive != 0 && keepAlive > this.MaxKeepAlive:
+		if this.RejectKeepAlive {
+			return 0, ErrPolicyKeepAlive
+		}
+		keepAlive = this.MaxKeepAlive
+	}
+	return keepAlive, nil
+}
+
+// check the client id sent by a client.
+func (this *Policy) checkClientId(cid string) error {
+	if this == nil {
+		return nil
+	}
+	if this.MaxClientIdLen != 0 && len(cid) > this.MaxClientIdLen {
+		return ErrPolicyClientId
+	}
+	if this.ClientIdChars != "" {
+		for _, r := range cid {
+			if !strings.ContainsRune(this.ClientIdChars, r) {
+				return ErrPolicyClientId
+			}
+		}
+	}
+	return nil
+}
+
+// check the session and the credentials of a connecting client.
+func (this *Policy) checkConnect(clean bool, username string) error {
+	if this == nil {
+		return nil
+	}
+	if this.DenyPersistent && !clean {
+		return ErrPolicyPersistent
+	}
+	if this.DenyAnonymous && username == "" {
+		return ErrPolicyAnonymous
+	}
+	return nil
+}
+
+// check the levels of a topic name or filter.
+func (this *Policy) checkTopic(topic string) error {
+	if this == nil || this.MaxTopicLevels == 0 {
+		return nil
+	}
+	if strings.Count(topic, "/")+1 > this.MaxTopicLevels {
+		return ErrPolicyTopicLevels
+	}
+	return nil
+}
+
+// the qos granted to a subscription, or an error if it's refused.
+// count is the subscriptions of the client, not counting this one.
+func (this *Policy) subscribe(filter string, qos byte, count int) (byte, error) {
+	if this == nil {
+		return qos, nil
+	}
+	if err := this.checkTopic(filter); err != nil {
+		return 0, err
+	}
+	if this.DenyWildcards && strings.ContainsAny(filter, "+#") {
+		return 0, ErrPolicyWildcard
+	}
+	if this.MaxSubscriptions != 0 && count >= this.MaxSubscriptions {
+		return 0, ErrPolicySubscriptions
+	}
+	if this.MaxQoS != nil {
+		qos = minQoS(qos, *this.MaxQoS)
+	}
+	return qos, nil
+}
@@ -0,0 +1,176 @@
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+// serve a listener with the options on a random loopback port, returns the address.
+func serveTestListener(t *testing.T, server *Server, opts *ListenerOptions) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeListener(ln, opts)
+	t.Cleanup(func() {
+		ln.Close()
+	})
+	return ln.Addr().String()
+}
+
+// the return code of the connack to the connect.
+func connackCode(t *testing.T, addr string, cp *packets.ConnectPacket) byte {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := cp.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := packets.ReadPacket(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.(*packets.ConnackPacket).ReturnCode
+}
+
+func testConnect(cid string, clean bool, keepAlive uint16) *packets.ConnectPacket {
+	cp := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ClientIdentifier = cid
+	cp.CleanSession = clean
+	cp.KeepaliveTimer = keepAlive
+	return cp
+}
+
+func TestPolicyKeepAlive(t *testing.T) {
+	var p *Policy
+	k, err := p.keepAlive(0, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, k)
+
+	p = &Policy{MinKeepAlive: 10 * time.Second, MaxKeepAlive: time.Minute}
+	for _, c := range []struct{ in, out time.Duration }{
+		{0, 10 * time.Second},
+		{5 * time.Second, 10 * time.Second},
+		{30 * time.Second, 30 * time.Second},
+		{time.Hour, time.Minute},
+	} {
+		k, err := p.keepAlive(c.in, time.Minute)
+		assert.NoError(t, err)
+		assert.Equal(t, c.out, k, "keepalive %v", c.in)
+	}
+
+	p.RejectKeepAlive = true
+	_, err = p.keepAlive(0, time.Minute)
+	assert.Equal(t, ErrPolicyKeepAlive, err)
+	_, err = p.keepAlive(time.Hour, time.Minute)
+	assert.Equal(t, ErrPolicyKeepAlive, err)
+
+	// only a maximum, the keepalive 0 is clamped to it
+	p = &Policy{MaxKeepAlive: time.Minute}
+	k, _ = p.keepAlive(0, time.Hour)
+	assert.Equal(t, time.Minute, k)
+}
+
+func TestPolicySubscribe(t *testing.T) {
+	p := NewPolicy()
+	p.MaxTopicLevels = 3
+	p.MaxSubscriptions = 2
+	p.DenyWildcards = true
+	maxQoS := byte(1)
+	p.MaxQoS = &maxQoS
+
+	qos, err := p.subscribe("a/b/c", 2, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(1), qos)
+	_, err = p.subscribe("a/b/c/d", 0, 0)
+	assert.Equal(t, ErrPolicyTopicLevels, err)
+	_, err = p.subscribe("a/+", 0, 0)
+	assert.Equal(t, ErrPolicyWildcard, err)
+	_, err = p.subscribe("a/b", 0, 2)
+	assert.Equal(t, ErrPolicySubscriptions, err)
+
+	// the zero value grants any qos
+	p = &Policy{}
+	qos, err = p.subscribe("a/b", 2, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(2), qos)
+	maxQoS = 0
+	p.MaxQoS = &maxQoS
+	qos, _ = p.subscribe("a/b", 2, 0)
+	assert.Equal(t, byte(0), qos)
+
+	p = &Policy{MaxClientIdLen: 4, ClientIdChars: ClientIdAlphanumeric}
+	assert.NoError(t, p.checkClientId("abc1"))
+	assert.Equal(t, ErrPolicyClientId, p.checkClientId("abc12"))
+	assert.Equal(t, ErrPolicyClientId, p.checkClientId("a-b"))
+}
+
+func TestListenerPolicy(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	policy := NewPolicy()
+	policy.MinKeepAlive = 10 * time.Second
+	policy.MaxKeepAlive = time.Minute
+	policy.MaxClientIdLen = 8
+	policy.MaxSubscriptions = 2
+	policy.MaxTopicLevels = 2
+	maxQoS := byte(1)
+	policy.MaxQoS = &maxQoS
+	policy.DenyWildcards = true
+	policy.DenyPersistent = true
+	addr := serveTestListener(t, server, &ListenerOptions{Policy: policy})
+	// the other listeners are not limited
+	open := serveTestServer(t, server)
+
+	assert.Equal(t, byte(packets.ErrRefusedNotAuthorised), connackCode(t, addr, testConnect("c", false, 30)))
+	assert.Equal(t, byte(packets.ErrRefusedIDRejected), connackCode(t, addr, testConnect("too-long-id", true, 30)))
+	assert.Equal(t, byte(packets.Accepted), connackCode(t, open, testConnect("too-long-id", false, 0)))
+
+	// the keepalive 0 is clamped, the client can't hold the connection forever
+	connectTestClient(t, addr, testConnect("c", true, 0))
+	c, ok := server.clients.get("c")
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Second, c.keepAlive)
+
+	sub := connectTestClient(t, addr, testConnect("sub", true, 30))
+	p := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	p.MessageID = sub.nextId()
+	p.Topics = []string{"a/b", "a/+", "a/b/c", "c/d", "a/b", "e"}
+	p.Qoss = []byte{2, 0, 0, 0, 1, 0}
+	sub.write(p)
+	ack, ok := sub.read().(*packets.SubackPacket)
+	if assert.True(t, ok) {
+		// the resubscription to a/b doesn't count to the limit
+		assert.Equal(t, []byte{1, 0x80, 0x80, 0, 1, 0x80}, ack.GrantedQoss)
+	}
+
+	// a publish with too many levels disconnects
+	pub := connectTestClient(t, addr, testConnect("pub", true, 30))
+	pub.publish("a/b", "ok", 1, false)
+	assert.Equal(t, "ok", string(sub.receive().Payload))
+	m := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	m.TopicName = "a/b/c"
+	pub.write(m)
+	pub.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := packets.ReadPacket(pub.conn)
+	assert.Error(t, err)
+}
+
+func TestPolicyAnonymous(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	server.opts.Policy = &Policy{DenyAnonymous: true}
+	addr := serveTestServer(t, server)
+
+	assert.Equal(t, byte(packets.ErrRefusedNotAuthorised), connackCode(t, addr, testConnect("c", true, 30)))
+	cp := testConnect("c", true, 30)
+	cp.UsernameFlag = true
+	cp.Username = "user"
+	assert.Equal(t, byte(packets.Accepted), connackCode(t, addr, cp))
+}
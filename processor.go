@@ -44,20 +44,39 @@ func (this *client) processPacket(msg packets.ControlPacket) (err error) {
 			}
 			return nil
 		}
-		log.Debugf("processor(%v) new publish message, mid: %v, topic: %q, qos: %q", this.id, p.MessageID, p.TopicName, p.Qos)
+		if err = this.policy.checkTopic(p.TopicName); err != nil {
+			log.Warnf("processor(%v) publish to %q refused, %v", this.id, p.TopicName, err)
+			return err
+		}
+		if !this.server.canPublish(this.username, p.TopicName) {
+			// MQTT 3.1.1 can't refuse a message, it's acknowledged and dropped
+			log.Infof("processor(%v) publish to %q not authorized", this.id, p.TopicName)
+			switch p.Qos {
+			case 1:
+				return this.puback(p.MessageID)
+			case 2:
+				return this.pubrec(p.MessageID)
+			}
+			return nil
+		}
+		log.Debugf("processor(%v) new publish message, mid: %v, topic: %q, qos: %v", this.id, p.MessageID, p.TopicName, p.Qos)
 
 		switch p.Qos {
 		case 0:
 			// [MQTT-3.3.1-2] the dup must be false if qos is 0
 			p.Dup = false
-			this.handlePublish(p)
+			if err := this.handlePublish(p); err != nil {
+				log.Warnf("processor(%v) message to %q dropped, %v", this.id, p.TopicName, err)
+			}
 		case 1:
 			if p.MessageID == 0 {
 				err = ErrInvalidMessageId
 				break
 			}
-			err = this.puback(p.MessageID)
-			this.handlePublish(p)
+			// acknowledge only the messages kept, the client resends the others after reconnecting.
+			if err = this.handlePublish(p); err == nil {
+				err = this.puback(p.MessageID)
+			}
 		case 2:
 			if p.MessageID == 0 {
 				err = ErrInvalidMessageId
@@ -65,27 +84,38 @@ func (this *client) processPacket(msg packets.ControlPacket) (err error) {
 			}
 
 			// ensure this packet is or not duplicate resend.
-			if this.server.store.FindInboundPacket(this.id, p.MessageID) == nil {
-				this.handlePublish(p)
-				this.server.store.StoreInboundPacket(this.id, p)
+			var cp packets.ControlPacket
+			if cp, err = this.server.store.FindInboundPacket(this.id, p.MessageID); this.server.storeFailed("find inbound packet", err) != nil {
+				break
+			}
+			// stored before it's forwarded, a message forwarded is never forwarded again when
+			// the client resends it. The one failed to be forwarded is deleted, it's forwarded when resent.
+			if cp == nil {
+				if err = this.server.checkStore("store inbound packet", this.server.store.StoreInboundPacket(this.id, p)); err != nil {
+					break
+				}
+				if err = this.handlePublish(p); err != nil {
+					this.server.checkStore("delete inbound packet", this.server.store.DeleteInboundPacket(this.id, p.MessageID))
+					break
+				}
 			}
 			err = this.pubrec(p.MessageID)
 		}
 	case *packets.PubackPacket:
-		this.handlePublished(msg.Details().MessageID)
+		err = this.handlePublished(msg.Details().MessageID)
 
 	case *packets.PubrecPacket:
-		err = this.pubrel(msg.Details().MessageID, false)
+		err = this.pubrel(msg.Details().MessageID)
 
 	case *packets.PubrelPacket:
 		mid := msg.Details().MessageID
 		err = this.pubcomp(mid)
 		if err == nil {
-			this.server.store.DeleteInboundPacket(this.id, mid)
+			err = this.server.checkStore("delete inbound packet", this.server.store.DeleteInboundPacket(this.id, mid))
 		}
 
 	case *packets.PubcompPacket:
-		this.handlePublished(msg.Details().MessageID)
+		err = this.handlePublished(msg.Details().MessageID)
 	case *packets.SubscribePacket:
 		p := msg.(*packets.SubscribePacket)
 
@@ -100,17 +130,36 @@ func (this *client) processPacket(msg packets.ControlPacket) (err error) {
 				qoss[index] = 0x80
 				continue
 			}
-			this.handleSubscribe(p.MessageID, topic, qos)
+			if !this.server.canSubscribe(this.username, topic) {
+				log.Infof("processor(%v) subscription to %q not authorized", this.id, topic)
+				qoss[index] = 0x80
+				continue
+			}
+			count := len(this.topics)
+			if this.topics[topic] {
+				count--
+			}
+			if qos, err = this.policy.subscribe(topic, qos, count); err != nil {
+				log.Infof("processor(%v) subscription to %q refused, %v", this.id, topic, err)
+				qoss[index] = 0x80
+				continue
+			}
+			// [MQTT-3.9.3-2] 0x80 for a subscription failed to be kept
+			if this.handleSubscribe(p.MessageID, topic, qos) != nil {
+				qoss[index] = 0x80
+				continue
+			}
 			qoss[index] = qos
 		}
 
-		this.suback(p.MessageID, qoss)
+		err = this.suback(p.MessageID, qoss)
 
 	//	case *packets.SubackPacket:
 	case *packets.UnsubscribePacket:
 		p := msg.(*packets.UnsubscribePacket)
-		this.handleUnsubscribe(p.Topics)
-		err = this.unsuback(p.MessageID)
+		if err = this.handleUnsubscribe(p.Topics); err == nil {
+			err = this.unsuback(p.MessageID)
+		}
 	//	case *packets.UnsubackPacket:
 
 	case *packets.PingreqPacket:
@@ -0,0 +1,223 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the signature of the PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// the longest v1 header, with the CRLF
+	proxyV1MaxLen = 107
+
+	proxyV2Local = 0x20
+	proxyV2Proxy = 0x21
+
+	proxyV2TCP4 = 0x11
+	proxyV2TCP6 = 0x21
+
+	// the TLS information of the connection to the proxy, and the common name of the
+	// client certificate in it
+	proxyTLVSSL   = 0x20
+	proxyTLVSSLCN = 0x22
+)
+
+// a connection behind a proxy, the addresses are the ones of the PROXY header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+	// the common name of the client certificate verified by the proxy
+	commonName string
+}
+
+func (this *proxyConn) Read(b []byte) (int, error) {
+	return this.r.Read(b)
+}
+
+func (this *proxyConn) RemoteAddr() net.Addr {
+	if this.remote != nil {
+		return this.remote
+	}
+	return this.Conn.RemoteAddr()
+}
+
+func (this *proxyConn) LocalAddr() net.Addr {
+	if this.local != nil {
+		return this.local
+	}
+	return this.Conn.LocalAddr()
+}
+
+// read the PROXY protocol header, v1 or v2, at the start of the connection.
+func readProxyHeader(conn net.Conn, timeout time.Duration) (*proxyConn, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	pc := &proxyConn{Conn: conn, r: bufio.NewReader(conn)}
+	sig, err := pc.r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(sig, proxyV2Signature):
+		err = pc.readV2()
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		err = pc.readV1()
+	default:
+		err = ErrInvalidProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// read a v1 header, a line of text:
+//
+//	PROXY TCP4 192.0.2.1 192.0.2.2 56324 1883\r\n
+func (this *proxyConn) readV1() error {
+	var line []byte
+	for {
+		b, err := this.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLen {
+			return ErrInvalidProxyHeader
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return ErrInvalidProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		// the proxy can't tell, the connection is used as is
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return ErrInvalidProxyHeader
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	sport, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dport, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return ErrInvalidProxyHeader
+	}
+	this.remote = &net.TCPAddr{IP: src, Port: int(sport)}
+	this.local = &net.TCPAddr{IP: dst, Port: int(dport)}
+	return nil
+}
+
+func (this *proxyConn) readV2() error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(this.r, header); err != nil {
+		return err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(this.r, body); err != nil {
+		return err
+	}
+
+	switch header[12] {
+	case proxyV2Local:
+		// a health check of the proxy, the connection is its own
+		return nil
+	case proxyV2Proxy:
+	default:
+		return ErrInvalidProxyHeader
+	}
+
+	var tlvs []byte
+	switch header[13] {
+	case proxyV2TCP4:
+		if len(body) < 12 {
+			return ErrInvalidProxyHeader
+		}
+		this.remote = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}
+		this.local = &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:]))}
+		tlvs = body[12:]
+	case proxyV2TCP6:
+		if len(body) < 36 {
+			return ErrInvalidProxyHeader
+		}
+		this.remote = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}
+		this.local = &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:]))}
+		tlvs = body[36:]
+	default:
+		// UDP, unix sockets or unspecified, the connection is used as is
+		return nil
+	}
+
+	return walkTLVs(tlvs, func(typ byte, value []byte) error {
+		if typ != proxyTLVSSL {
+			return nil
+		}
+		// the client flags and the verify result before the sub TLVs
+		if len(value) < 5 {
+			return ErrInvalidProxyHeader
+		}
+		verified := binary.BigEndian.Uint32(value[1:5]) == 0
+		return walkTLVs(value[5:], func(typ byte, value []byte) error {
+			if typ == proxyTLVSSLCN && verified {
+				this.commonName = string(value)
+			}
+			return nil
+		})
+	})
+}
+
+func walkTLVs(b []byte, callback func(typ byte, value []byte) error) error {
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return ErrInvalidProxyHeader
+		}
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return ErrInvalidProxyHeader
+		}
+		if err := callback(b[0], b[3:3+n]); err != nil {
+			return err
+		}
+		b = b[3+n:]
+	}
+	return nil
+}
+
+// the common name of the verified client certificate of the connection, of its TLS
+// handshake or of the PROXY header.
+func connCommonName(conn net.Conn) string {
+	for {
+		switch c := conn.(type) {
+		case *wsConn:
+			conn = c.Conn
+		case *releasedConn:
+			conn = c.Conn
+		case *bufferedConn:
+			conn = c.Conn
+		case *tls.Conn:
+			if state := c.ConnectionState(); len(state.VerifiedChains) > 0 {
+				return state.PeerCertificates[0].Subject.CommonName
+			}
+			conn = c.NetConn()
+		case *proxyConn:
+			return c.commonName
+		default:
+			return ""
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a PROXY v2 header of a TCP4 connection with the TLVs.
+func proxyV2Header(src, dst string, sport, dport uint16, tlvs []byte) []byte {
+	b := append([]byte{}, proxyV2Signature...)
+	b = append(b, proxyV2Proxy, proxyV2TCP4, 0, 0)
+	b = append(b, net.ParseIP(src).To4()...)
+	b = append(b, net.ParseIP(dst).To4()...)
+	b = binary.BigEndian.AppendUint16(b, sport)
+	b = binary.BigEndian.AppendUint16(b, dport)
+	b = append(b, tlvs...)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(b)-16))
+	return b
+}
+
+func tlv(typ byte, value []byte) []byte {
+	b := []byte{typ, 0, 0}
+	binary.BigEndian.PutUint16(b[1:], uint16(len(value)))
+	return append(b, value...)
+}
+
+// read the header sent through a pipe, the rest is read from the proxied connection.
+func readTestProxyHeader(t *testing.T, header string) (*proxyConn, error) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	go client.Write([]byte(header + "rest"))
+	pc, err := readProxyHeader(server, time.Second)
+	if err == nil {
+		rest := make([]byte, 4)
+		io.ReadFull(pc, rest)
+		assert.Equal(t, "rest", string(rest))
+	}
+	return pc, err
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	pc, err := readTestProxyHeader(t, "PROXY TCP4 203.0.113.7 10.0.0.1 40000 1883\r\n")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "203.0.113.7:40000", pc.RemoteAddr().String())
+		assert.Equal(t, "10.0.0.1:1883", pc.LocalAddr().String())
+	}
+	pc, err = readTestProxyHeader(t, "PROXY TCP6 2001:db8::1 2001:db8::2 40000 1883\r\n")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "[2001:db8::1]:40000", pc.RemoteAddr().String())
+	}
+	pc, err = readTestProxyHeader(t, "PROXY UNKNOWN\r\n")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "pipe", pc.RemoteAddr().String())
+	}
+
+	// the common name is kept if the proxy verified the certificate
+	ssl := append([]byte{0x07, 0, 0, 0, 0}, tlv(proxyTLVSSLCN, []byte("device-1"))...)
+	header := proxyV2Header("203.0.113.7", "10.0.0.1", 40000, 8883, append(tlv(0x04, []byte("noop")), tlv(proxyTLVSSL, ssl)...))
+	pc, err = readTestProxyHeader(t, string(header))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "203.0.113.7:40000", pc.RemoteAddr().String())
+		assert.Equal(t, "device-1", pc.commonName)
+	}
+	ssl[4] = 1
+	header = proxyV2Header("203.0.113.7", "10.0.0.1", 40000, 8883, tlv(proxyTLVSSL, ssl))
+	pc, err = readTestProxyHeader(t, string(header))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "", pc.commonName)
+	}
+
+	for _, header := range []string{
+		"PROXY TCP4 203.0.113.7 10.0.0.1 40000\r\n",
+		"PROXY TCP4 nowhere 10.0.0.1 40000 1883\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n",
+		"\x10\x0c\x00\x04MQTT\x04\x02\x00\x1e",
+		string(proxyV2Header("203.0.113.7", "10.0.0.1", 1, 2, []byte{proxyTLVSSL, 0, 9})),
+	} {
+		_, err = readTestProxyHeader(t, header)
+		assert.Error(t, err, "%q", header)
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	addr := serveTestListener(t, server, &ListenerOptions{
+		ProxyProtocol: true,
+		DenyNets:      []string{"198.51.100.0/24"},
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 40000 1883\r\n"))
+	connectTestConn(t, conn, testConnect("c", true, 30))
+	waitFor(t, func() bool {
+		return len(server.Clients()) == 1
+	})
+	assert.Equal(t, "203.0.113.7:40000", server.Clients()[0].Address)
+
+	// the lists check the source address of the header
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 198.51.100.1 10.0.0.1 40000 1883\r\n"))
+	testConnect("d", true, 30).Write(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.Equal(t, int64(1), server.Stats().Rejected.Denied)
+
+	// a connection without a header is closed
+	assertRefused(t, addr)
+}
+
+// a self-signed certificate of the common name, for the server and the clients.
+func testCertificate(t *testing.T, cn string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}
+}
+
+func TestTLSListener(t *testing.T) {
+	cert := testCertificate(t, "device-1")
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+
+	server := newServer(NewOptions(), newMemoryStore())
+	addr := serveTestListener(t, server, &ListenerOptions{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		},
+		// the test connects directly, it's not a proxy
+		ProxyProtocol: true,
+		ProxyNets:     []string{"10.0.0.0/8"},
+	})
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	connectTestConn(t, conn, testConnect("c", true, 30)).subscribe("a", 0)
+	clients := server.Clients()
+	if assert.Len(t, clients, 1) {
+		assert.Equal(t, "device-1", clients[0].CommonName)
+	}
+}
@@ -0,0 +1,141 @@
+package mqtt
+
+import (
+	"testing"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+// close the connection and wait until the server has seen it.
+func disconnectTestClient(t *testing.T, server *Server, c *testClient, cid string) {
+	t.Helper()
+	c.conn.Close()
+	waitFor(t, func() bool {
+		_, ok := server.clients.get(cid)
+		return !ok
+	})
+}
+
+func readPublish(t *testing.T, c *testClient) *packets.PublishPacket {
+	t.Helper()
+	p, ok := c.read().(*packets.PublishPacket)
+	if !ok {
+		t.Fatal("publish expected")
+	}
+	return p
+}
+
+func writeAck(c *testClient, packetType byte, mid uint16) {
+	p := packets.NewControlPacket(packetType)
+	switch p := p.(type) {
+	case *packets.PubrecPacket:
+		p.MessageID = mid
+	case *packets.PubcompPacket:
+		p.MessageID = mid
+	}
+	c.write(p)
+}
+
+// the subscriber disconnects at each step of the outbound QoS 2 flow, the session
+// resumes at the same step.
+func TestOutboundQoS2Resume(t *testing.T) {
+	server, addr := newTestServer(t)
+	sub := dialTestClient(t, addr, "sub", false)
+	sub.subscribe("billing", 2)
+	pub := dialTestClient(t, addr, "pub", true)
+
+	// queued while offline, it's resent from the store as a duplicate
+	disconnectTestClient(t, server, sub, "sub")
+	pub.publish("billing", "e1", 2, false)
+	sub = dialTestClient(t, addr, "sub", false)
+	p := readPublish(t, sub)
+	assert.Equal(t, "e1", string(p.Payload))
+	assert.True(t, p.Dup)
+
+	// disconnected before the PUBREC, the message is resent as a duplicate
+	disconnectTestClient(t, server, sub, "sub")
+	sub = dialTestClient(t, addr, "sub", false)
+	resent := readPublish(t, sub)
+	assert.Equal(t, p.MessageID, resent.MessageID)
+	assert.Equal(t, "e1", string(resent.Payload))
+	assert.True(t, resent.Dup)
+
+	// disconnected after the PUBREC, the release is resent instead of the message
+	writeAck(sub, packets.Pubrec, p.MessageID)
+	_, ok := sub.read().(*packets.PubrelPacket)
+	assert.True(t, ok, "pubrel expected")
+	disconnectTestClient(t, server, sub, "sub")
+	sub = dialTestClient(t, addr, "sub", false)
+	if rel, ok := sub.read().(*packets.PubrelPacket); assert.True(t, ok, "pubrel expected") {
+		assert.Equal(t, p.MessageID, rel.MessageID)
+		assert.False(t, rel.Dup)
+	}
+	assert.True(t, server.mids.used("sub", p.MessageID), "kept until the PUBCOMP")
+
+	// disconnected after the PUBCOMP, nothing is resent
+	writeAck(sub, packets.Pubcomp, p.MessageID)
+	waitFor(t, func() bool {
+		return !server.mids.used("sub", p.MessageID)
+	})
+	assert.Equal(t, 0, storeSize(t, server.store.OutPacketsSize))
+	disconnectTestClient(t, server, sub, "sub")
+	sub = dialTestClient(t, addr, "sub", false)
+	pub.publish("billing", "e2", 2, false)
+	p = sub.receive()
+	assert.Equal(t, "e2", string(p.Payload))
+	assert.False(t, p.Dup)
+}
+
+// the stored copy of a message is a duplicate only once it's sent.
+func TestOutboundQoS2Dup(t *testing.T) {
+	server, addr := newTestServer(t)
+	sub := dialTestClient(t, addr, "sub", false)
+	sub.subscribe("billing", 2)
+	pub := dialTestClient(t, addr, "pub", true)
+	stored := func() (l []*packets.PublishPacket) {
+		assert.NoError(t, server.store.StreamOfflinePackets("sub", func(p packets.ControlPacket) {
+			l = append(l, p.(*packets.PublishPacket))
+		}))
+		return
+	}
+
+	pub.publish("billing", "e1", 2, false)
+	assert.False(t, readPublish(t, sub).Dup)
+	// stored once, as it's sent
+	if l := stored(); assert.Len(t, l, 1) {
+		assert.False(t, l[0].Dup)
+	}
+
+	// not acknowledged, it's resent as a duplicate
+	disconnectTestClient(t, server, sub, "sub")
+	sub = dialTestClient(t, addr, "sub", false)
+	p := readPublish(t, sub)
+	assert.Equal(t, "e1", string(p.Payload))
+	assert.True(t, p.Dup)
+	if l := stored(); assert.Len(t, l, 1) {
+		assert.False(t, l[0].Dup)
+	}
+}
+
+// the ids of the stored packets are not reused after a restart.
+func TestMessageIdsReloaded(t *testing.T) {
+	store := newMemoryStore()
+	p := testPublish(1)
+	assert.NoError(t, store.StoreSubscription("billing", "sub", 2))
+	assert.NoError(t, store.StoreOutboundPacket("sub", p))
+	rel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	rel.MessageID = 2
+	assert.NoError(t, store.StoreOutboundPacket("sub", rel))
+
+	server, addr := newTestServerWithStore(t, store)
+	pub := dialTestClient(t, addr, "pub", true)
+	pub.publish("billing", "e3", 2, false)
+
+	var mids []uint16
+	assert.NoError(t, store.StreamOfflinePackets("sub", func(p packets.ControlPacket) {
+		mids = append(mids, p.Details().MessageID)
+	}))
+	assert.Equal(t, []uint16{1, 2, 3}, mids)
+	assert.True(t, server.mids.used("sub", 3))
+}
@@ -0,0 +1,125 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+// the ALPN of MQTT over QUIC when the TLS config has none
+const quicProtocol = "mqtt"
+
+func init() {
+	RegisterTransport("quic", listenQUIC)
+}
+
+// a listener of the bidirectional streams of QUIC connections, a stream per MQTT client.
+// A client moving to another address keeps its QUIC connection and its streams, its
+// session goes on without a new CONNECT.
+type quicListener struct {
+	ln    *quic.Listener
+	conns chan net.Conn
+	quit  chan struct{}
+	once  sync.Once
+	err   error
+}
+
+// a stream served as a connection, its addresses are the current addresses of its QUIC connection
+type quicConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (this *quicConn) LocalAddr() net.Addr {
+	return this.conn.LocalAddr()
+}
+
+func (this *quicConn) RemoteAddr() net.Addr {
+	return this.conn.RemoteAddr()
+}
+
+// Close closes both directions of the stream, the QUIC connection is closed by the client
+// or once it's idle.
+func (this *quicConn) Close() error {
+	this.Stream.CancelRead(0)
+	return this.Stream.Close()
+}
+
+// listen on the UDP host, the config is required by QUIC.
+func listenQUIC(host string, config *tls.Config) (net.Listener, error) {
+	if config == nil {
+		return nil, ErrQUICWithoutTLS
+	}
+	if len(config.NextProtos) == 0 {
+		config = config.Clone()
+		config.NextProtos = []string{quicProtocol}
+	}
+	ln, err := quic.ListenAddr(host, config, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	this := &quicListener{
+		ln:    ln,
+		conns: make(chan net.Conn),
+		quit:  make(chan struct{}),
+	}
+	go this.accept()
+	return this, nil
+}
+
+func (this *quicListener) accept() {
+	for {
+		conn, err := this.ln.Accept(context.Background())
+		if err != nil {
+			this.close(err)
+			return
+		}
+		go this.acceptStreams(conn)
+	}
+}
+
+func (this *quicListener) acceptStreams(conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(conn.Context())
+		if err != nil {
+			log.Debugf("quic connection from %v closed: %v", conn.RemoteAddr(), err)
+			return
+		}
+		select {
+		case this.conns <- &quicConn{stream, conn}:
+		case <-this.quit:
+			stream.CancelRead(0)
+			stream.CancelWrite(0)
+			return
+		}
+	}
+}
+
+func (this *quicListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-this.conns:
+		return conn, nil
+	case <-this.quit:
+		return nil, this.err
+	}
+}
+
+func (this *quicListener) close(err error) {
+	this.once.Do(func() {
+		this.err = err
+		close(this.quit)
+	})
+}
+
+func (this *quicListener) Close() error {
+	this.close(net.ErrClosed)
+	return this.ln.Close()
+}
+
+func (this *quicListener) Addr() net.Addr {
+	return this.ln.Addr()
+}
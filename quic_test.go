@@ -0,0 +1,85 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// a QUIC transport of the client on a new loopback UDP socket.
+func quicTestTransport(t *testing.T) *quic.Transport {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &quic.Transport{Conn: udp}
+	t.Cleanup(func() {
+		tr.Close()
+		udp.Close()
+	})
+	return tr
+}
+
+func TestQUICTransport(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	addr := serveTestServer(t, server)
+
+	cert := testCertificate(t, "broker")
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	ln, err := listenQUIC("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeListener(ln, nil)
+	t.Cleanup(func() {
+		ln.Close()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quicTestTransport(t).Dial(ctx, ln.Addr(), &tls.Config{RootCAs: pool, NextProtos: []string{quicProtocol}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := connectTestConn(t, &quicConn{stream, conn}, testConnect("c", true, 30))
+	c.subscribe("a", 1)
+	pub := dialTestClient(t, addr, "pub", true)
+	pub.publish("a", "1", 1, false)
+	assert.Equal(t, "1", string(c.receive().Payload))
+
+	// the client moves to another address, its session goes on over the same stream
+	tr := quicTestTransport(t)
+	path, err := conn.AddPath(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := path.Probe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := path.Switch(); err != nil {
+		t.Fatal(err)
+	}
+	pub.publish("a", "2", 1, false)
+	assert.Equal(t, "2", string(c.receive().Payload))
+	// the server moves to the address of the packets of the client
+	c.subscribe("b", 0)
+	client, ok := server.clients.get("c")
+	if assert.True(t, ok) {
+		waitFor(t, func() bool {
+			return client.conn.RemoteAddr().String() == tr.Conn.LocalAddr().String()
+		})
+	}
+	assert.Len(t, server.Clients(), 2)
+}
@@ -0,0 +1,281 @@
+package mqtt
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+)
+
+// the actions on the inbound packets over a quota
+const (
+	// pause the reads until the quota allows the packet, the default
+	QuotaThrottle = "throttle"
+	// drop the QoS 0 messages, the others are throttled
+	QuotaDrop = "drop"
+	// disconnect the client
+	QuotaDisconnect = "disconnect"
+)
+
+// Quota limits the traffic of the clients with token buckets, a rate not set is not limited.
+// The bursts are the tokens of a bucket, if not set then default to one second of its rate.
+type Quota struct {
+	// The inbound messages, ie: PUBLISH packets, per second.
+	MessageRate  float64
+	MessageBurst int
+
+	// The inbound bytes per second, of all the packets.
+	ByteRate  float64
+	ByteBurst int
+
+	// Action is what is done with the inbound packets over the quota, QuotaThrottle,
+	// QuotaDrop or QuotaDisconnect. If not set then default to QuotaThrottle.
+	Action string
+
+	// The outbound bytes per second, the writes are paced to it.
+	OutByteRate  float64
+	OutByteBurst int
+}
+
+// a token bucket, a zero rate is unlimited.
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, burst int) bucket {
+	b := bucket{rate: rate, burst: float64(burst)}
+	if b.burst <= 0 {
+		b.burst = rate
+	}
+	if b.burst < 1 {
+		b.burst = 1
+	}
+	b.tokens = b.burst
+	b.last = time.Now()
+	return b
+}
+
+func (this *bucket) refill(now time.Time) {
+	this.tokens += now.Sub(this.last).Seconds() * this.rate
+	if this.tokens > this.burst {
+		this.tokens = this.burst
+	}
+	this.last = now
+}
+
+// the time until the bucket has n tokens.
+func (this *bucket) wait(n float64) time.Duration {
+	if this.rate <= 0 || this.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - this.tokens) / this.rate * float64(time.Second))
+}
+
+func (this *bucket) take(n float64) {
+	if this.rate > 0 {
+		this.tokens -= n
+	}
+}
+
+// the buckets of a quota, for a client, a user or a listener.
+type quotaBuckets struct {
+	sync.Mutex
+	action   string
+	messages bucket
+	bytes    bucket
+	out      bucket
+}
+
+// the buckets of the quota, nil if there is no quota.
+func newQuotaBuckets(q *Quota) *quotaBuckets {
+	if q == nil {
+		return nil
+	}
+	action := q.Action
+	if action == "" {
+		action = QuotaThrottle
+	}
+	return &quotaBuckets{
+		action:   action,
+		messages: newBucket(q.MessageRate, q.MessageBurst),
+		bytes:    newBucket(q.ByteRate, q.ByteBurst),
+		out:      newBucket(q.OutByteRate, q.OutByteBurst),
+	}
+}
+
+// charge an inbound packet of n bytes, returns the time to wait before it's allowed.
+// A throttled packet is charged at once, the others only once they're allowed.
+func (this *quotaBuckets) inbound(messages, n float64, throttle bool) time.Duration {
+	this.Lock()
+	defer this.Unlock()
+	now := time.Now()
+	this.messages.refill(now)
+	this.bytes.refill(now)
+	wait := this.messages.wait(messages)
+	if w := this.bytes.wait(n); w > wait {
+		wait = w
+	}
+	if wait == 0 || throttle {
+		this.messages.take(messages)
+		this.bytes.take(n)
+	}
+	return wait
+}
+
+// charge an outbound write of n bytes, returns the time to wait before the next one.
+func (this *quotaBuckets) outbound(n float64) time.Duration {
+	this.Lock()
+	defer this.Unlock()
+	this.out.refill(time.Now())
+	this.out.take(n)
+	return this.out.wait(0)
+}
+
+// the buckets of the users shared by their clients, released with the last client.
+type userQuotas struct {
+	sync.Mutex
+	m map[string]*userQuota
+}
+
+type userQuota struct {
+	buckets *quotaBuckets
+	clients int
+}
+
+// the buckets of the user, q is the quota of the first client of the user.
+func (this *userQuotas) acquire(user string, q *Quota) *quotaBuckets {
+	if user == "" || q == nil {
+		return nil
+	}
+	this.Lock()
+	defer this.Unlock()
+	if this.m == nil {
+		this.m = make(map[string]*userQuota)
+	}
+	u, ok := this.m[user]
+	if !ok {
+		u = &userQuota{buckets: newQuotaBuckets(q)}
+		this.m[user] = u
+	}
+	u.clients++
+	return u.buckets
+}
+
+func (this *userQuotas) release(user string) {
+	this.Lock()
+	defer this.Unlock()
+	if u, ok := this.m[user]; ok {
+		if u.clients--; u.clients == 0 {
+			delete(this.m, user)
+		}
+	}
+}
+
+// the quotas of a connected client, of the client, its user and its listener.
+func (this *client) acquireQuotas(user string) {
+	var l *ListenerOptions
+	if this.listener != nil {
+		l = this.listener.opts
+	}
+	clientQuota, userQuota := this.opts.ClientQuota, this.opts.UserQuota
+	if l != nil && l.ClientQuota != nil {
+		clientQuota = l.ClientQuota
+	}
+	if l != nil && l.UserQuota != nil {
+		userQuota = l.UserQuota
+	}
+
+	this.quotas = nil
+	if b := newQuotaBuckets(clientQuota); b != nil {
+		this.quotas = append(this.quotas, b)
+	}
+	if b := this.server.userQuotas.acquire(user, userQuota); b != nil {
+		this.user = user
+		this.quotas = append(this.quotas, b)
+	}
+	if this.listener != nil && this.listener.quota != nil {
+		this.quotas = append(this.quotas, this.listener.quota)
+	}
+}
+
+func (this *client) releaseQuotas() {
+	if this.user != "" {
+		this.server.userQuotas.release(this.user)
+	}
+}
+
+// charge an inbound packet of n bytes to the quotas of the client, waits while it's
+// throttled. Returns false if the packet is dropped, or an error to disconnect.
+func (this *client) chargeInbound(cp packets.ControlPacket, n int) (bool, error) {
+	var messages float64
+	p, publish := cp.(*packets.PublishPacket)
+	if publish {
+		messages = 1
+	}
+	for _, q := range this.quotas {
+		throttle := q.action == QuotaThrottle || (q.action == QuotaDrop && !(publish && p.Qos == 0))
+		wait := q.inbound(messages, float64(n), throttle)
+		if wait == 0 {
+			continue
+		}
+		switch {
+		case throttle:
+			log.Debugf("client(%v) over its quota, reads paused for %v", this.id, wait)
+			if !this.sleep(wait) {
+				return false, ErrDisconnect
+			}
+		case q.action == QuotaDrop:
+			log.Debugf("client(%v) over its quota, message to %q dropped", this.id, p.TopicName)
+			return false, nil
+		default:
+			return false, ErrQuotaExceeded
+		}
+	}
+	return true, nil
+}
+
+// pace the outbound writes of the client after a write of n bytes.
+func (this *client) chargeOutbound(n int) bool {
+	var wait time.Duration
+	for _, q := range this.quotas {
+		if w := q.outbound(float64(n)); w > wait {
+			wait = w
+		}
+	}
+	return wait == 0 || this.sleep(wait)
+}
+
+// sleep unless the client is stopped, returns false if it's stopped.
+func (this *client) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-this.Dying():
+		return false
+	}
+}
+
+// counts the bytes read or written through it.
+type countingConn struct {
+	r io.Reader
+	w io.Writer
+	n int
+}
+
+func (this *countingConn) Read(b []byte) (int, error) {
+	n, err := this.r.Read(b)
+	this.n += n
+	return n, err
+}
+
+func (this *countingConn) Write(b []byte) (int, error) {
+	n, err := this.w.Write(b)
+	this.n += n
+	return n, err
+}
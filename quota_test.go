@@ -0,0 +1,146 @@
+package mqtt
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func userConnect(cid, user string) *packets.ConnectPacket {
+	cp := testConnect(cid, true, 30)
+	cp.UsernameFlag = true
+	cp.Username = user
+	return cp
+}
+
+func publishQoS0(c *testClient, topic, payload string) {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Payload = []byte(payload)
+	c.write(p)
+}
+
+// the server closes the connection of the client.
+func assertDisconnected(t *testing.T, c *testClient) {
+	t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := packets.ReadPacket(c.conn)
+	assert.Error(t, err)
+}
+
+func TestBucket(t *testing.T) {
+	b := newBucket(10, 2)
+	assert.Equal(t, time.Duration(0), b.wait(2))
+	b.take(2)
+	assert.InDelta(t, float64(100*time.Millisecond), float64(b.wait(1)), float64(10*time.Millisecond))
+
+	// the burst defaults to a second of the rate
+	b = newBucket(100, 0)
+	assert.Equal(t, float64(100), b.burst)
+
+	b = newBucket(0, 0)
+	b.take(1000)
+	assert.Equal(t, time.Duration(0), b.wait(1000))
+}
+
+func TestQuotaDisconnect(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	server.opts.ClientQuota = &Quota{MessageRate: 0.01, MessageBurst: 2, Action: QuotaDisconnect}
+	addr := serveTestServer(t, server)
+
+	pub := dialTestClient(t, addr, "pub", true)
+	pub.publish("a", "1", 1, false)
+	pub.publish("a", "2", 1, false)
+	publishQoS0(pub, "a", "3")
+	assertDisconnected(t, pub)
+
+	// the quota is of the client, the others are not limited
+	other := dialTestClient(t, addr, "other", true)
+	other.publish("a", "1", 1, false)
+}
+
+func TestQuotaDrop(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	addr := serveTestListener(t, server, &ListenerOptions{
+		ClientQuota: &Quota{MessageRate: 0.01, MessageBurst: 1, Action: QuotaDrop},
+	})
+	open := serveTestServer(t, server)
+
+	sub := dialTestClient(t, open, "sub", true)
+	sub.subscribe("a", 0)
+	pub := dialTestClient(t, addr, "pub", true)
+	publishQoS0(pub, "a", "1")
+	publishQoS0(pub, "a", "2")
+	publishQoS0(pub, "a", "3")
+	// the client of the other listener is not limited
+	dialTestClient(t, open, "other", true).publish("a", "marker", 0, false)
+
+	assert.Equal(t, "1", string(sub.receive().Payload))
+	assert.Equal(t, "marker", string(sub.receive().Payload))
+}
+
+func TestQuotaThrottle(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	server.opts.ClientQuota = &Quota{MessageRate: 20, MessageBurst: 1}
+	addr := serveTestServer(t, server)
+
+	pub := dialTestClient(t, addr, "pub", true)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		pub.publish("a", "m", 1, false)
+	}
+	// the reads are paused, the messages are acknowledged at the rate
+	assert.True(t, time.Since(start) >= 200*time.Millisecond, "throttled in %v", time.Since(start))
+}
+
+func TestUserQuota(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	server.opts.UserQuota = &Quota{MessageRate: 0.01, MessageBurst: 1, Action: QuotaDisconnect}
+	addr := serveTestServer(t, server)
+
+	c1 := connectTestClient(t, addr, userConnect("c1", "device"))
+	c2 := connectTestClient(t, addr, userConnect("c2", "device"))
+	c1.publish("a", "1", 1, false)
+	publishQoS0(c2, "a", "2")
+	assertDisconnected(t, c2)
+
+	// the anonymous clients have no user quota
+	anonymous := dialTestClient(t, addr, "c3", true)
+	anonymous.publish("a", "1", 1, false)
+	anonymous.publish("a", "2", 1, false)
+}
+
+func TestListenerOutboundQuota(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	addr := serveTestListener(t, server, &ListenerOptions{
+		ListenerQuota: &Quota{OutByteRate: 1000, OutByteBurst: 100},
+	})
+	open := serveTestServer(t, server)
+
+	sub := dialTestClient(t, addr, "sub", true)
+	sub.subscribe("a", 0)
+	pub := dialTestClient(t, open, "pub", true)
+	payload := strings.Repeat("x", 250)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		publishQoS0(pub, "a", payload)
+	}
+	for i := 0; i < 3; i++ {
+		sub.receive()
+	}
+	assert.True(t, time.Since(start) >= 400*time.Millisecond, "paced in %v", time.Since(start))
+}
+
+func TestUnknownQuotaAction(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.ServeListener(ln, &ListenerOptions{ClientQuota: &Quota{Action: "pause"}})
+	assert.Equal(t, ErrUnknownQuotaAction, err)
+}
@@ -0,0 +1,421 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-boltdb/v2"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const DefaultRaftApplyTimeout = 5 * time.Second
+
+// the operations replicated through the raft log
+const (
+	raftStoreSubscription byte = iota + 1
+	raftDeleteSubscription
+	raftCleanSubscription
+	raftStoreRetained
+	raftStoreInbound
+	raftStoreOutbound
+	raftDeleteInbound
+	raftDeleteOutbound
+	raftCleanPackets
+	raftStoreWill
+	raftDeleteWill
+)
+
+type RaftOptions struct {
+	// ID is the unique id of this node in the raft cluster.
+	ID string
+
+	// Dir keeps the leveldb store, the raft log and the snapshots of this node.
+	Dir string
+
+	// Transport connects this node to the others,
+	// raft.NewTCPTransport for real deployments or raft.NewInmemTransport in tests.
+	Transport raft.Transport
+
+	// Bootstrap is the initial members of the cluster, including this node.
+	// Set it on a new cluster only, the configuration is kept in the raft log after.
+	Bootstrap []raft.Server
+
+	// LogStore and StableStore keep the raft log and the votes.
+	// If not set then both default to a bolt database in Dir.
+	LogStore    raft.LogStore
+	StableStore raft.StableStore
+
+	// SnapshotStore keeps the snapshots of the store.
+	// If not set then default to a file snapshot store in Dir.
+	SnapshotStore raft.SnapshotStore
+
+	// Config tunes the raft timeouts, LocalID is set from ID.
+	// If not set then default to raft.DefaultConfig().
+	Config *raft.Config
+
+	// Keys encrypts the commands in the raft log, and the packets and the names in the store, if not nil.
+	Keys *Keyring
+
+	// The time to wait for a change to be committed by the majority of the nodes.
+	// If not set then default to 5 seconds.
+	ApplyTimeout time.Duration
+}
+
+// RaftStore replicates every change through a raft log before it's applied to
+// the LevelStore of each node, so the changes acknowledged by the leader survive
+// the failure of a minority of the nodes.
+//
+// The changes must be made on the leader, the others refuse them with raft.ErrNotLeader.
+// The lookups read the local copy, which may fall behind on the followers.
+type RaftStore struct {
+	*LevelStore
+
+	raft    *raft.Raft
+	timeout time.Duration
+	bolt    *raftboltdb.BoltStore
+}
+
+type raftCommand struct {
+	Op     byte
+	Cid    string
+	Filter string
+	Qos    byte
+	Mid    uint16
+	Packet []byte
+}
+
+// NewRaftStore opens the local store in opts.Dir and starts the raft node.
+func NewRaftStore(opts *RaftOptions) (*RaftStore, error) {
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	level, err := newLevelStore(filepath.Join(opts.Dir, "store.db"))
+	if err != nil {
+		return nil, err
+	}
+	level.keys = opts.Keys
+
+	store := &RaftStore{LevelStore: level, timeout: opts.ApplyTimeout}
+	if store.timeout == 0 {
+		store.timeout = DefaultRaftApplyTimeout
+	}
+
+	logs, stable := opts.LogStore, opts.StableStore
+	if logs == nil || stable == nil {
+		if store.bolt, err = raftboltdb.NewBoltStore(filepath.Join(opts.Dir, "raft.db")); err != nil {
+			level.db.Close()
+			return nil, err
+		}
+		if logs == nil {
+			logs = store.bolt
+		}
+		if stable == nil {
+			stable = store.bolt
+		}
+	}
+
+	snaps := opts.SnapshotStore
+	if snaps == nil {
+		if snaps, err = raft.NewFileSnapshotStore(opts.Dir, 2, os.Stderr); err != nil {
+			store.close()
+			return nil, err
+		}
+	}
+
+	config := raft.DefaultConfig()
+	if opts.Config != nil {
+		c := *opts.Config
+		config = &c
+	}
+	config.LocalID = raft.ServerID(opts.ID)
+
+	if store.raft, err = raft.NewRaft(config, (*raftFSM)(level), logs, stable, snaps, opts.Transport); err != nil {
+		store.close()
+		return nil, err
+	}
+
+	if len(opts.Bootstrap) > 0 {
+		err = store.raft.BootstrapCluster(raft.Configuration{Servers: opts.Bootstrap}).Error()
+		if err != nil && err != raft.ErrCantBootstrap {
+			store.Close()
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// Raft returns the raft node, to watch the leadership or change the members of the cluster.
+func (this *RaftStore) Raft() *raft.Raft {
+	return this.raft
+}
+
+func (this *RaftStore) IsLeader() bool {
+	return this.raft.State() == raft.Leader
+}
+
+// Join adds a node to the cluster as a voter, it must be called on the leader.
+func (this *RaftStore) Join(id string, addr raft.ServerAddress) error {
+	return this.raft.AddVoter(raft.ServerID(id), addr, 0, this.timeout).Error()
+}
+
+// Leave removes a node from the cluster, it must be called on the leader.
+func (this *RaftStore) Leave(id string) error {
+	return this.raft.RemoveServer(raft.ServerID(id), 0, this.timeout).Error()
+}
+
+// Close stops the raft node and closes the local store.
+func (this *RaftStore) Close() error {
+	err := this.raft.Shutdown().Error()
+	this.close()
+	return err
+}
+
+func (this *RaftStore) close() {
+	if this.bolt != nil {
+		this.bolt.Close()
+	}
+	this.db.Close()
+}
+
+// replicate the command and wait until it's applied locally.
+func (this *RaftStore) apply(cmd *raftCommand) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cmd); err != nil {
+		return err
+	}
+	f := this.raft.Apply(this.keys.seal(buf.Bytes()), this.timeout)
+	if err := f.Error(); err != nil {
+		return err
+	}
+	if err, ok := f.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+func (this *RaftStore) StoreSubscription(filter, cid string, qos byte) error {
+	return this.apply(&raftCommand{Op: raftStoreSubscription, Cid: cid, Filter: filter, Qos: qos})
+}
+
+func (this *RaftStore) DeleteSubscription(filter, cid string) error {
+	return this.apply(&raftCommand{Op: raftDeleteSubscription, Cid: cid, Filter: filter})
+}
+
+func (this *RaftStore) CleanSubscription(cid string) error {
+	return this.apply(&raftCommand{Op: raftCleanSubscription, Cid: cid})
+}
+
+func (this *RaftStore) StoreRetained(p *packets.PublishPacket) error {
+	return this.apply(&raftCommand{Op: raftStoreRetained, Packet: MarshalPacket(p)})
+}
+
+func (this *RaftStore) StoreWill(cid string, p *packets.PublishPacket) error {
+	return this.apply(&raftCommand{Op: raftStoreWill, Cid: cid, Packet: MarshalPacket(p)})
+}
+
+func (this *RaftStore) DeleteWill(cid string) error {
+	return this.apply(&raftCommand{Op: raftDeleteWill, Cid: cid})
+}
+
+func (this *RaftStore) StoreInboundPacket(cid string, p packets.ControlPacket) error {
+	return this.apply(&raftCommand{Op: raftStoreInbound, Cid: cid, Packet: MarshalPacket(p)})
+}
+
+func (this *RaftStore) StoreOutboundPacket(cid string, p packets.ControlPacket) error {
+	return this.apply(&raftCommand{Op: raftStoreOutbound, Cid: cid, Packet: MarshalPacket(p)})
+}
+
+func (this *RaftStore) DeleteInboundPacket(cid string, mid uint16) error {
+	return this.apply(&raftCommand{Op: raftDeleteInbound, Cid: cid, Mid: mid})
+}
+
+func (this *RaftStore) DeleteOutboundPacket(cid string, mid uint16) error {
+	return this.apply(&raftCommand{Op: raftDeleteOutbound, Cid: cid, Mid: mid})
+}
+
+func (this *RaftStore) CleanPackets(cid string) error {
+	return this.apply(&raftCommand{Op: raftCleanPackets, Cid: cid})
+}
+
+// writeOutbound replicates the writes one by one, the LevelStore batch would skip the log.
+func (this *RaftStore) writeOutbound(writes []outboundWrite) error {
+	for _, w := range writes {
+		var err error
+		if w.p == nil {
+			err = this.DeleteOutboundPacket(w.cid, w.mid)
+		} else {
+			err = this.StoreOutboundPacket(w.cid, w.p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// raftFSM applies the committed commands to the LevelStore of the node.
+// All the commands only put or delete keys, replaying them is harmless.
+type raftFSM LevelStore
+
+func (this *raftFSM) Apply(l *raft.Log) interface{} {
+	data, err := this.keys.open(l.Data)
+	if err != nil {
+		return err
+	}
+	cmd := new(raftCommand)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(cmd); err != nil {
+		return err
+	}
+
+	store := (*LevelStore)(this)
+	switch cmd.Op {
+	case raftStoreSubscription:
+		return store.StoreSubscription(cmd.Filter, cmd.Cid, cmd.Qos)
+	case raftDeleteSubscription:
+		return store.DeleteSubscription(cmd.Filter, cmd.Cid)
+	case raftCleanSubscription:
+		return store.CleanSubscription(cmd.Cid)
+	case raftStoreRetained:
+		p, err := decodePublish(cmd.Packet)
+		if err != nil {
+			return err
+		}
+		return store.StoreRetained(p)
+	case raftStoreWill:
+		p, err := decodePublish(cmd.Packet)
+		if err != nil {
+			return err
+		}
+		return store.StoreWill(cmd.Cid, p)
+	case raftDeleteWill:
+		return store.DeleteWill(cmd.Cid)
+	case raftStoreInbound, raftStoreOutbound:
+		p, err := decodePacket(cmd.Packet)
+		if err != nil {
+			return err
+		}
+		if cmd.Op == raftStoreInbound {
+			return store.StoreInboundPacket(cmd.Cid, p)
+		}
+		return store.StoreOutboundPacket(cmd.Cid, p)
+	case raftDeleteInbound:
+		return store.DeleteInboundPacket(cmd.Cid, cmd.Mid)
+	case raftDeleteOutbound:
+		return store.DeleteOutboundPacket(cmd.Cid, cmd.Mid)
+	case raftCleanPackets:
+		return store.CleanPackets(cmd.Cid)
+	}
+	return ErrUnknownRaftCommand
+}
+
+// Snapshot takes a leveldb snapshot, the keys and values are copied as they are,
+// so a snapshot has the same layout as the LevelStore.
+func (this *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	snap, err := this.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &raftSnapshot{snap}, nil
+}
+
+// Restore replaces the whole store with the snapshot.
+func (this *raftFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	b := new(leveldb.Batch)
+	iter := this.db.NewIterator(nil, nil)
+	for iter.Next() {
+		b.Delete(iter.Key())
+	}
+	iter.Release()
+	if err := this.db.Write(b, nil); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(rc)
+	b.Reset()
+	for {
+		key, err := readChunk(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		value, err := readChunk(r)
+		if err != nil {
+			return err
+		}
+		b.Put(key, value)
+		if b.Len() >= 1000 {
+			if err := this.db.Write(b, nil); err != nil {
+				return err
+			}
+			b.Reset()
+		}
+	}
+	return this.db.Write(b, nil)
+}
+
+type raftSnapshot struct {
+	snap *leveldb.Snapshot
+}
+
+// Persist writes every key and value prefixed by their lengths.
+func (this *raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	w := bufio.NewWriter(sink)
+	iter := this.snap.NewIterator(nil, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		if err := writeChunk(w, iter.Key()); err != nil {
+			sink.Cancel()
+			return err
+		}
+		if err := writeChunk(w, iter.Value()); err != nil {
+			sink.Cancel()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (this *raftSnapshot) Release() {
+	this.snap.Release()
+}
+
+func writeChunk(w io.Writer, data []byte) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readChunk(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,161 @@
+package mqtt
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+// start raft stores connected by in-memory transports.
+func newTestRaftStores(t *testing.T, size int) []*RaftStore {
+	dir := t.TempDir()
+	transports := make([]*raft.InmemTransport, size)
+	servers := make([]raft.Server, size)
+	for i := range transports {
+		var addr raft.ServerAddress
+		addr, transports[i] = raft.NewInmemTransport(raft.ServerAddress(fmt.Sprint("node", i)))
+		servers[i] = raft.Server{ID: raft.ServerID(addr), Address: addr}
+	}
+	for _, a := range transports {
+		for _, b := range transports {
+			if a != b {
+				a.Connect(b.LocalAddr(), b)
+			}
+		}
+	}
+
+	config := raft.DefaultConfig()
+	config.HeartbeatTimeout = 50 * time.Millisecond
+	config.ElectionTimeout = 50 * time.Millisecond
+	config.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.CommitTimeout = 5 * time.Millisecond
+
+	stores := make([]*RaftStore, size)
+	for i := range stores {
+		store, err := NewRaftStore(&RaftOptions{
+			ID:            string(servers[i].ID),
+			Dir:           filepath.Join(dir, string(servers[i].ID)),
+			Transport:     transports[i],
+			Bootstrap:     servers,
+			LogStore:      raft.NewInmemStore(),
+			StableStore:   raft.NewInmemStore(),
+			SnapshotStore: raft.NewInmemSnapshotStore(),
+			Config:        config,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores[i] = store
+	}
+	t.Cleanup(func() {
+		for _, store := range stores {
+			store.Close()
+		}
+	})
+	return stores
+}
+
+func waitForLeader(t *testing.T, stores []*RaftStore) *RaftStore {
+	t.Helper()
+	var leader *RaftStore
+	waitFor(t, func() bool {
+		for _, store := range stores {
+			if store.IsLeader() {
+				leader = store
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+func TestRaftStoreReplication(t *testing.T) {
+	stores := newTestRaftStores(t, 3)
+	leader := waitForLeader(t, stores)
+
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = "a/b"
+	p.Qos = 1
+	p.MessageID = 1
+	p.Payload = []byte("hello")
+	leader.StoreSubscription("a/#", "c1", 1)
+	assert.NoError(t, leader.StoreOutboundPacket("c1", p))
+
+	for _, store := range stores {
+		if store != leader {
+			assert.Equal(t, raft.ErrNotLeader, store.StoreOutboundPacket("c1", p))
+		}
+		store := store
+		waitFor(t, func() bool {
+			return storeSize(t, store.OutPacketsSize) == 1
+		})
+	}
+
+	// a new leader is elected with the acknowledged session
+	leader.raft.Shutdown()
+	var rest []*RaftStore
+	for _, store := range stores {
+		if store != leader {
+			rest = append(rest, store)
+		}
+	}
+	leader = waitForLeader(t, rest)
+
+	var filters []string
+	leader.LookupSubscriptions(func(filter, cid string, qos byte) {
+		filters = append(filters, filter)
+	})
+	assert.Equal(t, []string{"a/#"}, filters)
+	leader.StreamOfflinePackets("c1", func(cp packets.ControlPacket) {
+		assert.Equal(t, "hello", string(cp.(*packets.PublishPacket).Payload))
+	})
+
+	leader.DeleteOutboundPacket("c1", 1)
+	assert.Equal(t, 0, storeSize(t, leader.OutPacketsSize))
+}
+
+func TestRaftStoreSnapshot(t *testing.T) {
+	stores := newTestRaftStores(t, 1)
+	store := waitForLeader(t, stores)
+
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = "status"
+	p.Retain = true
+	p.Payload = []byte("online")
+	store.StoreRetained(p)
+	store.StoreSubscription("status", "c1", 2)
+
+	f := store.raft.Snapshot()
+	if !assert.NoError(t, f.Error()) {
+		return
+	}
+	_, rc, err := f.Open()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	restored, err := newLevelStore(t.TempDir())
+	if !assert.NoError(t, err) {
+		return
+	}
+	restored.StoreSubscription("stale", "c2", 0)
+	assert.NoError(t, (*raftFSM)(restored).Restore(rc))
+
+	var retained []string
+	restored.LookupRetained(func(p *packets.PublishPacket) {
+		retained = append(retained, p.TopicName)
+	})
+	assert.Equal(t, []string{"status"}, retained)
+
+	var subs []string
+	restored.LookupSubscriptions(func(filter, cid string, qos byte) {
+		subs = append(subs, cid+":"+filter)
+	})
+	assert.Equal(t, []string{"c1:status"}, subs)
+}
@@ -20,10 +20,11 @@ func (this *client) reader() (err error) {
 	}()
 
 	var cp packets.ControlPacket
+	var n int
 
 	for {
 		timeout := this.keepAlive + (this.keepAlive)/2
-		if cp, err = this.readPacket(timeout); err != nil {
+		if cp, n, err = this.readPacket(timeout); err != nil {
 			switch err.(type) {
 			case net.Error:
 				if err.(net.Error).Timeout() {
@@ -39,6 +40,14 @@ func (this *client) reader() (err error) {
 			break
 		}
 		log.Debugf("reader(%v) new packet received, %v, queue len:%v", this.id, reflect.TypeOf(cp), len(this.in))
+		if len(this.quotas) > 0 {
+			var keep bool
+			if keep, err = this.chargeInbound(cp, n); err != nil {
+				return
+			} else if !keep {
+				continue
+			}
+		}
 
 		select {
 		case <-this.Dying():
@@ -49,19 +58,20 @@ func (this *client) reader() (err error) {
 	return
 }
 
-// read one message from stream
-func (this *client) readPacket(timeout time.Duration) (cp packets.ControlPacket, err error) {
+// read one message from stream, n is the bytes read
+func (this *client) readPacket(timeout time.Duration) (cp packets.ControlPacket, n int, err error) {
 	//	log.Debug("read packet with timeout ", timeout)
 	this.conn.SetReadDeadline(time.Now().Add(timeout))
-	cp, err = packets.ReadPacket(this.conn)
+	r := &countingConn{r: this.conn}
+	cp, err = packets.ReadPacket(r)
 	this.conn.SetReadDeadline(time.Time{})
-	return
+	return cp, r.n, err
 }
 
 func (this *client) ReadConnectPacket() (p *packets.ConnectPacket, err error) {
 	var cp packets.ControlPacket
 	var ok bool
-	if cp, err = this.readPacket(this.opts.ConnectTimeout); err == nil {
+	if cp, _, err = this.readPacket(this.opts.ConnectTimeout); err == nil {
 		if p, ok = cp.(*packets.ConnectPacket); !ok {
 			err = errors.New("connect message expected")
 		}
@@ -6,23 +6,40 @@ import (
 	"strings"
 )
 
-// store retain packet into memory cache and backend store.
+// store retain packet into memory cache and backend store, and replicate it to the cluster.
 func (this *Server) retainPacket(p *packets.PublishPacket) error {
+	if err := this.retainLocal(p); err != nil {
+		return err
+	}
+	if c := this.clustered(); c != nil {
+		c.retained(p)
+	}
+	return nil
+}
+
+// store retain packet into memory cache and backend store.
+func (this *Server) retainLocal(p *packets.PublishPacket) error {
 	tokens, err := topicTokenise(p.TopicName)
 	if err != nil {
 		return err
 	}
+	// keep the memory cache as the store, a message not stored is not retained.
+	if err := this.checkStore("store retained", this.store.StoreRetained(p)); err != nil {
+		return err
+	}
+	this.retainsLock.Lock()
 	this.retains.retain(tokens, p)
-	this.store.StoreRetained(p)
+	this.retainsLock.Unlock()
 	return nil
 }
 
 // reload all stored retain messages to memory cache
 func (this *Server) reloadRetains() {
-	this.store.LookupRetained(func(p *packets.PublishPacket) {
+	err := this.store.LookupRetained(func(p *packets.PublishPacket) {
 		tokens, _ := topicTokenise(p.TopicName)
 		this.retains.retain(tokens, p)
 	})
+	this.storeFailed("reload retained", err)
 }
 
 // match retain messages by topic filter.
@@ -32,7 +49,9 @@ func (this *Server) matchRetain(filter string, callback func(*packets.PublishPac
 		return err
 	}
 	l := list.New()
+	this.retainsLock.RLock()
 	this.retains.match(tokens, l)
+	this.retainsLock.RUnlock()
 	for e := l.Front(); e != nil; e = e.Next() {
 		if message, ok := e.Value.(*packets.PublishPacket); ok {
 			callback(message)
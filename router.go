@@ -74,7 +74,12 @@ func (this *Server) subscribe(filter string, cid string, qos byte) error {
 	if tokens, err := topicTokenise(filter); err != nil {
 		return err
 	} else {
-		this.store.StoreSubscription(filter, cid, qos)
+		if err := this.checkStore("store subscription", this.store.StoreSubscription(filter, cid, qos)); err != nil {
+			return err
+		}
+		if c := this.clustered(); c != nil {
+			c.subscribed(filter, cid)
+		}
 		return this.subhier.subscribe(tokens, cid, qos)
 	}
 }
@@ -84,7 +89,12 @@ func (this *Server) unsubscribe(filter string, cid string) error {
 	if tokens, err := topicTokenise(filter); err != nil {
 		return err
 	} else {
-		this.store.DeleteSubscription(filter, cid)
+		if err := this.checkStore("delete subscription", this.store.DeleteSubscription(filter, cid)); err != nil {
+			return err
+		}
+		if c := this.clustered(); c != nil {
+			c.unsubscribed(filter, cid)
+		}
 		return this.subhier.unsubscribe(tokens, cid)
 	}
 }
@@ -106,17 +116,22 @@ func (this *Server) subscribers(topic string, qos byte) (result *list.List, err
 	return
 }
 
-func (this *Server) cleanSubscriptions(cid string) {
+func (this *Server) cleanSubscriptions(cid string) error {
 	this.subhier.clean(cid)
-	this.store.CleanSubscription(cid)
+	err := this.checkStore("clean subscriptions", this.store.CleanSubscription(cid))
+	if c := this.clustered(); c != nil {
+		c.cleaned(cid)
+	}
+	return err
 }
 
 func (this *Server) reloadSubscriptions() {
-	this.store.LookupSubscriptions(func(filter, cid string, qos byte){
+	err := this.store.LookupSubscriptions(func(filter, cid string, qos byte){
 		tokens, _ := topicTokenise(filter)
 		log.Debugf("restore subscription, cid: %v, filter: %v, qos: %v", cid, filter, qos)
 		this.subhier.subscribe(tokens, cid, qos)
 	})
+	this.storeFailed("reload subscriptions", err)
 }
 
 
@@ -130,13 +145,21 @@ func (this *subhier) subscribe(tokens []string, cid string, qos byte) error {
 	token := tokens[0]
 
 	this.Lock()
-	if _, ok := this.routes[token]; !ok {
-		hire := newSubhier()
-		this.routes[token] = hire
+	route, ok := this.routes[token]
+	if !ok {
+		route = newSubhier()
+		this.routes[token] = route
 	}
 	this.Unlock()
 
-	return this.routes[token].subscribe(tokens[1:], cid, qos)
+	return route.subscribe(tokens[1:], cid, qos)
+}
+
+func (this *subhier) route(token string) (route *subhier, ok bool) {
+	this.RLock()
+	defer this.RUnlock()
+	route, ok = this.routes[token]
+	return
 }
 
 func (this *subhier) unsubscribe(tokens []string, cid string) error {
@@ -145,9 +168,8 @@ func (this *subhier) unsubscribe(tokens []string, cid string) error {
 		return nil
 	}
 
-	token := tokens[0]
-	if _, ok := this.routes[token]; ok {
-		return this.routes[token].unsubscribe(tokens[1:], cid)
+	if route, ok := this.route(tokens[0]); ok {
+		return route.unsubscribe(tokens[1:], cid)
 	}
 	return nil
 }
@@ -155,18 +177,20 @@ func (this *subhier) unsubscribe(tokens []string, cid string) error {
 
 func (this *subhier) search(tokens []string, result *list.List) {
 	if len(tokens) == 0 {
+		this.subs.RLock()
+		defer this.subs.RUnlock()
 		for _, sub := range this.subs.subs {
 			var found bool
 			for e := result.Front(); e != nil; e = e.Next() {
 				f := e.Value.(*subscribe)
 				if f.cid == sub.cid {
 					found = true
-					e.Value.(*subscribe).qos = maxQoS(sub.qos, f.qos)
+					f.qos = maxQoS(sub.qos, f.qos)
 				}
 			}
 
 			if !found {
-				result.PushBack(sub)
+				result.PushBack(&subscribe{sub.cid, sub.qos})
 			}
 		}
 		return
@@ -174,19 +198,17 @@ func (this *subhier) search(tokens []string, result *list.List) {
 
 	path := tokens[0]
 
-	if wildcards, ok := this.routes["#"]; ok {
+	if wildcards, ok := this.route("#"); ok {
 		wildcards.search([]string{}, result)
 	}
 
-	if wildcards, ok := this.routes["+"]; ok {
+	if wildcards, ok := this.route("+"); ok {
 		wildcards.search(tokens[1:], result)
 	}
 
-	if _, ok := this.routes[path]; !ok {
-		return
+	if route, ok := this.route(path); ok {
+		route.search(tokens[1:], result)
 	}
-
-	this.routes[path].search(tokens[1:], result)
 }
 
 // split the topic name or topic filter to tokens, also validate topic rules.
@@ -215,15 +237,37 @@ func topicTokenise(topic string) (tokens []string, err error) {
 // remove all subscriptions of a client
 func (this *subhier) clean(cid string) {
 	this.subs.remove(cid)
+	this.RLock()
+	defer this.RUnlock()
 	for _, route := range this.routes {
 		route.clean(cid)
 	}
 }
 
+// walk through all subscriptions of the tree, tokens is the path from root to this node.
+func (this *subhier) walk(tokens []string, callback func(filter, cid string, qos byte)) {
+	if len(tokens) > 0 {
+		filter := strings.Join(tokens, "/")
+		this.subs.RLock()
+		for _, sub := range this.subs.subs {
+			callback(filter, sub.cid, sub.qos)
+		}
+		this.subs.RUnlock()
+	}
+
+	this.RLock()
+	defer this.RUnlock()
+	for token, route := range this.routes {
+		route.walk(append(tokens[:len(tokens):len(tokens)], token), callback)
+	}
+}
+
 func (this *subhier) size() int {
 	count := 0
 	count += this.subs.size()
 
+	this.RLock()
+	defer this.RUnlock()
 	for _, route := range this.routes {
 		count += route.size()
 	}
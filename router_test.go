@@ -81,4 +81,16 @@ func TestSugerRouters(t *testing.T) {
 
 }
 
+func TestSubhierWalk(t *testing.T) {
+	subhier := newSubhier()
+	subhier.subscribe(strings.Split("a/b/c", "/"), "1", 1)
+	subhier.subscribe(strings.Split("a/+/c", "/"), "1", 0)
+	subhier.subscribe(strings.Split("a/#", "/"), "2", 2)
 
+	found := make(map[string]byte)
+	subhier.walk(nil, func(filter, cid string, qos byte) {
+		found[cid+" "+filter] = qos
+	})
+
+	assert.Equal(t, map[string]byte{"1 a/b/c": 1, "1 a/+/c": 0, "2 a/#": 2}, found)
+}
@@ -1,16 +1,15 @@
 package mqtt
 
 import (
+	"io"
 	"net"
 	"net/url"
-	"runtime"
 	"sync"
 	"time"
 
 	"fmt"
 	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
 	"github.com/Sirupsen/logrus"
-	"golang.org/x/net/websocket"
 	"net/http"
 	"reflect"
 )
@@ -31,50 +30,99 @@ type Server struct {
 	// gracefully shut them down if they are still alive when the server goes down.
 	clients *clients
 	store   Store
+	health  health
 
-	subhier *subhier
-	mids    *messageIds
-	retains *retains
+	subhier     *subhier
+	mids        *messageIds
+	retains     *retains
+	retainsLock sync.RWMutex
 
-	// Mutex for updating svcs
+	// subscribers which are not network clients, such as bridges. guarded by the server mutex.
+	deliverers map[string]deliverer
+
+	// not nil if joined a cluster, guarded by the server mutex.
+	cluster *Cluster
+
+	wills wills
+
+	limits     *limits
+	userQuotas userQuotas
+}
+
+// a subscriber which is not a network client, it receives the matched messages by its id.
+type deliverer interface {
+	// deliver a matched message with the granted qos, origin is the id of the publisher.
+	// An error means the message could not be kept for the subscriber.
+	deliver(origin string, message *packets.PublishPacket, qos byte) error
 }
 
 func NewServer(opts *Options) *Server {
+	store, err := OpenStore(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return newServer(opts, store)
+}
+
+func newServer(opts *Options, store Store) *Server {
 	server := &Server{}
 	server.opts = opts
 
 	server.quit = make(chan struct{})
 	server.clients = newClients()
 	server.subhier = newSubhier()
-	server.store = newLevelStore()
-	//	server.store = newMemoryStore()
+	server.store = store
+	server.deliverers = make(map[string]deliverer)
 	server.mids = newMessageIds()
 	server.retains = newRetains()
+	server.limits = newLimits()
 
 	server.reloadRetains()
 	server.reloadSubscriptions()
+	server.reloadMessageIds()
+	server.reloadWills()
 
 	return server
 }
 
 func (this *Server) ListenAndServe(uri string) error {
+	return this.ListenAndServeListener(uri, nil)
+}
+
+// ListenAndServeListener listens on the uri, ie: tcp://0.0.0.0:1883, quic://0.0.0.0:14567
+// or the uri of a registered transport, see RegisterTransport, and serves the connections
+// with the listener options, see ServeListener.
+func (this *Server) ListenAndServeListener(uri string, opts *ListenerOptions) error {
 	u, err := url.Parse(uri)
 	if err != nil {
 		return err
 	}
 
-	this.ln, err = net.Listen(u.Scheme, u.Host)
+	ln, opts, err := listen(u.Scheme, u.Host, opts)
 	if err != nil {
 		return err
 	}
-	defer this.ln.Close()
+	this.Lock()
+	this.ln = ln
+	this.Unlock()
 
 	log.Info("MQTT server listenning on ", uri)
 	go this.state()
 
+	return this.ServeListener(ln, opts)
+}
+
+// Serve accepts incoming connections on the listener, the listener is closed when returns.
+func (this *Server) Serve(ln net.Listener) error {
+	return this.ServeListener(ln, nil)
+}
+
+func (this *Server) serve(ln net.Listener, l *listener) error {
+	defer ln.Close()
+
 	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
-		conn, err := this.ln.Accept()
+		conn, err := ln.Accept()
 
 		if err != nil {
 			select {
@@ -98,38 +146,76 @@ func (this *Server) ListenAndServe(uri string) error {
 			}
 			return err
 		}
-		go this.handleConnection(conn)
+		if l.proxied(conn) {
+			// the source is known once the header is read
+			go this.serveProxied(conn, l)
+			continue
+		}
+		// the connections over the limits are closed before they cost a goroutine
+		if !this.admitConn(conn, l) {
+			continue
+		}
+		go this.serveAdmitted(conn, l)
 	}
 	return nil
 }
 
-func (this *Server) ListenAndServeWebSocket(uri string) error {
-	var server websocket.Server
-	//override the Websocket handshake to accept any protocol name
-	server.Handshake = func(c *websocket.Config, req *http.Request) error {
-		c.Origin, _ = url.Parse(req.RemoteAddr)
-		ver := req.Header.Get("Sec-WebSocket-Protocol")
-		c.Protocol = []string{ver}
-		//		c.Version = 4
-		log.Debugf("websocket handshake: %v", c.Origin)
+// Close stops accepting connections on the ListenAndServe listener and closes the store,
+// the writes kept in memory by the store are flushed.
+func (this *Server) Close() error {
+	this.Lock()
+	defer this.Unlock()
+	select {
+	case <-this.quit:
 		return nil
+	default:
 	}
-	//set up the ws connection handler, ie what we do when we get a new websocket connection
-	server.Handler = func(ws *websocket.Conn) {
-		ws.PayloadType = websocket.BinaryFrame
-		log.Infof("New incoming websocket connection, %v", ws.RemoteAddr())
-		//		INFO.Println("New incoming websocket connection", ws.RemoteAddr())
-		//		listener.connections = append(listener.connections, ws)
-		this.handleConnection(ws)
+	close(this.quit)
+	if this.ln != nil {
+		this.ln.Close()
+	}
+	if c, ok := this.store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// ListenAndServeWebSocket serves the MQTT over WebSocket connections on uri, they're limited
+// like the connections of a listener without options.
+func (this *Server) ListenAndServeWebSocket(uri string) error {
+	l, err := this.newListener(nil)
+	if err != nil {
+		return err
 	}
 	//set the path that the http server will recognise as related to this websocket
 	//server, needs to be configurable really.
-	http.Handle("/", server)
+	http.Handle("/", this.webSocketHandler(l, true))
 	//ListenAndServe loops forever receiving connections and initiating the handler
 	//for each one.
 	return http.ListenAndServe(uri, nil)
 }
 
+// the handler of the MQTT over WebSocket connections, as clients of the listener, l may be nil.
+// The connections are admitted by the handler if they're not admitted by the listener serving
+// the requests, ie: the connections of an http server.
+func (this *Server) webSocketHandler(l *listener, admit bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := this.upgradeWebSocket(w, r)
+		if err != nil {
+			log.Debugf("websocket handshake from %v failed, %v", r.RemoteAddr, err)
+			return
+		}
+		log.Infof("New incoming websocket connection, %v", ws.RemoteAddr())
+		if admit {
+			if !this.admitConn(ws, l) {
+				return
+			}
+			defer this.release(l)
+		}
+		this.serveConn(ws, l)
+	})
+}
+
 func (this *Server) state() error {
 	for range time.Tick(time.Second) {
 		//		log.Infof("gorutines: %v, clients: %v, store: %v", runtime.NumGoroutine(), this.clients.size(), this.store.OfflineMessageLen())
@@ -138,9 +224,9 @@ func (this *Server) state() error {
 			s +
 			"| Gorutines |   Clients   |   Subs   |   InPackets   |  OutPackets  |   Retains   |\n" +
 			s
+		stats := this.Stats()
 		value += fmt.Sprintf("| %9d | %11d | %8d | %13d | %12d | %11d |\n",
-			runtime.NumGoroutine(), this.clients.size(), this.subhier.size(), this.store.InPacketsSize(), this.store.OutPacketsSize(),
-			this.retains.size())
+			stats.Goroutines, stats.Clients, stats.Subscriptions, stats.InPackets, stats.OutPackets, stats.Retained)
 		value += s
 		log.Info(value)
 	}
@@ -148,6 +234,11 @@ func (this *Server) state() error {
 }
 
 func (this *Server) handleConnection(conn net.Conn) (c *client, err error) {
+	return this.serveConn(conn, nil)
+}
+
+// serve a connection accepted by a listener, l may be nil.
+func (this *Server) serveConn(conn net.Conn, l *listener) (c *client, err error) {
 	defer func() {
 		if err != nil {
 			conn.Close()
@@ -159,9 +250,11 @@ func (this *Server) handleConnection(conn net.Conn) (c *client, err error) {
 	}
 
 	c = &client{
-		server: this,
-		opts:   this.opts,
-		conn:   conn,
+		server:   this,
+		opts:     this.opts,
+		policy:   this.listenerPolicy(l),
+		listener: l,
+		conn:     conn,
 	}
 
 	if err = c.start(); err != nil {
@@ -173,10 +266,23 @@ func (this *Server) handleConnection(conn net.Conn) (c *client, err error) {
 	return nil, nil
 }
 
-func (this *Server) forwardMessage(message *packets.PublishPacket) {
+// publish a message to all subscribers, origin is the id of the publisher.
+// An error means the message is not retained or not kept for some offline subscribers,
+// it must not be acknowledged to the publisher.
+func (this *Server) publishMessage(origin string, message *packets.PublishPacket) error {
+	if message.Retain {
+		if err := this.retainPacket(message); err != nil {
+			return err
+		}
+	}
+
+	return this.forwardMessage(origin, message)
+}
+
+func (this *Server) forwardMessage(origin string, message *packets.PublishPacket) (err error) {
 	l, err := this.subscribers(message.TopicName, message.Qos)
 	if err != nil {
-		return
+		return nil
 	}
 
 	log.Debugf("forward message %v to topic %q, clients: %v", message.MessageID, message.TopicName, l.Len())
@@ -189,23 +295,54 @@ func (this *Server) forwardMessage(message *packets.PublishPacket) {
 			qos := sub.qos
 
 			if c, ok := this.clients.get(cid); ok {
+				// a connecting client, ie: taking over the connection publishing its will,
+				// gets the message with the offline ones once it's started.
+				if c.whileConnecting(func() {
+					if e := this.storeOfflineMessage(cid, message, qos); e != nil {
+						err = e
+					}
+				}) {
+					continue
+				}
 				log.Debugf("forward message to %q, topic: %q, qos: %q", cid, message.TopicName, qos)
 				// It MUST set the RETAIN flag to 0 when a PUBLISH Packet is sent to a Client
 				// because it matches an established subscription regardless of
 				// how the flag was set in the message it received.
-				c.publish(message.TopicName, message.Payload, qos, false, false)
-				return
+				if e := c.publish(message.TopicName, message.Payload, qos, false, false); e != nil && e != ErrDisconnect {
+					// the session state of the subscriber is lost, the publisher is not to blame.
+					go c.stop(e)
+				}
+				continue
+			}
+			if d, ok := this.deliverer(cid); ok {
+				if e := d.deliver(origin, message, qos); e != nil {
+					err = e
+				}
+				continue
 			}
-			if qos > 0 {
-				p := message.Copy()
-				p.Qos = qos
-				p.Retain = false
-				p.Dup = false
-				p.MessageID = this.mids.request(cid)
-				this.store.StoreOutboundPacket(cid, p)
+			if e := this.storeOfflineMessage(cid, message, qos); e != nil {
+				err = e
 			}
 		}
 	}
+	return
+}
+
+// store a message to the session of a client not connected, the ones of qos 0 are dropped.
+func (this *Server) storeOfflineMessage(cid string, message *packets.PublishPacket, qos byte) error {
+	if qos == 0 {
+		return nil
+	}
+	p := message.Copy()
+	p.Qos = qos
+	p.Retain = false
+	p.Dup = false
+	p.MessageID = this.mids.request(cid)
+	if err := this.checkStore("store offline message", this.store.StoreOutboundPacket(cid, p)); err != nil {
+		this.mids.free(cid, p.MessageID)
+		return err
+	}
+	return nil
 }
 
 func (this *Server) forwardOfflineMessage(c *client) {
@@ -213,15 +350,51 @@ func (this *Server) forwardOfflineMessage(c *client) {
 		return
 	}
 	log.Infof("forward offline message of %q", c.id)
-	this.store.StreamOfflinePackets(c.id, func(p packets.ControlPacket) {
+	err := this.store.StreamOfflinePackets(c.id, func(p packets.ControlPacket) {
 		log.Debugf("forward offline message to %q, type: %v, mid: %v", c.id, reflect.TypeOf(p), p.Details().MessageID)
+		this.mids.use(c.id, p.Details().MessageID)
+		// the stored messages may have been sent already
+		if publish, ok := p.(*packets.PublishPacket); ok {
+			dup := *publish
+			dup.Dup = true
+			p = &dup
+		}
 		c.write(p)
 	})
+	this.storeFailed("stream offline messages", err)
+}
+
+func (this *Server) cleanSession(cid string) error {
+	log.Debugf("clean session of %q", cid)
+	err := this.cleanSubscriptions(cid)
+	this.mids.clean(cid)
+	if e := this.checkStore("clean packets", this.store.CleanPackets(cid)); e != nil {
+		err = e
+	}
+	return err
+}
+
+func (this *Server) addDeliverer(id string, d deliverer) {
+	this.Lock()
+	defer this.Unlock()
+	this.deliverers[id] = d
+}
+
+func (this *Server) removeDeliverer(id string) {
+	this.Lock()
+	defer this.Unlock()
+	delete(this.deliverers, id)
+}
+
+func (this *Server) deliverer(id string) (d deliverer, ok bool) {
+	this.RLock()
+	defer this.RUnlock()
+	d, ok = this.deliverers[id]
+	return
 }
 
-func (this *Server) cleanSession(c *client) {
-	log.Debugf("clean session of %q", c.id)
-	this.cleanSubscriptions(c.id)
-	this.mids.clean(c.id)
-	this.store.CleanPackets(c.id)
+func (this *Server) clustered() *Cluster {
+	this.RLock()
+	defer this.RUnlock()
+	return this.cluster
 }
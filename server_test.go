@@ -0,0 +1,220 @@
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+// start a server with a memory store, listening on a random loopback port.
+func newTestServer(t *testing.T) (*Server, string) {
+	return newTestServerWithStore(t, newMemoryStore())
+}
+
+func newTestServerWithStore(t *testing.T, store Store) (*Server, string) {
+	server := newServer(NewOptions(), store)
+	return server, serveTestServer(t, server)
+}
+
+// serve on a random loopback port, returns the address.
+func serveTestServer(t *testing.T, server *Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	t.Cleanup(func() {
+		ln.Close()
+	})
+	return ln.Addr().String()
+}
+
+// wait until the condition is true, fail the test after a few seconds.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatal("condition not met in time")
+}
+
+// a raw mqtt client to drive the server in tests.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	mid  uint16
+	// the messages received while waiting for an acknowledgement
+	queue []packets.ControlPacket
+}
+
+func dialTestClient(t *testing.T, addr, cid string, clean bool) *testClient {
+	t.Helper()
+	cp := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ClientIdentifier = cid
+	cp.CleanSession = clean
+	cp.KeepaliveTimer = 30
+	return connectTestClient(t, addr, cp)
+}
+
+func connectTestClient(t *testing.T, addr string, cp *packets.ConnectPacket) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return connectTestConn(t, conn, cp)
+}
+
+// connect a client over a connection dialed by the test, ie: a TLS one.
+func connectTestConn(t *testing.T, conn net.Conn, cp *packets.ConnectPacket) *testClient {
+	t.Helper()
+	c := &testClient{t: t, conn: conn}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	c.write(cp)
+	ack, ok := c.read().(*packets.ConnackPacket)
+	if !ok || ack.ReturnCode != packets.Accepted {
+		t.Fatalf("client(%v) connect refused, %v", cp.ClientIdentifier, ack)
+	}
+	return c
+}
+
+func (this *testClient) nextId() uint16 {
+	this.mid++
+	return this.mid
+}
+
+func (this *testClient) write(p packets.ControlPacket) {
+	this.t.Helper()
+	if err := p.Write(this.conn); err != nil {
+		this.t.Fatal(err)
+	}
+}
+
+func (this *testClient) read() packets.ControlPacket {
+	this.t.Helper()
+	this.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := packets.ReadPacket(this.conn)
+	if err != nil {
+		this.t.Fatal(err)
+	}
+	return p
+}
+
+func (this *testClient) subscribe(filter string, qos byte) {
+	this.t.Helper()
+	p := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	p.MessageID = this.nextId()
+	p.Topics = []string{filter}
+	p.Qoss = []byte{qos}
+	this.write(p)
+
+	for {
+		switch ack := this.read().(type) {
+		case *packets.SubackPacket:
+			assert.Equal(this.t, []byte{qos}, ack.GrantedQoss)
+			return
+		case *packets.PublishPacket:
+			// the matched retained messages may be sent before the suback
+			this.queue = append(this.queue, ack)
+		default:
+			this.t.Fatalf("suback expected, got %v", ack)
+		}
+	}
+}
+
+// publish a message and wait for the acknowledgement of its qos.
+func (this *testClient) publish(topic, payload string, qos byte, retain bool) {
+	this.t.Helper()
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Payload = []byte(payload)
+	p.Qos = qos
+	p.Retain = retain
+	if qos > 0 {
+		p.MessageID = this.nextId()
+	}
+	this.write(p)
+
+	switch qos {
+	case 1:
+		_, ok := this.read().(*packets.PubackPacket)
+		assert.True(this.t, ok, "puback expected")
+	case 2:
+		_, ok := this.read().(*packets.PubrecPacket)
+		assert.True(this.t, ok, "pubrec expected")
+		rel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+		rel.MessageID = p.MessageID
+		this.write(rel)
+		_, ok = this.read().(*packets.PubcompPacket)
+		assert.True(this.t, ok, "pubcomp expected")
+	}
+}
+
+// receive the next publish message and acknowledge it.
+func (this *testClient) receive() *packets.PublishPacket {
+	this.t.Helper()
+	var cp packets.ControlPacket
+	if len(this.queue) > 0 {
+		cp, this.queue = this.queue[0], this.queue[1:]
+	} else {
+		cp = this.read()
+	}
+	p, ok := cp.(*packets.PublishPacket)
+	if !ok {
+		this.t.Fatalf("publish expected, got %v", p)
+	}
+	switch p.Qos {
+	case 1:
+		ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		ack.MessageID = p.MessageID
+		this.write(ack)
+	case 2:
+		rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		rec.MessageID = p.MessageID
+		this.write(rec)
+		_, ok := this.read().(*packets.PubrelPacket)
+		assert.True(this.t, ok, "pubrel expected")
+		comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+		comp.MessageID = p.MessageID
+		this.write(comp)
+	}
+	return p
+}
+
+func TestForwardMessage(t *testing.T) {
+	server, addr := newTestServer(t)
+
+	// every subscriber gets the message, connected or not
+	var subs []*testClient
+	for _, cid := range []string{"s1", "s2"} {
+		c := dialTestClient(t, addr, cid, true)
+		c.subscribe("a/+", 1)
+		subs = append(subs, c)
+	}
+	offline := dialTestClient(t, addr, "s3", false)
+	offline.subscribe("a/#", 1)
+	offline.conn.Close()
+	waitFor(t, func() bool {
+		_, ok := server.clients.get("s3")
+		return !ok
+	})
+
+	pub := dialTestClient(t, addr, "pub", true)
+	pub.publish("a/b", "hello", 1, false)
+	for _, c := range subs {
+		p := c.receive()
+		assert.Equal(t, "a/b", p.TopicName)
+		assert.Equal(t, "hello", string(p.Payload))
+	}
+
+	offline = dialTestClient(t, addr, "s3", false)
+	assert.Equal(t, "hello", string(offline.receive().Payload))
+}
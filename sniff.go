@@ -0,0 +1,174 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+)
+
+// the ALPN protocols of a sniffing TLS listener.
+const (
+	ALPNMQTT = "mqtt"
+	ALPNHTTP = "http/1.1"
+)
+
+// the first byte of a CONNECT packet, any other starts an HTTP request.
+const connectByte = packets.Connect << 4
+
+// a connection with the bytes peeked at its start.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (this *bufferedConn) Read(b []byte) (int, error) {
+	return this.r.Read(b)
+}
+
+// tell an MQTT connection from an HTTP one, by the ALPN protocol of a TLS connection or by
+// its first byte. The connection to serve is returned.
+func sniff(conn net.Conn, timeout time.Duration) (mqtt bool, c net.Conn, err error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			return false, nil, err
+		}
+		switch tc.ConnectionState().NegotiatedProtocol {
+		case ALPNMQTT:
+			return true, conn, nil
+		case ALPNHTTP:
+			return false, conn, nil
+		}
+	}
+
+	bc := &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+	b, err := bc.r.Peek(1)
+	if err != nil {
+		return false, nil, err
+	}
+	return b[0] == connectByte, bc, nil
+}
+
+// the HTTP connections of a sniffing listener, served by an http server as a listener.
+type httpConns struct {
+	conns  chan net.Conn
+	addr   net.Addr
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newHTTPConns(addr net.Addr) *httpConns {
+	return &httpConns{
+		conns:  make(chan net.Conn),
+		addr:   addr,
+		closed: make(chan struct{}),
+	}
+}
+
+// serve a connection, false if the listener is closed.
+func (this *httpConns) serve(conn net.Conn) bool {
+	select {
+	case this.conns <- conn:
+		return true
+	case <-this.closed:
+		return false
+	}
+}
+
+func (this *httpConns) Accept() (net.Conn, error) {
+	select {
+	case conn := <-this.conns:
+		return conn, nil
+	case <-this.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (this *httpConns) Close() error {
+	this.once.Do(func() {
+		close(this.closed)
+	})
+	return nil
+}
+
+func (this *httpConns) Addr() net.Addr {
+	return this.addr
+}
+
+// a connection released once it's closed.
+type releasedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (this *releasedConn) Close() error {
+	err := this.Conn.Close()
+	this.once.Do(this.release)
+	return err
+}
+
+// the handler of the HTTP connections of a listener, the WebSocket upgrades are served
+// as MQTT clients of the listener and the other requests by the handler.
+func (this *Server) sniffHandler(l *listener, handler http.Handler) http.Handler {
+	ws := this.webSocketHandler(l, false)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			ws.ServeHTTP(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), listenerKey{}, l)))
+	})
+}
+
+// the key of the listener serving a request in its context.
+type listenerKey struct{}
+
+// the listener serving the request, nil if it's not served by a sniffing listener.
+func requestListener(r *http.Request) *listener {
+	l, _ := r.Context().Value(listenerKey{}).(*listener)
+	return l
+}
+
+// the TLS config of a sniffing listener, with the ALPN protocols if it has none.
+func sniffTLSConfig(config *tls.Config) *tls.Config {
+	if len(config.NextProtos) > 0 {
+		return config
+	}
+	config = config.Clone()
+	config.NextProtos = []string{ALPNMQTT, ALPNHTTP}
+	return config
+}
+
+// serve a connection of a sniffing listener.
+func (this *Server) serveSniffed(conn net.Conn, l *listener) {
+	mqtt, c, err := sniff(conn, this.opts.ConnectTimeout)
+	if err != nil {
+		log.Debugf("connection from %v closed before its protocol is known, %v", conn.RemoteAddr(), err)
+		conn.Close()
+		this.release(l)
+		return
+	}
+	if mqtt {
+		defer this.release(l)
+		this.serveConn(c, l)
+		return
+	}
+	log.Debugf("http connection from %v", c.RemoteAddr())
+	rc := &releasedConn{Conn: c, release: func() {
+		this.release(l)
+	}}
+	if !l.http.serve(rc) {
+		rc.Close()
+	}
+}
@@ -0,0 +1,99 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})
+	return mux
+}
+
+func httpGet(t *testing.T, client *http.Client, url string) string {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return string(b)
+}
+
+func TestSniffListener(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	addr := serveTestListener(t, server, &ListenerOptions{HTTPHandler: testHTTPHandler(), MaxConnections: 10})
+
+	sub := dialTestClient(t, addr, "sub", true)
+	sub.subscribe("a", 0)
+
+	assert.Equal(t, "hello", httpGet(t, http.DefaultClient, "http://"+addr+"/hello"))
+
+	pub := dialTestClient(t, addr, "pub", true)
+	pub.publish("a", "m", 0, false)
+	assert.Equal(t, "m", string(sub.receive().Payload))
+
+	// the http connections are released once closed
+	http.DefaultClient.CloseIdleConnections()
+	waitFor(t, func() bool {
+		return server.Stats().Connections == 2
+	})
+}
+
+func TestSniffTLSListener(t *testing.T) {
+	cert := testCertificate(t, "broker")
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+
+	server := newServer(NewOptions(), newMemoryStore())
+	addr := serveTestListener(t, server, &ListenerOptions{
+		TLSConfig:   &tls.Config{Certificates: []tls.Certificate{cert}},
+		HTTPHandler: testHTTPHandler(),
+	})
+
+	// told by the ALPN protocol, or by the first byte without one
+	for _, protos := range [][]string{{ALPNMQTT}, nil} {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, NextProtos: protos})
+		if err != nil {
+			t.Fatal(err)
+		}
+		connectTestConn(t, conn, testConnect("c", true, 30)).subscribe("a", 0)
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	assert.Equal(t, "hello", httpGet(t, client, "https://"+addr+"/hello"))
+	client.CloseIdleConnections()
+}
+
+func TestSniff(t *testing.T) {
+	for _, c := range []struct {
+		data string
+		mqtt bool
+	}{
+		{"\x10\x0c\x00\x04MQTT", true},
+		{"GET / HTTP/1.1\r\n", false},
+	} {
+		client, server := net.Pipe()
+		go client.Write([]byte(c.data))
+		mqtt, conn, err := sniff(server, time.Second)
+		if assert.NoError(t, err) {
+			assert.Equal(t, c.mqtt, mqtt)
+			b := make([]byte, len(c.data))
+			io.ReadFull(conn, b)
+			assert.Equal(t, c.data, string(b))
+		}
+		client.Close()
+		server.Close()
+	}
+}
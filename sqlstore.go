@@ -0,0 +1,355 @@
+package mqtt
+
+import (
+	"database/sql"
+	"sort"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS subscriptions (
+	client_id TEXT NOT NULL,
+	filter    TEXT NOT NULL,
+	qos       INTEGER NOT NULL,
+	PRIMARY KEY (client_id, filter)
+);
+CREATE TABLE IF NOT EXISTS retained (
+	topic  TEXT PRIMARY KEY,
+	packet BLOB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS wills (
+	client_id TEXT PRIMARY KEY,
+	packet    BLOB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS packets (
+	client_id  TEXT NOT NULL,
+	inbound    INTEGER NOT NULL,
+	message_id INTEGER NOT NULL,
+	packet     BLOB NOT NULL,
+	PRIMARY KEY (client_id, inbound, message_id)
+);
+CREATE TABLE IF NOT EXISTS meta (
+	name  TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+`
+
+// SQLiteStore keeps everything in a single sqlite database, in the tables
+// subscriptions, retained, wills and packets. The client ids, the filters and
+// the topics are encrypted with a keyring, the meta table marks a store created
+// with one.
+type SQLiteStore struct {
+	db *sql.DB
+	// encrypts the packets and the names in the keys if not nil
+	keys *Keyring
+}
+
+// the dsn is a file name or a sqlite uri, ie: "file:store.sqlite?_journal_mode=WAL"
+func newSQLiteStore(dsn string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite allows one writer at a time, share one connection to avoid busy errors
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (this *SQLiteStore) Close() error {
+	return this.db.Close()
+}
+
+func (this *SQLiteStore) encrypted() (marked, empty bool, err error) {
+	if err = this.db.QueryRow("SELECT COUNT(*) > 0 FROM meta WHERE name = 'encrypted'").Scan(&marked); err != nil || marked {
+		return
+	}
+	err = this.db.QueryRow(`SELECT NOT EXISTS (SELECT 1 FROM subscriptions UNION ALL SELECT 1 FROM retained
+		UNION ALL SELECT 1 FROM wills UNION ALL SELECT 1 FROM packets)`).Scan(&empty)
+	return
+}
+
+func (this *SQLiteStore) markEncrypted() error {
+	return this.exec("INSERT OR REPLACE INTO meta (name, value) VALUES ('encrypted', 'true')")
+}
+
+func (this *SQLiteStore) StoreSubscription(filter, cid string, qos byte) error {
+	return this.exec("INSERT OR REPLACE INTO subscriptions (client_id, filter, qos) VALUES (?, ?, ?)",
+		this.keys.hide(cid), this.keys.hide(filter), qos)
+}
+
+func (this *SQLiteStore) DeleteSubscription(filter, cid string) error {
+	return this.exec("DELETE FROM subscriptions WHERE client_id = ? AND filter = ?", this.keys.hide(cid), this.keys.hide(filter))
+}
+
+func (this *SQLiteStore) CleanSubscription(cid string) error {
+	return this.exec("DELETE FROM subscriptions WHERE client_id = ?", this.keys.hide(cid))
+}
+
+func (this *SQLiteStore) LookupSubscriptions(callback func(filter, cid string, qos byte)) error {
+	type subscription struct {
+		filter, cid string
+		qos         byte
+	}
+	var l []subscription
+	var corrupt error
+	err := this.query("SELECT filter, client_id, qos FROM subscriptions", func(rows *sql.Rows) error {
+		var s subscription
+		if err := rows.Scan(&s.filter, &s.cid, &s.qos); err != nil {
+			return err
+		}
+		var err error
+		if s.filter, err = this.keys.reveal(s.filter); err != nil {
+			corrupt = err
+			return nil
+		}
+		if s.cid, err = this.keys.reveal(s.cid); err != nil {
+			corrupt = err
+			return nil
+		}
+		l = append(l, s)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, s := range l {
+		callback(s.filter, s.cid, s.qos)
+	}
+	return corrupt
+}
+
+func (this *SQLiteStore) StoreRetained(p *packets.PublishPacket) error {
+	if len(p.Payload) == 0 {
+		return this.exec("DELETE FROM retained WHERE topic = ?", this.keys.hide(p.TopicName))
+	}
+	return this.exec("INSERT OR REPLACE INTO retained (topic, packet) VALUES (?, ?)", this.keys.hide(p.TopicName), this.keys.marshal(p))
+}
+
+func (this *SQLiteStore) LookupRetained(callback func(*packets.PublishPacket)) error {
+	l, corrupt, err := this.queryPackets("SELECT packet FROM retained")
+	if err != nil {
+		return err
+	}
+	for _, cp := range l {
+		if p, ok := cp.(*packets.PublishPacket); ok {
+			callback(p)
+		} else {
+			corrupt = ErrCorruptValue
+		}
+	}
+	return corrupt
+}
+
+func (this *SQLiteStore) StoreWill(cid string, p *packets.PublishPacket) error {
+	return this.exec("INSERT OR REPLACE INTO wills (client_id, packet) VALUES (?, ?)", this.keys.hide(cid), this.keys.marshal(p))
+}
+
+func (this *SQLiteStore) DeleteWill(cid string) error {
+	return this.exec("DELETE FROM wills WHERE client_id = ?", this.keys.hide(cid))
+}
+
+func (this *SQLiteStore) LookupWills(callback func(cid string, p *packets.PublishPacket)) error {
+	type will struct {
+		cid string
+		p   *packets.PublishPacket
+	}
+	var l []will
+	var corrupt error
+	err := this.query("SELECT client_id, packet FROM wills", func(rows *sql.Rows) error {
+		var w will
+		var value []byte
+		if err := rows.Scan(&w.cid, &value); err != nil {
+			return err
+		}
+		p, err := this.keys.decodePublish(value)
+		if err != nil {
+			corrupt = err
+			return nil
+		}
+		if w.cid, err = this.keys.reveal(w.cid); err != nil {
+			corrupt = err
+			return nil
+		}
+		w.p = p
+		l = append(l, w)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// ordered once the client ids are decrypted
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].cid < l[j].cid
+	})
+	for _, w := range l {
+		callback(w.cid, w.p)
+	}
+	return corrupt
+}
+
+func (this *SQLiteStore) FindInboundPacket(cid string, mid uint16) (packets.ControlPacket, error) {
+	var value []byte
+	err := this.db.QueryRow("SELECT packet FROM packets WHERE client_id = ? AND inbound = 1 AND message_id = ?", this.keys.hide(cid), mid).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return this.keys.decode(value)
+}
+
+func (this *SQLiteStore) StoreInboundPacket(cid string, p packets.ControlPacket) error {
+	return this.storePacket(cid, true, p)
+}
+
+func (this *SQLiteStore) StoreOutboundPacket(cid string, p packets.ControlPacket) error {
+	return this.storePacket(cid, false, p)
+}
+
+func (this *SQLiteStore) storePacket(cid string, inbound bool, p packets.ControlPacket) error {
+	return this.exec("INSERT OR REPLACE INTO packets (client_id, inbound, message_id, packet) VALUES (?, ?, ?, ?)",
+		this.keys.hide(cid), inbound, p.Details().MessageID, this.keys.marshal(p))
+}
+
+func (this *SQLiteStore) StreamOfflinePackets(cid string, callback func(packets.ControlPacket)) error {
+	l, corrupt, err := this.queryPackets("SELECT packet FROM packets WHERE client_id = ? AND inbound = 0 ORDER BY message_id", this.keys.hide(cid))
+	if err != nil {
+		return err
+	}
+	for _, cp := range l {
+		callback(cp)
+	}
+	return corrupt
+}
+
+func (this *SQLiteStore) LookupPackets(callback func(cid string, inbound bool, p packets.ControlPacket)) error {
+	type storedPacket struct {
+		cid     string
+		inbound bool
+		p       packets.ControlPacket
+	}
+	var l []storedPacket
+	var corrupt error
+	err := this.query("SELECT client_id, inbound, packet FROM packets ORDER BY client_id, inbound DESC, message_id", func(rows *sql.Rows) error {
+		var sp storedPacket
+		var value []byte
+		if err := rows.Scan(&sp.cid, &sp.inbound, &value); err != nil {
+			return err
+		}
+		cp, err := this.keys.decode(value)
+		if err != nil {
+			corrupt = err
+			return nil
+		}
+		if sp.cid, err = this.keys.reveal(sp.cid); err != nil {
+			corrupt = err
+			return nil
+		}
+		sp.p = cp
+		l = append(l, sp)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// ordered once the client ids are decrypted, the packets of a client are ordered already
+	sort.SliceStable(l, func(i, j int) bool {
+		return l[i].cid < l[j].cid
+	})
+	for _, sp := range l {
+		callback(sp.cid, sp.inbound, sp.p)
+	}
+	return corrupt
+}
+
+func (this *SQLiteStore) DeleteInboundPacket(cid string, mid uint16) error {
+	return this.exec("DELETE FROM packets WHERE client_id = ? AND inbound = 1 AND message_id = ?", this.keys.hide(cid), mid)
+}
+
+func (this *SQLiteStore) DeleteOutboundPacket(cid string, mid uint16) error {
+	return this.exec("DELETE FROM packets WHERE client_id = ? AND inbound = 0 AND message_id = ?", this.keys.hide(cid), mid)
+}
+
+// writeOutbound writes the packets in one transaction.
+func (this *SQLiteStore) writeOutbound(writes []outboundWrite) error {
+	tx, err := this.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, w := range writes {
+		if w.p == nil {
+			_, err = tx.Exec("DELETE FROM packets WHERE client_id = ? AND inbound = 0 AND message_id = ?", this.keys.hide(w.cid), w.mid)
+		} else {
+			_, err = tx.Exec("INSERT OR REPLACE INTO packets (client_id, inbound, message_id, packet) VALUES (?, ?, ?, ?)",
+				this.keys.hide(w.cid), false, w.mid, this.keys.marshal(w.p))
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (this *SQLiteStore) CleanPackets(cid string) error {
+	return this.exec("DELETE FROM packets WHERE client_id = ?", this.keys.hide(cid))
+}
+
+func (this *SQLiteStore) InPacketsSize() (int, error) {
+	return this.count("SELECT COUNT(*) FROM packets WHERE inbound = 1")
+}
+
+func (this *SQLiteStore) OutPacketsSize() (int, error) {
+	return this.count("SELECT COUNT(*) FROM packets WHERE inbound = 0")
+}
+
+func (this *SQLiteStore) count(query string) (count int, err error) {
+	err = this.db.QueryRow(query).Scan(&count)
+	return
+}
+
+func (this *SQLiteStore) exec(query string, args ...interface{}) error {
+	_, err := this.db.Exec(query, args...)
+	return err
+}
+
+// query and scan all rows before returning, the store has only one connection
+// and the callbacks may write to it.
+func (this *SQLiteStore) query(query string, scan func(*sql.Rows) error, args ...interface{}) error {
+	rows, err := this.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// query the packets, the corrupt ones are skipped and reported by corrupt.
+func (this *SQLiteStore) queryPackets(query string, args ...interface{}) (l []packets.ControlPacket, corrupt, err error) {
+	err = this.query(query, func(rows *sql.Rows) error {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return err
+		}
+		cp, err := this.keys.decode(value)
+		if err != nil {
+			corrupt = err
+			return nil
+		}
+		l = append(l, cp)
+		return nil
+	}, args...)
+	return
+}
@@ -2,23 +2,116 @@ package mqtt
 
 import "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
 
+// Store keeps the subscriptions, the retained messages and the session packets.
+//
+// Every method returns the error of the backend, the broker never acknowledges
+// a message it could not persist. A corrupt value is skipped by the lookups,
+// which return ErrCorruptValue after visiting the rest.
 type Store interface {
-	StoreSubscription(filter, cid string, qos byte)
-	DeleteSubscription(filter, cid string)
-	CleanSubscription(cid string)
-	LookupSubscriptions(callback func(filter, cid string, qos byte))
+	StoreSubscription(filter, cid string, qos byte) error
+	DeleteSubscription(filter, cid string) error
+	CleanSubscription(cid string) error
+	LookupSubscriptions(callback func(filter, cid string, qos byte)) error
 
-	StoreRetained(p *packets.PublishPacket)
-	LookupRetained(callback func(*packets.PublishPacket))
+	StoreRetained(p *packets.PublishPacket) error
+	LookupRetained(callback func(*packets.PublishPacket)) error
 
-	FindInboundPacket(cid string, mid uint16) packets.ControlPacket
+	// the will message of a connected client, kept until the client disconnects,
+	// so it's published after a restart if the broker stopped without a disconnect.
+	StoreWill(cid string, p *packets.PublishPacket) error
+	DeleteWill(cid string) error
+	// visit the wills ordered by client id
+	LookupWills(callback func(cid string, p *packets.PublishPacket)) error
+
+	// returns nil without error if the packet is not found
+	FindInboundPacket(cid string, mid uint16) (packets.ControlPacket, error)
 	StoreInboundPacket(cid string, p packets.ControlPacket) error
 	StoreOutboundPacket(cid string, p packets.ControlPacket) error
-	StreamOfflinePackets(cid string, callback func(packets.ControlPacket))
-	DeleteInboundPacket(cid string, mid uint16)
-	DeleteOutboundPacket(cid string, mid uint16)
-	CleanPackets(cid string)
+	// visit the outbound packets of the client ordered by message id, a release replaces
+	// the message it acknowledges
+	StreamOfflinePackets(cid string, callback func(packets.ControlPacket)) error
+	DeleteInboundPacket(cid string, mid uint16) error
+	DeleteOutboundPacket(cid string, mid uint16) error
+	CleanPackets(cid string) error
+	// visit the packets of all clients, ordered by client id, the inbound packets before the
+	// outbound ones, and the outbound packets in the order of StreamOfflinePackets.
+	LookupPackets(callback func(cid string, inbound bool, p packets.ControlPacket)) error
+
+	InPacketsSize() (int, error)
+	OutPacketsSize() (int, error)
+}
+
+// OpenStore opens the store chosen by the options.
+func OpenStore(opts *Options) (Store, error) {
+	store, err := openStore(opts)
+	if err != nil || opts.StoreWriteBehind <= 0 {
+		return store, err
+	}
+	return NewWriteBehindStore(store, opts.StoreWriteBehind, opts.StoreWriteBehindSize), nil
+}
+
+func openStore(opts *Options) (Store, error) {
+	if opts.Store != nil {
+		return opts.Store, nil
+	}
 
-	InPacketsSize() int
-	OutPacketsSize() int
+	path := opts.StorePath
+	if path == "" {
+		path = DefaultStorePath
+	}
+	keys, err := storeKeyring(opts)
+	if err != nil {
+		return nil, err
+	}
+	switch opts.StoreBackend {
+	case "", "leveldb":
+		if opts.StoreRestore != "" {
+			log.Infof("restore store %v from %v", path, opts.StoreRestore)
+			if err := RestoreLevelStore(opts.StoreRestore, path); err != nil {
+				return nil, err
+			}
+		}
+		store, err := newLevelStore(path)
+		if err != nil {
+			return nil, err
+		}
+		store.keys = keys
+		if err := checkEncrypted(store, keys); err != nil {
+			store.Close()
+			return nil, err
+		}
+		if err := store.setDurability(opts.StoreDurability); err != nil {
+			store.Close()
+			return nil, err
+		}
+		return store, nil
+	case "bolt":
+		store, err := newBoltStore(path)
+		if err != nil {
+			return nil, err
+		}
+		store.keys = keys
+		if err := checkEncrypted(store, keys); err != nil {
+			store.Close()
+			return nil, err
+		}
+		return store, nil
+	case "sqlite":
+		store, err := newSQLiteStore(path)
+		if err != nil {
+			return nil, err
+		}
+		store.keys = keys
+		if err := checkEncrypted(store, keys); err != nil {
+			store.Close()
+			return nil, err
+		}
+		return store, nil
+	case "memory":
+		if opts.StoreSnapshotInterval > 0 {
+			return newMemoryStoreSnapshot(path, opts.StoreSnapshotInterval, keys)
+		}
+		return newMemoryStore(), nil
+	}
+	return nil, ErrUnknownStoreBackend
 }
@@ -0,0 +1,138 @@
+package mqtt_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bitbucket.org/j3r0lin/mqtt"
+	"bitbucket.org/j3r0lin/mqtt/storetest"
+	"github.com/hashicorp/raft"
+)
+
+func openStore(t *testing.T, backend, path string) mqtt.Store {
+	return openStoreOptions(t, backend, path, mqtt.NewOptions())
+}
+
+func openStoreOptions(t *testing.T, backend, path string, opts *mqtt.Options) mqtt.Store {
+	opts.StoreBackend = backend
+	if path != "" {
+		opts.StorePath = path
+		opts.StoreSnapshotInterval = time.Hour
+	}
+	store, err := mqtt.OpenStore(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// a single node raft store with its raft log in dir, it's the leader once opened.
+func openRaftStore(t *testing.T, dir string, keys *mqtt.Keyring) mqtt.Store {
+	addr, transport := raft.NewInmemTransport("")
+	config := raft.DefaultConfig()
+	config.HeartbeatTimeout = 50 * time.Millisecond
+	config.ElectionTimeout = 50 * time.Millisecond
+	config.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.LogOutput = io.Discard
+
+	store, err := mqtt.NewRaftStore(&mqtt.RaftOptions{
+		ID:        "node",
+		Dir:       dir,
+		Transport: transport,
+		Bootstrap: []raft.Server{{ID: "node", Address: addr}},
+		Config:    config,
+		Keys:      keys,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); !store.IsLeader(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("no leader elected")
+		}
+	}
+	return store
+}
+
+func TestStoreConformance(t *testing.T) {
+	for _, backend := range []string{"leveldb", "bolt", "sqlite", "memory"} {
+		backend := backend
+		t.Run(backend, func(t *testing.T) {
+			storetest.Run(t, func(dir string) mqtt.Store {
+				return openStore(t, backend, filepath.Join(dir, "store.db"))
+			})
+		})
+	}
+
+	// the same keys for every test, they're kept in the test directory to reopen the store
+	key, err := mqtt.NewKeyEntry("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := mqtt.NewKeyEntry(mqtt.IndexKeyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key += "\n" + index
+	for _, backend := range []string{"leveldb", "bolt", "sqlite", "memory"} {
+		backend := backend
+		t.Run("encrypted-"+backend, func(t *testing.T) {
+			storetest.Run(t, func(dir string) mqtt.Store {
+				keyFile := filepath.Join(dir, "keys")
+				if err := os.WriteFile(keyFile, []byte(key), 0600); err != nil {
+					t.Fatal(err)
+				}
+				opts := mqtt.NewOptions()
+				opts.StoreKeyFile = keyFile
+				return openStoreOptions(t, backend, filepath.Join(dir, "store.db"), opts)
+			})
+		})
+	}
+
+	for _, durability := range []string{mqtt.DurabilitySync, mqtt.DurabilityGroup} {
+		durability := durability
+		t.Run("leveldb-"+durability, func(t *testing.T) {
+			storetest.Run(t, func(dir string) mqtt.Store {
+				opts := mqtt.NewOptions()
+				opts.StoreDurability = durability
+				return openStoreOptions(t, "leveldb", filepath.Join(dir, "store.db"), opts)
+			})
+		})
+	}
+
+	for _, backend := range []string{"leveldb", "memory"} {
+		backend := backend
+		t.Run("write-behind-"+backend, func(t *testing.T) {
+			storetest.Run(t, func(dir string) mqtt.Store {
+				opts := mqtt.NewOptions()
+				opts.StoreWriteBehind = 10 * time.Millisecond
+				return openStoreOptions(t, backend, filepath.Join(dir, "store.db"), opts)
+			})
+		})
+	}
+
+	t.Run("raft", func(t *testing.T) {
+		storetest.Run(t, func(dir string) mqtt.Store {
+			return openRaftStore(t, dir, nil)
+		})
+	})
+
+	keys, err := mqtt.ParseKeyring(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("encrypted-raft", func(t *testing.T) {
+		storetest.Run(t, func(dir string) mqtt.Store {
+			return openRaftStore(t, dir, keys)
+		})
+	})
+
+	t.Run("ephemeral", func(t *testing.T) {
+		storetest.RunEphemeral(t, func() mqtt.Store {
+			return openStore(t, "memory", "")
+		})
+	})
+}
@@ -1,6 +1,9 @@
 package mqtt
 import (
+	"io"
+	"path/filepath"
 	"testing"
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/stretchr/testify/assert"
 	"math/rand"
@@ -9,7 +12,7 @@ import (
 )
 
 func TestRetainInLeveldb(t *testing.T) {
-	db, err := leveldb.OpenFile("test.db", nil)
+	db, err := leveldb.OpenFile(filepath.Join(t.TempDir(), "test.db"), nil)
 	assert.NoError(t, err, "failed to open level.db")
 
 	start := time.Now()
@@ -31,3 +34,78 @@ func TestRetainInLeveldb(t *testing.T) {
 
 	log.Println(float64(500000) / time.Since(start).Seconds())
 }
+
+func TestOpenStoreBackends(t *testing.T) {
+	for _, backend := range []string{"leveldb", "bolt", "sqlite", "memory"} {
+		opts := NewOptions()
+		opts.StoreBackend = backend
+		opts.StorePath = filepath.Join(t.TempDir(), "store.db")
+		opts.StoreSnapshotInterval = time.Hour
+
+		store, err := OpenStore(opts)
+		if !assert.NoError(t, err, backend) {
+			continue
+		}
+		assert.NoError(t, store.StoreSubscription("a/#", "c1", 1), backend)
+		assert.NoError(t, store.StoreSubscription("b", "c1", 2), backend)
+		assert.NoError(t, store.DeleteSubscription("b", "c1"), backend)
+
+		retain := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		retain.TopicName = "status"
+		retain.Retain = true
+		retain.Payload = []byte("online")
+		assert.NoError(t, store.StoreRetained(retain), backend)
+
+		p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		p.TopicName = "a/b"
+		p.Qos = 2
+		p.MessageID = 7
+		p.Payload = []byte("hello")
+		assert.NoError(t, store.StoreInboundPacket("c1", p), backend)
+		assert.NoError(t, store.StoreOutboundPacket("c1", p), backend)
+		store.(io.Closer).Close()
+
+		// everything is still there after reopen
+		store, err = OpenStore(opts)
+		if !assert.NoError(t, err, backend) {
+			continue
+		}
+		var subs []string
+		assert.NoError(t, store.LookupSubscriptions(func(filter, cid string, qos byte) {
+			subs = append(subs, cid+":"+filter)
+		}), backend)
+		assert.Equal(t, []string{"c1:a/#"}, subs, backend)
+
+		var retained []string
+		assert.NoError(t, store.LookupRetained(func(p *packets.PublishPacket) {
+			retained = append(retained, string(p.Payload))
+		}), backend)
+		assert.Equal(t, []string{"online"}, retained, backend)
+
+		in, err := store.FindInboundPacket("c1", 7)
+		assert.NoError(t, err, backend)
+		if assert.NotNil(t, in, backend) {
+			assert.Equal(t, "hello", string(in.(*packets.PublishPacket).Payload), backend)
+		}
+		assert.Equal(t, 1, storeSize(t, store.InPacketsSize), backend)
+		assert.Equal(t, 1, storeSize(t, store.OutPacketsSize), backend)
+
+		assert.NoError(t, store.CleanPackets("c1"), backend)
+		assert.NoError(t, store.CleanSubscription("c1"), backend)
+		assert.Equal(t, 0, storeSize(t, store.InPacketsSize)+storeSize(t, store.OutPacketsSize), backend)
+		store.LookupSubscriptions(func(filter, cid string, qos byte) {
+			t.Errorf("%v: subscription %v of %v not cleaned", backend, filter, cid)
+		})
+		store.(io.Closer).Close()
+	}
+
+	_, err := OpenStore(&Options{StoreBackend: "nosuch"})
+	assert.Equal(t, ErrUnknownStoreBackend, err)
+}
+
+// the size of the stored packets, failing the test if the store can't count them.
+func storeSize(t *testing.T, size func() (int, error)) int {
+	n, err := size()
+	assert.NoError(t, err)
+	return n
+}
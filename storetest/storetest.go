@@ -0,0 +1,426 @@
+// Package storetest checks that a Store implementation behaves as the broker expects.
+//
+// A backend proves it's a drop-in replacement by running the suite in its tests:
+//
+//	func TestMyStore(t *testing.T) {
+//		storetest.Run(t, func(dir string) mqtt.Store {
+//			store, err := OpenMyStore(filepath.Join(dir, "my.db"))
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return store
+//		})
+//	}
+//
+// The stores are closed by the suite if they implement io.Closer.
+package storetest
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+
+	"bitbucket.org/j3r0lin/mqtt"
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+// Run checks every Store method, including persistence across reopen.
+// open is called with a new directory for each test, and again with the same
+// directory to reopen the store.
+func Run(t *testing.T, open func(dir string) mqtt.Store) {
+	run(t, open)
+	t.Run("Persistence", func(t *testing.T) {
+		testPersistence(t, open)
+	})
+}
+
+// RunEphemeral checks every Store method except persistence, for the stores
+// which lose everything when closed.
+func RunEphemeral(t *testing.T, open func() mqtt.Store) {
+	run(t, func(string) mqtt.Store {
+		return open()
+	})
+}
+
+func run(t *testing.T, open func(dir string) mqtt.Store) {
+	tests := []struct {
+		name string
+		test func(*testing.T, mqtt.Store)
+	}{
+		{"Subscriptions", testSubscriptions},
+		{"Retained", testRetained},
+		{"Wills", testWills},
+		{"InboundDedupe", testInboundDedupe},
+		{"OutboundOrdering", testOutboundOrdering},
+		{"CleanIsolation", testCleanIsolation},
+		{"Counters", testCounters},
+		{"LookupPackets", testLookupPackets},
+		{"Concurrency", testConcurrency},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			store := open(t.TempDir())
+			defer closeStore(t, store)
+			tt.test(t, store)
+		})
+	}
+}
+
+func closeStore(t *testing.T, store mqtt.Store) {
+	if c, ok := store.(io.Closer); ok {
+		assert.NoError(t, c.Close())
+	}
+}
+
+type subscription struct {
+	Filter   string
+	ClientID string
+	QoS      byte
+}
+
+func lookupSubscriptions(t *testing.T, store mqtt.Store) []subscription {
+	l := []subscription{}
+	assert.NoError(t, store.LookupSubscriptions(func(filter, cid string, qos byte) {
+		l = append(l, subscription{filter, cid, qos})
+	}))
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].ClientID != l[j].ClientID {
+			return l[i].ClientID < l[j].ClientID
+		}
+		return l[i].Filter < l[j].Filter
+	})
+	return l
+}
+
+func lookupRetained(t *testing.T, store mqtt.Store) map[string]string {
+	m := map[string]string{}
+	assert.NoError(t, store.LookupRetained(func(p *packets.PublishPacket) {
+		m[p.TopicName] = string(p.Payload)
+	}))
+	return m
+}
+
+func offlineMessageIds(t *testing.T, store mqtt.Store, cid string) []uint16 {
+	l := []uint16{}
+	assert.NoError(t, store.StreamOfflinePackets(cid, func(p packets.ControlPacket) {
+		l = append(l, p.Details().MessageID)
+	}))
+	return l
+}
+
+func findInbound(t *testing.T, store mqtt.Store, cid string, mid uint16) packets.ControlPacket {
+	p, err := store.FindInboundPacket(cid, mid)
+	assert.NoError(t, err)
+	return p
+}
+
+func inPackets(t *testing.T, store mqtt.Store) int {
+	n, err := store.InPacketsSize()
+	assert.NoError(t, err)
+	return n
+}
+
+func outPackets(t *testing.T, store mqtt.Store) int {
+	n, err := store.OutPacketsSize()
+	assert.NoError(t, err)
+	return n
+}
+
+func publish(topic, payload string, qos byte, mid uint16) *packets.PublishPacket {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Payload = []byte(payload)
+	p.Qos = qos
+	p.MessageID = mid
+	return p
+}
+
+func pubrel(mid uint16) *packets.PubrelPacket {
+	p := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	p.MessageID = mid
+	return p
+}
+
+func testSubscriptions(t *testing.T, store mqtt.Store) {
+	assert.Empty(t, lookupSubscriptions(t, store))
+
+	assert.NoError(t, store.StoreSubscription("a/b", "c1", 0))
+	assert.NoError(t, store.StoreSubscription("a/#", "c1", 1))
+	assert.NoError(t, store.StoreSubscription("+/b", "c2", 2))
+	assert.Equal(t, []subscription{{"a/#", "c1", 1}, {"a/b", "c1", 0}, {"+/b", "c2", 2}}, lookupSubscriptions(t, store))
+
+	// the qos is replaced by the new subscription of the same filter
+	assert.NoError(t, store.StoreSubscription("a/b", "c1", 2))
+	assert.Equal(t, []subscription{{"a/#", "c1", 1}, {"a/b", "c1", 2}, {"+/b", "c2", 2}}, lookupSubscriptions(t, store))
+
+	assert.NoError(t, store.DeleteSubscription("a/b", "c1"))
+	assert.NoError(t, store.DeleteSubscription("a/b", "c2"))
+	assert.NoError(t, store.DeleteSubscription("nothing", "c3"))
+	assert.Equal(t, []subscription{{"a/#", "c1", 1}, {"+/b", "c2", 2}}, lookupSubscriptions(t, store))
+
+	assert.NoError(t, store.CleanSubscription("c1"))
+	assert.Equal(t, []subscription{{"+/b", "c2", 2}}, lookupSubscriptions(t, store))
+	assert.NoError(t, store.CleanSubscription("c2"))
+	assert.Empty(t, lookupSubscriptions(t, store))
+}
+
+func testRetained(t *testing.T, store mqtt.Store) {
+	assert.Empty(t, lookupRetained(t, store))
+
+	retain := publish("status/a", "online", 1, 0)
+	retain.Retain = true
+	assert.NoError(t, store.StoreRetained(retain))
+	assert.NoError(t, store.StoreRetained(publish("status/b", "online", 0, 0)))
+	assert.Equal(t, map[string]string{"status/a": "online", "status/b": "online"}, lookupRetained(t, store))
+
+	assert.NoError(t, store.LookupRetained(func(p *packets.PublishPacket) {
+		if p.TopicName == "status/a" {
+			assert.Equal(t, byte(1), p.Qos, "qos of the retained message")
+		}
+	}))
+
+	// replaced by the last message of the topic
+	assert.NoError(t, store.StoreRetained(publish("status/a", "offline", 0, 0)))
+	assert.Equal(t, map[string]string{"status/a": "offline", "status/b": "online"}, lookupRetained(t, store))
+
+	// an empty payload deletes the retained message
+	assert.NoError(t, store.StoreRetained(publish("status/a", "", 0, 0)))
+	assert.NoError(t, store.StoreRetained(publish("status/c", "", 0, 0)))
+	assert.Equal(t, map[string]string{"status/b": "online"}, lookupRetained(t, store))
+}
+
+func lookupWills(t *testing.T, store mqtt.Store) map[string]string {
+	wills := make(map[string]string)
+	var cids []string
+	assert.NoError(t, store.LookupWills(func(cid string, p *packets.PublishPacket) {
+		wills[cid] = p.TopicName + " " + string(p.Payload)
+		cids = append(cids, cid)
+	}))
+	assert.True(t, sort.StringsAreSorted(cids), "wills ordered by client id")
+	return wills
+}
+
+func testWills(t *testing.T, store mqtt.Store) {
+	assert.Empty(t, lookupWills(t, store))
+
+	will := publish("status/c2", "offline", 1, 0)
+	will.Retain = true
+	assert.NoError(t, store.StoreWill("c2", will))
+	assert.NoError(t, store.StoreWill("c1", publish("status/c1", "offline", 0, 0)))
+	assert.Equal(t, map[string]string{"c1": "status/c1 offline", "c2": "status/c2 offline"}, lookupWills(t, store))
+	assert.NoError(t, store.LookupWills(func(cid string, p *packets.PublishPacket) {
+		if cid == "c2" {
+			assert.Equal(t, byte(1), p.Qos, "qos of the will")
+			assert.True(t, p.Retain, "retain of the will")
+		}
+	}))
+
+	// replaced by the will of the next connection
+	assert.NoError(t, store.StoreWill("c1", publish("status/c1", "gone", 0, 0)))
+	assert.NoError(t, store.DeleteWill("c2"))
+	assert.NoError(t, store.DeleteWill("c3"))
+	assert.Equal(t, map[string]string{"c1": "status/c1 gone"}, lookupWills(t, store))
+
+	// the session packets are not the will
+	assert.NoError(t, store.CleanPackets("c1"))
+	assert.NoError(t, store.CleanSubscription("c1"))
+	assert.Len(t, lookupWills(t, store), 1)
+}
+
+func testInboundDedupe(t *testing.T, store mqtt.Store) {
+	assert.Nil(t, findInbound(t, store, "c1", 1))
+
+	assert.NoError(t, store.StoreInboundPacket("c1", publish("a", "first", 2, 1)))
+	// the resent message with the same id replaces the first one
+	dup := publish("a", "resent", 2, 1)
+	dup.Dup = true
+	assert.NoError(t, store.StoreInboundPacket("c1", dup))
+	assert.Equal(t, 1, inPackets(t, store))
+
+	p, ok := findInbound(t, store, "c1", 1).(*packets.PublishPacket)
+	if assert.True(t, ok, "stored publish packet") {
+		assert.Equal(t, "resent", string(p.Payload))
+		assert.Equal(t, byte(2), p.Qos)
+	}
+	assert.Nil(t, findInbound(t, store, "c2", 1), "inbound packets are per client")
+	assert.Nil(t, findInbound(t, store, "c1", 2))
+
+	// the inbound packets are not sent to the client
+	assert.Empty(t, offlineMessageIds(t, store, "c1"))
+
+	assert.NoError(t, store.DeleteInboundPacket("c1", 1))
+	assert.Nil(t, findInbound(t, store, "c1", 1))
+	assert.Equal(t, 0, inPackets(t, store))
+}
+
+func testOutboundOrdering(t *testing.T, store mqtt.Store) {
+	// stored out of order, and across the string order of the ids: 5, 12, 19, 6, ...
+	var mids []uint16
+	for i := 0; i < 20; i++ {
+		mid := uint16(i*7%20 + 1)
+		assert.NoError(t, store.StoreOutboundPacket("c1", publish("a", fmt.Sprint(mid), 1, mid)))
+	}
+	for mid := uint16(1); mid <= 20; mid++ {
+		mids = append(mids, mid)
+	}
+	assert.Equal(t, mids, offlineMessageIds(t, store, "c1"))
+
+	// a release replaces the message it acknowledged, in place
+	assert.NoError(t, store.StoreOutboundPacket("c1", pubrel(5)))
+	assert.NoError(t, store.StreamOfflinePackets("c1", func(p packets.ControlPacket) {
+		if p.Details().MessageID == 5 {
+			_, ok := p.(*packets.PubrelPacket)
+			assert.True(t, ok, "pubrel replaced the message")
+		}
+	}))
+	assert.Equal(t, mids, offlineMessageIds(t, store, "c1"))
+
+	assert.NoError(t, store.DeleteOutboundPacket("c1", 5))
+	assert.NoError(t, store.DeleteOutboundPacket("c1", 99))
+	assert.Equal(t, append(mids[:4:4], mids[5:]...), offlineMessageIds(t, store, "c1"))
+}
+
+func testCleanIsolation(t *testing.T, store mqtt.Store) {
+	// the client ids share prefixes, or the separators of the keys
+	for _, cid := range []string{"c1", "c10", "c1x", "a", "a:b", "a%3Ab"} {
+		assert.NoError(t, store.StoreSubscription("a", cid, 1))
+		assert.NoError(t, store.StoreInboundPacket(cid, publish("a", cid, 2, 1)))
+		assert.NoError(t, store.StoreOutboundPacket(cid, publish("a", cid, 1, 1)))
+	}
+
+	for _, cid := range []string{"c1", "a"} {
+		assert.NoError(t, store.CleanSubscription(cid))
+		assert.NoError(t, store.CleanPackets(cid))
+		assert.Nil(t, findInbound(t, store, cid, 1))
+		assert.Empty(t, offlineMessageIds(t, store, cid))
+	}
+	expected := []subscription{{"a", "a%3Ab", 1}, {"a", "a:b", 1}, {"a", "c10", 1}, {"a", "c1x", 1}}
+	assert.Equal(t, expected, lookupSubscriptions(t, store))
+	for _, cid := range []string{"c10", "c1x", "a:b", "a%3Ab"} {
+		assert.NotNil(t, findInbound(t, store, cid, 1), cid)
+		assert.Equal(t, []uint16{1}, offlineMessageIds(t, store, cid), cid)
+	}
+	assert.Equal(t, 4, inPackets(t, store))
+	assert.Equal(t, 4, outPackets(t, store))
+	assert.Equal(t, []string{"a%3Ab in 1", "a%3Ab out 1", "a:b in 1", "a:b out 1",
+		"c10 in 1", "c10 out 1", "c1x in 1", "c1x out 1"}, lookupPackets(t, store))
+}
+
+func testCounters(t *testing.T, store mqtt.Store) {
+	assert.Equal(t, 0, inPackets(t, store))
+	assert.Equal(t, 0, outPackets(t, store))
+
+	for mid := uint16(1); mid <= 3; mid++ {
+		assert.NoError(t, store.StoreInboundPacket("c1", publish("a", "in", 2, mid)))
+		assert.NoError(t, store.StoreOutboundPacket("c1", publish("a", "out", 1, mid)))
+		assert.NoError(t, store.StoreOutboundPacket("c2", publish("a", "out", 1, mid)))
+	}
+	assert.Equal(t, 3, inPackets(t, store))
+	assert.Equal(t, 6, outPackets(t, store))
+
+	assert.NoError(t, store.DeleteInboundPacket("c1", 1))
+	assert.NoError(t, store.DeleteOutboundPacket("c2", 1))
+	assert.Equal(t, 2, inPackets(t, store))
+	assert.Equal(t, 5, outPackets(t, store))
+
+	assert.NoError(t, store.CleanPackets("c2"))
+	assert.Equal(t, 2, inPackets(t, store))
+	assert.Equal(t, 3, outPackets(t, store))
+}
+
+func testLookupPackets(t *testing.T, store mqtt.Store) {
+	assert.Empty(t, lookupPackets(t, store))
+
+	assert.NoError(t, store.StoreOutboundPacket("c2", publish("a", "out", 1, 3)))
+	assert.NoError(t, store.StoreOutboundPacket("c1", publish("a", "out", 1, 2)))
+	assert.NoError(t, store.StoreOutboundPacket("c1", publish("a", "out", 1, 1)))
+	assert.NoError(t, store.StoreInboundPacket("c1", publish("a", "in", 2, 9)))
+	assert.NoError(t, store.StoreOutboundPacket("c1", pubrel(2)))
+	assert.NoError(t, store.StoreInboundPacket("c1:x", pubrel(1)))
+
+	// ordered by client id, inbound first, and outbound as they are streamed
+	expected := []string{"c1 in 9"}
+	for _, mid := range offlineMessageIds(t, store, "c1") {
+		expected = append(expected, fmt.Sprint("c1 out ", mid))
+	}
+	expected = append(expected, "c1:x in 1", "c2 out 3")
+	assert.Equal(t, expected, lookupPackets(t, store))
+
+	assert.NoError(t, store.LookupPackets(func(cid string, inbound bool, p packets.ControlPacket) {
+		if cid == "c1" && !inbound && p.Details().MessageID == 2 {
+			_, ok := p.(*packets.PubrelPacket)
+			assert.True(t, ok, "the stored pubrel")
+		}
+	}))
+}
+
+func lookupPackets(t *testing.T, store mqtt.Store) []string {
+	l := []string{}
+	assert.NoError(t, store.LookupPackets(func(cid string, inbound bool, p packets.ControlPacket) {
+		direction := "out"
+		if inbound {
+			direction = "in"
+		}
+		l = append(l, fmt.Sprint(cid, " ", direction, " ", p.Details().MessageID))
+	}))
+	return l
+}
+
+func testConcurrency(t *testing.T, store mqtt.Store) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(cid string) {
+			defer wg.Done()
+			for mid := uint16(1); mid <= 50; mid++ {
+				assert.NoError(t, store.StoreSubscription(fmt.Sprint("t/", mid), cid, 1))
+				assert.NoError(t, store.StoreRetained(publish(fmt.Sprint("r/", cid, "/", mid), "v", 0, 0)))
+				assert.NoError(t, store.StoreInboundPacket(cid, publish("a", "in", 2, mid)))
+				assert.NoError(t, store.StoreOutboundPacket(cid, publish("a", "out", 1, mid)))
+				findInbound(t, store, cid, mid)
+				assert.NoError(t, store.LookupSubscriptions(func(string, string, byte) {}))
+				assert.NoError(t, store.StreamOfflinePackets(cid, func(packets.ControlPacket) {}))
+				inPackets(t, store)
+				if mid%2 == 0 {
+					assert.NoError(t, store.DeleteInboundPacket(cid, mid))
+					assert.NoError(t, store.DeleteOutboundPacket(cid, mid))
+					assert.NoError(t, store.DeleteSubscription(fmt.Sprint("t/", mid), cid))
+				}
+			}
+		}(fmt.Sprint("c", i))
+	}
+	wg.Wait()
+
+	assert.Equal(t, 8*25, inPackets(t, store))
+	assert.Equal(t, 8*25, outPackets(t, store))
+	assert.Len(t, lookupSubscriptions(t, store), 8*25)
+	assert.Len(t, lookupRetained(t, store), 8*50)
+}
+
+func testPersistence(t *testing.T, open func(dir string) mqtt.Store) {
+	dir := t.TempDir()
+	store := open(dir)
+	assert.NoError(t, store.StoreSubscription("a/#", "c1", 2))
+	assert.NoError(t, store.StoreRetained(publish("status", "online", 1, 0)))
+	assert.NoError(t, store.StoreInboundPacket("c1", publish("in", "qos2", 2, 7)))
+	assert.NoError(t, store.StoreOutboundPacket("c1", publish("out", "qos1", 1, 8)))
+	assert.NoError(t, store.StoreOutboundPacket("c1", pubrel(9)))
+	assert.NoError(t, store.StoreWill("c1", publish("status/c1", "offline", 1, 0)))
+	closeStore(t, store)
+
+	store = open(dir)
+	defer closeStore(t, store)
+	assert.Equal(t, []subscription{{"a/#", "c1", 2}}, lookupSubscriptions(t, store))
+	assert.Equal(t, map[string]string{"status": "online"}, lookupRetained(t, store))
+	if p, ok := findInbound(t, store, "c1", 7).(*packets.PublishPacket); assert.True(t, ok, "inbound packet kept") {
+		assert.Equal(t, "qos2", string(p.Payload))
+	}
+	assert.Equal(t, []uint16{8, 9}, offlineMessageIds(t, store, "c1"))
+	assert.Equal(t, 1, inPackets(t, store))
+	assert.Equal(t, 2, outPackets(t, store))
+	assert.Equal(t, map[string]string{"c1": "status/c1 offline"}, lookupWills(t, store))
+}
@@ -0,0 +1,56 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+)
+
+// A Transport listens on the host of a uri scheme that's not a network of the net
+// package. The listener accepts a connection per MQTT client, ie: a QUIC transport
+// accepts a bidirectional stream per client, and the stream is kept by the client
+// when its QUIC connection migrates to another address.
+//
+// The config is the ListenerOptions.TLSConfig, the transport secures its connections
+// itself and they're served as they are.
+type Transport func(host string, config *tls.Config) (net.Listener, error)
+
+var transports = struct {
+	sync.RWMutex
+	m map[string]Transport
+}{m: make(map[string]Transport)}
+
+// RegisterTransport makes the transport listen on the uris of the scheme, see
+// ListenAndServeListener. The "quic" scheme is built in, a QUIC listener requires
+// the ListenerOptions.TLSConfig.
+func RegisterTransport(scheme string, transport Transport) {
+	transports.Lock()
+	defer transports.Unlock()
+	transports.m[scheme] = transport
+}
+
+func transport(scheme string) Transport {
+	transports.RLock()
+	defer transports.RUnlock()
+	return transports.m[scheme]
+}
+
+// listen on the uri scheme and host, with the transport of the scheme if it's registered,
+// the options of the connections served as they are.
+func listen(scheme, host string, opts *ListenerOptions) (net.Listener, *ListenerOptions, error) {
+	t := transport(scheme)
+	if t == nil {
+		ln, err := net.Listen(scheme, host)
+		return ln, opts, err
+	}
+
+	var config *tls.Config
+	if opts != nil {
+		config = opts.TLSConfig
+		o := *opts
+		o.TLSConfig = nil
+		opts = &o
+	}
+	ln, err := t(host, config)
+	return ln, opts, err
+}
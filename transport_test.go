@@ -0,0 +1,30 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransport(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	defer server.Close()
+	assert.Equal(t, ErrQUICWithoutTLS, server.ListenAndServeListener("quic://127.0.0.1:0", nil))
+
+	config := &tls.Config{}
+	addrs := make(chan string, 1)
+	RegisterTransport("test", func(host string, c *tls.Config) (net.Listener, error) {
+		assert.True(t, c == config)
+		ln, err := net.Listen("tcp", host)
+		if err == nil {
+			addrs <- ln.Addr().String()
+		}
+		return ln, err
+	})
+	go server.ListenAndServeListener("test://127.0.0.1:0", &ListenerOptions{TLSConfig: config})
+
+	// the connections of the transport are not wrapped in TLS again
+	dialTestClient(t, <-addrs, "c", true).subscribe("a", 0)
+}
@@ -16,3 +16,30 @@ func UnmarshalPacket(p []byte) packets.ControlPacket {
 	return cp
 }
 
+// decode a stored packet, unlike UnmarshalPacket it reports the corrupt values.
+func decodePacket(value []byte) (cp packets.ControlPacket, err error) {
+	// the unpacking panics on some truncated fields
+	defer func() {
+		if r := recover(); r != nil {
+			cp, err = nil, ErrCorruptValue
+		}
+	}()
+	r := bytes.NewBuffer(value)
+	cp, err = packets.ReadPacket(r)
+	if err != nil || r.Len() > 0 {
+		return nil, ErrCorruptValue
+	}
+	return cp, nil
+}
+
+// decode a stored message, ie: a retained message.
+func decodePublish(value []byte) (*packets.PublishPacket, error) {
+	cp, err := decodePacket(value)
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := cp.(*packets.PublishPacket); ok {
+		return p, nil
+	}
+	return nil, ErrCorruptValue
+}
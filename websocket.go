@@ -0,0 +1,451 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the opcodes of the WebSocket frames.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// the status codes of the close frames.
+const (
+	wsCloseNormal      = 1000
+	wsCloseProtocol    = 1002
+	wsCloseUnsupported = 1003
+	wsCloseTooBig      = 1009
+)
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsMaxControl = 125
+	// the largest frame, an MQTT packet of the largest remaining length
+	wsMaxFrame = 268435455 + 5
+	// the smaller messages are sent uncompressed
+	wsCompressMin = 64
+)
+
+// appended to a compressed message to inflate it: the tail stripped by the sender,
+// then an empty final block ending the stream.
+const wsDeflateTail = "\x00\x00\xff\xff\x01\x00\x00\xff\xff"
+
+type wsHeader struct {
+	fin    bool
+	rsv1   bool
+	opcode byte
+	masked bool
+	mask   [4]byte
+	length int64
+}
+
+func readWSHeader(r io.Reader) (h wsHeader, err error) {
+	var b [8]byte
+	if _, err = io.ReadFull(r, b[:2]); err != nil {
+		return
+	}
+	h.fin = b[0]&0x80 != 0
+	h.rsv1 = b[0]&0x40 != 0
+	h.opcode = b[0] & 0x0f
+	h.masked = b[1]&0x80 != 0
+	if b[0]&0x30 != 0 {
+		return h, ErrInvalidWebSocketFrame
+	}
+	switch n := b[1] & 0x7f; n {
+	case 126:
+		if _, err = io.ReadFull(r, b[:2]); err != nil {
+			return
+		}
+		h.length = int64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err = io.ReadFull(r, b[:8]); err != nil {
+			return
+		}
+		h.length = int64(binary.BigEndian.Uint64(b[:8]))
+	default:
+		h.length = int64(n)
+	}
+	if h.masked {
+		if _, err = io.ReadFull(r, h.mask[:]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// a frame of the payload, masked by the clients and unmasked by the server.
+func wsFrame(opcode byte, fin, rsv1 bool, mask []byte, payload []byte) []byte {
+	b := make([]byte, 2, 14+len(payload))
+	b[0] = opcode
+	if fin {
+		b[0] |= 0x80
+	}
+	if rsv1 {
+		b[0] |= 0x40
+	}
+	switch n := len(payload); {
+	case n < 126:
+		b[1] = byte(n)
+	case n <= 0xffff:
+		b[1] = 126
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b[1] = 127
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	if mask != nil {
+		b[1] |= 0x80
+		b = append(b, mask...)
+		start := len(b)
+		b = append(b, payload...)
+		wsMask(mask, 0, b[start:])
+		return b
+	}
+	return append(b, payload...)
+}
+
+// mask or unmask b from the position pos of the payload, the next position is returned.
+func wsMask(mask []byte, pos int, b []byte) int {
+	for i := range b {
+		b[i] ^= mask[pos&3]
+		pos++
+	}
+	return pos
+}
+
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// a WebSocket connection as the stream of its binary messages, the MQTT packets are read
+// across the frames and the messages, each write is sent as a message.
+type wsConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	// the frame being read and the position in its payload
+	frame wsHeader
+	pos   int
+	// the message being read, nil between the messages
+	message io.Reader
+	inflate io.ReadCloser
+
+	wmu     sync.Mutex
+	deflate *flate.Writer
+	buf     bytes.Buffer
+	closing bool
+
+	done chan struct{}
+	once sync.Once
+}
+
+func newWSConn(conn net.Conn, r *bufio.Reader, compress bool, ping time.Duration) *wsConn {
+	this := &wsConn{Conn: conn, r: r, done: make(chan struct{})}
+	if compress {
+		this.inflate = flate.NewReader(nil)
+		this.deflate, _ = flate.NewWriter(nil, flate.BestSpeed)
+	}
+	if ping > 0 {
+		go this.keepAlive(ping)
+	}
+	return this
+}
+
+func (this *wsConn) Read(b []byte) (n int, err error) {
+	for {
+		if this.message == nil {
+			if err = this.nextMessage(); err != nil {
+				return 0, err
+			}
+		}
+		n, err = this.message.Read(b)
+		if err == io.EOF {
+			this.message, err = nil, nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// start reading the next data message.
+func (this *wsConn) nextMessage() error {
+	if err := this.nextFrame(); err != nil {
+		return err
+	}
+	switch this.frame.opcode {
+	case wsBinary:
+	case wsText:
+		// MQTT is sent in binary messages only
+		return this.fail(wsCloseUnsupported, ErrInvalidWebSocketFrame)
+	default:
+		return this.fail(wsCloseProtocol, ErrInvalidWebSocketFrame)
+	}
+	this.message = wsFrames{this}
+	if this.frame.rsv1 {
+		this.inflate.(flate.Resetter).Reset(io.MultiReader(this.message, strings.NewReader(wsDeflateTail)), nil)
+		this.message = this.inflate
+	}
+	return nil
+}
+
+// read the header of the next data frame, the control frames before it are handled.
+func (this *wsConn) nextFrame() error {
+	for {
+		h, err := readWSHeader(this.r)
+		if err != nil {
+			if err == ErrInvalidWebSocketFrame {
+				return this.fail(wsCloseProtocol, err)
+			}
+			return err
+		}
+		// the clients must mask their frames, and only the first frame of a message
+		// is compressed, if the compression is negotiated
+		if !h.masked || (h.rsv1 && (this.inflate == nil || h.opcode == wsContinuation)) {
+			return this.fail(wsCloseProtocol, ErrInvalidWebSocketFrame)
+		}
+		if h.length > wsMaxFrame {
+			return this.fail(wsCloseTooBig, ErrInvalidWebSocketFrame)
+		}
+		if h.opcode < wsClose {
+			this.frame, this.pos = h, 0
+			return nil
+		}
+		if !h.fin || h.rsv1 || h.length > wsMaxControl {
+			return this.fail(wsCloseProtocol, ErrInvalidWebSocketFrame)
+		}
+		payload := make([]byte, h.length)
+		if _, err := io.ReadFull(this.r, payload); err != nil {
+			return err
+		}
+		wsMask(h.mask[:], 0, payload)
+		switch h.opcode {
+		case wsPing:
+			if err := this.writeFrame(wsPong, false, payload); err != nil {
+				return err
+			}
+		case wsPong:
+		case wsClose:
+			// the close is echoed with the status of the client
+			if len(payload) >= 2 {
+				payload = payload[:2]
+			}
+			this.writeClose(payload)
+			return io.EOF
+		default:
+			return this.fail(wsCloseProtocol, ErrInvalidWebSocketFrame)
+		}
+	}
+}
+
+// the payload of the frames of a message.
+type wsFrames struct {
+	*wsConn
+}
+
+func (this wsFrames) Read(b []byte) (int, error) {
+	for int64(this.pos) == this.frame.length {
+		if this.frame.fin {
+			return 0, io.EOF
+		}
+		if err := this.nextFrame(); err != nil {
+			return 0, err
+		}
+		if this.frame.opcode != wsContinuation {
+			return 0, this.fail(wsCloseProtocol, ErrInvalidWebSocketFrame)
+		}
+	}
+	if rest := this.frame.length - int64(this.pos); int64(len(b)) > rest {
+		b = b[:rest]
+	}
+	n, err := this.r.Read(b)
+	this.pos = wsMask(this.frame.mask[:], this.pos, b[:n])
+	if err == io.EOF {
+		// the connection ends in the frame, not the message
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// close the connection for a protocol error, with the status code.
+func (this *wsConn) fail(code int, err error) error {
+	this.writeClose(binary.BigEndian.AppendUint16(nil, uint16(code)))
+	return err
+}
+
+// send b in a binary message, compressed if it's worth it.
+func (this *wsConn) Write(b []byte) (int, error) {
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+	if this.closing {
+		return 0, io.EOF
+	}
+	var err error
+	if this.deflate != nil && len(b) >= wsCompressMin {
+		this.buf.Reset()
+		this.deflate.Reset(&this.buf)
+		this.deflate.Write(b)
+		this.deflate.Flush()
+		_, err = this.Conn.Write(wsFrame(wsBinary, true, true, nil, bytes.TrimSuffix(this.buf.Bytes(), []byte{0, 0, 0xff, 0xff})))
+	} else {
+		_, err = this.Conn.Write(wsFrame(wsBinary, true, false, nil, b))
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (this *wsConn) writeFrame(opcode byte, closing bool, payload []byte) error {
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+	if this.closing {
+		return io.EOF
+	}
+	this.closing = closing
+	_, err := this.Conn.Write(wsFrame(opcode, true, false, nil, payload))
+	return err
+}
+
+// send the close frame, once.
+func (this *wsConn) writeClose(payload []byte) {
+	this.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	this.writeFrame(wsClose, true, payload)
+}
+
+// ping the client while it's idle, keeping the connection open through the proxies.
+func (this *wsConn) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := this.writeFrame(wsPing, false, nil); err != nil {
+				return
+			}
+		case <-this.done:
+			return
+		}
+	}
+}
+
+func (this *wsConn) Close() error {
+	this.once.Do(func() {
+		close(this.done)
+		// a writer stuck on the connection is not waited for
+		if this.wmu.TryLock() {
+			closing := this.closing
+			this.closing = true
+			if !closing {
+				this.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+				this.Conn.Write(wsFrame(wsClose, true, false, nil, binary.BigEndian.AppendUint16(nil, wsCloseNormal)))
+			}
+			this.wmu.Unlock()
+		}
+	})
+	return this.Conn.Close()
+}
+
+// the permessage-deflate offer of the client that can be accepted, the server compresses
+// with the full window and neither side keeps its context between the messages.
+func wsAcceptDeflate(header http.Header) bool {
+	for _, value := range header.Values("Sec-WebSocket-Extensions") {
+		for _, offer := range strings.Split(value, ",") {
+			params := strings.Split(offer, ";")
+			if strings.TrimSpace(params[0]) != "permessage-deflate" {
+				continue
+			}
+			ok := true
+			for _, param := range params[1:] {
+				name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if name == "server_max_window_bits" && strings.Trim(value, `"`) != "15" {
+					ok = false
+				}
+			}
+			if ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// the subprotocol of the client, the first it offers, ie: "mqtt" or "mqttv3.1".
+func wsProtocol(header http.Header) string {
+	for _, value := range header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				return protocol
+			}
+		}
+	}
+	return ""
+}
+
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgrade the request to a WebSocket connection.
+func (this *Server) upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "websocket upgrade expected", http.StatusBadRequest)
+		return nil, ErrWebSocketHandshake
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, ErrWebSocketHandshake
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, ErrWebSocketHandshake
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	compress := wsAcceptDeflate(r.Header)
+	response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n"
+	if protocol := wsProtocol(r.Header); protocol != "" {
+		response += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	if compress {
+		response += "Sec-WebSocket-Extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover\r\n"
+	}
+	if _, err = conn.Write([]byte(response + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newWSConn(conn, rw.Reader, compress, this.opts.WebSocketPing), nil
+}
@@ -0,0 +1,289 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+var testMask = []byte{0x12, 0x34, 0x56, 0x78}
+
+// a WebSocket client writing its frames by hand, like a browser would.
+type wsTestClient struct {
+	t        *testing.T
+	conn     net.Conn
+	r        *bufio.Reader
+	response *http.Response
+}
+
+func dialWebSocket(t *testing.T, addr string, header string) *wsTestClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	conn.Write([]byte("GET /mqtt HTTP/1.1\r\nHost: " + addr + "\r\n" +
+		"Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Protocol: mqtt\r\n" + header + "\r\n"))
+	c := &wsTestClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if c.response, err = http.ReadResponse(c.r, nil); err != nil {
+		t.Fatal(err)
+	}
+	if c.response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake refused, %v", c.response.Status)
+	}
+	return c
+}
+
+func (this *wsTestClient) send(opcode byte, fin, rsv1 bool, payload []byte) {
+	this.conn.Write(wsFrame(opcode, fin, rsv1, testMask, payload))
+}
+
+func (this *wsTestClient) readFrame() (wsHeader, []byte) {
+	this.t.Helper()
+	this.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	h, err := readWSHeader(this.r)
+	if err != nil {
+		this.t.Fatal(err)
+	}
+	assert.False(this.t, h.masked)
+	payload := make([]byte, h.length)
+	if _, err := io.ReadFull(this.r, payload); err != nil {
+		this.t.Fatal(err)
+	}
+	return h, payload
+}
+
+// read the packet of the next binary message, inflated if it's compressed.
+func (this *wsTestClient) readPacket() packets.ControlPacket {
+	this.t.Helper()
+	h, payload := this.readFrame()
+	assert.Equal(this.t, byte(wsBinary), h.opcode)
+	if h.rsv1 {
+		payload, _ = io.ReadAll(flate.NewReader(io.MultiReader(bytes.NewReader(payload), strings.NewReader(wsDeflateTail))))
+	}
+	cp, err := packets.ReadPacket(bytes.NewReader(payload))
+	if err != nil {
+		this.t.Fatal(err)
+	}
+	return cp
+}
+
+// the close frame of the server and its status code.
+func (this *wsTestClient) assertClosed(code int) {
+	this.t.Helper()
+	h, payload := this.readFrame()
+	if assert.Equal(this.t, byte(wsClose), h.opcode) && assert.Len(this.t, payload, 2) {
+		assert.Equal(this.t, code, int(binary.BigEndian.Uint16(payload)))
+	}
+	_, err := this.r.ReadByte()
+	assert.Error(this.t, err)
+}
+
+func packetBytes(cp packets.ControlPacket) []byte {
+	var b bytes.Buffer
+	cp.Write(&b)
+	return b.Bytes()
+}
+
+func compress(b []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	w.Write(b)
+	w.Flush()
+	return bytes.TrimSuffix(buf.Bytes(), []byte{0, 0, 0xff, 0xff})
+}
+
+func subscribeBytes(filter string) []byte {
+	p := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	p.MessageID = 1
+	p.Topics = []string{filter}
+	p.Qoss = []byte{0}
+	return packetBytes(p)
+}
+
+func publishBytes(topic, payload string) []byte {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Payload = []byte(payload)
+	return packetBytes(p)
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	ts := httptest.NewServer(server.webSocketHandler(nil, false))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	c := dialWebSocket(t, addr, "")
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", c.response.Header.Get("Sec-WebSocket-Accept"))
+	assert.Equal(t, "mqtt", c.response.Header.Get("Sec-WebSocket-Protocol"))
+	assert.Equal(t, "", c.response.Header.Get("Sec-WebSocket-Extensions"))
+
+	resp, err := http.Get(ts.URL)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestWebSocketLimits(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	server.opts.MaxConnections = 1
+	// the listener of ListenAndServeWebSocket
+	l, err := server.newListener(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server.webSocketHandler(l, true))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	c := dialWebSocket(t, addr, "")
+	c.send(wsBinary, true, false, packetBytes(testConnect("ws", true, 30)))
+	assert.IsType(t, &packets.ConnackPacket{}, c.readPacket())
+	dialWebSocket(t, addr, "").assertClosed(wsCloseNormal)
+	assert.Equal(t, int64(1), server.Stats().Rejected.MaxConnections)
+
+	// a closed connection is released
+	c.send(wsClose, true, false, binary.BigEndian.AppendUint16(nil, wsCloseNormal))
+	c.assertClosed(wsCloseNormal)
+	waitFor(t, func() bool {
+		return server.Stats().Connections == 0
+	})
+	c = dialWebSocket(t, addr, "")
+	c.send(wsBinary, true, false, packetBytes(testConnect("ws", true, 30)))
+	assert.IsType(t, &packets.ConnackPacket{}, c.readPacket())
+}
+
+func TestWebSocketFragments(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	addr := serveTestListener(t, server, &ListenerOptions{HTTPHandler: testHTTPHandler()})
+	c := dialWebSocket(t, addr, "")
+
+	// the CONNECT in three frames, with a ping between them
+	connect := packetBytes(testConnect("ws", true, 30))
+	c.send(wsBinary, false, false, connect[:3])
+	c.send(wsPing, true, false, []byte("ping"))
+	c.send(wsContinuation, false, false, connect[3:7])
+	c.send(wsContinuation, true, false, connect[7:])
+	h, payload := c.readFrame()
+	assert.Equal(t, byte(wsPong), h.opcode)
+	assert.Equal(t, "ping", string(payload))
+	assert.IsType(t, &packets.ConnackPacket{}, c.readPacket())
+
+	// two packets in a frame
+	c.send(wsBinary, true, false, append(subscribeBytes("a"), packetBytes(packets.NewControlPacket(packets.Pingreq))...))
+	assert.IsType(t, &packets.SubackPacket{}, c.readPacket())
+	assert.IsType(t, &packets.PingrespPacket{}, c.readPacket())
+
+	// a packet in two messages
+	publish := publishBytes("a", "split")
+	c.send(wsBinary, true, false, publish[:5])
+	c.send(wsBinary, true, false, publish[5:])
+	p := c.readPacket().(*packets.PublishPacket)
+	assert.Equal(t, "split", string(p.Payload))
+
+	c.send(wsClose, true, false, binary.BigEndian.AppendUint16(nil, wsCloseNormal))
+	c.assertClosed(wsCloseNormal)
+	waitFor(t, func() bool {
+		return len(server.Clients()) == 0
+	})
+}
+
+func TestWebSocketDeflate(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	addr := serveTestListener(t, server, &ListenerOptions{HTTPHandler: testHTTPHandler()})
+	c := dialWebSocket(t, addr, "Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n")
+	assert.Equal(t, "permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+		c.response.Header.Get("Sec-WebSocket-Extensions"))
+
+	// only the first frame of a compressed message is flagged
+	connect := compress(packetBytes(testConnect("ws", true, 30)))
+	c.send(wsBinary, false, true, connect[:4])
+	c.send(wsContinuation, true, false, connect[4:])
+	assert.IsType(t, &packets.ConnackPacket{}, c.readPacket())
+
+	// the messages may be sent uncompressed
+	c.send(wsBinary, true, false, subscribeBytes("a"))
+	assert.IsType(t, &packets.SubackPacket{}, c.readPacket())
+
+	payload := strings.Repeat("compressed ", 50)
+	c.send(wsBinary, true, true, compress(publishBytes("a", payload)))
+	h, b := c.readFrame()
+	assert.True(t, h.rsv1)
+	assert.True(t, len(b) < len(payload))
+	p, err := packets.ReadPacket(flate.NewReader(io.MultiReader(bytes.NewReader(b), strings.NewReader(wsDeflateTail))))
+	if assert.NoError(t, err) {
+		assert.Equal(t, payload, string(p.(*packets.PublishPacket).Payload))
+	}
+
+	// the server refuses a compressed continuation frame
+	c.send(wsBinary, false, false, publishBytes("a", "x")[:2])
+	c.send(wsContinuation, true, true, []byte{0})
+	c.assertClosed(wsCloseProtocol)
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	addr := serveTestListener(t, server, &ListenerOptions{HTTPHandler: testHTTPHandler()})
+
+	c := dialWebSocket(t, addr, "")
+	c.send(wsText, true, false, packetBytes(testConnect("ws", true, 30)))
+	c.assertClosed(wsCloseUnsupported)
+
+	c = dialWebSocket(t, addr, "")
+	c.conn.Write(wsFrame(wsBinary, true, false, nil, packetBytes(testConnect("ws", true, 30))))
+	c.assertClosed(wsCloseProtocol)
+
+	// compressed without the extension
+	c = dialWebSocket(t, addr, "")
+	c.send(wsBinary, true, true, compress(packetBytes(testConnect("ws", true, 30))))
+	c.assertClosed(wsCloseProtocol)
+
+	c = dialWebSocket(t, addr, "")
+	c.send(wsPing, false, false, nil)
+	c.assertClosed(wsCloseProtocol)
+}
+
+func TestWebSocketPing(t *testing.T) {
+	server := newServer(NewOptions(), newMemoryStore())
+	server.opts.WebSocketPing = 50 * time.Millisecond
+	addr := serveTestListener(t, server, &ListenerOptions{HTTPHandler: testHTTPHandler()})
+	c := dialWebSocket(t, addr, "")
+
+	c.send(wsBinary, true, false, packetBytes(testConnect("ws", true, 30)))
+	for {
+		h, _ := c.readFrame()
+		if h.opcode == wsPing {
+			break
+		}
+		assert.Equal(t, byte(wsBinary), h.opcode)
+	}
+	c.send(wsPong, true, false, nil)
+	c.send(wsBinary, true, false, subscribeBytes("a"))
+	for {
+		h, payload := c.readFrame()
+		if h.opcode == wsBinary {
+			cp, _ := packets.ReadPacket(bytes.NewReader(payload))
+			assert.IsType(t, &packets.SubackPacket{}, cp)
+			break
+		}
+	}
+}
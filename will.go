@@ -0,0 +1,77 @@
+package mqtt
+
+import (
+	"sync"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+)
+
+// the wills of the sessions connected when the broker stopped, waiting for the will delay.
+type wills struct {
+	sync.Mutex
+	pending map[string]*time.Timer
+}
+
+// publish the stored wills, they belong to the clients connected when the broker stopped
+// without their disconnect being handled, ie: a crash.
+func (this *Server) reloadWills() {
+	type will struct {
+		cid string
+		p   *packets.PublishPacket
+	}
+	var l []will
+	err := this.store.LookupWills(func(cid string, p *packets.PublishPacket) {
+		l = append(l, will{cid, p})
+	})
+	this.storeFailed("reload wills", err)
+
+	this.wills.Lock()
+	defer this.wills.Unlock()
+	this.wills.pending = make(map[string]*time.Timer)
+	for _, w := range l {
+		w := w
+		log.Infof("will of %q published in %v, connected when the broker stopped", w.cid, this.opts.WillDelay)
+		this.wills.pending[w.cid] = time.AfterFunc(this.opts.WillDelay, func() {
+			this.publishStoredWill(w.cid, w.p)
+		})
+	}
+}
+
+func (this *Server) publishStoredWill(cid string, p *packets.PublishPacket) {
+	// the lock is held while publishing, a client reconnecting meanwhile stores its
+	// new will after this one is deleted.
+	this.wills.Lock()
+	defer this.wills.Unlock()
+	if _, ok := this.wills.pending[cid]; !ok {
+		return
+	}
+	delete(this.wills.pending, cid)
+
+	if err := this.publishMessage(cid, p); err != nil {
+		// kept for the next start
+		log.Warnf("will of %q not published, %v", cid, err)
+		return
+	}
+	this.checkStore("delete will", this.store.DeleteWill(cid))
+}
+
+// cancel the stored will of a client reconnecting within the will delay.
+func (this *Server) cancelStoredWill(cid string) {
+	this.wills.Lock()
+	defer this.wills.Unlock()
+	if t, ok := this.wills.pending[cid]; ok {
+		t.Stop()
+		delete(this.wills.pending, cid)
+		log.Infof("will of %q canceled, reconnected", cid)
+	}
+}
+
+// keep the will of a connecting client, or delete the will of its last connection.
+func (this *client) storeWill() error {
+	this.server.cancelStoredWill(this.id)
+	if this.will == nil {
+		return this.server.checkStore("delete will", this.server.store.DeleteWill(this.id))
+	}
+	return this.server.checkStore("store will", this.server.store.StoreWill(this.id, this.will))
+}
@@ -0,0 +1,84 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func dialTestClientWill(t *testing.T, addr, cid, topic, payload string) *testClient {
+	t.Helper()
+	cp := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ClientIdentifier = cid
+	cp.CleanSession = true
+	cp.KeepaliveTimer = 30
+	cp.WillFlag = true
+	cp.WillTopic = topic
+	cp.WillMessage = []byte(payload)
+	cp.WillQos = 1
+	return connectTestClient(t, addr, cp)
+}
+
+func storedWills(t *testing.T, store Store) map[string]string {
+	wills := make(map[string]string)
+	assert.NoError(t, store.LookupWills(func(cid string, p *packets.PublishPacket) {
+		wills[cid] = string(p.Payload)
+	}))
+	return wills
+}
+
+func TestWillStored(t *testing.T) {
+	server, addr := newTestServer(t)
+	sub := dialTestClient(t, addr, "monitor", true)
+	sub.subscribe("status/#", 1)
+
+	// kept while connected
+	dev := dialTestClientWill(t, addr, "dev1", "status/dev1", "offline")
+	assert.Equal(t, map[string]string{"dev1": "offline"}, storedWills(t, server.store))
+
+	// a disconnect deletes it without publishing
+	dev.write(packets.NewControlPacket(packets.Disconnect))
+	waitFor(t, func() bool {
+		return len(storedWills(t, server.store)) == 0
+	})
+
+	// a lost connection publishes and deletes it
+	dev = dialTestClientWill(t, addr, "dev1", "status/dev1", "lost")
+	dev.conn.Close()
+	assert.Equal(t, "lost", string(sub.receive().Payload))
+	waitFor(t, func() bool {
+		return len(storedWills(t, server.store)) == 0
+	})
+}
+
+// the broker crashed with dev1 connected, the restarted one publishes its will.
+func TestWillAfterCrash(t *testing.T) {
+	store := newMemoryStore()
+	assert.NoError(t, store.StoreSubscription("status/#", "monitor", 1))
+	will := testPublish(0)
+	will.TopicName = "status/dev1"
+	will.Qos = 1
+	will.Payload = []byte("offline")
+	assert.NoError(t, store.StoreWill("dev1", will))
+	will.TopicName = "status/dev2"
+	assert.NoError(t, store.StoreWill("dev2", will))
+
+	opts := NewOptions()
+	opts.WillDelay = 200 * time.Millisecond
+	server := newServer(opts, store)
+
+	// dev2 reconnects within the delay, its will is canceled and replaced
+	addr := serveTestServer(t, server)
+	dialTestClientWill(t, addr, "dev2", "status/dev2", "back")
+
+	monitor := dialTestClient(t, addr, "monitor", false)
+	p := monitor.receive()
+	assert.Equal(t, "status/dev1", p.TopicName)
+	assert.Equal(t, "offline", string(p.Payload))
+	waitFor(t, func() bool {
+		wills := storedWills(t, store)
+		return len(wills) == 1 && wills["dev2"] == "back"
+	})
+}
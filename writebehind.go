@@ -0,0 +1,313 @@
+package mqtt
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+)
+
+// the most outbound writes kept by a WriteBehindStore before they're flushed,
+// if not set by Options.StoreWriteBehindSize.
+const DefaultWriteBehindSize = 10000
+
+// a write of an outbound packet, a nil packet deletes it.
+type outboundWrite struct {
+	cid string
+	mid uint16
+	p   packets.ControlPacket
+}
+
+// a store able to write many outbound packets at once, ie: in one transaction.
+type outboundBatcher interface {
+	writeOutbound(writes []outboundWrite) error
+}
+
+// the writes of a session waiting to be flushed, in the order they were made.
+type sessionWrites struct {
+	order []uint16
+	ops   map[uint16]packets.ControlPacket
+}
+
+func (this *sessionWrites) remove(mid uint16) {
+	for i, m := range this.order {
+		if m == mid {
+			this.order = append(this.order[:i], this.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// WriteBehindStore keeps the outbound packets written to a store in memory, and writes
+// them in batches at most window after they were made, or when size writes are waiting.
+//
+// The writes to the same packet are coalesced, a packet stored and deleted before it's
+// flushed, ie: a QoS 1 message acknowledged within the window, is never written.
+// The reads of the packets flush the waiting writes first. The other writes, and the
+// inbound packets, go straight to the store.
+//
+// The outbound packets acknowledged by the store are lost if the broker crashes before
+// they're flushed, Close flushes them on shutdown.
+// A failed flush is retried, the writes fail with its error until the retry succeeds.
+type WriteBehindStore struct {
+	Store
+
+	window time.Duration
+	size   int
+
+	// serializes the flushes and the writes which must follow them
+	flushMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[string]*sessionWrites
+	count   int
+	// the packets which may be in the store, their deletes can't be dropped
+	written map[string]map[uint16]bool
+	err     error
+	// the writes after the close fail, they would never be flushed
+	closed bool
+
+	quit chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// NewWriteBehindStore wraps the store, size is DefaultWriteBehindSize if not set.
+func NewWriteBehindStore(store Store, window time.Duration, size int) *WriteBehindStore {
+	if size <= 0 {
+		size = DefaultWriteBehindSize
+	}
+	this := &WriteBehindStore{
+		Store:   store,
+		window:  window,
+		size:    size,
+		pending: make(map[string]*sessionWrites),
+		written: make(map[string]map[uint16]bool),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go this.run()
+	return this
+}
+
+func (this *WriteBehindStore) run() {
+	defer close(this.done)
+	ticker := time.NewTicker(this.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			this.Flush()
+		case <-this.quit:
+			return
+		}
+	}
+}
+
+func (this *WriteBehindStore) StoreOutboundPacket(cid string, p packets.ControlPacket) error {
+	return this.queue(cid, p.Details().MessageID, p)
+}
+
+func (this *WriteBehindStore) DeleteOutboundPacket(cid string, mid uint16) error {
+	return this.queue(cid, mid, nil)
+}
+
+func (this *WriteBehindStore) queue(cid string, mid uint16, p packets.ControlPacket) error {
+	this.mu.Lock()
+	if this.closed {
+		this.mu.Unlock()
+		return ErrStoreClosed
+	}
+	if this.err != nil {
+		err := this.err
+		this.mu.Unlock()
+		return err
+	}
+	s, ok := this.pending[cid]
+	if !ok {
+		s = &sessionWrites{ops: make(map[uint16]packets.ControlPacket)}
+		this.pending[cid] = s
+	}
+	stored, ok := s.ops[mid]
+	switch {
+	case !ok:
+		s.order = append(s.order, mid)
+		s.ops[mid] = p
+		this.count++
+	case p == nil && stored != nil && !this.written[cid][mid]:
+		// stored and deleted within the window
+		delete(s.ops, mid)
+		s.remove(mid)
+		this.count--
+	default:
+		s.ops[mid] = p
+	}
+	full := this.count >= this.size
+	this.mu.Unlock()
+
+	if full {
+		return this.Flush()
+	}
+	return nil
+}
+
+// Flush writes the waiting writes to the store.
+func (this *WriteBehindStore) Flush() error {
+	this.flushMu.Lock()
+	defer this.flushMu.Unlock()
+	return this.flush()
+}
+
+// the flush lock must be held
+func (this *WriteBehindStore) flush() error {
+	this.mu.Lock()
+	pending := this.pending
+	this.pending = make(map[string]*sessionWrites)
+	this.count = 0
+	var writes []outboundWrite
+	for cid, s := range pending {
+		for _, mid := range s.order {
+			p := s.ops[mid]
+			writes = append(writes, outboundWrite{cid, mid, p})
+			if p != nil {
+				if this.written[cid] == nil {
+					this.written[cid] = make(map[uint16]bool)
+				}
+				this.written[cid][mid] = true
+			}
+		}
+	}
+	this.mu.Unlock()
+
+	var err error
+	if len(writes) > 0 {
+		err = this.write(writes)
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if err != nil {
+		log.Errorf("store: flush %v outbound writes failed, %v", len(writes), err)
+		this.err = err
+		// retry the writes not replaced meanwhile
+		for _, w := range writes {
+			s, ok := this.pending[w.cid]
+			if !ok {
+				s = &sessionWrites{ops: make(map[uint16]packets.ControlPacket)}
+				this.pending[w.cid] = s
+			}
+			if _, ok := s.ops[w.mid]; !ok {
+				s.order = append(s.order, w.mid)
+				s.ops[w.mid] = w.p
+				this.count++
+			}
+		}
+		return err
+	}
+	this.err = nil
+	for _, w := range writes {
+		if w.p == nil {
+			delete(this.written[w.cid], w.mid)
+			if len(this.written[w.cid]) == 0 {
+				delete(this.written, w.cid)
+			}
+		}
+	}
+	return nil
+}
+
+func (this *WriteBehindStore) write(writes []outboundWrite) error {
+	if batcher, ok := this.Store.(outboundBatcher); ok {
+		return batcher.writeOutbound(writes)
+	}
+	for _, w := range writes {
+		var err error
+		if w.p == nil {
+			err = this.Store.DeleteOutboundPacket(w.cid, w.mid)
+		} else {
+			err = this.Store.StoreOutboundPacket(w.cid, w.p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *WriteBehindStore) CleanPackets(cid string) error {
+	this.flushMu.Lock()
+	defer this.flushMu.Unlock()
+
+	this.mu.Lock()
+	if s, ok := this.pending[cid]; ok {
+		this.count -= len(s.ops)
+		delete(this.pending, cid)
+	}
+	delete(this.written, cid)
+	this.mu.Unlock()
+	return this.Store.CleanPackets(cid)
+}
+
+func (this *WriteBehindStore) StreamOfflinePackets(cid string, callback func(packets.ControlPacket)) error {
+	if err := this.Flush(); err != nil {
+		return err
+	}
+	return this.Store.StreamOfflinePackets(cid, callback)
+}
+
+func (this *WriteBehindStore) LookupPackets(callback func(cid string, inbound bool, p packets.ControlPacket)) error {
+	if err := this.Flush(); err != nil {
+		return err
+	}
+	return this.Store.LookupPackets(callback)
+}
+
+func (this *WriteBehindStore) OutPacketsSize() (int, error) {
+	if err := this.Flush(); err != nil {
+		return 0, err
+	}
+	return this.Store.OutPacketsSize()
+}
+
+func (this *WriteBehindStore) BackupTo(dir string) error {
+	store, ok := this.Store.(BackupStore)
+	if !ok {
+		return ErrBackupNotSupported
+	}
+	if err := this.Flush(); err != nil {
+		return err
+	}
+	return store.BackupTo(dir)
+}
+
+func (this *WriteBehindStore) Backup(w io.Writer) error {
+	store, ok := this.Store.(BackupStore)
+	if !ok {
+		return ErrBackupNotSupported
+	}
+	if err := this.Flush(); err != nil {
+		return err
+	}
+	return store.Backup(w)
+}
+
+// Close flushes the waiting writes and closes the store, the writes after it fail
+// with ErrStoreClosed.
+func (this *WriteBehindStore) Close() error {
+	this.once.Do(func() {
+		close(this.quit)
+	})
+	<-this.done
+	this.mu.Lock()
+	this.closed = true
+	this.mu.Unlock()
+
+	err := this.Flush()
+	if c, ok := this.Store.(io.Closer); ok {
+		if e := c.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
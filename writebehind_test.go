@@ -0,0 +1,140 @@
+package mqtt
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+// counts the outbound writes reaching the store.
+type countingStore struct {
+	Store
+	stores, deletes int32
+}
+
+func (this *countingStore) StoreOutboundPacket(cid string, p packets.ControlPacket) error {
+	atomic.AddInt32(&this.stores, 1)
+	return this.Store.StoreOutboundPacket(cid, p)
+}
+
+func (this *countingStore) DeleteOutboundPacket(cid string, mid uint16) error {
+	atomic.AddInt32(&this.deletes, 1)
+	return this.Store.DeleteOutboundPacket(cid, mid)
+}
+
+func offlineMids(t *testing.T, store Store, cid string) []uint16 {
+	var mids []uint16
+	assert.NoError(t, store.StreamOfflinePackets(cid, func(p packets.ControlPacket) {
+		mids = append(mids, p.Details().MessageID)
+	}))
+	return mids
+}
+
+func TestWriteBehindStore(t *testing.T) {
+	backend := &countingStore{Store: newMemoryStore()}
+	store := NewWriteBehindStore(backend, time.Hour, 0)
+	defer store.Close()
+
+	for mid := uint16(1); mid <= 3; mid++ {
+		assert.NoError(t, store.StoreOutboundPacket("c1", testPublish(mid)))
+	}
+	// acknowledged within the window, never written
+	assert.NoError(t, store.DeleteOutboundPacket("c1", 2))
+	assert.EqualValues(t, 0, atomic.LoadInt32(&backend.stores))
+
+	// the reads see the waiting writes
+	assert.Equal(t, []uint16{1, 3}, offlineMids(t, store, "c1"))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&backend.stores))
+	assert.EqualValues(t, 0, atomic.LoadInt32(&backend.deletes))
+
+	// the written packets are deleted, a release replaces its message
+	assert.NoError(t, store.DeleteOutboundPacket("c1", 1))
+	pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	pubrel.MessageID = 3
+	assert.NoError(t, store.StoreOutboundPacket("c1", pubrel))
+	assert.NoError(t, store.DeleteOutboundPacket("c1", 3))
+	assert.NoError(t, store.Flush())
+	assert.EqualValues(t, 2, atomic.LoadInt32(&backend.deletes))
+	assert.Empty(t, offlineMids(t, backend, "c1"))
+
+	// a clean drops the waiting writes
+	assert.NoError(t, store.StoreOutboundPacket("c2", testPublish(1)))
+	assert.NoError(t, store.CleanPackets("c2"))
+	assert.Empty(t, offlineMids(t, store, "c2"))
+}
+
+func TestWriteBehindStoreFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	level, err := newLevelStore(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	backend := &brokenStore{Store: &countingStore{Store: level}}
+	store := NewWriteBehindStore(backend, 10*time.Millisecond, 0)
+
+	// flushed within the window
+	assert.NoError(t, store.StoreOutboundPacket("c1", testPublish(1)))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []uint16{1}, offlineMids(t, level, "c1"))
+
+	// the writes fail until the failed flush is retried
+	backend.set(true)
+	assert.NoError(t, store.StoreOutboundPacket("c1", testPublish(2)))
+	assert.Equal(t, errDiskFull, store.Flush())
+	assert.Equal(t, errDiskFull, store.StoreOutboundPacket("c1", testPublish(3)))
+	backend.set(false)
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, store.StoreOutboundPacket("c1", testPublish(3)))
+
+	// flushed on close, the wrappers hide the Close of the leveldb
+	assert.NoError(t, store.Close())
+	// the writes after the close fail, they're not lost silently
+	assert.Equal(t, ErrStoreClosed, store.StoreOutboundPacket("c1", testPublish(4)))
+	assert.Equal(t, ErrStoreClosed, store.DeleteOutboundPacket("c1", 1))
+	level.Close()
+	level, err = newLevelStore(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer level.Close()
+	assert.Equal(t, []uint16{1, 2, 3}, offlineMids(t, level, "c1"))
+}
+
+// go test -run none -bench WriteBehind
+func BenchmarkWriteBehindFanout(b *testing.B) {
+	const subscribers = 100
+	for _, window := range []time.Duration{0, 10 * time.Millisecond} {
+		b.Run(fmt.Sprintf("window=%v", window), func(b *testing.B) {
+			store, err := OpenStore(&Options{StorePath: filepath.Join(b.TempDir(), "store.db"), StoreWriteBehind: window})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer store.(interface{ Close() error }).Close()
+
+			// a QoS 1 message to every subscriber, acknowledged after the next one is sent
+			p := testPublish(0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				mid := uint16(i%60000 + 1)
+				for s := 0; s < subscribers; s++ {
+					cid := fmt.Sprintf("c%v", s)
+					p.MessageID = mid
+					if err := store.StoreOutboundPacket(cid, p); err != nil {
+						b.Fatal(err)
+					}
+					if i > 0 {
+						if err := store.DeleteOutboundPacket(cid, uint16((i-1)%60000+1)); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			}
+			b.ReportMetric(float64(b.N*subscribers)/b.Elapsed().Seconds(), "msg/s")
+		})
+	}
+}
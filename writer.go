@@ -22,12 +22,16 @@ func (this *client) writer() (err error) {
 		select {
 		case cp = <-this.out:
 			log.Debugf("writer(%v) sending message %v, mid: %v", this.id, reflect.TypeOf(cp), cp.Details().MessageID)
-			if err = this.writePacket(cp); err != nil {
+			w := &countingConn{w: this.conn}
+			if err = cp.Write(w); err != nil {
 				if err != io.EOF {
 					log.Warnf("writer(%v) writting message to connection err, %v", this.id, err)
 				}
 				return
 			}
+			if len(this.quotas) > 0 && !this.chargeOutbound(w.n) {
+				return
+			}
 		case <-this.Dying():
 			return
 		}
@@ -54,8 +58,13 @@ func (this *client) write(p packets.ControlPacket) (err error) {
 //		log.Debugf("writer(%v): message %v sended to queue", this.id, reflect.TypeOf(p))
 //	default:
 //	}
-	// we need to wait for pre message flushed if channel is full
-	this.out <- p
+	// we need to wait for pre message flushed if channel is full,
+	// a connecting client is written once it's started.
+	select {
+	case this.out <- p:
+	case <-this.Dying():
+		return ErrDisconnect
+	}
 	log.Debugf("writer(%v): message %v, id: %v sended to queue", this.id, reflect.TypeOf(p), p.Details().MessageID)
 	return
 }
@@ -63,6 +72,12 @@ func (this *client) write(p packets.ControlPacket) (err error) {
 func (this *client) connack(returnCode byte, sessionPresent bool) error {
 	p := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
 	p.ReturnCode = returnCode
+	switch returnCode {
+	case packets.Accepted:
+		this.server.authSucceeded(this.address)
+	case packets.ErrRefusedBadUsernameOrPassword, packets.ErrRefusedNotAuthorised:
+		this.server.authFailed(this.address)
+	}
 	if sessionPresent && returnCode == packets.Accepted {
 		p.TopicNameCompression = 0x01
 	}
@@ -84,7 +99,12 @@ func (this *client) publish(topic string, payload []byte, qos byte, retain bool,
 
 	if qos > 0 {
 		p.MessageID = this.server.mids.request(this.id)
-		this.server.store.StoreOutboundPacket(this.id, p)
+		// the stored copy is resent as a duplicate after a reconnect
+		stored := *p
+		if err := this.server.checkStore("store outbound packet", this.server.store.StoreOutboundPacket(this.id, &stored)); err != nil {
+			this.server.mids.free(this.id, p.MessageID)
+			return err
+		}
 	}
 	return this.write(p)
 }
@@ -107,12 +127,17 @@ func (this *client) pubcomp(mid uint16) error {
 	return this.write(cp)
 }
 
-func (this *client) pubrel(mid uint16, dup bool) error {
+// release a message received by the subscriber, the PUBREL replaces the PUBLISH in the
+// outbound packets, it's the one resent after a reconnect until the PUBCOMP.
+func (this *client) pubrel(mid uint16) error {
 	p := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
 	p.MessageID = mid
-	p.Dup = dup
-//	this.server.store.DeleteOutboundPacket(this.id, mid)
-	this.server.store.StoreInboundPacket(this.id, p)
+	// a PUBREC of an unknown message is answered without keeping any state
+	if this.server.mids.used(this.id, mid) {
+		if err := this.server.checkStore("store pubrel", this.server.store.StoreOutboundPacket(this.id, p)); err != nil {
+			return err
+		}
+	}
 	return this.write(p)
 }
 